@@ -0,0 +1,7 @@
+// Package api holds the OpenAPI document of the server.
+package api
+
+import _ "embed"
+
+//go:embed openapi.json
+var Spec []byte
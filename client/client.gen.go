@@ -0,0 +1,604 @@
+// Code generated by apigen from api/openapi.json. DO NOT EDIT.
+
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+// MergeActivitiesParams are the query parameters of MergeActivities.
+type MergeActivitiesParams struct {
+	UserId int
+}
+
+func (p MergeActivitiesParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// MergeActivities calls POST /activities/merge: move all blocks of the source activity to the target and delete the source.
+func (c *Client) MergeActivities(params MergeActivitiesParams, body schemas.ActivityMerge) error {
+	return c.do(http.MethodPost, "/activities/merge", params.values(), body, nil)
+}
+
+// GetActivities calls GET /activities/{userId}: list the activities of a user with their finished blocks.
+func (c *Client) GetActivities(userId int) ([]schemas.Activity, error) {
+	var result []schemas.Activity
+	err := c.do(http.MethodGet, "/activities/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
+
+// CreateActivity calls POST /activity: add an activity.
+func (c *Client) CreateActivity(body schemas.ActivityCreate) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/activity", nil, body, &result)
+	return result, err
+}
+
+// UpdateActivity calls PUT /activity: rename an activity.
+func (c *Client) UpdateActivity(body schemas.Activity) (Versioned, error) {
+	var result Versioned
+	err := c.do(http.MethodPut, "/activity", nil, body, &result)
+	return result, err
+}
+
+// GetActivity calls GET /activity/{id}: get an activity with its finished blocks.
+func (c *Client) GetActivity(id int) (schemas.Activity, error) {
+	var result schemas.Activity
+	err := c.do(http.MethodGet, "/activity/"+strconv.Itoa(id), nil, nil, &result)
+	return result, err
+}
+
+// DeleteActivity calls DELETE /activity/{id}: delete an activity and its blocks.
+func (c *Client) DeleteActivity(id int) error {
+	return c.do(http.MethodDelete, "/activity/"+strconv.Itoa(id), nil, nil, nil)
+}
+
+// GetAuditLogParams are the query parameters of GetAuditLog.
+type GetAuditLogParams struct {
+	Entity string
+	Id     int
+}
+
+func (p GetAuditLogParams) values() url.Values {
+	values := url.Values{}
+	values.Set("entity", p.Entity)
+	values.Set("id", strconv.Itoa(p.Id))
+	return values
+}
+
+// GetAuditLog calls GET /audit: list the recorded changes of a user, activity, block or pause.
+func (c *Client) GetAuditLog(params GetAuditLogParams) ([]schemas.AuditEntry, error) {
+	var result []schemas.AuditEntry
+	err := c.do(http.MethodGet, "/audit", params.values(), nil, &result)
+	return result, err
+}
+
+// GetAutoStoppedBlocks calls GET /autostopped/{userId}: list the blocks of a user that were stopped automatically.
+func (c *Client) GetAutoStoppedBlocks(userId int) ([]schemas.Block, error) {
+	var result []schemas.Block
+	err := c.do(http.MethodGet, "/autostopped/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
+
+// ApplyBatch calls POST /batch: create, update and delete activities, blocks and pauses in one transaction.
+func (c *Client) ApplyBatch(body schemas.BatchRequest) (schemas.BatchResponse, error) {
+	var result schemas.BatchResponse
+	err := c.do(http.MethodPost, "/batch", nil, body, &result)
+	return result, err
+}
+
+// CreateBlock calls POST /block: add a block, leaving out the end time starts a running block.
+func (c *Client) CreateBlock(body schemas.BlockCreate) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/block", nil, body, &result)
+	return result, err
+}
+
+// UpdateBlock calls PUT /block: update a block, replacing its tags and pauses.
+func (c *Client) UpdateBlock(body schemas.Block) (Versioned, error) {
+	var result Versioned
+	err := c.do(http.MethodPut, "/block", nil, body, &result)
+	return result, err
+}
+
+// GetBlock calls GET /block/{id}: get a block.
+func (c *Client) GetBlock(id int) (schemas.Block, error) {
+	var result schemas.Block
+	err := c.do(http.MethodGet, "/block/"+strconv.Itoa(id), nil, nil, &result)
+	return result, err
+}
+
+// DeleteBlock calls DELETE /block/{id}: delete a block.
+func (c *Client) DeleteBlock(id int) error {
+	return c.do(http.MethodDelete, "/block/"+strconv.Itoa(id), nil, nil, nil)
+}
+
+// DiffBlockRevisionsParams are the query parameters of DiffBlockRevisions.
+type DiffBlockRevisionsParams struct {
+	From int
+	To   int
+}
+
+func (p DiffBlockRevisionsParams) values() url.Values {
+	values := url.Values{}
+	values.Set("from", strconv.Itoa(p.From))
+	values.Set("to", strconv.Itoa(p.To))
+	return values
+}
+
+// DiffBlockRevisions calls GET /block/{id}/diff: compare two revisions of a block.
+func (c *Client) DiffBlockRevisions(id int, params DiffBlockRevisionsParams) (schemas.BlockDiff, error) {
+	var result schemas.BlockDiff
+	err := c.do(http.MethodGet, "/block/"+strconv.Itoa(id)+"/diff", params.values(), nil, &result)
+	return result, err
+}
+
+// RevertBlock calls POST /block/{id}/revert/{rev}: restore a block, its tags and pauses to an earlier revision.
+func (c *Client) RevertBlock(id int, rev int) (Reverted, error) {
+	var result Reverted
+	err := c.do(http.MethodPost, "/block/"+strconv.Itoa(id)+"/revert/"+strconv.Itoa(rev), nil, nil, &result)
+	return result, err
+}
+
+// GetBlockRevisions calls GET /block/{id}/revisions: list the saved revisions of a block.
+func (c *Client) GetBlockRevisions(id int) ([]schemas.BlockRevision, error) {
+	var result []schemas.BlockRevision
+	err := c.do(http.MethodGet, "/block/"+strconv.Itoa(id)+"/revisions", nil, nil, &result)
+	return result, err
+}
+
+// SplitBlock calls POST /block/{id}/split: split a block into two at the given time.
+func (c *Client) SplitBlock(id int, body schemas.BlockSplit) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/block/"+strconv.Itoa(id)+"/split", nil, body, &result)
+	return result, err
+}
+
+// MergeBlocks calls POST /blocks/merge: merge adjacent blocks of the same activity.
+func (c *Client) MergeBlocks(body schemas.BlockMerge) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/blocks/merge", nil, body, &result)
+	return result, err
+}
+
+// MoveBlocksParams are the query parameters of MoveBlocks.
+type MoveBlocksParams struct {
+	UserId int
+}
+
+func (p MoveBlocksParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// MoveBlocks calls POST /blocks/move: move blocks to another activity.
+func (c *Client) MoveBlocks(params MoveBlocksParams, body schemas.BlockMove) error {
+	return c.do(http.MethodPost, "/blocks/move", params.values(), body, nil)
+}
+
+// GetBlocks calls GET /blocks/{activityId}: list the finished blocks of an activity.
+func (c *Client) GetBlocks(activityId int) ([]schemas.Block, error) {
+	var result []schemas.Block
+	err := c.do(http.MethodGet, "/blocks/"+strconv.Itoa(activityId), nil, nil, &result)
+	return result, err
+}
+
+// GetCurrentBlock calls GET /current: get the running block.
+func (c *Client) GetCurrentBlock() (schemas.CurrentBlock, error) {
+	var result schemas.CurrentBlock
+	err := c.do(http.MethodGet, "/current", nil, nil, &result)
+	return result, err
+}
+
+// GetHealth calls GET /healthz: check that the server is running.
+func (c *Client) GetHealth() (Status, error) {
+	var result Status
+	err := c.do(http.MethodGet, "/healthz", nil, nil, &result)
+	return result, err
+}
+
+// AcceptInvitation calls POST /invitation/{token}/accept: join the workspace of an invitation.
+func (c *Client) AcceptInvitation(token string, body schemas.InvitationAccept) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/invitation/"+url.PathEscape(token)+"/accept", nil, body, &result)
+	return result, err
+}
+
+// GetInvitations calls GET /invitations/{userId}: list the pending invitations addressed to a user.
+func (c *Client) GetInvitations(userId int) ([]schemas.Invitation, error) {
+	var result []schemas.Invitation
+	err := c.do(http.MethodGet, "/invitations/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
+
+// SetUserLockDate calls PUT /lock/user/{id}: lock the blocks of a user before a date.
+func (c *Client) SetUserLockDate(id int, body schemas.LockDateUpdate) error {
+	return c.do(http.MethodPut, "/lock/user/"+strconv.Itoa(id), nil, body, nil)
+}
+
+// DeleteUserLockDateParams are the query parameters of DeleteUserLockDate.
+type DeleteUserLockDateParams struct {
+	UserId int
+}
+
+func (p DeleteUserLockDateParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// DeleteUserLockDate calls DELETE /lock/user/{id}: remove the lock date of a user.
+func (c *Client) DeleteUserLockDate(id int, params DeleteUserLockDateParams) error {
+	return c.do(http.MethodDelete, "/lock/user/"+strconv.Itoa(id), params.values(), nil, nil)
+}
+
+// SetWorkspaceLockDate calls PUT /lock/workspace/{id}: lock the blocks of a workspace before a date.
+func (c *Client) SetWorkspaceLockDate(id int, body schemas.LockDateUpdate) error {
+	return c.do(http.MethodPut, "/lock/workspace/"+strconv.Itoa(id), nil, body, nil)
+}
+
+// DeleteWorkspaceLockDateParams are the query parameters of DeleteWorkspaceLockDate.
+type DeleteWorkspaceLockDateParams struct {
+	UserId int
+}
+
+func (p DeleteWorkspaceLockDateParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// DeleteWorkspaceLockDate calls DELETE /lock/workspace/{id}: remove the lock date of a workspace.
+func (c *Client) DeleteWorkspaceLockDate(id int, params DeleteWorkspaceLockDateParams) error {
+	return c.do(http.MethodDelete, "/lock/workspace/"+strconv.Itoa(id), params.values(), nil, nil)
+}
+
+// GetLockDates calls GET /locks/{userId}: list the lock dates applying to the blocks of a user.
+func (c *Client) GetLockDates(userId int) ([]schemas.LockDate, error) {
+	var result []schemas.LockDate
+	err := c.do(http.MethodGet, "/locks/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
+
+// Login calls POST /login: check the credentials of a user and start a session.
+func (c *Client) Login(body schemas.Login) (LoginUser, error) {
+	var result LoginUser
+	err := c.do(http.MethodPost, "/login", nil, body, &result)
+	return result, err
+}
+
+// GetOpenAPI calls GET /openapi.json: get this document.
+func (c *Client) GetOpenAPI() (map[string]any, error) {
+	var result map[string]any
+	err := c.do(http.MethodGet, "/openapi.json", nil, nil, &result)
+	return result, err
+}
+
+// CreatePause calls POST /pause: add a pause to a block.
+func (c *Client) CreatePause(body schemas.PauseCreate) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/pause", nil, body, &result)
+	return result, err
+}
+
+// UpdatePause calls PUT /pause: update a pause.
+func (c *Client) UpdatePause(body schemas.Pause) (Versioned, error) {
+	var result Versioned
+	err := c.do(http.MethodPut, "/pause", nil, body, &result)
+	return result, err
+}
+
+// GetPauses calls GET /pause/{blockId}: list the pauses of a block.
+func (c *Client) GetPauses(blockId int) ([]schemas.Pause, error) {
+	var result []schemas.Pause
+	err := c.do(http.MethodGet, "/pause/"+strconv.Itoa(blockId), nil, nil, &result)
+	return result, err
+}
+
+// DeletePause calls DELETE /pause/{id}: delete a pause.
+func (c *Client) DeletePause(id int) error {
+	return c.do(http.MethodDelete, "/pause/"+strconv.Itoa(id), nil, nil, nil)
+}
+
+// GetReadiness calls GET /readyz: check that the database is reachable and migrated.
+func (c *Client) GetReadiness() (Status, error) {
+	var result Status
+	err := c.do(http.MethodGet, "/readyz", nil, nil, &result)
+	return result, err
+}
+
+// SearchParams are the query parameters of Search.
+type SearchParams struct {
+	Q      string
+	UserId int
+	From   string
+	To     string
+}
+
+func (p SearchParams) values() url.Values {
+	values := url.Values{}
+	values.Set("q", p.Q)
+	values.Set("userId", strconv.Itoa(p.UserId))
+	if p.From != "" {
+		values.Set("from", p.From)
+	}
+	if p.To != "" {
+		values.Set("to", p.To)
+	}
+	return values
+}
+
+// Search calls GET /search: search the activity names, block notes and tags of a user.
+func (c *Client) Search(params SearchParams) ([]schemas.SearchResult, error) {
+	var result []schemas.SearchResult
+	err := c.do(http.MethodGet, "/search", params.values(), nil, &result)
+	return result, err
+}
+
+// UpdateSettings calls PUT /settings: update the settings of a user.
+func (c *Client) UpdateSettings(body schemas.Settings) error {
+	return c.do(http.MethodPut, "/settings", nil, body, nil)
+}
+
+// GetSettings calls GET /settings/{userId}: get the settings of a user.
+func (c *Client) GetSettings(userId int) (schemas.Settings, error) {
+	var result schemas.Settings
+	err := c.do(http.MethodGet, "/settings/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
+
+// GetChangesParams are the query parameters of GetChanges.
+type GetChangesParams struct {
+	UserId int
+	Since  string
+}
+
+func (p GetChangesParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	if p.Since != "" {
+		values.Set("since", p.Since)
+	}
+	return values
+}
+
+// GetChanges calls GET /sync: list the activities, blocks and pauses of a user changed since a sync token.
+func (c *Client) GetChanges(params GetChangesParams) (schemas.SyncChanges, error) {
+	var result schemas.SyncChanges
+	err := c.do(http.MethodGet, "/sync", params.values(), nil, &result)
+	return result, err
+}
+
+// ApplyMutations calls POST /sync: apply mutations recorded offline in one transaction.
+func (c *Client) ApplyMutations(body schemas.SyncRequest) ([]schemas.SyncResult, error) {
+	var result []schemas.SyncResult
+	err := c.do(http.MethodPost, "/sync", nil, body, &result)
+	return result, err
+}
+
+// RunTimerCommand calls POST /timer/{command}: start, stop, pause or resume the timer of a user.
+func (c *Client) RunTimerCommand(command string, body schemas.TimerRequest) (schemas.Block, error) {
+	var result schemas.Block
+	err := c.do(http.MethodPost, "/timer/"+url.PathEscape(command), nil, body, &result)
+	return result, err
+}
+
+// GetTimer calls GET /timer/{userId}: get the running block of a user.
+func (c *Client) GetTimer(userId int) (schemas.CurrentBlock, error) {
+	var result schemas.CurrentBlock
+	err := c.do(http.MethodGet, "/timer/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
+
+// GetTimesheet calls GET /timesheet/{userId}/{week}: get the weekly timesheet of a user with its blocks and history.
+func (c *Client) GetTimesheet(userId int, week string) (schemas.Timesheet, error) {
+	var result schemas.Timesheet
+	err := c.do(http.MethodGet, "/timesheet/"+strconv.Itoa(userId)+"/"+url.PathEscape(week), nil, nil, &result)
+	return result, err
+}
+
+// RunTimesheetAction calls POST /timesheet/{userId}/{week}/{action}: submit, approve, reject or comment on a weekly timesheet.
+func (c *Client) RunTimesheetAction(userId int, week string, action string, body schemas.TimesheetAction) (schemas.Timesheet, error) {
+	var result schemas.Timesheet
+	err := c.do(http.MethodPost, "/timesheet/"+strconv.Itoa(userId)+"/"+url.PathEscape(week)+"/"+url.PathEscape(action), nil, body, &result)
+	return result, err
+}
+
+// GetPendingTimesheets calls GET /timesheets/pending/{userId}: list the submitted timesheets a user may review.
+func (c *Client) GetPendingTimesheets(userId int) ([]schemas.Timesheet, error) {
+	var result []schemas.Timesheet
+	err := c.do(http.MethodGet, "/timesheets/pending/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
+
+// CreateUser calls POST /user: add a user.
+func (c *Client) CreateUser(body schemas.UserCreate) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/user", nil, body, &result)
+	return result, err
+}
+
+// CreateWebhook calls POST /webhook: subscribe a url to the events of a user.
+func (c *Client) CreateWebhook(body schemas.WebhookCreate) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/webhook", nil, body, &result)
+	return result, err
+}
+
+// DeleteWebhook calls DELETE /webhook/{id}: delete a webhook.
+func (c *Client) DeleteWebhook(id int) error {
+	return c.do(http.MethodDelete, "/webhook/"+strconv.Itoa(id), nil, nil, nil)
+}
+
+// GetWebhookDeliveries calls GET /webhook/{id}/deliveries: list the latest deliveries of a webhook.
+func (c *Client) GetWebhookDeliveries(id int) ([]schemas.WebhookDelivery, error) {
+	var result []schemas.WebhookDelivery
+	err := c.do(http.MethodGet, "/webhook/"+strconv.Itoa(id)+"/deliveries", nil, nil, &result)
+	return result, err
+}
+
+// TestWebhook calls POST /webhook/{id}/test: send a test event to a webhook.
+func (c *Client) TestWebhook(id int) (schemas.WebhookDelivery, error) {
+	var result schemas.WebhookDelivery
+	err := c.do(http.MethodPost, "/webhook/"+strconv.Itoa(id)+"/test", nil, nil, &result)
+	return result, err
+}
+
+// GetWebhooks calls GET /webhooks/{userId}: list the webhooks of a user.
+func (c *Client) GetWebhooks(userId int) ([]schemas.Webhook, error) {
+	var result []schemas.Webhook
+	err := c.do(http.MethodGet, "/webhooks/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
+
+// CreateWorkspace calls POST /workspace: create a workspace owned by the user.
+func (c *Client) CreateWorkspace(body schemas.WorkspaceCreate) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/workspace", nil, body, &result)
+	return result, err
+}
+
+// GetWorkspaceParams are the query parameters of GetWorkspace.
+type GetWorkspaceParams struct {
+	UserId int
+}
+
+func (p GetWorkspaceParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// GetWorkspace calls GET /workspace/{id}: get a workspace with its members.
+func (c *Client) GetWorkspace(id int, params GetWorkspaceParams) (schemas.Workspace, error) {
+	var result schemas.Workspace
+	err := c.do(http.MethodGet, "/workspace/"+strconv.Itoa(id), params.values(), nil, &result)
+	return result, err
+}
+
+// DeleteWorkspaceParams are the query parameters of DeleteWorkspace.
+type DeleteWorkspaceParams struct {
+	UserId int
+}
+
+func (p DeleteWorkspaceParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// DeleteWorkspace calls DELETE /workspace/{id}: delete a workspace with its activities, only the owner may.
+func (c *Client) DeleteWorkspace(id int, params DeleteWorkspaceParams) error {
+	return c.do(http.MethodDelete, "/workspace/"+strconv.Itoa(id), params.values(), nil, nil)
+}
+
+// GetWorkspaceActivitiesParams are the query parameters of GetWorkspaceActivities.
+type GetWorkspaceActivitiesParams struct {
+	UserId int
+}
+
+func (p GetWorkspaceActivitiesParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// GetWorkspaceActivities calls GET /workspace/{id}/activities: list the activities of a workspace with their finished blocks.
+func (c *Client) GetWorkspaceActivities(id int, params GetWorkspaceActivitiesParams) ([]schemas.Activity, error) {
+	var result []schemas.Activity
+	err := c.do(http.MethodGet, "/workspace/"+strconv.Itoa(id)+"/activities", params.values(), nil, &result)
+	return result, err
+}
+
+// CreateWorkspaceActivity calls POST /workspace/{id}/activity: add an activity all members can log blocks against.
+func (c *Client) CreateWorkspaceActivity(id int, body schemas.ActivityCreate) (Created, error) {
+	var result Created
+	err := c.do(http.MethodPost, "/workspace/"+strconv.Itoa(id)+"/activity", nil, body, &result)
+	return result, err
+}
+
+// CreateInvitation calls POST /workspace/{id}/invitation: invite an email into the workspace.
+func (c *Client) CreateInvitation(id int, body schemas.InvitationCreate) (schemas.Invitation, error) {
+	var result schemas.Invitation
+	err := c.do(http.MethodPost, "/workspace/"+strconv.Itoa(id)+"/invitation", nil, body, &result)
+	return result, err
+}
+
+// GetWorkspaceInvitationsParams are the query parameters of GetWorkspaceInvitations.
+type GetWorkspaceInvitationsParams struct {
+	UserId int
+}
+
+func (p GetWorkspaceInvitationsParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// GetWorkspaceInvitations calls GET /workspace/{id}/invitations: list the pending invitations of a workspace.
+func (c *Client) GetWorkspaceInvitations(id int, params GetWorkspaceInvitationsParams) ([]schemas.Invitation, error) {
+	var result []schemas.Invitation
+	err := c.do(http.MethodGet, "/workspace/"+strconv.Itoa(id)+"/invitations", params.values(), nil, &result)
+	return result, err
+}
+
+// UpdateMember calls PUT /workspace/{id}/member/{memberId}: change the role of a member, only the owner may.
+func (c *Client) UpdateMember(id int, memberId int, body schemas.MemberUpdate) error {
+	return c.do(http.MethodPut, "/workspace/"+strconv.Itoa(id)+"/member/"+strconv.Itoa(memberId), nil, body, nil)
+}
+
+// RemoveMemberParams are the query parameters of RemoveMember.
+type RemoveMemberParams struct {
+	UserId int
+}
+
+func (p RemoveMemberParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	return values
+}
+
+// RemoveMember calls DELETE /workspace/{id}/member/{memberId}: remove a member or leave the workspace.
+func (c *Client) RemoveMember(id int, memberId int, params RemoveMemberParams) error {
+	return c.do(http.MethodDelete, "/workspace/"+strconv.Itoa(id)+"/member/"+strconv.Itoa(memberId), params.values(), nil, nil)
+}
+
+// GetWorkspaceReportParams are the query parameters of GetWorkspaceReport.
+type GetWorkspaceReportParams struct {
+	UserId int
+	From   string
+	To     string
+}
+
+func (p GetWorkspaceReportParams) values() url.Values {
+	values := url.Values{}
+	values.Set("userId", strconv.Itoa(p.UserId))
+	if p.From != "" {
+		values.Set("from", p.From)
+	}
+	if p.To != "" {
+		values.Set("to", p.To)
+	}
+	return values
+}
+
+// GetWorkspaceReport calls GET /workspace/{id}/report: sum up the time of the members per workspace activity.
+func (c *Client) GetWorkspaceReport(id int, params GetWorkspaceReportParams) (schemas.WorkspaceReport, error) {
+	var result schemas.WorkspaceReport
+	err := c.do(http.MethodGet, "/workspace/"+strconv.Itoa(id)+"/report", params.values(), nil, &result)
+	return result, err
+}
+
+// GetWorkspaces calls GET /workspaces/{userId}: list the workspaces of a user with their role.
+func (c *Client) GetWorkspaces(userId int) ([]schemas.Workspace, error) {
+	var result []schemas.Workspace
+	err := c.do(http.MethodGet, "/workspaces/"+strconv.Itoa(userId), nil, nil, &result)
+	return result, err
+}
@@ -0,0 +1,126 @@
+// Package client is a typed client for the activities server. The methods of
+// Client are generated from api/openapi.json, run go generate after changing
+// the spec.
+package client
+
+//go:generate go run ../cmd/apigen -spec ../api/openapi.json -out client.gen.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// New returns a client for the server at the given url. A nil httpClient
+// uses http.DefaultClient.
+func New(server string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{server: strings.TrimRight(server, "/"), http: httpClient}
+}
+
+// WithToken returns a copy of the client sending the session token returned
+// by Login with every request.
+func (c *Client) WithToken(token string) *Client {
+	authenticated := *c
+	authenticated.token = token
+	return &authenticated
+}
+
+// Created is the response of the routes that add an entity.
+type Created struct {
+	Id int `json:"id"`
+}
+
+// Reverted is the response of reverting a block to an earlier revision.
+type Reverted struct {
+	Revision int `json:"revision"`
+}
+
+// Versioned is the response of updating an activity, a block or a pause.
+type Versioned struct {
+	Version int `json:"version"`
+}
+
+// LoginUser is the response of a successful login.
+type LoginUser struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// Status is the body of error responses.
+type Status struct {
+	Status string `json:"status"`
+}
+
+// Error is returned for responses outside of the 2xx range.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
+
+// do sends the body as JSON and decodes the response into result, unless
+// result is nil.
+func (c *Client) do(method string, path string, query url.Values, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	target := c.server + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		var status Status
+		if json.Unmarshal(data, &status) != nil || status.Status == "" {
+			status.Status = response.Status
+		}
+		return &Error{Method: method, Path: path, StatusCode: response.StatusCode, Status: status.Status}
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kilianmandscharo/activities/client"
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+var commands = map[string]func(args []string) error{
+	"login":  login,
+	"start":  timerCommand("start"),
+	"pause":  timerCommand("pause"),
+	"resume": timerCommand("resume"),
+	"stop":   timerCommand("stop"),
+	"status": status,
+	"log":    logBlocks,
+	"add":    add,
+	"edit":   edit,
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *bool) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the server response as JSON")
+	return flags, asJSON
+}
+
+// session loads the config of a logged in user and a client for its server
+// sending the session token.
+func session() (config, *client.Client, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return cfg, nil, err
+	}
+	if cfg.UserId == 0 || cfg.Token == "" {
+		return cfg, nil, errNotLoggedIn
+	}
+	return cfg, newClient(cfg.Server).WithToken(cfg.Token), nil
+}
+
+func newClient(server string) *client.Client {
+	return client.New(server, &http.Client{Timeout: 10 * time.Second})
+}
+
+func login(args []string) error {
+	flags, asJSON := newFlagSet("login")
+	server := flags.String("server", "", "url of the activities server")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: activities login [--server url] <email> <password>")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if *server != "" {
+		cfg.Server = *server
+	}
+
+	login := schemas.Login{Email: flags.Arg(0), Password: flags.Arg(1)}
+	user, err := newClient(cfg.Server).Login(login)
+	if err != nil {
+		return err
+	}
+	cfg.UserId = user.Id
+	cfg.Email = login.Email
+	cfg.Token = user.Token
+	if err := saveConfig(cfg); err != nil {
+		return err
+	}
+	if *asJSON {
+		user.Token = ""
+		return printJSON(user)
+	}
+	fmt.Printf("logged in as %s (%s)\n", user.Name, login.Email)
+	return nil
+}
+
+func timerCommand(command string) func(args []string) error {
+	return func(args []string) error {
+		flags, asJSON := newFlagSet(command)
+		at := flags.String("at", "", "time of the "+command+", defaults to now")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		cfg, c, err := session()
+		if err != nil {
+			return err
+		}
+
+		request := schemas.TimerRequest{UserId: cfg.UserId}
+		if *at != "" {
+			t, err := parseTime(*at, time.Now())
+			if err != nil {
+				return err
+			}
+			request.Time = t.UTC().Format(time.RFC3339)
+		}
+		if command == "start" {
+			if flags.NArg() != 1 {
+				return errors.New("usage: activities start [--at time] <activity>")
+			}
+			activity, err := findActivity(c, cfg.UserId, flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			request.ActivityId = activity.Id
+		}
+
+		block, err := c.RunTimerCommand(command, request)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(block)
+		}
+		activities, err := activityNames(c, cfg.UserId)
+		if err != nil {
+			return err
+		}
+		printBlocks([]schemas.Block{block}, activities, time.Now())
+		return nil
+	}
+}
+
+func status(args []string) error {
+	flags, asJSON := newFlagSet("status")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cfg, c, err := session()
+	if err != nil {
+		return err
+	}
+	current, err := c.GetTimer(cfg.UserId)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(current)
+	}
+	if current.Id == 0 {
+		fmt.Println("no block is running")
+		return nil
+	}
+	activities, err := activityNames(c, cfg.UserId)
+	if err != nil {
+		return err
+	}
+	printBlocks([]schemas.Block{current.Block}, activities, time.Now())
+	if current.Pomodoro != nil {
+		remaining := time.Duration(current.Pomodoro.RemainingSeconds) * time.Second
+		fmt.Printf("\npomodoro: %s (cycle %d), %s remaining\n",
+			current.Pomodoro.Phase, current.Pomodoro.Cycle, formatDuration(remaining))
+	}
+	return nil
+}
+
+func logBlocks(args []string) error {
+	flags, asJSON := newFlagSet("log")
+	week := flags.Bool("week", false, "list the blocks of the current week instead of today")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cfg, c, err := session()
+	if err != nil {
+		return err
+	}
+	activities, err := c.GetActivities(cfg.UserId)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	from := startOfDay(now)
+	if *week {
+		from = startOfWeek(now)
+	}
+	names := make(map[int]string)
+	var blocks []schemas.Block
+	for _, activity := range activities {
+		names[activity.Id] = activity.Name
+		for _, block := range activity.Blocks {
+			start, err := time.Parse(time.RFC3339Nano, block.StartTime)
+			if err == nil && !start.Before(from) {
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].StartTime < blocks[j].StartTime
+	})
+	if *asJSON {
+		return printJSON(blocks)
+	}
+	if len(blocks) == 0 {
+		fmt.Println("no blocks")
+		return nil
+	}
+	printBlocks(blocks, names, now)
+	return nil
+}
+
+func add(args []string) error {
+	flags, asJSON := newFlagSet("add")
+	start := flags.String("start", "", "start of the block")
+	end := flags.String("end", "", "end of the block")
+	note := flags.String("note", "", "note of the block")
+	tags := flags.String("tags", "", "comma separated tags of the block")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *start == "" || *end == "" {
+		return errors.New("usage: activities add --start time --end time [--note text] [--tags a,b] <activity>")
+	}
+	cfg, c, err := session()
+	if err != nil {
+		return err
+	}
+	activity, err := findActivity(c, cfg.UserId, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	block := schemas.BlockCreate{ActivityId: activity.Id, Note: *note, Tags: splitTags(*tags)}
+	if block.StartTime, err = formatInput(*start, now); err != nil {
+		return err
+	}
+	if block.EndTime, err = formatInput(*end, now); err != nil {
+		return err
+	}
+	created, err := c.CreateBlock(block)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(created)
+	}
+	fmt.Printf("added block %d\n", created.Id)
+	return nil
+}
+
+func edit(args []string) error {
+	flags, asJSON := newFlagSet("edit")
+	start := flags.String("start", "", "new start of the block")
+	end := flags.String("end", "", "new end of the block")
+	note := flags.String("note", "", "new note of the block")
+	activityName := flags.String("activity", "", "activity to move the block to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: activities edit [--start time] [--end time] [--note text] [--activity name] <block id>")
+	}
+	blockId, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid block id %q", flags.Arg(0))
+	}
+	cfg, c, err := session()
+	if err != nil {
+		return err
+	}
+	block, err := c.GetBlock(blockId)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if *start != "" {
+		if block.StartTime, err = formatInput(*start, now); err != nil {
+			return err
+		}
+	}
+	if *end != "" {
+		if block.EndTime, err = formatInput(*end, now); err != nil {
+			return err
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "note" {
+			block.Note = *note
+		}
+	})
+	if *activityName != "" {
+		activity, err := findActivity(c, cfg.UserId, *activityName)
+		if err != nil {
+			return err
+		}
+		block.ActivityId = activity.Id
+	}
+	updated, err := c.UpdateBlock(block)
+	if err != nil {
+		return err
+	}
+	block.Version = updated.Version
+	if *asJSON {
+		return printJSON(block)
+	}
+	activities, err := activityNames(c, cfg.UserId)
+	if err != nil {
+		return err
+	}
+	printBlocks([]schemas.Block{block}, activities, now)
+	return nil
+}
+
+// findActivity looks up an activity of the user by id or by its name,
+// ignoring the case.
+func findActivity(c *client.Client, userId int, nameOrId string) (schemas.Activity, error) {
+	activities, err := c.GetActivities(userId)
+	if err != nil {
+		return schemas.Activity{}, err
+	}
+	id, _ := strconv.Atoi(nameOrId)
+	for _, activity := range activities {
+		if activity.Id == id || strings.EqualFold(activity.Name, nameOrId) {
+			return activity, nil
+		}
+	}
+	return schemas.Activity{}, fmt.Errorf("unknown activity %q", nameOrId)
+}
+
+func activityNames(c *client.Client, userId int) (map[int]string, error) {
+	activities, err := c.GetActivities(userId)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string)
+	for _, activity := range activities {
+		names[activity.Id] = activity.Name
+	}
+	return names, nil
+}
+
+func splitTags(tags string) []string {
+	var result []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+func formatInput(value string, now time.Time) (string, error) {
+	t, err := parseTime(value, now)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const defaultServer = "http://localhost:8080"
+
+var errNotLoggedIn = errors.New("not logged in, run \"activities login\" first")
+
+// config is stored readable only by its owner, since Token authenticates the
+// requests of the user until the session expires.
+type config struct {
+	Server string `json:"server"`
+	UserId int    `json:"userId"`
+	Email  string `json:"email"`
+	Token  string `json:"token"`
+}
+
+// configPath returns the location of the config file, which can be
+// overridden with the ACTIVITIES_CONFIG environment variable.
+func configPath() (string, error) {
+	if path := os.Getenv("ACTIVITIES_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "activities", "config.json"), nil
+}
+
+func loadConfig() (config, error) {
+	cfg := config{Server: defaultServer}
+	path, err := configPath()
+	if err != nil {
+		return cfg, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func saveConfig(cfg config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
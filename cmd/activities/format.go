@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+const displayLayout = "2006-01-02 15:04"
+
+var inputLayouts = []string{time.RFC3339Nano, displayLayout, "2006-01-02T15:04"}
+
+// parseTime reads a time given as RFC 3339, as a local date and time or as a
+// local time of the day of now.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	for _, layout := range inputLayouts {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	if clock, err := time.Parse("15:04", value); err == nil {
+		year, month, day := now.Date()
+		return time.Date(year, month, day, clock.Hour(), clock.Minute(), 0, 0, now.Location()), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+func startOfDay(now time.Time) time.Time {
+	year, month, day := now.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+}
+
+// startOfWeek returns the beginning of the monday of the week of now.
+func startOfWeek(now time.Time) time.Time {
+	offset := (int(now.Weekday()) + 6) % 7
+	return startOfDay(now).AddDate(0, 0, -offset)
+}
+
+// blockDuration is the time spent on the block without its pauses. Running
+// blocks and open pauses count until now.
+func blockDuration(block schemas.Block, now time.Time) time.Duration {
+	duration := span(block.StartTime, block.EndTime, now)
+	for _, pause := range block.Pauses {
+		duration -= span(pause.StartTime, pause.EndTime, now)
+	}
+	if duration < 0 {
+		return 0
+	}
+	return duration
+}
+
+func span(startTime string, endTime string, now time.Time) time.Duration {
+	start, err := time.Parse(time.RFC3339Nano, startTime)
+	if err != nil {
+		return 0
+	}
+	end := now
+	if endTime != "" {
+		if end, err = time.Parse(time.RFC3339Nano, endTime); err != nil {
+			return 0
+		}
+	}
+	return end.Sub(start)
+}
+
+func isPaused(block schemas.Block) bool {
+	for _, pause := range block.Pauses {
+		if pause.EndTime == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func formatDuration(duration time.Duration) string {
+	duration = duration.Round(time.Minute)
+	return fmt.Sprintf("%d:%02d", int(duration.Hours()), int(duration.Minutes())%60)
+}
+
+func formatTime(value string, location *time.Location) string {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return value
+	}
+	return t.In(location).Format(displayLayout)
+}
+
+func printBlocks(blocks []schemas.Block, activities map[int]string, now time.Time) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tACTIVITY\tSTART\tEND\tDURATION\tNOTE")
+	var total time.Duration
+	for _, block := range blocks {
+		end := "running"
+		if block.EndTime != "" {
+			end = formatTime(block.EndTime, now.Location())
+		} else if isPaused(block) {
+			end = "paused"
+		}
+		duration := blockDuration(block, now)
+		total += duration
+		note := block.Note
+		if len(block.Tags) > 0 {
+			note = strings.TrimSpace(note + " #" + strings.Join(block.Tags, " #"))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n",
+			block.Id,
+			activities[block.ActivityId],
+			formatTime(block.StartTime, now.Location()),
+			end,
+			formatDuration(duration),
+			note)
+	}
+	if len(blocks) > 1 {
+		fmt.Fprintf(w, "\t\t\t\t%s\t\n", formatDuration(total))
+	}
+	w.Flush()
+}
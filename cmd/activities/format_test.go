@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+	"github.com/stretchr/testify/assert"
+)
+
+var testNow = time.Date(2023, 2, 1, 15, 0, 0, 0, time.UTC)
+
+func TestParseTime(t *testing.T) {
+	expected := time.Date(2023, 2, 1, 14, 30, 0, 0, time.UTC)
+	for _, value := range []string{"2023-02-01T14:30:00Z", "2023-02-01 14:30", "2023-02-01T14:30", "14:30"} {
+		parsed, err := parseTime(value, testNow)
+		if err != nil {
+			t.Fatalf("could not parse %q, %v", value, err)
+		}
+		assert.True(t, expected.Equal(parsed), value)
+	}
+	_, err := parseTime("yesterday", testNow)
+	assert.NotNil(t, err)
+}
+
+func TestStartOfWeek(t *testing.T) {
+	assert.Equal(t, time.Date(2023, 1, 30, 0, 0, 0, 0, time.UTC), startOfWeek(testNow))
+	sunday := time.Date(2023, 2, 5, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2023, 1, 30, 0, 0, 0, 0, time.UTC), startOfWeek(sunday))
+}
+
+func TestBlockDuration(t *testing.T) {
+	block := schemas.Block{
+		StartTime: "2023-02-01T14:00:00Z",
+		EndTime:   "2023-02-01T14:30:00Z",
+		Pauses: []schemas.Pause{
+			{StartTime: "2023-02-01T14:15:00Z", EndTime: "2023-02-01T14:20:00Z"},
+		},
+	}
+	assert.Equal(t, 25*time.Minute, blockDuration(block, testNow))
+
+	block.EndTime = ""
+	block.Pauses = append(block.Pauses, schemas.Pause{StartTime: "2023-02-01T14:50:00Z"})
+	assert.Equal(t, 45*time.Minute, blockDuration(block, testNow))
+	assert.True(t, isPaused(block))
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "0:25", formatDuration(25*time.Minute))
+	assert.Equal(t, "14:05", formatDuration(14*time.Hour+5*time.Minute))
+}
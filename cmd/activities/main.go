@@ -0,0 +1,41 @@
+// Command activities is a terminal client for the activities server.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: activities <command> [flags] [arguments]
+
+commands:
+  login [--server url] <email> <password>  log in and store the session in the config file
+  start [--at time] <activity>             start a block of the activity, stopping a running one
+  pause [--at time]                        pause the running block
+  resume [--at time]                       resume the paused block
+  stop [--at time]                         stop the running block
+  status                                   show the running block
+  log [--week]                             list the blocks of today or of the current week
+  add --start time --end time <activity>   add a finished block
+  edit [flags] <block id>                  change the times, note or activity of a block
+
+Times are given as RFC 3339, "2006-01-02 15:04" or "15:04" for today, in
+local time unless a zone is given. Every command accepts --json to print the
+server response instead of a table.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "activities:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,328 @@
+// Command apigen generates the methods of the client package from the
+// OpenAPI document of the server.
+//
+// Component schemas name the Go type they map to with x-go-type, either a
+// type of the schemas package or one declared in the client package.
+// Operations without a JSON response, like the event stream and the
+// websocket, are skipped.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type spec struct {
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas map[string]schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	OperationId string      `json:"operationId"`
+	Summary     string      `json:"summary"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema schema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+}
+
+type parameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+	Schema   schema `json:"schema"`
+}
+
+type schema struct {
+	Ref    string  `json:"$ref"`
+	Type   string  `json:"type"`
+	Items  *schema `json:"items"`
+	GoType string  `json:"x-go-type"`
+}
+
+var methods = []string{"get", "post", "put", "delete"}
+
+func main() {
+	specPath := flag.String("spec", "api/openapi.json", "path of the OpenAPI document")
+	out := flag.String("out", "client/client.gen.go", "path of the generated file")
+	flag.Parse()
+
+	data, err := os.ReadFile(*specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	source, err := Generate(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Generate returns the formatted source of the client methods for the
+// OpenAPI document in data.
+func Generate(data []byte) ([]byte, error) {
+	var s spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	g := generator{spec: s, imports: map[string]bool{"net/http": true}}
+
+	paths := make([]string, 0, len(s.Paths))
+	for path := range s.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for _, method := range methods {
+			if op, ok := s.Paths[path][method]; ok {
+				if err := g.operation(path, method, op); err != nil {
+					return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(method), path, err)
+				}
+			}
+		}
+	}
+
+	var file bytes.Buffer
+	file.WriteString("// Code generated by apigen from api/openapi.json. DO NOT EDIT.\n\npackage client\n\nimport (\n")
+	imports := make([]string, 0, len(g.imports))
+	for imp := range g.imports {
+		imports = append(imports, imp)
+	}
+	sort.Slice(imports, func(i, j int) bool {
+		iStd, jStd := !strings.Contains(imports[i], "."), !strings.Contains(imports[j], ".")
+		if iStd != jStd {
+			return iStd
+		}
+		return imports[i] < imports[j]
+	})
+	for i, imp := range imports {
+		if i > 0 && strings.Contains(imp, ".") && !strings.Contains(imports[i-1], ".") {
+			file.WriteString("\n")
+		}
+		fmt.Fprintf(&file, "%q\n", imp)
+	}
+	file.WriteString(")\n")
+	file.Write(g.body.Bytes())
+	return format.Source(file.Bytes())
+}
+
+type generator struct {
+	spec    spec
+	imports map[string]bool
+	body    bytes.Buffer
+}
+
+func (g *generator) operation(path string, method string, op operation) error {
+	success, ok := op.Responses["200"]
+	if !ok {
+		return nil
+	}
+	name := exported(op.OperationId)
+	resultType := ""
+	if len(success.Content) > 0 {
+		response, ok := success.Content["application/json"]
+		if !ok {
+			return nil
+		}
+		var err error
+		if resultType, err = g.goType(response.Schema); err != nil {
+			return err
+		}
+	}
+
+	var args []string
+	var query []parameter
+	for _, param := range op.Parameters {
+		switch param.In {
+		case "path":
+			paramType, err := g.goType(param.Schema)
+			if err != nil {
+				return err
+			}
+			args = append(args, param.Name+" "+paramType)
+		case "query":
+			query = append(query, param)
+		}
+	}
+	if len(query) > 0 {
+		if err := g.params(name, query); err != nil {
+			return err
+		}
+		args = append(args, "params "+name+"Params")
+	}
+	body := "nil"
+	if op.RequestBody != nil {
+		bodyType, err := g.goType(op.RequestBody.Content["application/json"].Schema)
+		if err != nil {
+			return err
+		}
+		args = append(args, "body "+bodyType)
+		body = "body"
+	}
+	pathExpr, err := g.pathExpr(path, op.Parameters)
+	if err != nil {
+		return err
+	}
+	queryExpr := "nil"
+	if len(query) > 0 {
+		queryExpr = "params.values()"
+	}
+
+	fmt.Fprintf(&g.body, "\n// %s calls %s %s: %s.\n", name, strings.ToUpper(method), path, lowerFirst(op.Summary))
+	if resultType == "" {
+		fmt.Fprintf(&g.body, "func (c *Client) %s(%s) error {\n", name, strings.Join(args, ", "))
+		fmt.Fprintf(&g.body, "return c.do(http.Method%s, %s, %s, %s, nil)\n}\n", exported(method), pathExpr, queryExpr, body)
+		return nil
+	}
+	fmt.Fprintf(&g.body, "func (c *Client) %s(%s) (%s, error) {\n", name, strings.Join(args, ", "), resultType)
+	fmt.Fprintf(&g.body, "var result %s\n", resultType)
+	fmt.Fprintf(&g.body, "err := c.do(http.Method%s, %s, %s, %s, &result)\n", exported(method), pathExpr, queryExpr, body)
+	g.body.WriteString("return result, err\n}\n")
+	return nil
+}
+
+// params declares the struct holding the query parameters of an operation
+// and its values method. Optional parameters are left out when zero.
+func (g *generator) params(name string, query []parameter) error {
+	g.imports["net/url"] = true
+	fmt.Fprintf(&g.body, "\n// %sParams are the query parameters of %s.\ntype %sParams struct {\n", name, name, name)
+	for _, param := range query {
+		paramType, err := g.goType(param.Schema)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&g.body, "%s %s\n", exported(param.Name), paramType)
+	}
+	fmt.Fprintf(&g.body, "}\n\nfunc (p %sParams) values() url.Values {\nvalues := url.Values{}\n", name)
+	for _, param := range query {
+		field := "p." + exported(param.Name)
+		value := field
+		zero := `""`
+		if param.Schema.Type == "integer" {
+			g.imports["strconv"] = true
+			value = "strconv.Itoa(" + field + ")"
+			zero = "0"
+		}
+		if param.Required {
+			fmt.Fprintf(&g.body, "values.Set(%q, %s)\n", param.Name, value)
+		} else {
+			fmt.Fprintf(&g.body, "if %s != %s {\nvalues.Set(%q, %s)\n}\n", field, zero, param.Name, value)
+		}
+	}
+	g.body.WriteString("return values\n}\n")
+	return nil
+}
+
+// pathExpr returns a Go expression building the path with its parameters
+// filled in.
+func (g *generator) pathExpr(path string, params []parameter) (string, error) {
+	var parts []string
+	rest := path
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest, '}')
+		if end < start {
+			return "", fmt.Errorf("invalid path")
+		}
+		parts = append(parts, fmt.Sprintf("%q", rest[:start]))
+		name := rest[start+1 : end]
+		param, ok := findParam(params, name)
+		if !ok {
+			return "", fmt.Errorf("missing path parameter %s", name)
+		}
+		if param.Schema.Type == "integer" {
+			g.imports["strconv"] = true
+			parts = append(parts, "strconv.Itoa("+name+")")
+		} else {
+			g.imports["net/url"] = true
+			parts = append(parts, "url.PathEscape("+name+")")
+		}
+		rest = rest[end+1:]
+	}
+	if rest != "" {
+		parts = append(parts, fmt.Sprintf("%q", rest))
+	}
+	return strings.Join(parts, " + "), nil
+}
+
+func (g *generator) goType(s schema) (string, error) {
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		component, ok := g.spec.Components.Schemas[name]
+		if !ok {
+			return "", fmt.Errorf("unknown schema %s", s.Ref)
+		}
+		return g.goType(component)
+	}
+	if s.GoType != "" {
+		if strings.HasPrefix(s.GoType, "schemas.") {
+			g.imports["github.com/kilianmandscharo/activities/schemas"] = true
+		}
+		return s.GoType, nil
+	}
+	switch s.Type {
+	case "integer":
+		return "int", nil
+	case "number":
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "string":
+		return "string", nil
+	case "object":
+		return "map[string]any", nil
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		item, err := g.goType(*s.Items)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + item, nil
+	}
+	return "", fmt.Errorf("unsupported schema type %q", s.Type)
+}
+
+func findParam(params []parameter, name string) (parameter, bool) {
+	for _, param := range params {
+		if param.In == "path" && param.Name == name {
+			return param, true
+		}
+	}
+	return parameter{}, false
+}
+
+func exported(name string) string {
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+func lowerFirst(text string) string {
+	runes := []rune(text)
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestClientUpToDate(t *testing.T) {
+	spec, err := os.ReadFile("../../api/openapi.json")
+	if err != nil {
+		t.Fatalf("could not read spec, %v", err)
+	}
+	source, err := Generate(spec)
+	if err != nil {
+		t.Fatalf("could not generate client, %v", err)
+	}
+	current, err := os.ReadFile("../../client/client.gen.go")
+	if err != nil {
+		t.Fatalf("could not read client, %v", err)
+	}
+	if !bytes.Equal(source, current) {
+		t.Fatal("client/client.gen.go is out of date, run go generate ./client")
+	}
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/kilianmandscharo/activities/logging"
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+var ErrUnknownEntity = errors.New("entity is not audited")
+
+// auditedEntities are the entities whose tables have a trigger recording
+// every inserted, updated and deleted row in the audit log.
+var auditedEntities = []string{"user", "activity", "block", "pause"}
+
+// auditChange records a change of a row in the audit log. The actor and the
+// request are read from the settings begin puts into the transaction, and
+// passwords are never recorded. The owner of the row is recorded as well, so
+// that the sync feed can select the changes of a user; pauses deleted along
+// with their block inherit the owner recorded for the block.
+const auditChange = `CREATE OR REPLACE FUNCTION audit_change() RETURNS trigger AS $$
+DECLARE
+	state jsonb := CASE WHEN TG_OP = 'DELETE' THEN to_jsonb(OLD) ELSE to_jsonb(NEW) END;
+	owner int := (state->>'user_id')::int;
+BEGIN
+	IF TG_OP = 'UPDATE' AND OLD IS NOT DISTINCT FROM NEW THEN
+		RETURN NULL;
+	END IF;
+	IF TG_ARGV[0] = 'user' THEN
+		owner := (state->>'id')::int;
+	ELSIF TG_ARGV[0] = 'pause' THEN
+		owner := coalesce(
+			(SELECT user_id FROM blocks WHERE id = (state->>'block_id')::int),
+			(SELECT owner_id FROM audit_log WHERE entity = 'block' AND entity_id = (state->>'block_id')::int ORDER BY id DESC LIMIT 1));
+	END IF;
+	INSERT INTO audit_log (entity, entity_id, action, before, after, created_at, request_id, user_id, owner_id) VALUES (
+		TG_ARGV[0],
+		CASE WHEN TG_OP = 'DELETE' THEN OLD.id ELSE NEW.id END,
+		lower(TG_OP),
+		CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE to_jsonb(OLD) - 'password' END,
+		CASE WHEN TG_OP = 'DELETE' THEN NULL ELSE to_jsonb(NEW) - 'password' END,
+		now() AT TIME ZONE 'utc',
+		nullif(current_setting('activities.request_id', true), ''),
+		nullif(current_setting('activities.actor_id', true), '')::int,
+		owner);
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql`
+
+// auditAppendOnly keeps the audit log from being rewritten.
+const auditAppendOnly = `CREATE OR REPLACE FUNCTION audit_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit log is append-only';
+END
+$$ LANGUAGE plpgsql`
+
+type actorKey struct{}
+
+// WithActor returns a context attributing the changes made with it to the
+// user in the audit log.
+func WithActor(ctx context.Context, userId int) context.Context {
+	return context.WithValue(ctx, actorKey{}, userId)
+}
+
+func actorId(ctx context.Context) int {
+	userId, _ := ctx.Value(actorKey{}).(int)
+	return userId
+}
+
+func actor(ctx context.Context) string {
+	if userId := actorId(ctx); userId != 0 {
+		return strconv.Itoa(userId)
+	}
+	return ""
+}
+
+// begin starts a transaction whose changes the audit log attributes to the
+// actor and the request of the context.
+func (db *Database) begin(ctx context.Context) (*sql.Tx, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"SELECT set_config('activities.actor_id', $1, true), set_config('activities.request_id', $2, true)",
+		actor(ctx),
+		logging.RequestId(ctx))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// exec runs a single statement in a transaction of its own, so that the
+// audit log knows who made the change.
+func (db *Database) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return result, tx.Commit()
+}
+
+// insert runs an INSERT returning the new id like exec.
+func (db *Database) insert(ctx context.Context, query string, args ...any) (int, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	var id int
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&id); err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// GetAuditLog returns the recorded changes of an entity, oldest first. The
+// history outlives the entity, so deleted ones can be inspected as well.
+func (db *Database) GetAuditLog(ctx context.Context, entity string, id int) (_ []schemas.AuditEntry, err error) {
+	defer db.observe(ctx, "GetAuditLog", time.Now(), &err)
+	if !contains(auditedEntities, entity) {
+		return nil, ErrUnknownEntity
+	}
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, entity, entity_id, action, coalesce(before, 'null'), coalesce(after, 'null'),
+			coalesce(user_id, 0), coalesce(request_id, ''), created_at
+		FROM audit_log WHERE entity = $1 AND entity_id = $2 ORDER BY id`,
+		entity,
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []schemas.AuditEntry
+	for rows.Next() {
+		var entry schemas.AuditEntry
+		var before, after []byte
+		err := rows.Scan(
+			&entry.Id,
+			&entry.Entity,
+			&entry.EntityId,
+			&entry.Action,
+			&before,
+			&after,
+			&entry.UserId,
+			&entry.RequestId,
+			&entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.Before = before
+		entry.After = after
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,192 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+var (
+	ErrUnknownRef   = errors.New("reference names no entity created by an earlier operation")
+	ErrDuplicateRef = errors.New("reference is already used by an earlier operation")
+)
+
+const (
+	BatchSkipped    = "skipped"
+	BatchRolledBack = "rolledBack"
+)
+
+// ApplyBatch applies the operations on activities, blocks and pauses in one
+// transaction. An operation creating an entity can name it with a reference,
+// which later operations use in place of its id. In atomic mode the first
+// operation that cannot be applied rolls back the whole batch; the
+// operations applied before it are reported as rolled back and the ones
+// after it as skipped. Otherwise a failed operation is rolled back on its own
+// and the others are committed.
+func (db *Database) ApplyBatch(ctx context.Context, userId int, operations []schemas.BatchOperation, atomic bool) (_ schemas.BatchResponse, err error) {
+	defer db.observe(ctx, "ApplyBatch", time.Now(), &err)
+	results, committed, err := db.applyOperations(ctx, userId, operations, atomic, false)
+	if err != nil {
+		return schemas.BatchResponse{}, err
+	}
+	return schemas.BatchResponse{Committed: committed, Results: results}, nil
+}
+
+// entityRef is an entity created by an operation of a batch.
+type entityRef struct {
+	entity string
+	id     int
+}
+
+// applyOperations applies the operations in a transaction and reports
+// whether it has been committed. Without atomic, every operation runs under a
+// savepoint, so that one failing rolls back only its own changes. With
+// requireClientId, creates have to name the entity by a client id.
+func (db *Database) applyOperations(ctx context.Context, userId int, operations []schemas.BatchOperation, atomic bool, requireClientId bool) ([]schemas.BatchResult, bool, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	results := make([]schemas.BatchResult, len(operations))
+	refs := make(map[string]entityRef)
+	failed := -1
+	for i, operation := range operations {
+		result := schemas.BatchResult{
+			Ref: operation.Ref,
+			SyncResult: schemas.SyncResult{
+				Entity:   operation.Entity,
+				Action:   operation.Action,
+				ClientId: operation.ClientId,
+				Status:   SyncApplied,
+			},
+		}
+		if failed != -1 {
+			result.Status = BatchSkipped
+			results[i] = result
+			continue
+		}
+		if !atomic {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT operation"); err != nil {
+				return nil, false, err
+			}
+		}
+
+		var mutation schemas.SyncMutation
+		mutation, err = resolveRefs(ctx, tx, operation, refs)
+		if err == nil && requireClientId && mutation.Action == MutationCreate && mutation.ClientId == "" {
+			err = ErrInvalidClientId
+		}
+		if err == nil {
+			result.Id, result.Version, err = applyMutation(ctx, tx, userId, mutation)
+		}
+		switch {
+		case err == nil:
+			if operation.Ref != "" && operation.Action == MutationCreate {
+				refs[operation.Ref] = entityRef{operation.Entity, result.Id}
+			}
+		case errors.Is(err, ErrVersionConflict):
+			result.Status = SyncConflict
+			result.Error = err.Error()
+		case errors.Is(err, sql.ErrNoRows):
+			result.Status = SyncRejected
+			result.Error = "entity does not exist"
+		case isRejected(err):
+			result.Status = SyncRejected
+			result.Error = err.Error()
+		default:
+			return nil, false, err
+		}
+		results[i] = result
+		if result.Status == SyncApplied {
+			if !atomic {
+				if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT operation"); err != nil {
+					return nil, false, err
+				}
+			}
+			continue
+		}
+		if atomic {
+			failed = i
+		} else if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT operation"); err != nil {
+			return nil, false, err
+		}
+	}
+
+	committed := failed == -1
+	if committed {
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+	} else {
+		if err := tx.Rollback(); err != nil {
+			return nil, false, err
+		}
+		for i := 0; i < failed; i++ {
+			results[i].Status = BatchRolledBack
+			results[i].Id, results[i].Version = 0, 0
+		}
+	}
+
+	for i := range results {
+		if results[i].Status != SyncConflict {
+			continue
+		}
+		current := schemas.Change{Entity: results[i].Entity, Id: results[i].Id, ClientId: results[i].ClientId, Action: ChangeUpdated}
+		if err := db.loadChange(ctx, &current); err != nil {
+			return nil, false, err
+		}
+		results[i].Current = &current
+	}
+	return results, committed, nil
+}
+
+// resolveRefs replaces the references of the operation by the ids of the
+// entities created for them. An update or a delete of an entity created in
+// the same batch is addressed by its reference, and applies to its latest
+// version.
+func resolveRefs(ctx context.Context, tx *sql.Tx, operation schemas.BatchOperation, refs map[string]entityRef) (schemas.SyncMutation, error) {
+	mutation := operation.SyncMutation
+	lookup := func(ref string, entity string) (int, error) {
+		created, ok := refs[ref]
+		if !ok || created.entity != entity {
+			return 0, ErrUnknownRef
+		}
+		return created.id, nil
+	}
+	var err error
+	if operation.ActivityRef != "" {
+		if mutation.ActivityId, err = lookup(operation.ActivityRef, "activity"); err != nil {
+			return mutation, err
+		}
+	}
+	if operation.BlockRef != "" {
+		if mutation.BlockId, err = lookup(operation.BlockRef, "block"); err != nil {
+			return mutation, err
+		}
+	}
+	if operation.Ref == "" {
+		return mutation, nil
+	}
+	if mutation.Action == MutationCreate {
+		if _, ok := refs[operation.Ref]; ok {
+			return mutation, ErrDuplicateRef
+		}
+		return mutation, nil
+	}
+	if mutation.Id, err = lookup(operation.Ref, mutation.Entity); err != nil {
+		return mutation, err
+	}
+	row := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT version FROM %s WHERE id = $1", syncTables[mutation.Entity]), mutation.Id)
+	err = row.Scan(&mutation.Version)
+	if errors.Is(err, sql.ErrNoRows) && mutation.Action == MutationDelete {
+		mutation.Version = 1
+		return mutation, nil
+	}
+	return mutation, err
+}
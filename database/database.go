@@ -1,14 +1,69 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
+	_ "time/tzdata"
 
+	"github.com/kilianmandscharo/activities/metrics"
 	"github.com/kilianmandscharo/activities/schemas"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+var (
+	ErrInvalidSplitTime   = errors.New("split time is not within the block")
+	ErrForeignActivity    = errors.New("activity belongs to another user")
+	ErrBlocksNotMergeable = errors.New("blocks are not adjacent blocks of the same activity")
+	ErrMergeIntoSelf      = errors.New("activity cannot be merged into itself")
+	ErrInvalidTimezone    = errors.New("unknown timezone")
+)
+
+// sentinels are the errors reporting a request that cannot be applied, as
+// opposed to a failing database.
+var sentinels = []error{
+	ErrInvalidSplitTime,
+	ErrForeignActivity,
+	ErrBlocksNotMergeable,
+	ErrMergeIntoSelf,
+	ErrInvalidTimezone,
+	ErrNoRunningBlock,
+	ErrAlreadyPaused,
+	ErrNotPaused,
+	ErrTimeBeforeRun,
+	ErrNotMember,
+	ErrRoleNotAllowed,
+	ErrInvalidRole,
+	ErrAlreadyMember,
+	ErrOwnerLeaves,
+	ErrInvitationEmail,
+	ErrTimesheetApproved,
+	ErrInvalidTransition,
+	ErrForeignTimesheet,
+	ErrNotApprover,
+	ErrCommentRequired,
+	ErrPeriodLocked,
+	ErrInvalidLockDate,
+	ErrLockOverrideDenied,
+	ErrUnknownEntity,
+	ErrVersionConflict,
+	ErrInvalidSyncToken,
+	ErrInvalidMutation,
+	ErrInvalidClientId,
+	ErrUnknownClientId,
+	ErrForeignEntity,
+	ErrVersionRequired,
+	ErrIdempotencyKeyReused,
+	ErrIdempotencyKeyInUse,
+	ErrUnknownRef,
+	ErrDuplicateRef,
+	ErrInvalidUuid,
+	ErrUuidTaken,
+}
+
 type Database struct {
 	db *sql.DB
 }
@@ -18,6 +73,98 @@ var tables = []schemas.TableSchema{
 	{Name: "activities", Columns: "(id serial PRIMARY KEY, name text, user_id int references users(id) ON DELETE CASCADE)"},
 	{Name: "blocks", Columns: "(id serial PRIMARY KEY, start_time timestamp, end_time timestamp, activity_id int references activities(id) ON DELETE CASCADE)"},
 	{Name: "pauses", Columns: "(id serial PRIMARY KEY, start_time timestamp, end_time timestamp, block_id int references blocks(id) ON DELETE CASCADE)"},
+	{Name: "tags", Columns: "(id serial PRIMARY KEY, name text, block_id int references blocks(id) ON DELETE CASCADE)"},
+	{Name: "settings", Columns: "(user_id int PRIMARY KEY references users(id) ON DELETE CASCADE, max_block_minutes int, end_of_day time)"},
+	{Name: "webhooks", Columns: "(id serial PRIMARY KEY, url text, secret text, events text[], user_id int references users(id) ON DELETE CASCADE)"},
+	{Name: "schema_version", Columns: "(id int PRIMARY KEY DEFAULT 1 CHECK (id = 1), version int NOT NULL)"},
+	{Name: "workspaces", Columns: "(id serial PRIMARY KEY, name text, created_at timestamp)"},
+	{Name: "workspace_members", Columns: "(workspace_id int references workspaces(id) ON DELETE CASCADE, user_id int references users(id) ON DELETE CASCADE, role text NOT NULL, PRIMARY KEY (workspace_id, user_id))"},
+	{Name: "workspace_invitations", Columns: "(id serial PRIMARY KEY, email text, role text NOT NULL, token text UNIQUE, created_at timestamp, accepted_at timestamp, invited_by int references users(id) ON DELETE SET NULL, workspace_id int references workspaces(id) ON DELETE CASCADE)"},
+	{Name: "timesheets", Columns: "(id serial PRIMARY KEY, week_start date NOT NULL, status text NOT NULL, user_id int references users(id) ON DELETE CASCADE, UNIQUE (user_id, week_start))"},
+	{Name: "timesheet_events", Columns: "(id serial PRIMARY KEY, action text NOT NULL, comment text, created_at timestamp, user_id int references users(id) ON DELETE SET NULL, timesheet_id int references timesheets(id) ON DELETE CASCADE)"},
+	{Name: "lock_dates", Columns: "(id serial PRIMARY KEY, lock_date date NOT NULL, updated_at timestamp, set_by int references users(id) ON DELETE SET NULL, user_id int UNIQUE references users(id) ON DELETE CASCADE, workspace_id int UNIQUE references workspaces(id) ON DELETE CASCADE)"},
+	{Name: "lock_overrides", Columns: "(id serial PRIMARY KEY, lock_date date, request_id text, created_at timestamp, user_id int references users(id) ON DELETE SET NULL, lock_id int references lock_dates(id) ON DELETE SET NULL)"},
+	{Name: "audit_log", Columns: "(id bigserial PRIMARY KEY, entity text NOT NULL, entity_id int NOT NULL, action text NOT NULL, before jsonb, after jsonb, created_at timestamp NOT NULL, request_id text, user_id int, xid bigint NOT NULL DEFAULT txid_current())"},
+	{Name: "block_revisions", Columns: "(id serial PRIMARY KEY, revision int NOT NULL, start_time timestamp, end_time timestamp, activity_id int, note text, tags text[], pauses jsonb, created_at timestamp, user_id int, block_id int references blocks(id) ON DELETE CASCADE, UNIQUE (block_id, revision))"},
+	{Name: "webhook_deliveries", Columns: "(id serial PRIMARY KEY, event text, payload jsonb, status text, attempts int NOT NULL DEFAULT 0, next_attempt_at timestamp, last_status_code int, last_error text, created_at timestamp, delivered_at timestamp, webhook_id int references webhooks(id) ON DELETE CASCADE)"},
+	{Name: "webhook_outbox", Columns: "(id int PRIMARY KEY CHECK (id = 1), xid bigint NOT NULL, audit_id bigint NOT NULL)"},
+	{Name: "sessions", Columns: "(token_hash text PRIMARY KEY, created_at timestamp NOT NULL, expires_at timestamp NOT NULL, user_id int references users(id) ON DELETE CASCADE)"},
+	{Name: "idempotency_keys", Columns: "(key text NOT NULL, route text NOT NULL, user_id int NOT NULL DEFAULT 0, request_hash text NOT NULL, status int, content_type text, response bytea, created_at timestamp NOT NULL, PRIMARY KEY (key, route, user_id))"},
+}
+
+// migrations are applied in order after the tables have been created. Every
+// statement has to be idempotent, since they run on each call to Init.
+var migrations = []string{
+	"ALTER TABLE blocks ADD COLUMN IF NOT EXISTS note text",
+	"CREATE INDEX IF NOT EXISTS activities_user_id_idx ON activities (user_id)",
+	"CREATE INDEX IF NOT EXISTS blocks_activity_id_idx ON blocks (activity_id)",
+	"CREATE INDEX IF NOT EXISTS tags_block_id_idx ON tags (block_id)",
+	"CREATE INDEX IF NOT EXISTS activities_name_search_idx ON activities USING GIN (to_tsvector('simple', name))",
+	"CREATE INDEX IF NOT EXISTS blocks_note_search_idx ON blocks USING GIN (to_tsvector('simple', coalesce(note, '')))",
+	"CREATE INDEX IF NOT EXISTS tags_name_search_idx ON tags USING GIN (to_tsvector('simple', name))",
+	"ALTER TABLE blocks ADD COLUMN IF NOT EXISTS auto_stopped boolean NOT NULL DEFAULT false",
+	"CREATE INDEX IF NOT EXISTS blocks_open_idx ON blocks (activity_id) WHERE end_time IS NULL",
+	"ALTER TABLE settings ADD COLUMN IF NOT EXISTS pomodoro_enabled boolean NOT NULL DEFAULT false",
+	"ALTER TABLE settings ADD COLUMN IF NOT EXISTS pomodoro_work_minutes int NOT NULL DEFAULT 25",
+	"ALTER TABLE settings ADD COLUMN IF NOT EXISTS pomodoro_short_break_minutes int NOT NULL DEFAULT 5",
+	"ALTER TABLE settings ADD COLUMN IF NOT EXISTS pomodoro_long_break_minutes int NOT NULL DEFAULT 15",
+	"ALTER TABLE settings ADD COLUMN IF NOT EXISTS pomodoro_cycles int NOT NULL DEFAULT 4",
+	"CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks (user_id)",
+	"CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, created_at)",
+	"CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'",
+	"ALTER TABLE activities ADD COLUMN IF NOT EXISTS workspace_id int references workspaces(id) ON DELETE CASCADE",
+	"CREATE INDEX IF NOT EXISTS activities_workspace_id_idx ON activities (workspace_id)",
+	"ALTER TABLE blocks ADD COLUMN IF NOT EXISTS user_id int references users(id) ON DELETE CASCADE",
+	"UPDATE blocks SET user_id = a.user_id FROM activities a WHERE a.id = blocks.activity_id AND blocks.user_id IS NULL",
+	"CREATE INDEX IF NOT EXISTS blocks_user_id_idx ON blocks (user_id, start_time)",
+	auditChange,
+	auditAppendOnly,
+	"DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log",
+	"CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log FOR EACH ROW EXECUTE FUNCTION audit_append_only()",
+	"DROP TRIGGER IF EXISTS users_audit ON users",
+	"CREATE TRIGGER users_audit AFTER INSERT OR UPDATE OR DELETE ON users FOR EACH ROW EXECUTE FUNCTION audit_change('user')",
+	"DROP TRIGGER IF EXISTS activities_audit ON activities",
+	"CREATE TRIGGER activities_audit AFTER INSERT OR UPDATE OR DELETE ON activities FOR EACH ROW EXECUTE FUNCTION audit_change('activity')",
+	"DROP TRIGGER IF EXISTS blocks_audit ON blocks",
+	"CREATE TRIGGER blocks_audit AFTER INSERT OR UPDATE OR DELETE ON blocks FOR EACH ROW EXECUTE FUNCTION audit_change('block')",
+	"DROP TRIGGER IF EXISTS pauses_audit ON pauses",
+	"CREATE TRIGGER pauses_audit AFTER INSERT OR UPDATE OR DELETE ON pauses FOR EACH ROW EXECUTE FUNCTION audit_change('pause')",
+	"CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity, entity_id, id)",
+	"ALTER TABLE activities ADD COLUMN IF NOT EXISTS version int NOT NULL DEFAULT 1",
+	"ALTER TABLE blocks ADD COLUMN IF NOT EXISTS version int NOT NULL DEFAULT 1",
+	"ALTER TABLE pauses ADD COLUMN IF NOT EXISTS version int NOT NULL DEFAULT 1",
+	bumpVersion,
+	touchBlock,
+	"DROP TRIGGER IF EXISTS activities_version ON activities",
+	"CREATE TRIGGER activities_version BEFORE UPDATE ON activities FOR EACH ROW EXECUTE FUNCTION bump_version()",
+	"DROP TRIGGER IF EXISTS blocks_version ON blocks",
+	"CREATE TRIGGER blocks_version BEFORE UPDATE ON blocks FOR EACH ROW EXECUTE FUNCTION bump_version()",
+	"DROP TRIGGER IF EXISTS pauses_version ON pauses",
+	"CREATE TRIGGER pauses_version BEFORE UPDATE ON pauses FOR EACH ROW EXECUTE FUNCTION bump_version()",
+	"DROP TRIGGER IF EXISTS pauses_touch_block ON pauses",
+	"CREATE TRIGGER pauses_touch_block AFTER INSERT OR UPDATE OR DELETE ON pauses FOR EACH ROW EXECUTE FUNCTION touch_block()",
+	"DROP TRIGGER IF EXISTS tags_touch_block ON tags",
+	"CREATE TRIGGER tags_touch_block AFTER INSERT OR UPDATE OR DELETE ON tags FOR EACH ROW EXECUTE FUNCTION touch_block()",
+	"ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS owner_id int",
+	"CREATE INDEX IF NOT EXISTS audit_log_owner_idx ON audit_log (owner_id, id)",
+	"CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at)",
+	"ALTER TABLE activities ADD COLUMN IF NOT EXISTS uuid uuid NOT NULL DEFAULT gen_random_uuid()",
+	"ALTER TABLE blocks ADD COLUMN IF NOT EXISTS uuid uuid NOT NULL DEFAULT gen_random_uuid()",
+	"ALTER TABLE pauses ADD COLUMN IF NOT EXISTS uuid uuid NOT NULL DEFAULT gen_random_uuid()",
+	copySyncIds,
+	"DROP TABLE IF EXISTS sync_ids",
+	"CREATE UNIQUE INDEX IF NOT EXISTS activities_uuid_idx ON activities (uuid)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS blocks_uuid_idx ON blocks (uuid)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS pauses_uuid_idx ON pauses (uuid)",
+	"CREATE INDEX IF NOT EXISTS audit_log_deleted_uuid_idx ON audit_log ((before->>'uuid')) WHERE action = 'delete'",
+	"ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS user_id int NOT NULL DEFAULT 0",
+	scopeIdempotencyKeys,
+	"ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS xid bigint NOT NULL DEFAULT txid_current()",
+	"CREATE INDEX IF NOT EXISTS audit_log_owner_xid_idx ON audit_log (owner_id, xid, id)",
+	"CREATE INDEX IF NOT EXISTS audit_log_xid_idx ON audit_log (xid, id)",
+	initWebhookOutbox,
+	"ALTER TABLE settings ADD COLUMN IF NOT EXISTS timezone text",
+	"CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions (expires_at)",
 }
 
 func New(connStr string) (*Database, error) {
@@ -28,16 +175,75 @@ func New(connStr string) (*Database, error) {
 	return &Database{db: db}, nil
 }
 
-func (db *Database) Init() error {
+// Connect opens the database and pings it until it answers, doubling the
+// delay after every failed attempt.
+func Connect(connStr string, attempts int, delay time.Duration) (*Database, error) {
+	db, err := New(connStr)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = db.Ping(ctx)
+		cancel()
+		if err == nil {
+			return db, nil
+		}
+		if attempt >= attempts {
+			db.Close()
+			return nil, fmt.Errorf("database unreachable after %d attempts: %w", attempt, err)
+		}
+		slog.Warn("database unreachable", "retry_in", delay, "attempt", attempt, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (db *Database) Ping(ctx context.Context) (err error) {
+	defer db.observe(ctx, "Ping", time.Now(), &err)
+	return db.db.PingContext(ctx)
+}
+
+func (db *Database) Init(ctx context.Context) error {
 	for _, table := range tables {
-		err := createTable(db.db, table.Name, table.Columns)
+		err := createTable(ctx, db.db, table.Name, table.Columns)
 		if err != nil {
 			return err
 		}
 	}
+	for _, migration := range migrations {
+		if _, err := db.db.ExecContext(ctx, migration); err != nil {
+			return err
+		}
+	}
+	_, err := db.db.ExecContext(ctx, `
+		INSERT INTO schema_version (id, version) VALUES (1, $1)
+		ON CONFLICT (id) DO UPDATE SET version = greatest(schema_version.version, EXCLUDED.version)`,
+		len(migrations))
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// PendingMigrations returns the number of migrations that have not been
+// applied to the database yet.
+func (db *Database) PendingMigrations(ctx context.Context) (_ int, err error) {
+	defer db.observe(ctx, "PendingMigrations", time.Now(), &err)
+	var version int
+	err = db.db.QueryRowContext(ctx, "SELECT version FROM schema_version WHERE id = 1").Scan(&version)
+	if err == sql.ErrNoRows {
+		return len(migrations), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	if version >= len(migrations) {
+		return 0, nil
+	}
+	return len(migrations) - version, nil
+}
+
 func (db *Database) Close() error {
 	err := db.db.Close()
 	if err != nil {
@@ -46,30 +252,41 @@ func (db *Database) Close() error {
 	return nil
 }
 
-func (db *Database) Clear() error {
-	_, err := db.db.Exec("TRUNCATE users RESTART IDENTITY CASCADE")
+// Stats returns the statistics of the connection pool.
+func (db *Database) Stats() sql.DBStats {
+	return db.db.Stats()
+}
+
+func (db *Database) Clear(ctx context.Context) error {
+	_, err := db.db.ExecContext(ctx, "TRUNCATE users, audit_log, idempotency_keys RESTART IDENTITY CASCADE")
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (db *Database) AddUser(name string, email string, password string) (int, error) {
-	row := db.db.QueryRow(
+// AddUser adds a user whose password is stored as a bcrypt hash.
+func (db *Database) AddUser(ctx context.Context, name string, email string, password string) (_ int, err error) {
+	defer db.observe(ctx, "AddUser", time.Now(), &err)
+	hash, err := hashPassword(password)
+	if err != nil {
+		return -1, err
+	}
+	id, err := db.insert(ctx,
 		"INSERT INTO users (name, email, password) VALUES ($1, $2, $3) RETURNING id",
 		name,
 		email,
-		password)
-	var id int
-	if err := row.Scan(&id); err != nil {
+		hash)
+	if err != nil {
 		return -1, err
 	}
 	return id, nil
 }
 
-func (db *Database) GetUser(userId int) (schemas.User, error) {
+func (db *Database) GetUser(ctx context.Context, userId int) (_ schemas.User, err error) {
+	defer db.observe(ctx, "GetUser", time.Now(), &err)
 	var user schemas.User
-	row := db.db.QueryRow("SELECT * FROM users WHERE id = $1", userId)
+	row := db.db.QueryRowContext(ctx, "SELECT * FROM users WHERE id = $1", userId)
 	var id int
 	var name string
 	var email string
@@ -77,286 +294,1394 @@ func (db *Database) GetUser(userId int) (schemas.User, error) {
 	if err := row.Scan(&id, &name, &email, &password); err != nil {
 		return user, err
 	}
-	user.Id = id
-	user.Name = name
-	user.Email = email
-	user.Password = password
-	return user, nil
+	user.Id = id
+	user.Name = name
+	user.Email = email
+	user.Password = password
+	return user, nil
+}
+
+// GetUserByLogin returns the user with the email and password, or
+// sql.ErrNoRows if there is none. Passwords stored in plaintext by earlier
+// versions are replaced by their hash on the first login.
+func (db *Database) GetUserByLogin(ctx context.Context, email string, password string) (_ schemas.User, err error) {
+	defer db.observe(ctx, "GetUserByLogin", time.Now(), &err)
+	var user schemas.User
+	row := db.db.QueryRowContext(ctx,
+		"SELECT id, name, email, password FROM users WHERE email = $1 ORDER BY id",
+		email)
+	if err := row.Scan(&user.Id, &user.Name, &user.Email, &user.Password); err != nil {
+		return user, err
+	}
+	ok, rehash := checkPassword(user.Password, password)
+	if !ok {
+		return schemas.User{}, sql.ErrNoRows
+	}
+	if rehash {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return user, err
+		}
+		if _, err := db.db.ExecContext(ctx, "UPDATE users SET password = $1 WHERE id = $2", hash, user.Id); err != nil {
+			return user, err
+		}
+		user.Password = hash
+	}
+	return user, nil
+}
+
+func (db *Database) GetActivityUserId(ctx context.Context, activityId int) (_ int, err error) {
+	defer db.observe(ctx, "GetActivityUserId", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx, "SELECT user_id FROM activities WHERE id = $1", activityId)
+	var userId int
+	if err := row.Scan(&userId); err != nil {
+		return -1, err
+	}
+	return userId, nil
+}
+
+func (db *Database) GetBlockUserId(ctx context.Context, blockId int) (_ int, err error) {
+	defer db.observe(ctx, "GetBlockUserId", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx, "SELECT user_id FROM blocks WHERE id = $1", blockId)
+	var userId int
+	if err := row.Scan(&userId); err != nil {
+		return -1, err
+	}
+	return userId, nil
+}
+
+func (db *Database) GetSettings(ctx context.Context, userId int) (_ schemas.Settings, err error) {
+	defer db.observe(ctx, "GetSettings", time.Now(), &err)
+	settings := schemas.Settings{UserId: userId, Pomodoro: pomodoroDefaults(schemas.Pomodoro{})}
+	row := db.db.QueryRowContext(ctx, `
+		SELECT coalesce(max_block_minutes, 0), coalesce(to_char(end_of_day, 'HH24:MI'), ''),
+			coalesce(timezone, ''), pomodoro_enabled, pomodoro_work_minutes, pomodoro_short_break_minutes,
+			pomodoro_long_break_minutes, pomodoro_cycles
+		FROM settings WHERE user_id = $1`,
+		userId)
+	err = row.Scan(
+		&settings.MaxBlockMinutes,
+		&settings.EndOfDay,
+		&settings.Timezone,
+		&settings.Pomodoro.Enabled,
+		&settings.Pomodoro.WorkMinutes,
+		&settings.Pomodoro.ShortBreakMinutes,
+		&settings.Pomodoro.LongBreakMinutes,
+		&settings.Pomodoro.Cycles)
+	if err != nil && err != sql.ErrNoRows {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// UpdateSettings stores the settings of the user. The timezone is an IANA
+// name such as Europe/Berlin, an empty one stands for UTC.
+func (db *Database) UpdateSettings(ctx context.Context, settings schemas.Settings) (err error) {
+	defer db.observe(ctx, "UpdateSettings", time.Now(), &err)
+	if _, err := loadTimezone(settings.Timezone); err != nil {
+		return ErrInvalidTimezone
+	}
+	pomodoro := pomodoroDefaults(settings.Pomodoro)
+	_, err = db.db.ExecContext(ctx, `
+		INSERT INTO settings (
+			user_id, max_block_minutes, end_of_day, pomodoro_enabled, pomodoro_work_minutes,
+			pomodoro_short_break_minutes, pomodoro_long_break_minutes, pomodoro_cycles, timezone)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id) DO UPDATE SET
+			max_block_minutes = $2, end_of_day = $3, pomodoro_enabled = $4, pomodoro_work_minutes = $5,
+			pomodoro_short_break_minutes = $6, pomodoro_long_break_minutes = $7, pomodoro_cycles = $8,
+			timezone = $9`,
+		settings.UserId,
+		newNullInt(settings.MaxBlockMinutes),
+		newNullString(settings.EndOfDay),
+		pomodoro.Enabled,
+		pomodoro.WorkMinutes,
+		pomodoro.ShortBreakMinutes,
+		pomodoro.LongBreakMinutes,
+		pomodoro.Cycles,
+		newNullString(settings.Timezone))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// loadTimezone returns the location of the IANA timezone name, or UTC for an
+// empty name.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// GetActivities returns the activities of the user together with the
+// activities of the workspaces the user is a member of, with the blocks the
+// user may see.
+func (db *Database) GetActivities(ctx context.Context, userId int) (_ []schemas.Activity, err error) {
+	defer db.observe(ctx, "GetActivities", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+activityColumns+" FROM activities WHERE id IN ("+accessibleActivities("$1")+") ORDER BY id",
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return db.scanActivities(ctx, rows, userId)
+}
+
+func (db *Database) GetActivity(ctx context.Context, activityId int) (_ schemas.Activity, err error) {
+	defer db.observe(ctx, "GetActivity", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx, "SELECT "+activityColumns+" FROM activities WHERE id = $1", activityId)
+	return db.scanActivity(ctx, row, 0)
+}
+
+// AddActivity adds an activity of the user. The activity gets the UUID if
+// one is given, otherwise a generated one.
+func (db *Database) AddActivity(ctx context.Context, name string, user_id int, uuid string) (_ int, err error) {
+	defer db.observe(ctx, "AddActivity", time.Now(), &err)
+	publicId, err := newUuid(uuid)
+	if err != nil {
+		return -1, err
+	}
+	id, err := db.insert(ctx,
+		"INSERT INTO activities (name, user_id, uuid) VALUES ($1, $2, coalesce($3::uuid, gen_random_uuid())) RETURNING id",
+		name,
+		user_id,
+		publicId)
+	if err != nil {
+		return -1, uuidTaken(err)
+	}
+	return id, nil
+}
+
+// UpdateActivity renames the activity and returns its new version. The
+// activity has to have the given version, unless it is 0.
+func (db *Database) UpdateActivity(ctx context.Context, id int, version int, name string) (_ int, err error) {
+	defer db.observe(ctx, "UpdateActivity", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	if err := checkVersion(ctx, tx, "activities", id, version); err != nil {
+		return -1, err
+	}
+	row := tx.QueryRowContext(ctx, "UPDATE activities SET name = $1 WHERE id = $2 RETURNING version", name, id)
+	var newVersion int
+	if err := row.Scan(&newVersion); err != nil {
+		return -1, err
+	}
+	return newVersion, tx.Commit()
+}
+
+// MergeActivities moves all blocks of the source activity to the target
+// activity and deletes the source afterwards. Since that removes the source,
+// the user has to be allowed to delete it, see checkActivityAdmin.
+func (db *Database) MergeActivities(ctx context.Context, userId int, sourceId int, targetId int) (err error) {
+	defer db.observe(ctx, "MergeActivities", time.Now(), &err)
+	if sourceId == targetId {
+		return ErrMergeIntoSelf
+	}
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkSameOwner(ctx, tx, sourceId, targetId); err != nil {
+		return err
+	}
+	if err := checkActivityAdmin(ctx, tx, userId, sourceId); err != nil {
+		return err
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.activity_id = $1", sourceId); err != nil {
+		return err
+	}
+	blockIds, err := blocksOf(ctx, tx, sourceId)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, blockId := range blockIds {
+		if err := saveBaseRevision(ctx, tx, blockId, now); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE blocks SET activity_id = $1 WHERE activity_id = $2", targetId, sourceId); err != nil {
+		return err
+	}
+	for _, blockId := range blockIds {
+		if _, err := saveBlockRevision(ctx, tx, blockId, now); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM activities WHERE id = $1", sourceId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *Database) GetBlocks(ctx context.Context, activityId int) (_ []schemas.Block, err error) {
+	defer db.observe(ctx, "GetBlocks", time.Now(), &err)
+	return db.queryBlocks(ctx, "activity_id = $1 AND end_time IS NOT NULL", activityId)
+}
+
+// queryBlocks returns the blocks matching the condition along with their
+// pauses and tags.
+func (db *Database) queryBlocks(ctx context.Context, condition string, args ...any) ([]schemas.Block, error) {
+	var blocks []schemas.Block
+	rows, err := db.db.QueryContext(ctx, "SELECT "+blockColumns+" FROM blocks WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		block, err := db.scanBlock(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (db *Database) GetBlock(ctx context.Context, blockId int) (_ schemas.Block, err error) {
+	defer db.observe(ctx, "GetBlock", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx, "SELECT "+blockColumns+" FROM blocks WHERE id = $1", blockId)
+	return db.scanBlock(ctx, row)
+}
+
+func (db *Database) GetCurrentBlock(ctx context.Context) (_ schemas.Block, err error) {
+	defer db.observe(ctx, "GetCurrentBlock", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx, "SELECT "+blockColumns+" FROM blocks WHERE end_time IS NULL")
+	block, err := db.scanBlock(ctx, row)
+	if err == sql.ErrNoRows {
+		return schemas.Block{}, nil
+	}
+	return block, err
+}
+
+// CountRunningBlocks returns the number of blocks without an end time across
+// all users.
+func (db *Database) CountRunningBlocks(ctx context.Context) (_ int, err error) {
+	defer db.observe(ctx, "CountRunningBlocks", time.Now(), &err)
+	var count int
+	err = db.db.QueryRowContext(ctx, "SELECT count(*) FROM blocks WHERE end_time IS NULL").Scan(&count)
+	if err != nil {
+		return -1, err
+	}
+	return count, nil
+}
+
+// AddBlock adds a block of the user to the activity. Without a user the block
+// belongs to the owner of the activity, otherwise the activity has to be one
+// the user may log blocks against. Without a UUID one is generated.
+func (db *Database) AddBlock(ctx context.Context, userId int, startTime string, endTime string, activityId int, uuid string) (_ int, err error) {
+	defer db.observe(ctx, "AddBlock", time.Now(), &err)
+	publicId, err := newUuid(uuid)
+	if err != nil {
+		return -1, err
+	}
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertBlock(ctx, tx, userId, startTime, endTime, activityId, publicId)
+	if err != nil {
+		return -1, err
+	}
+	if _, err := saveBlockRevision(ctx, tx, id, time.Now()); err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// CreateBlock adds the block like AddBlock, along with its note, tags and
+// pauses, in one transaction, so that the block starts out with a single
+// revision.
+func (db *Database) CreateBlock(ctx context.Context, block schemas.BlockCreate) (_ int, err error) {
+	defer db.observe(ctx, "CreateBlock", time.Now(), &err)
+	publicId, err := newUuid(block.Uuid)
+	if err != nil {
+		return -1, err
+	}
+	pauseIds := make([]sql.NullString, len(block.Pauses))
+	for i, pause := range block.Pauses {
+		if pauseIds[i], err = newUuid(pause.Uuid); err != nil {
+			return -1, err
+		}
+	}
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertBlock(ctx, tx, block.UserId, block.StartTime, block.EndTime, block.ActivityId, publicId)
+	if err != nil {
+		return -1, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE blocks SET note = $1 WHERE id = $2", newNullString(block.Note), id); err != nil {
+		return -1, err
+	}
+	for _, tag := range block.Tags {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tags (name, block_id) VALUES ($1, $2)", tag, id); err != nil {
+			return -1, err
+		}
+	}
+	for i, pause := range block.Pauses {
+		if _, err := insertPause(ctx, tx, pause.StartTime, pause.EndTime, id, pauseIds[i]); err != nil {
+			return -1, err
+		}
+	}
+	if _, err := saveBlockRevision(ctx, tx, id, time.Now()); err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// insertBlock adds a block of the user to the activity, see AddBlock.
+func insertBlock(ctx context.Context, tx *sql.Tx, userId int, startTime string, endTime string, activityId int, uuid sql.NullString) (int, error) {
+	if userId == 0 {
+		row := tx.QueryRowContext(ctx, "SELECT user_id FROM activities WHERE id = $1", activityId)
+		if err := row.Scan(&userId); err != nil {
+			return -1, err
+		}
+	} else if err := checkActivityAccess(ctx, tx, userId, activityId); err != nil {
+		return -1, err
+	}
+	if err := checkUnlocked(ctx, tx, userId, activityId, startTime); err != nil {
+		return -1, err
+	}
+	row := tx.QueryRowContext(ctx,
+		"INSERT INTO blocks (start_time, end_time, activity_id, user_id, uuid) VALUES ($1, $2, $3, $4, coalesce($5::uuid, gen_random_uuid())) RETURNING id",
+		startTime,
+		newNullString(endTime),
+		activityId,
+		userId,
+		uuid)
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return -1, uuidTaken(err)
+	}
+	return id, nil
+}
+
+// UpdateBlock changes the times of the block. Neither the block nor its new
+// start may lie in an approved timesheet week or before a lock date.
+func (db *Database) UpdateBlock(ctx context.Context, id int, startTime string, endTime string) (err error) {
+	defer db.observe(ctx, "UpdateBlock", time.Now(), &err)
+	return db.changeBlock(ctx, id, func(tx *sql.Tx) error {
+		if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", id); err != nil {
+			return err
+		}
+		row := tx.QueryRowContext(ctx, "SELECT coalesce(user_id, 0), activity_id FROM blocks WHERE id = $1", id)
+		var userId, activityId int
+		if err := row.Scan(&userId, &activityId); err != nil {
+			return err
+		}
+		if err := checkUnlocked(ctx, tx, userId, activityId, startTime); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx,
+			"UPDATE blocks SET start_time = $1, end_time = $2, auto_stopped = false WHERE id = $3",
+			startTime,
+			newNullString(endTime),
+			id)
+		return err
+	})
+}
+
+// MoveBlocks reassigns blocks of the user to the given activity. The user and
+// the users of all blocks have to be allowed to log blocks against the target
+// activity.
+func (db *Database) MoveBlocks(ctx context.Context, userId int, blockIds []int, activityId int) (err error) {
+	defer db.observe(ctx, "MoveBlocks", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx,
+		"SELECT count(*) FROM blocks WHERE id = ANY($1) AND user_id IS DISTINCT FROM $2",
+		pq.Array(blockIds),
+		userId)
+	var others int
+	if err := row.Scan(&others); err != nil {
+		return err
+	}
+	if others > 0 {
+		return ErrForeignEntity
+	}
+	if err := checkActivityAccess(ctx, tx, userId, activityId); err != nil {
+		return err
+	}
+	row = tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM blocks b
+		WHERE b.id = ANY($1) AND $2 NOT IN (`+accessibleActivities("b.user_id")+`)`,
+		pq.Array(blockIds),
+		activityId)
+	var foreign int
+	if err := row.Scan(&foreign); err != nil {
+		return err
+	}
+	if foreign > 0 {
+		return ErrForeignActivity
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = ANY($1)", pq.Array(blockIds)); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, blockId := range blockIds {
+		if err := saveBaseRevision(ctx, tx, blockId, now); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE blocks SET activity_id = $1 WHERE id = ANY($2)", activityId, pq.Array(blockIds))
+	if err != nil {
+		return err
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = ANY($1)", pq.Array(blockIds)); err != nil {
+		return err
+	}
+	for _, blockId := range blockIds {
+		if _, err := saveBlockRevision(ctx, tx, blockId, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SplitBlock ends the block at the given time and continues it in a new block
+// of the given activity, which defaults to the activity of the original block.
+// Pauses after the split point are moved to the new block, a pause spanning
+// the split point is divided between both blocks.
+func (db *Database) SplitBlock(ctx context.Context, id int, at string, newActivityId int) (_ int, err error) {
+	defer db.observe(ctx, "SplitBlock", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx,
+		"SELECT start_time, end_time, activity_id, user_id FROM blocks WHERE id = $1 FOR UPDATE",
+		id)
+	var startTime string
+	var endTime sql.NullString
+	var activityId int
+	var userId int
+	if err := row.Scan(&startTime, &endTime, &activityId, &userId); err != nil {
+		return -1, err
+	}
+
+	splitTime, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return -1, ErrInvalidSplitTime
+	}
+	start, err := time.Parse(time.RFC3339Nano, startTime)
+	if err != nil {
+		return -1, err
+	}
+	if !splitTime.After(start) {
+		return -1, ErrInvalidSplitTime
+	}
+	if endTime.Valid {
+		end, err := time.Parse(time.RFC3339Nano, endTime.String)
+		if err != nil {
+			return -1, err
+		}
+		if !splitTime.Before(end) {
+			return -1, ErrInvalidSplitTime
+		}
+	}
+
+	if newActivityId == 0 {
+		newActivityId = activityId
+	} else if err := checkActivityAccess(ctx, tx, userId, newActivityId); err != nil {
+		return -1, err
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", id); err != nil {
+		return -1, err
+	}
+	if err := checkUnlocked(ctx, tx, userId, newActivityId, at); err != nil {
+		return -1, err
+	}
+	now := time.Now()
+	if err := saveBaseRevision(ctx, tx, id, now); err != nil {
+		return -1, err
+	}
+
+	row = tx.QueryRowContext(ctx,
+		"INSERT INTO blocks (start_time, end_time, activity_id, user_id) VALUES ($1, $2, $3, $4) RETURNING id",
+		at,
+		endTime,
+		newActivityId,
+		userId)
+	var newId int
+	if err := row.Scan(&newId); err != nil {
+		return -1, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE blocks SET end_time = $1 WHERE id = $2", at, id); err != nil {
+		return -1, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE pauses SET block_id = $1 WHERE block_id = $2 AND start_time >= $3::timestamp",
+		newId,
+		id,
+		at)
+	if err != nil {
+		return -1, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO pauses (start_time, end_time, block_id) SELECT $1::timestamp, end_time, $2 FROM pauses WHERE block_id = $3 AND start_time < $1::timestamp AND (end_time IS NULL OR end_time > $1::timestamp)",
+		at,
+		newId,
+		id)
+	if err != nil {
+		return -1, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE pauses SET end_time = $1::timestamp WHERE block_id = $2 AND start_time < $1::timestamp AND (end_time IS NULL OR end_time > $1::timestamp)",
+		at,
+		id)
+	if err != nil {
+		return -1, err
+	}
+	for _, blockId := range []int{id, newId} {
+		if _, err := saveBlockRevision(ctx, tx, blockId, now); err != nil {
+			return -1, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return -1, err
+	}
+	return newId, nil
+}
+
+// MergeBlocks combines adjacent blocks of the same activity into the earliest
+// of them. The gaps between the blocks become pauses, the pauses and tags of
+// the other blocks are moved over and their notes are joined.
+func (db *Database) MergeBlocks(ctx context.Context, ids []int) (_ int, err error) {
+	defer db.observe(ctx, "MergeBlocks", time.Now(), &err)
+	if len(ids) < 2 {
+		return -1, ErrBlocksNotMergeable
+	}
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id, start_time, end_time, activity_id, user_id FROM blocks WHERE id = ANY($1) ORDER BY start_time FOR UPDATE",
+		pq.Array(ids))
+	if err != nil {
+		return -1, err
+	}
+	type mergeBlock struct {
+		id         int
+		startTime  string
+		endTime    sql.NullString
+		activityId int
+		userId     int
+	}
+	var blocks []mergeBlock
+	for rows.Next() {
+		var block mergeBlock
+		if err := rows.Scan(&block.id, &block.startTime, &block.endTime, &block.activityId, &block.userId); err != nil {
+			rows.Close()
+			return -1, err
+		}
+		blocks = append(blocks, block)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return -1, err
+	}
+	if len(blocks) != len(ids) {
+		return -1, ErrBlocksNotMergeable
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = ANY($1)", pq.Array(ids)); err != nil {
+		return -1, err
+	}
+
+	first := blocks[0]
+	last := blocks[len(blocks)-1]
+	for i := 1; i < len(blocks); i++ {
+		previous := blocks[i-1]
+		if blocks[i].activityId != first.activityId || blocks[i].userId != first.userId || !previous.endTime.Valid {
+			return -1, ErrBlocksNotMergeable
+		}
+		end, err := time.Parse(time.RFC3339Nano, previous.endTime.String)
+		if err != nil {
+			return -1, err
+		}
+		start, err := time.Parse(time.RFC3339Nano, blocks[i].startTime)
+		if err != nil {
+			return -1, err
+		}
+		if start.Before(end) {
+			return -1, ErrBlocksNotMergeable
+		}
+	}
+
+	row := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM blocks b
+		WHERE b.user_id = $1
+			AND b.id <> ALL($2)
+			AND ($4::timestamp IS NULL OR b.start_time < $4::timestamp)
+			AND (b.end_time IS NULL OR b.end_time > $3::timestamp)`,
+		first.userId,
+		pq.Array(ids),
+		first.startTime,
+		last.endTime)
+	var overlapping int
+	if err := row.Scan(&overlapping); err != nil {
+		return -1, err
+	}
+	if overlapping > 0 {
+		return -1, ErrBlocksNotMergeable
+	}
+	now := time.Now()
+	if err := saveBaseRevision(ctx, tx, first.id, now); err != nil {
+		return -1, err
+	}
+
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i-1].endTime.String == blocks[i].startTime {
+			continue
+		}
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO pauses (start_time, end_time, block_id) VALUES ($1, $2, $3)",
+			blocks[i-1].endTime.String,
+			blocks[i].startTime,
+			first.id)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE blocks SET end_time = $1, note = (SELECT string_agg(note, E'\\n' ORDER BY start_time) FROM blocks WHERE id = ANY($2) AND note <> '') WHERE id = $3",
+		last.endTime,
+		pq.Array(ids),
+		first.id)
+	if err != nil {
+		return -1, err
+	}
+	for _, table := range []string{"pauses", "tags"} {
+		_, err := tx.ExecContext(ctx,
+			fmt.Sprintf("UPDATE %s SET block_id = $1 WHERE block_id = ANY($2)", table),
+			first.id,
+			pq.Array(ids))
+		if err != nil {
+			return -1, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM blocks WHERE id = ANY($1) AND id <> $2", pq.Array(ids), first.id)
+	if err != nil {
+		return -1, err
+	}
+	if _, err := saveBlockRevision(ctx, tx, first.id, now); err != nil {
+		return -1, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return -1, err
+	}
+	return first.id, nil
 }
 
-func (db *Database) GetActivities(userId int) ([]schemas.Activity, error) {
-	var activities []schemas.Activity
-
-	rows, err := db.db.Query("SELECT * FROM activities WHERE user_id = $1", userId)
+// StopIdleBlocks closes running blocks that exceed the maximum duration or
+// the end of day configured in the settings of their user, in the timezone
+// of the user. The blocks are flagged as auto stopped until the user updates
+// them.
+func (db *Database) StopIdleBlocks(ctx context.Context, now time.Time) (_ []schemas.Block, err error) {
+	defer db.observe(ctx, "StopIdleBlocks", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT b.id, b.start_time, coalesce(s.max_block_minutes, 0), coalesce(to_char(s.end_of_day, 'HH24:MI'), ''),
+			coalesce(s.timezone, '')
+		FROM blocks b
+		JOIN settings s ON s.user_id = b.user_id
+		WHERE b.end_time IS NULL AND (s.max_block_minutes IS NOT NULL OR s.end_of_day IS NOT NULL)`)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer rows.Close()
-
+	stopTimes := make(map[int]time.Time)
 	for rows.Next() {
 		var (
-			id     int
-			name   string
-			userId int
+			id              int
+			startTime       string
+			maxBlockMinutes int
+			endOfDay        string
+			timezone        string
 		)
-		if err := rows.Scan(&id, &name, &userId); err != nil {
+		if err := rows.Scan(&id, &startTime, &maxBlockMinutes, &endOfDay, &timezone); err != nil {
+			rows.Close()
 			return nil, err
 		}
-		blocks, err := db.GetBlocks(id)
+		start, err := time.Parse(time.RFC3339Nano, startTime)
 		if err != nil {
+			rows.Close()
 			return nil, err
 		}
-		activities = append(activities, schemas.Activity{
-			Id:     id,
-			Name:   name,
-			UserId: userId,
-			Blocks: blocks})
+		location, err := loadTimezone(timezone)
+		if err != nil {
+			location = time.UTC
+		}
+		stopTime, ok := idleStopTime(start.In(location), maxBlockMinutes, endOfDay)
+		if ok && !now.Before(stopTime) {
+			stopTimes[id] = stopTime
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	return activities, nil
-}
 
-func (db *Database) GetActivity(activityId int) (schemas.Activity, error) {
-	var activity schemas.Activity
-	row := db.db.QueryRow("SELECT * FROM activities WHERE id = $1", activityId)
-	var id int
-	var name string
-	var userId int
-	if err := row.Scan(&id, &name, &userId); err != nil {
-		return activity, err
+	var blocks []schemas.Block
+	for id, stopTime := range stopTimes {
+		stopped, err := db.stopBlock(ctx, id, stopTime)
+		if isLocked(err) {
+			slog.WarnContext(ctx, "could not stop locked block", "block_id", id, "err", err)
+			continue
+		}
+		if err != nil {
+			return blocks, err
+		}
+		if !stopped {
+			continue
+		}
+		block, err := db.GetBlock(ctx, id)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
 	}
-	blocks, err := db.GetBlocks(activityId)
+	return blocks, nil
+}
+
+func (db *Database) stopBlock(ctx context.Context, id int, stopTime time.Time) (bool, error) {
+	tx, err := db.begin(ctx)
 	if err != nil {
-		return activity, err
+		return false, err
 	}
-	activity.Id = id
-	activity.Name = name
-	activity.UserId = userId
-	activity.Blocks = blocks
-	return activity, nil
-}
+	defer tx.Rollback()
 
-func (db *Database) AddActivity(name string, user_id int) (int, error) {
-	row := db.db.QueryRow(
-		"INSERT INTO activities (name, user_id) VALUES ($1, $2) RETURNING id",
-		name,
-		user_id)
-	var id int
-	if err := row.Scan(&id); err != nil {
-		return -1, err
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", id); err != nil {
+		return false, err
 	}
-	return id, nil
+	now := time.Now()
+	if err := saveBaseRevision(ctx, tx, id, now); err != nil {
+		return false, err
+	}
+	result, err := tx.ExecContext(ctx,
+		"UPDATE blocks SET end_time = $1, auto_stopped = true WHERE id = $2 AND end_time IS NULL",
+		stopTime.UTC(),
+		id)
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM pauses WHERE block_id = $1 AND start_time >= $2", id, stopTime.UTC()); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE pauses SET end_time = $1 WHERE block_id = $2 AND (end_time IS NULL OR end_time > $1)", stopTime.UTC(), id); err != nil {
+		return false, err
+	}
+	if _, err := saveBlockRevision(ctx, tx, id, now); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
 
-func (db *Database) UpdateActivity(id int, name string) error {
-	_, err := db.db.Exec("UPDATE activities SET name = $1 WHERE id = $2", name, id)
-	if err != nil {
-		return err
+// idleStopTime returns the earliest point at which a block started at start
+// has to be stopped, either after maxBlockMinutes or at the next endOfDay
+// (formatted as HH:MM) in the location of start. Zero values disable the
+// respective limit.
+func idleStopTime(start time.Time, maxBlockMinutes int, endOfDay string) (time.Time, bool) {
+	var stopTime time.Time
+	found := false
+	if maxBlockMinutes > 0 {
+		stopTime = start.Add(time.Duration(maxBlockMinutes) * time.Minute)
+		found = true
 	}
-	return nil
+	if endOfDay != "" {
+		clock, err := time.Parse("15:04", endOfDay)
+		if err == nil {
+			year, month, day := start.Date()
+			end := time.Date(year, month, day, clock.Hour(), clock.Minute(), 0, 0, start.Location())
+			if !end.After(start) {
+				end = end.AddDate(0, 0, 1)
+			}
+			if !found || end.Before(stopTime) {
+				stopTime = end
+				found = true
+			}
+		}
+	}
+	return stopTime, found
 }
 
-func (db *Database) GetBlocks(activityId int) ([]schemas.Block, error) {
+func (db *Database) GetAutoStoppedBlocks(ctx context.Context, userId int) (_ []schemas.Block, err error) {
+	defer db.observe(ctx, "GetAutoStoppedBlocks", time.Now(), &err)
 	var blocks []schemas.Block
-	rows, err := db.db.Query("SELECT * FROM blocks WHERE activity_id = $1 AND end_time IS NOT NULL", activityId)
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+blockColumns+" FROM blocks WHERE auto_stopped AND user_id = $1 ORDER BY start_time",
+		userId)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var (
-			id         int
-			startTime  string
-			endTime    string
-			activityId int
-		)
-		if err := rows.Scan(&id, &startTime, &endTime, &activityId); err != nil {
-			return nil, err
-		}
-		pauses, err := db.GetPauses(id)
+		block, err := db.scanBlock(ctx, rows)
 		if err != nil {
 			return nil, err
 		}
-		blocks = append(blocks, schemas.Block{
-			Id:         id,
-			StartTime:  startTime,
-			EndTime:    endTime,
-			ActivityId: activityId,
-			Pauses:     pauses})
+		blocks = append(blocks, block)
 	}
-	return blocks, nil
+	return blocks, rows.Err()
 }
 
-func (db *Database) GetBlock(blockId int) (schemas.Block, error) {
-	var block schemas.Block
-	row := db.db.QueryRow("SELECT * FROM blocks WHERE id = $1", blockId)
-	var id int
-	var startTime string
-	var endTime string
-	var activityId int
-	if err := row.Scan(&id, &startTime, &endTime, &activityId); err != nil {
-		return block, err
-	}
-	pauses, err := db.GetPauses(blockId)
-	if err != nil {
-		return block, err
-	}
-
-	block.Id = id
-	block.StartTime = startTime
-	block.EndTime = endTime
-	block.ActivityId = activityId
-	block.Pauses = pauses
-	return block, nil
+func (db *Database) UpdateBlockNote(ctx context.Context, id int, note string) (err error) {
+	defer db.observe(ctx, "UpdateBlockNote", time.Now(), &err)
+	return db.changeBlock(ctx, id, func(tx *sql.Tx) error {
+		if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE blocks SET note = $1 WHERE id = $2", newNullString(note), id)
+		return err
+	})
 }
 
-func (db *Database) GetCurrentBlock() (schemas.Block, error) {
-	var block schemas.Block
-	row := db.db.QueryRow("SELECT * FROM blocks WHERE end_time IS NULL")
-	var id int
-	var startTime string
-	var endTime sql.NullString
-	var activityId int
-	err := row.Scan(&id, &startTime, &endTime, &activityId)
-	if err == sql.ErrNoRows {
-		return block, nil
-	}
-	if err != nil {
-		return block, err
-	}
-	pauses, err := db.GetPauses(id)
+func (db *Database) GetTags(ctx context.Context, blockId int) (_ []string, err error) {
+	defer db.observe(ctx, "GetTags", time.Now(), &err)
+	var tags []string
+
+	rows, err := db.db.QueryContext(ctx, "SELECT name FROM tags WHERE block_id = $1 ORDER BY id", blockId)
 	if err != nil {
-		return block, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	block.Id = id
-	block.StartTime = startTime
-	block.EndTime = endTime.String
-	block.ActivityId = activityId
-	block.Pauses = pauses
-	return block, nil
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tags = append(tags, name)
+	}
+	return tags, nil
 }
 
-func (db *Database) AddBlock(startTime string, endTime string, activityId int) (int, error) {
-	row := db.db.QueryRow(
-		"INSERT INTO blocks (start_time, end_time, activity_id) VALUES ($1, $2, $3) RETURNING id",
-		startTime,
-		newNullString(endTime),
-		activityId)
+func (db *Database) AddTag(ctx context.Context, name string, blockId int) (_ int, err error) {
+	defer db.observe(ctx, "AddTag", time.Now(), &err)
 	var id int
-	if err := row.Scan(&id); err != nil {
+	err = db.changeBlock(ctx, blockId, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx,
+			"INSERT INTO tags (name, block_id) VALUES ($1, $2) RETURNING id",
+			name,
+			blockId)
+		return row.Scan(&id)
+	})
+	if err != nil {
 		return -1, err
 	}
 	return id, nil
 }
 
-func (db *Database) UpdateBlock(id int, startTime string, endTime string) error {
-	_, err := db.db.Exec("UPDATE blocks SET start_time = $1, end_time = $2 WHERE id = $3", startTime, endTime, id)
-	if err != nil {
+func (db *Database) DeleteTags(ctx context.Context, blockId int) (err error) {
+	defer db.observe(ctx, "DeleteTags", time.Now(), &err)
+	return db.changeBlock(ctx, blockId, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE block_id = $1", blockId)
 		return err
+	})
+}
+
+// Search matches the query against the activity names, block notes and tags
+// of a user. Results are ranked by relevance, the optional from and to
+// timestamps restrict the matches to blocks started within that range.
+func (db *Database) Search(ctx context.Context, userId int, query string, from string, to string) (_ []schemas.SearchResult, err error) {
+	defer db.observe(ctx, "Search", time.Now(), &err)
+	var results []schemas.SearchResult
+
+	rows, err := db.db.QueryContext(ctx, searchQuery, userId, query, newNullString(from), newNullString(to))
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			kind       string
+			activityId int
+			blockId    sql.NullInt64
+			startTime  sql.NullString
+			snippet    string
+			rank       float64
+		)
+		if err := rows.Scan(&kind, &activityId, &blockId, &startTime, &snippet, &rank); err != nil {
+			return nil, err
+		}
+		results = append(results, schemas.SearchResult{
+			Kind:       kind,
+			ActivityId: activityId,
+			BlockId:    int(blockId.Int64),
+			StartTime:  startTime.String,
+			Snippet:    snippet,
+			Rank:       rank})
+	}
+	return results, rows.Err()
 }
 
-func (db *Database) GetPauses(blockId int) ([]schemas.Pause, error) {
+func (db *Database) GetPauses(ctx context.Context, blockId int) (_ []schemas.Pause, err error) {
+	defer db.observe(ctx, "GetPauses", time.Now(), &err)
 	var pauses []schemas.Pause
 
-	rows, err := db.db.Query("SELECT * FROM pauses WHERE block_id = $1", blockId)
+	rows, err := db.db.QueryContext(ctx, "SELECT "+pauseColumns+" FROM pauses WHERE block_id = $1", blockId)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var (
 			id        int
+			uuid      string
 			startTime string
-			endTime   string
+			endTime   sql.NullString
 			blockId   int
+			version   int
 		)
-		if err := rows.Scan(&id, &startTime, &endTime, &blockId); err != nil {
+		if err := rows.Scan(&id, &uuid, &startTime, &endTime, &blockId, &version); err != nil {
 			return nil, err
 		}
 		pauses = append(pauses, schemas.Pause{
 			Id:        id,
+			Uuid:      uuid,
 			StartTime: startTime,
-			EndTime:   endTime,
-			BlockId:   blockId})
+			EndTime:   endTime.String,
+			BlockId:   blockId,
+			Version:   version})
 	}
 	return pauses, nil
 }
 
-func (db *Database) GetPause(pauseId int) (schemas.Pause, error) {
+func (db *Database) GetPause(ctx context.Context, pauseId int) (_ schemas.Pause, err error) {
+	defer db.observe(ctx, "GetPause", time.Now(), &err)
 	var pause schemas.Pause
-	row := db.db.QueryRow("SELECT * FROM pauses WHERE id = $1", pauseId)
+	row := db.db.QueryRowContext(ctx, "SELECT "+pauseColumns+" FROM pauses WHERE id = $1", pauseId)
 	var id int
+	var uuid string
 	var startTime string
-	var endTime string
+	var endTime sql.NullString
 	var blockId int
-	if err := row.Scan(&id, &startTime, &endTime, &blockId); err != nil {
+	var version int
+	if err := row.Scan(&id, &uuid, &startTime, &endTime, &blockId, &version); err != nil {
 		return pause, err
 	}
 
 	pause.Id = id
+	pause.Uuid = uuid
 	pause.StartTime = startTime
-	pause.EndTime = endTime
+	pause.EndTime = endTime.String
 	pause.BlockId = blockId
+	pause.Version = version
 	return pause, nil
 }
 
-func (db *Database) AddPause(startTime string, endTime string, blockId int) (int, error) {
-	row := db.db.QueryRow(
-		"INSERT INTO pauses (start_time, end_time, block_id) VALUES ($1, $2, $3) RETURNING id",
+// AddPause adds a pause to the block. Without a UUID one is generated.
+func (db *Database) AddPause(ctx context.Context, startTime string, endTime string, blockId int, uuid string) (_ int, err error) {
+	defer db.observe(ctx, "AddPause", time.Now(), &err)
+	publicId, err := newUuid(uuid)
+	if err != nil {
+		return -1, err
+	}
+	var id int
+	err = db.changeBlock(ctx, blockId, func(tx *sql.Tx) error {
+		if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", blockId); err != nil {
+			return err
+		}
+		id, err = insertPause(ctx, tx, startTime, endTime, blockId, publicId)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+func insertPause(ctx context.Context, tx *sql.Tx, startTime string, endTime string, blockId int, uuid sql.NullString) (int, error) {
+	row := tx.QueryRowContext(ctx,
+		"INSERT INTO pauses (start_time, end_time, block_id, uuid) VALUES ($1, $2, $3, coalesce($4::uuid, gen_random_uuid())) RETURNING id",
 		startTime,
-		endTime,
-		blockId)
+		newNullString(endTime),
+		blockId,
+		uuid)
 	var id int
 	if err := row.Scan(&id); err != nil {
-		return -1, err
+		return -1, uuidTaken(err)
 	}
 	return id, nil
 }
 
-func (db *Database) UpdatePause(id int, startTime string, endTime string) error {
-	_, err := db.db.Exec("UPDATE pauses SET start_time = $1, end_time = $2 WHERE id = $3", startTime, endTime, id)
+// UpdatePause changes the times of the pause and returns its new version. The
+// pause has to have the given version, unless it is 0.
+func (db *Database) UpdatePause(ctx context.Context, id int, version int, startTime string, endTime string) (_ int, err error) {
+	defer db.observe(ctx, "UpdatePause", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	if err := checkVersion(ctx, tx, "pauses", id, version); err != nil {
+		return -1, err
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = (SELECT block_id FROM pauses WHERE id = $1)", id); err != nil {
+		return -1, err
+	}
+	blockId, err := pauseBlockId(ctx, tx, id)
+	if err != nil {
+		return -1, err
+	}
+	now := time.Now()
+	if err := saveBaseRevision(ctx, tx, blockId, now); err != nil {
+		return -1, err
+	}
+	row := tx.QueryRowContext(ctx,
+		"UPDATE pauses SET start_time = $1, end_time = $2 WHERE id = $3 RETURNING version",
+		startTime,
+		endTime,
+		id)
+	var newVersion int
+	if err := row.Scan(&newVersion); err != nil {
+		return -1, err
+	}
+	if _, err := saveBlockRevision(ctx, tx, blockId, now); err != nil {
+		return -1, err
+	}
+	return newVersion, tx.Commit()
+}
+
+func (db *Database) DeletePauses(ctx context.Context, blockId int) (err error) {
+	defer db.observe(ctx, "DeletePauses", time.Now(), &err)
+	return db.changeBlock(ctx, blockId, func(tx *sql.Tx) error {
+		if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", blockId); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM pauses WHERE block_id = $1", blockId)
+		return err
+	})
+}
+
+// lockedBlocks are the conditions selecting the blocks a delete from the
+// table affects, which must not lie in an approved timesheet week or before a
+// lock date.
+var lockedBlocks = map[string]string{
+	"activities": "b.activity_id = $1",
+	"blocks":     "b.id = $1",
+	"pauses":     "b.id = (SELECT block_id FROM pauses WHERE id = $1)",
+}
+
+func (db *Database) DeleteByTableAndId(ctx context.Context, table string, id int) (err error) {
+	defer db.observe(ctx, "DeleteByTableAndId", time.Now(), &err)
+	if table == "pauses" {
+		blockId, err := pauseBlockId(ctx, db.db, id)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return db.changeBlock(ctx, blockId, func(tx *sql.Tx) error {
+			if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", blockId); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "DELETE FROM pauses WHERE id = $1", id)
+			return err
+		})
+	}
+	// The check runs in the transaction of the delete, so that overrides of
+	// lock dates are only recorded along with the delete they allowed.
+	tx, err := db.begin(ctx)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+	if condition, ok := lockedBlocks[table]; ok {
+		if err := checkBlocksUnlocked(ctx, tx, condition, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = %d", table, id)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pauseBlockId returns the id of the block the pause belongs to.
+func pauseBlockId(ctx context.Context, q queryRower, pauseId int) (int, error) {
+	var blockId int
+	err := q.QueryRowContext(ctx, "SELECT block_id FROM pauses WHERE id = $1", pauseId).Scan(&blockId)
+	return blockId, err
 }
 
-func (db *Database) DeletePauses(blockId int) error {
-	_, err := db.db.Exec("DELETE FROM pauses WHERE block_id = $1", blockId)
+// blocksOf returns the ids of the blocks of the activity.
+func blocksOf(ctx context.Context, q querier, activityId int) ([]int, error) {
+	rows, err := q.QueryContext(ctx, "SELECT id FROM blocks WHERE activity_id = $1 ORDER BY id", activityId)
 	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// checkSameOwner returns ErrForeignActivity unless both activities are
+// personal activities of the same user or belong to the same workspace.
+func checkSameOwner(ctx context.Context, tx *sql.Tx, activityId int, otherActivityId int) error {
+	row := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM activities a JOIN activities b
+			ON (a.workspace_id IS NULL AND b.workspace_id IS NULL AND a.user_id = b.user_id) OR a.workspace_id = b.workspace_id
+		WHERE a.id = $1 AND b.id = $2`,
+		activityId,
+		otherActivityId)
+	var count int
+	if err := row.Scan(&count); err != nil {
 		return err
 	}
+	if count == 0 {
+		return ErrForeignActivity
+	}
 	return nil
 }
 
-func (db *Database) DeleteByTableAndId(table string, id int) error {
-	_, err := db.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = %d", table, id))
-	if err != nil {
+const blockColumns = "id, uuid, start_time, end_time, activity_id, coalesce(note, ''), auto_stopped, coalesce(user_id, 0), version"
+
+const activityColumns = "id, uuid, name, user_id, coalesce(workspace_id, 0), version"
+
+const pauseColumns = "id, uuid, start_time, end_time, block_id, version"
+
+// accessibleActivities returns a query selecting the ids of the activities
+// the user given by the expression may log blocks against: their own ones and
+// those of the workspaces they are a member of.
+func accessibleActivities(userId string) string {
+	return "SELECT id FROM activities WHERE user_id = " + userId +
+		" OR workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = " + userId + ")"
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	queryRower
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// checkActivityAccess returns ErrForeignActivity unless the user may log
+// blocks against the activity.
+func checkActivityAccess(ctx context.Context, q queryRower, userId int, activityId int) error {
+	row := q.QueryRowContext(ctx, `
+		SELECT user_id = $1 OR workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = $1)
+		FROM activities WHERE id = $2`,
+		userId,
+		activityId)
+	var allowed sql.NullBool
+	if err := row.Scan(&allowed); err != nil {
 		return err
 	}
+	if !allowed.Bool {
+		return ErrForeignActivity
+	}
 	return nil
 }
 
-func createTable(db *sql.DB, name string, columns string) error {
-	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", name, columns))
+// checkActivityAdmin returns ErrForeignActivity unless the user may rename or
+// delete the activity: its own activities, or those of a workspace the user
+// is an owner or admin of, as deleting them removes the blocks of all members.
+func checkActivityAdmin(ctx context.Context, q queryRower, userId int, activityId int) error {
+	row := q.QueryRowContext(ctx, "SELECT coalesce(user_id, 0), coalesce(workspace_id, 0) FROM activities WHERE id = $1", activityId)
+	var owner, workspaceId int
+	if err := row.Scan(&owner, &workspaceId); err != nil {
+		return err
+	}
+	if workspaceId == 0 {
+		if owner != userId {
+			return ErrForeignActivity
+		}
+		return nil
+	}
+	_, err := requireRole(ctx, q, workspaceId, userId, RoleOwner, RoleAdmin)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanBlock reads a row selected with blockColumns and loads the pauses and
+// tags of the block.
+func (db *Database) scanBlock(ctx context.Context, row rowScanner) (schemas.Block, error) {
+	var block schemas.Block
+	var endTime sql.NullString
+	err := row.Scan(
+		&block.Id,
+		&block.Uuid,
+		&block.StartTime,
+		&endTime,
+		&block.ActivityId,
+		&block.Note,
+		&block.AutoStopped,
+		&block.UserId,
+		&block.Version)
+	if err != nil {
+		return block, err
+	}
+	block.EndTime = endTime.String
+
+	pauses, err := db.GetPauses(ctx, block.Id)
+	if err != nil {
+		return block, err
+	}
+	tags, err := db.GetTags(ctx, block.Id)
+	if err != nil {
+		return block, err
+	}
+	block.Pauses = pauses
+	block.Tags = tags
+	return block, nil
+}
+
+// scanActivity reads a row selected with activityColumns and loads the
+// finished blocks of the activity. Of workspace activities, members only get
+// to see their own blocks, owners and admins those of everyone; a userId of
+// 0 loads all blocks.
+func (db *Database) scanActivity(ctx context.Context, row rowScanner, userId int) (schemas.Activity, error) {
+	var activity schemas.Activity
+	if err := row.Scan(&activity.Id, &activity.Uuid, &activity.Name, &activity.UserId, &activity.WorkspaceId, &activity.Version); err != nil {
+		return activity, err
+	}
+	allBlocks := userId == 0 || activity.WorkspaceId == 0
+	if !allBlocks {
+		_, err := requireRole(ctx, db.db, activity.WorkspaceId, userId, RoleOwner, RoleAdmin)
+		if err != nil && !errors.Is(err, ErrRoleNotAllowed) && !errors.Is(err, ErrNotMember) {
+			return activity, err
+		}
+		allBlocks = err == nil
+	}
+	var blocks []schemas.Block
+	var err error
+	if allBlocks {
+		blocks, err = db.queryBlocks(ctx, "activity_id = $1 AND end_time IS NOT NULL", activity.Id)
+	} else {
+		blocks, err = db.queryBlocks(ctx, "activity_id = $1 AND end_time IS NOT NULL AND user_id = $2", activity.Id, userId)
+	}
+	if err != nil {
+		return activity, err
+	}
+	activity.Blocks = blocks
+	return activity, nil
+}
+
+func (db *Database) scanActivities(ctx context.Context, rows *sql.Rows, userId int) ([]schemas.Activity, error) {
+	var activities []schemas.Activity
+	for rows.Next() {
+		activity, err := db.scanActivity(ctx, rows, userId)
+		if err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+	return activities, rows.Err()
+}
+
+func createTable(ctx context.Context, db *sql.DB, name string, columns string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", name, columns))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (db *Database) DeleteTable(name string) error {
-	_, err := db.db.Exec("DROP TABLE IF EXISTS ?", name)
+func (db *Database) DeleteTable(ctx context.Context, name string) error {
+	_, err := db.db.ExecContext(ctx, "DROP TABLE IF EXISTS ?", name)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// The to_tsvector expressions have to match the ones of the search indexes
+// declared in migrations, otherwise postgres falls back to table scans.
+const searchQuery = `
+WITH q AS (SELECT websearch_to_tsquery('simple', $2) AS query)
+SELECT kind, activity_id, block_id, start_time, snippet, rank FROM (
+	SELECT 'activity' AS kind, a.id AS activity_id, NULL::int AS block_id, NULL::timestamp AS start_time,
+		ts_headline('simple', a.name, q.query, 'StartSel=<mark>, StopSel=</mark>') AS snippet,
+		ts_rank(to_tsvector('simple', a.name), q.query) AS rank
+	FROM activities a, q
+	WHERE a.user_id = $1
+		AND to_tsvector('simple', a.name) @@ q.query
+		AND (($3::timestamp IS NULL AND $4::timestamp IS NULL) OR EXISTS (
+			SELECT 1 FROM blocks b
+			WHERE b.activity_id = a.id
+				AND ($3::timestamp IS NULL OR b.start_time >= $3::timestamp)
+				AND ($4::timestamp IS NULL OR b.start_time < $4::timestamp)))
+	UNION ALL
+	SELECT 'note', b.activity_id, b.id, b.start_time,
+		ts_headline('simple', b.note, q.query, 'StartSel=<mark>, StopSel=</mark>'),
+		ts_rank(to_tsvector('simple', coalesce(b.note, '')), q.query)
+	FROM blocks b, q
+	WHERE b.user_id = $1
+		AND to_tsvector('simple', coalesce(b.note, '')) @@ q.query
+		AND ($3::timestamp IS NULL OR b.start_time >= $3::timestamp)
+		AND ($4::timestamp IS NULL OR b.start_time < $4::timestamp)
+	UNION ALL
+	SELECT 'tag', b.activity_id, b.id, b.start_time,
+		ts_headline('simple', t.name, q.query, 'StartSel=<mark>, StopSel=</mark>'),
+		ts_rank(to_tsvector('simple', t.name), q.query)
+	FROM tags t JOIN blocks b ON b.id = t.block_id, q
+	WHERE b.user_id = $1
+		AND to_tsvector('simple', t.name) @@ q.query
+		AND ($3::timestamp IS NULL OR b.start_time >= $3::timestamp)
+		AND ($4::timestamp IS NULL OR b.start_time < $4::timestamp)
+) AS matches
+ORDER BY rank DESC, start_time DESC NULLS LAST
+LIMIT 100`
+
+func newNullInt(i int) sql.NullInt64 {
+	if i == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{
+		Int64: int64(i),
+		Valid: true,
+	}
+}
+
 func newNullString(s string) sql.NullString {
 	if len(s) == 0 {
 		return sql.NullString{}
@@ -394,10 +1719,30 @@ func newNullString(s string) sql.NullString {
 
 // func clearTable(db *sql.DB, name string) error {
 // 	query := fmt.Sprintf("DELETE FROM %s", name)
-// 	_, err := db.Exec(query)
+// 	_, err := db.ExecContext(ctx, query)
 // 	if err != nil {
 // 		return databaseError("Could not clear table", err)
 // 	}
 //
 // 	return nil
 // }
+
+// observe reports the duration of a call of the method and whether it failed,
+// and logs failures with the request id of the context. Missing rows and the
+// sentinel errors of this package are outcomes of the call rather than
+// failures of the database.
+func (db *Database) observe(ctx context.Context, method string, start time.Time, err *error) {
+	duration := time.Since(start)
+	failed := *err != nil && !errors.Is(*err, sql.ErrNoRows)
+	for _, sentinel := range sentinels {
+		if failed && errors.Is(*err, sentinel) {
+			failed = false
+		}
+	}
+	metrics.ObserveQuery(method, duration, failed)
+	if failed {
+		slog.ErrorContext(ctx, "database call failed", "method", method, "duration", duration, "err", *err)
+	} else {
+		slog.DebugContext(ctx, "database call", "method", method, "duration", duration)
+	}
+}
@@ -1,16 +1,24 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/kilianmandscharo/activities/schemas"
 	"github.com/stretchr/testify/assert"
 )
 
-var db *Database
+var (
+	db  *Database
+	ctx = context.Background()
+)
 
 const (
 	testUserId       = 1
@@ -36,6 +44,96 @@ const (
 
 	testStartTimeCurrentBlock = "2023-02-01T14:15:00Z"
 	testEndTimeCurrentBlock   = ""
+
+	testSplitTime        = "2023-04-05T16:17:00Z"
+	testEndTimeMergeable = "2023-02-01T14:45:00Z"
+
+	testOtherActivityName = "Cycling"
+	testOtherUserName     = "Artemis"
+	testOtherUserEmail    = "other@gmail.com"
+
+	testMaxBlockMinutes  = 60
+	testEndOfDay         = "18:00"
+	testTimezone         = "Europe/Berlin"
+	testIdleStartTime    = "2023-05-01T09:00:00Z"
+	testIdleStopTime     = "2023-05-01T10:00:00Z"
+	testIdlePauseStart   = "2023-05-01T09:50:00Z"
+	testIdlePauseEnd     = "2023-05-01T10:10:00Z"
+	testIdleLatePause    = "2023-05-01T10:20:00Z"
+	testIdleLatePauseEnd = "2023-05-01T10:30:00Z"
+
+	testPomodoroStartTime  = "2023-05-02T09:00:00Z"
+	testPomodoroPauseStart = "2023-05-02T09:25:00Z"
+	testPomodoroPauseEnd   = "2023-05-02T09:30:00Z"
+
+	testTimerStartTime  = "2023-05-03T09:00:00Z"
+	testTimerPauseTime  = "2023-05-03T09:10:00Z"
+	testTimerResumeTime = "2023-05-03T09:15:00Z"
+	testTimerStopTime   = "2023-05-03T09:30:00Z"
+
+	testBreakStartTime  = "2023-05-03T11:00:00Z"
+	testBreakPauseStart = "2023-05-03T11:25:00Z"
+	testBreakResumeTime = "2023-05-03T11:27:00Z"
+	testBreakPauseEnd   = "2023-05-03T11:30:00Z"
+	testBreakStopTime   = "2023-05-03T11:28:00Z"
+
+	testWebhookUrl     = "http://localhost:9000/hook"
+	testWebhookSecret  = "secret"
+	testWebhookEvent   = "block.started"
+	testWebhookPayload = `{"event": "block.started", "data": {"id": 1}}`
+
+	testBlockNote = "fixed the invoice bug"
+	testTag       = "billing"
+
+	testWorkspaceName      = "Team"
+	testWorkspaceActivity  = "Planning"
+	testMemberName         = "Hermes"
+	testMemberEmail        = "hermes@gmail.com"
+	testWorkspaceStartTime = "2023-05-05T09:00:00Z"
+	testWorkspaceEndTime   = "2023-05-05T09:30:00Z"
+
+	testTimesheetWeek      = "2023-05-10"
+	testTimesheetMonday    = "2023-05-08"
+	testTimesheetStartTime = "2023-05-09T09:00:00Z"
+	testTimesheetEndTime   = "2023-05-09T10:00:00Z"
+	testTimesheetComment   = "missing the afternoon"
+
+	testLockDate      = "2023-04-10"
+	testLockedTime    = "2023-04-03T09:00:00Z"
+	testLockedEndTime = "2023-04-03T10:00:00Z"
+
+	testAuditStartTime   = "2023-06-01T09:00:00Z"
+	testAuditEndTime     = "2023-06-01T10:00:00Z"
+	testAuditUpdatedTime = "2023-06-01T11:00:00Z"
+
+	testRevisionStartTime      = "2023-06-02T09:00:00Z"
+	testRevisionEndTime        = "2023-06-02T10:00:00Z"
+	testRevisionUpdatedEndTime = "2023-06-02T12:00:00Z"
+	testRevisionPauseStart     = "2023-06-02T09:15:00Z"
+	testRevisionPauseEnd       = "2023-06-02T09:30:00Z"
+
+	testVersionStartTime  = "2023-06-03T09:00:00Z"
+	testVersionEndTime    = "2023-06-03T10:00:00Z"
+	testVersionPauseStart = "2023-06-03T09:15:00Z"
+	testVersionPauseEnd   = "2023-06-03T09:30:00Z"
+
+	testSyncActivityId = "7f1c2a4e-5b7d-4c1e-9a3f-2d6b8e0c4a11"
+	testSyncBlockId    = "0b9e4d3c-2a1f-4e8d-b7c6-5a4f3e2d1c22"
+	testSyncPauseId    = "c3d2e1f0-9a8b-4c7d-8e6f-1a2b3c4d5e33"
+	testSyncStartTime  = "2023-06-05T09:00:00Z"
+	testSyncEndTime    = "2023-06-05T10:00:00Z"
+	testSyncPauseStart = "2023-06-05T09:15:00Z"
+	testSyncPauseEnd   = "2023-06-05T09:30:00Z"
+
+	testBatchStartTime  = "2023-06-06T09:00:00Z"
+	testBatchEndTime    = "2023-06-06T12:00:00Z"
+	testBatchPauseStart = "2023-06-06T10:00:00Z"
+	testBatchPauseEnd   = "2023-06-06T10:15:00Z"
+
+	testUuidActivity  = "5d2f8a1b-3c4e-4f6a-8b9c-0d1e2f3a4b55"
+	testUuidBlock     = "9a8b7c6d-5e4f-4a3b-9c2d-1e0f9a8b7c66"
+	testUuidStartTime = "2023-06-07T09:00:00Z"
+	testUuidEndTime   = "2023-06-07T10:00:00Z"
 )
 
 func init() {
@@ -57,46 +155,94 @@ func init() {
 		log.Fatal("could not open database:", err)
 	}
 	db = database
-	if err := db.Init(); err != nil {
+	if err := db.Init(ctx); err != nil {
 		log.Fatal("could not initialize database:", err)
 	}
-	if err := db.Clear(); err != nil {
+	if err := db.Clear(ctx); err != nil {
 		log.Fatal("could not clear database:", err)
 	}
 }
 
 func TestAddUser(t *testing.T) {
-	testId, err := db.AddUser(testUserName, testUserEmail, testUserPassword)
+	testId, err := db.AddUser(ctx, testUserName, testUserEmail, testUserPassword)
 	if err != nil {
 		t.Fatalf("could not add user, %v", err)
 	}
-	user, err := db.GetUser(testUserId)
+	user, err := db.GetUser(ctx, testUserId)
 	if err != nil {
 		t.Fatalf("could not retrieve user, %v", err)
 	}
 	assert.Equal(t, testId, user.Id)
 	assert.Equal(t, testUserName, user.Name)
 	assert.Equal(t, testUserEmail, user.Email)
-	assert.Equal(t, testUserPassword, user.Password)
+	assert.NotEqual(t, testUserPassword, user.Password)
+	ok, _ := checkPassword(user.Password, testUserPassword)
+	assert.True(t, ok)
 }
 
 func TestGetUser(t *testing.T) {
-	user, err := db.GetUser(testUserId)
+	user, err := db.GetUser(ctx, testUserId)
 	if err != nil {
 		t.Fatalf("could not retrieve user, %v", err)
 	}
 	assert.Equal(t, testUserId, user.Id)
 	assert.Equal(t, testUserName, user.Name)
 	assert.Equal(t, testUserEmail, user.Email)
-	assert.Equal(t, testUserPassword, user.Password)
+}
+
+func TestGetUserByLogin(t *testing.T) {
+	user, err := db.GetUserByLogin(ctx, testUserEmail, testUserPassword)
+	if err != nil {
+		t.Fatalf("could not log in, %v", err)
+	}
+	assert.Equal(t, testUserId, user.Id)
+	_, err = db.GetUserByLogin(ctx, testUserEmail, "wrong")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	if _, err := db.db.Exec("UPDATE users SET password = $1 WHERE id = $2", testUserPassword, testUserId); err != nil {
+		t.Fatalf("could not store plaintext password, %v", err)
+	}
+	if _, err := db.GetUserByLogin(ctx, testUserEmail, testUserPassword); err != nil {
+		t.Fatalf("could not log in, %v", err)
+	}
+	user, err = db.GetUser(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not retrieve user, %v", err)
+	}
+	ok, rehash := checkPassword(user.Password, testUserPassword)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+}
+
+func TestSessions(t *testing.T) {
+	now := time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC)
+	token, err := db.AddSession(ctx, testUserId, now, time.Hour)
+	if err != nil {
+		t.Fatalf("could not add session, %v", err)
+	}
+	userId, err := db.GetSessionUser(ctx, token, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("could not get session user, %v", err)
+	}
+	assert.Equal(t, testUserId, userId)
+	_, err = db.GetSessionUser(ctx, token+"0", now)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = db.GetSessionUser(ctx, token, now.Add(time.Hour))
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	deleted, err := db.DeleteSessions(ctx, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("could not delete sessions, %v", err)
+	}
+	assert.Equal(t, 1, deleted)
 }
 
 func TestAddActivity(t *testing.T) {
-	testId, err := db.AddActivity(testActivityName, testUserId)
+	testId, err := db.AddActivity(ctx, testActivityName, testUserId, "")
 	if err != nil {
 		t.Fatalf("could not add activity, %v", err)
 	}
-	activity, err := db.GetActivity(testActivityId)
+	activity, err := db.GetActivity(ctx, testActivityId)
 	if err != nil {
 		t.Fatalf("could not retrieve activity, %v", err)
 	}
@@ -106,10 +252,10 @@ func TestAddActivity(t *testing.T) {
 }
 
 func TestUpdateActivity(t *testing.T) {
-	if err := db.UpdateActivity(testActivityId, testActivityNameUpdated); err != nil {
+	if _, err := db.UpdateActivity(ctx, testActivityId, 0, testActivityNameUpdated); err != nil {
 		t.Fatalf("could not update activity, %v", err)
 	}
-	activity, err := db.GetActivity(testActivityId)
+	activity, err := db.GetActivity(ctx, testActivityId)
 	if err != nil {
 		t.Fatalf("could not retrieve activity, %v", err)
 	}
@@ -119,11 +265,11 @@ func TestUpdateActivity(t *testing.T) {
 }
 
 func TestAddBlock(t *testing.T) {
-	testId, err := db.AddBlock(testBlockStartTime, testBlockEndTime, testActivityId)
+	testId, err := db.AddBlock(ctx, testUserId, testBlockStartTime, testBlockEndTime, testActivityId, "")
 	if err != nil {
 		t.Fatalf("could not add block, %v", err)
 	}
-	block, err := db.GetBlock(testId)
+	block, err := db.GetBlock(ctx, testId)
 	if err != nil {
 		t.Fatalf("could not retrieve block, %v", err)
 	}
@@ -134,10 +280,10 @@ func TestAddBlock(t *testing.T) {
 }
 
 func TestUpdateBlock(t *testing.T) {
-	if err := db.UpdateBlock(testBlockId, testBlockStartTimeUpdated, testBlockEndTimeUpdated); err != nil {
+	if err := db.UpdateBlock(ctx, testBlockId, testBlockStartTimeUpdated, testBlockEndTimeUpdated); err != nil {
 		t.Fatalf("could not update block, %v", err)
 	}
-	block, err := db.GetBlock(testBlockId)
+	block, err := db.GetBlock(ctx, testBlockId)
 	if err != nil {
 		t.Fatalf("could not retrieve block, %v", err)
 	}
@@ -147,11 +293,11 @@ func TestUpdateBlock(t *testing.T) {
 }
 
 func TestAddPause(t *testing.T) {
-	testId, err := db.AddPause(testPauseStartTime, testPauseEndTime, testBlockId)
+	testId, err := db.AddPause(ctx, testPauseStartTime, testPauseEndTime, testBlockId, "")
 	if err != nil {
 		t.Fatalf("could not add pause, %v", err)
 	}
-	pause, err := db.GetPause(testPauseId)
+	pause, err := db.GetPause(ctx, testPauseId)
 	if err != nil {
 		t.Fatalf("could not retrieve pause, %v", err)
 	}
@@ -162,10 +308,10 @@ func TestAddPause(t *testing.T) {
 }
 
 func TestUpdatePause(t *testing.T) {
-	if err := db.UpdatePause(testPauseId, testPauseStartTimeUpdated, testPauseEndTimeUpdated); err != nil {
+	if _, err := db.UpdatePause(ctx, testPauseId, 0, testPauseStartTimeUpdated, testPauseEndTimeUpdated); err != nil {
 		t.Fatalf("could not update pause, %v", err)
 	}
-	pause, err := db.GetPause(testPauseId)
+	pause, err := db.GetPause(ctx, testPauseId)
 	if err != nil {
 		t.Fatalf("could not retrieve pause, %v", err)
 	}
@@ -175,7 +321,7 @@ func TestUpdatePause(t *testing.T) {
 }
 
 func TestGetActivities(t *testing.T) {
-	activities, err := db.GetActivities(testUserId)
+	activities, err := db.GetActivities(ctx, testUserId)
 	if err != nil {
 		t.Fatalf("could not retrieve activities, %v", err)
 	}
@@ -201,7 +347,7 @@ func TestGetActivities(t *testing.T) {
 }
 
 func TestGetActivity(t *testing.T) {
-	activity, err := db.GetActivity(testActivityId)
+	activity, err := db.GetActivity(ctx, testActivityId)
 	if err != nil {
 		t.Fatalf("could not retrieve activity, %v", err)
 	}
@@ -225,7 +371,7 @@ func TestGetActivity(t *testing.T) {
 }
 
 func TestGetBlocks(t *testing.T) {
-	blocks, err := db.GetBlocks(testActivityId)
+	blocks, err := db.GetBlocks(ctx, testActivityId)
 	if err != nil {
 		t.Fatalf("could not retrieve blocks, %v", err)
 	}
@@ -244,7 +390,7 @@ func TestGetBlocks(t *testing.T) {
 }
 
 func TestGetBlock(t *testing.T) {
-	block, err := db.GetBlock(testBlockId)
+	block, err := db.GetBlock(ctx, testBlockId)
 	if err != nil {
 		t.Fatalf("could not retrieve block, %v", err)
 	}
@@ -261,7 +407,7 @@ func TestGetBlock(t *testing.T) {
 }
 
 func TestGetPauses(t *testing.T) {
-	pauses, err := db.GetPauses(testBlockId)
+	pauses, err := db.GetPauses(ctx, testBlockId)
 	if err != nil {
 		t.Fatalf("could not retrieve pauses, %v", err)
 	}
@@ -273,7 +419,7 @@ func TestGetPauses(t *testing.T) {
 }
 
 func TestGetPause(t *testing.T) {
-	pause, err := db.GetPause(testPauseId)
+	pause, err := db.GetPause(ctx, testPauseId)
 	if err != nil {
 		t.Fatalf("could not retrieve pause, %v", err)
 	}
@@ -283,11 +429,11 @@ func TestGetPause(t *testing.T) {
 }
 
 func TestGetCurrentBlock(t *testing.T) {
-	id, err := db.AddBlock(testStartTimeCurrentBlock, "", testActivityId)
+	id, err := db.AddBlock(ctx, testUserId, testStartTimeCurrentBlock, "", testActivityId, "")
 	if err != nil {
 		t.Fatalf("could not add block, %v", err)
 	}
-	block, err := db.GetCurrentBlock()
+	block, err := db.GetCurrentBlock(ctx)
 	if err != nil {
 		t.Fatalf("could not get get current block, %v", err)
 	}
@@ -296,26 +442,1453 @@ func TestGetCurrentBlock(t *testing.T) {
 	assert.Equal(t, testEndTimeCurrentBlock, block.EndTime)
 }
 
+func TestUpdateBlockNote(t *testing.T) {
+	if err := db.UpdateBlockNote(ctx, testBlockId, testBlockNote); err != nil {
+		t.Fatalf("could not update block note, %v", err)
+	}
+	block, err := db.GetBlock(ctx, testBlockId)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, testBlockNote, block.Note)
+}
+
+func TestAddTag(t *testing.T) {
+	if _, err := db.AddTag(ctx, testTag, testBlockId); err != nil {
+		t.Fatalf("could not add tag, %v", err)
+	}
+	tags, err := db.GetTags(ctx, testBlockId)
+	if err != nil {
+		t.Fatalf("could not retrieve tags, %v", err)
+	}
+	assert.Equal(t, []string{testTag}, tags)
+}
+
+func TestSearch(t *testing.T) {
+	results, err := db.Search(ctx, testUserId, "invoice", "", "")
+	if err != nil {
+		t.Fatalf("could not search, %v", err)
+	}
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "note", results[0].Kind)
+	assert.Equal(t, testBlockId, results[0].BlockId)
+	assert.Equal(t, "fixed the <mark>invoice</mark> bug", results[0].Snippet)
+
+	results, err = db.Search(ctx, testUserId, testTag, "", "")
+	if err != nil {
+		t.Fatalf("could not search, %v", err)
+	}
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "tag", results[0].Kind)
+
+	results, err = db.Search(ctx, testUserId, testActivityNameUpdated, "", "")
+	if err != nil {
+		t.Fatalf("could not search, %v", err)
+	}
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "activity", results[0].Kind)
+	assert.Equal(t, testActivityId, results[0].ActivityId)
+
+	results, err = db.Search(ctx, testUserId, "invoice", testBlockEndTimeUpdated, "")
+	if err != nil {
+		t.Fatalf("could not search, %v", err)
+	}
+	assert.Equal(t, 0, len(results))
+}
+
+func TestSplitBlock(t *testing.T) {
+	_, err := db.SplitBlock(ctx, testBlockId, testBlockEndTimeUpdated, 0)
+	assert.ErrorIs(t, err, ErrInvalidSplitTime)
+
+	newId, err := db.SplitBlock(ctx, testBlockId, testSplitTime, 0)
+	if err != nil {
+		t.Fatalf("could not split block, %v", err)
+	}
+	block, err := db.GetBlock(ctx, testBlockId)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, testBlockStartTimeUpdated, block.StartTime)
+	assert.Equal(t, testSplitTime, block.EndTime)
+	assert.Equal(t, 1, len(block.Pauses))
+	assert.Equal(t, testPauseStartTimeUpdated, block.Pauses[0].StartTime)
+	assert.Equal(t, testSplitTime, block.Pauses[0].EndTime)
+
+	newBlock, err := db.GetBlock(ctx, newId)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, testSplitTime, newBlock.StartTime)
+	assert.Equal(t, testBlockEndTimeUpdated, newBlock.EndTime)
+	assert.Equal(t, testActivityId, newBlock.ActivityId)
+	assert.Equal(t, 1, len(newBlock.Pauses))
+	assert.Equal(t, testSplitTime, newBlock.Pauses[0].StartTime)
+	assert.Equal(t, testPauseEndTimeUpdated, newBlock.Pauses[0].EndTime)
+}
+
+func TestMergeBlocks(t *testing.T) {
+	current, err := db.GetCurrentBlock(ctx)
+	if err != nil {
+		t.Fatalf("could not get current block, %v", err)
+	}
+	blocks, err := db.GetBlocks(ctx, testActivityId)
+	if err != nil {
+		t.Fatalf("could not retrieve blocks, %v", err)
+	}
+	assert.Equal(t, 2, len(blocks))
+	ids := []int{blocks[0].Id, blocks[1].Id}
+
+	_, err = db.MergeBlocks(ctx, ids)
+	assert.ErrorIs(t, err, ErrBlocksNotMergeable)
+
+	if err := db.UpdateBlock(ctx, current.Id, current.StartTime, testEndTimeMergeable); err != nil {
+		t.Fatalf("could not update block, %v", err)
+	}
+	id, err := db.MergeBlocks(ctx, ids)
+	if err != nil {
+		t.Fatalf("could not merge blocks, %v", err)
+	}
+	assert.Equal(t, testBlockId, id)
+	block, err := db.GetBlock(ctx, id)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, testBlockStartTimeUpdated, block.StartTime)
+	assert.Equal(t, testBlockEndTimeUpdated, block.EndTime)
+	assert.Equal(t, 2, len(block.Pauses))
+	assert.Equal(t, testBlockNote, block.Note)
+	assert.Equal(t, []string{testTag}, block.Tags)
+}
+
+func TestMoveBlocks(t *testing.T) {
+	activityId, err := db.AddActivity(ctx, testOtherActivityName, testUserId, "")
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	if err := db.MoveBlocks(ctx, testUserId, []int{testBlockId}, activityId); err != nil {
+		t.Fatalf("could not move blocks, %v", err)
+	}
+	block, err := db.GetBlock(ctx, testBlockId)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, activityId, block.ActivityId)
+
+	userId, err := db.AddUser(ctx, testOtherUserName, testOtherUserEmail, testUserPassword)
+	if err != nil {
+		t.Fatalf("could not add user, %v", err)
+	}
+	foreignActivityId, err := db.AddActivity(ctx, testActivityName, userId, "")
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	err = db.MoveBlocks(ctx, testUserId, []int{testBlockId}, foreignActivityId)
+	assert.ErrorIs(t, err, ErrForeignActivity)
+	err = db.MoveBlocks(ctx, userId, []int{testBlockId}, foreignActivityId)
+	assert.ErrorIs(t, err, ErrForeignEntity)
+	err = db.MergeActivities(ctx, testUserId, activityId, foreignActivityId)
+	assert.ErrorIs(t, err, ErrForeignActivity)
+	err = db.MergeActivities(ctx, userId, activityId, testActivityId)
+	assert.ErrorIs(t, err, ErrForeignActivity)
+}
+
+func TestMergeActivities(t *testing.T) {
+	err := db.MergeActivities(ctx, testUserId, testActivityId, testActivityId)
+	assert.ErrorIs(t, err, ErrMergeIntoSelf)
+
+	block, err := db.GetBlock(ctx, testBlockId)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	if err := db.MergeActivities(ctx, testUserId, block.ActivityId, testActivityId); err != nil {
+		t.Fatalf("could not merge activities, %v", err)
+	}
+	block, err = db.GetBlock(ctx, testBlockId)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, testActivityId, block.ActivityId)
+	activities, err := db.GetActivities(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not retrieve activities, %v", err)
+	}
+	assert.Equal(t, 1, len(activities))
+}
+
+func TestSettings(t *testing.T) {
+	settings, err := db.GetSettings(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not retrieve settings, %v", err)
+	}
+	assert.Equal(t, 0, settings.MaxBlockMinutes)
+	assert.Equal(t, "", settings.EndOfDay)
+
+	settings.MaxBlockMinutes = testMaxBlockMinutes
+	settings.EndOfDay = testEndOfDay
+	settings.Timezone = "Mars/Olympus"
+	err = db.UpdateSettings(ctx, settings)
+	assert.ErrorIs(t, err, ErrInvalidTimezone)
+	settings.Timezone = testTimezone
+	if err := db.UpdateSettings(ctx, settings); err != nil {
+		t.Fatalf("could not update settings, %v", err)
+	}
+	settings, err = db.GetSettings(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not retrieve settings, %v", err)
+	}
+	assert.Equal(t, testMaxBlockMinutes, settings.MaxBlockMinutes)
+	assert.Equal(t, testEndOfDay, settings.EndOfDay)
+	assert.Equal(t, testTimezone, settings.Timezone)
+}
+
+func TestIdleStopTime(t *testing.T) {
+	start := time.Date(2023, 5, 1, 17, 30, 0, 0, time.UTC)
+	stopTime, ok := idleStopTime(start, 0, "")
+	assert.False(t, ok)
+	stopTime, ok = idleStopTime(start, testMaxBlockMinutes, "")
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Hour), stopTime)
+	stopTime, ok = idleStopTime(start, testMaxBlockMinutes, testEndOfDay)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2023, 5, 1, 18, 0, 0, 0, time.UTC), stopTime)
+	stopTime, ok = idleStopTime(start, 0, "08:00")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2023, 5, 2, 8, 0, 0, 0, time.UTC), stopTime)
+
+	location, err := time.LoadLocation(testTimezone)
+	if err != nil {
+		t.Fatalf("could not load timezone, %v", err)
+	}
+	stopTime, ok = idleStopTime(start.In(location), 0, testEndOfDay)
+	assert.True(t, ok)
+	assert.True(t, time.Date(2023, 5, 2, 16, 0, 0, 0, time.UTC).Equal(stopTime))
+}
+
+func TestStopIdleBlocks(t *testing.T) {
+	id, err := db.AddBlock(ctx, testUserId, testIdleStartTime, "", testActivityId, "")
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	if _, err := db.AddPause(ctx, testIdlePauseStart, testIdlePauseEnd, id, ""); err != nil {
+		t.Fatalf("could not add pause, %v", err)
+	}
+	if _, err := db.AddPause(ctx, testIdleLatePause, testIdleLatePauseEnd, id, ""); err != nil {
+		t.Fatalf("could not add pause, %v", err)
+	}
+	blocks, err := db.StopIdleBlocks(ctx, time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("could not stop idle blocks, %v", err)
+	}
+	assert.Equal(t, 0, len(blocks))
+
+	blocks, err = db.StopIdleBlocks(ctx, time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("could not stop idle blocks, %v", err)
+	}
+	assert.Equal(t, 1, len(blocks))
+	block := blocks[0]
+	assert.Equal(t, id, block.Id)
+	assert.Equal(t, testIdleStopTime, block.EndTime)
+	assert.True(t, block.AutoStopped)
+	assert.Equal(t, 1, len(block.Pauses))
+	assert.Equal(t, testIdleStopTime, block.Pauses[0].EndTime)
+
+	blocks, err = db.GetAutoStoppedBlocks(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not retrieve auto stopped blocks, %v", err)
+	}
+	assert.Equal(t, 1, len(blocks))
+
+	if err := db.UpdateBlock(ctx, id, block.StartTime, block.EndTime); err != nil {
+		t.Fatalf("could not update block, %v", err)
+	}
+	blocks, err = db.GetAutoStoppedBlocks(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not retrieve auto stopped blocks, %v", err)
+	}
+	assert.Equal(t, 0, len(blocks))
+}
+
+func TestPomodoroPhaseAt(t *testing.T) {
+	start := time.Date(2023, 5, 2, 9, 0, 0, 0, time.UTC)
+	pomodoro := schemas.Pomodoro{Enabled: true, WorkMinutes: 25, ShortBreakMinutes: 5, LongBreakMinutes: 15, Cycles: 2}
+
+	phase := pomodoroPhaseAt(start, start.Add(10*time.Minute), pomodoro)
+	assert.Equal(t, PhaseWork, phase.name)
+	assert.Equal(t, 1, phase.cycle)
+	assert.Equal(t, start.Add(25*time.Minute), phase.end)
+
+	phase = pomodoroPhaseAt(start, start.Add(27*time.Minute), pomodoro)
+	assert.Equal(t, PhaseShortBreak, phase.name)
+	assert.Equal(t, start.Add(30*time.Minute), phase.end)
+
+	phase = pomodoroPhaseAt(start, start.Add(60*time.Minute), pomodoro)
+	assert.Equal(t, PhaseLongBreak, phase.name)
+	assert.Equal(t, 2, phase.cycle)
+	assert.Equal(t, start.Add(75*time.Minute), phase.end)
+
+	breaks := pomodoroBreaks(start, start.Add(80*time.Minute), pomodoro)
+	assert.Equal(t, 2, len(breaks))
+}
+
+func TestInsertPomodoroPauses(t *testing.T) {
+	settings, err := db.GetSettings(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not retrieve settings, %v", err)
+	}
+	settings.Pomodoro.Enabled = true
+	if err := db.UpdateSettings(ctx, settings); err != nil {
+		t.Fatalf("could not update settings, %v", err)
+	}
+	id, err := db.AddBlock(ctx, testUserId, testPomodoroStartTime, "", testActivityId, "")
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	now := time.Date(2023, 5, 2, 9, 35, 0, 0, time.UTC)
+	blockIds, err := db.InsertPomodoroPauses(ctx, now)
+	if err != nil {
+		t.Fatalf("could not insert pomodoro pauses, %v", err)
+	}
+	assert.Equal(t, []int{id}, blockIds)
+	blockIds, err = db.InsertPomodoroPauses(ctx, now)
+	if err != nil {
+		t.Fatalf("could not insert pomodoro pauses, %v", err)
+	}
+	assert.Equal(t, 0, len(blockIds))
+	block, err := db.GetBlock(ctx, id)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, 1, len(block.Pauses))
+	assert.Equal(t, testPomodoroPauseStart, block.Pauses[0].StartTime)
+	assert.Equal(t, testPomodoroPauseEnd, block.Pauses[0].EndTime)
+
+	resumed, err := db.GetResumedBlocks(ctx, now.Add(-10*time.Minute), now)
+	if err != nil {
+		t.Fatalf("could not get resumed blocks, %v", err)
+	}
+	assert.Equal(t, []int{id}, resumed)
+	resumed, err = db.GetResumedBlocks(ctx, now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatalf("could not get resumed blocks, %v", err)
+	}
+	assert.Equal(t, 0, len(resumed))
+
+	state, err := db.GetPomodoroState(ctx, block, now)
+	if err != nil {
+		t.Fatalf("could not get pomodoro state, %v", err)
+	}
+	assert.Equal(t, PhaseWork, state.Phase)
+	assert.Equal(t, 2, state.Cycle)
+	assert.Equal(t, 20*60, state.RemainingSeconds)
+}
+
+func TestTimer(t *testing.T) {
+	running, err := db.GetRunningBlock(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not get running block, %v", err)
+	}
+	start, _ := time.Parse(time.RFC3339, testTimerStartTime)
+	id, err := db.StartBlock(ctx, testUserId, testActivityId, start)
+	if err != nil {
+		t.Fatalf("could not start block, %v", err)
+	}
+	previous, err := db.GetBlock(ctx, running.Id)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, testTimerStartTime, previous.EndTime)
+	running, err = db.GetRunningBlock(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not get running block, %v", err)
+	}
+	assert.Equal(t, id, running.Id)
+	_, err = db.StartBlock(ctx, testUserId, testActivityId, start.Add(-time.Minute))
+	assert.ErrorIs(t, err, ErrTimeBeforeRun)
+	_, err = db.PauseBlock(ctx, testUserId, start.Add(-time.Minute))
+	assert.ErrorIs(t, err, ErrTimeBeforeRun)
+
+	pause, _ := time.Parse(time.RFC3339, testTimerPauseTime)
+	if _, err := db.PauseBlock(ctx, testUserId, pause); err != nil {
+		t.Fatalf("could not pause block, %v", err)
+	}
+	_, err = db.PauseBlock(ctx, testUserId, pause)
+	assert.ErrorIs(t, err, ErrAlreadyPaused)
+	_, err = db.ResumeBlock(ctx, testUserId, pause.Add(-time.Minute))
+	assert.ErrorIs(t, err, ErrTimeBeforeRun)
+	_, err = db.StopBlock(ctx, testUserId, pause.Add(-time.Minute))
+	assert.ErrorIs(t, err, ErrTimeBeforeRun)
+	resume, _ := time.Parse(time.RFC3339, testTimerResumeTime)
+	if _, err := db.ResumeBlock(ctx, testUserId, resume); err != nil {
+		t.Fatalf("could not resume block, %v", err)
+	}
+	_, err = db.ResumeBlock(ctx, testUserId, resume)
+	assert.ErrorIs(t, err, ErrNotPaused)
+
+	stop, _ := time.Parse(time.RFC3339, testTimerStopTime)
+	if _, err := db.StopBlock(ctx, testUserId, stop); err != nil {
+		t.Fatalf("could not stop block, %v", err)
+	}
+	block, err := db.GetBlock(ctx, id)
+	if err != nil {
+		t.Fatalf("could not retrieve block, %v", err)
+	}
+	assert.Equal(t, testTimerStopTime, block.EndTime)
+	assert.Equal(t, 1, len(block.Pauses))
+	assert.Equal(t, testTimerPauseTime, block.Pauses[0].StartTime)
+	assert.Equal(t, testTimerResumeTime, block.Pauses[0].EndTime)
+
+	_, err = db.GetRunningBlock(ctx, testUserId)
+	assert.ErrorIs(t, err, ErrNoRunningBlock)
+	_, err = db.StopBlock(ctx, testUserId, stop)
+	assert.ErrorIs(t, err, ErrNoRunningBlock)
+
+	foreignActivities, err := db.GetActivities(ctx, testUserId+1)
+	if err != nil {
+		t.Fatalf("could not retrieve activities, %v", err)
+	}
+	_, err = db.StartBlock(ctx, testUserId, foreignActivities[0].Id, start)
+	assert.ErrorIs(t, err, ErrForeignActivity)
+}
+
+// TestTimerPomodoroBreak makes sure a pomodoro break, which is inserted with
+// its end, can be ended early and is ended along with its block.
+func TestTimerPomodoroBreak(t *testing.T) {
+	start, _ := time.Parse(time.RFC3339, testBreakStartTime)
+	id, err := db.StartBlock(ctx, testUserId, testActivityId, start)
+	if err != nil {
+		t.Fatalf("could not start block, %v", err)
+	}
+	pauseId, err := db.AddPause(ctx, testBreakPauseStart, testBreakPauseEnd, id, "")
+	if err != nil {
+		t.Fatalf("could not add pause, %v", err)
+	}
+	resume, _ := time.Parse(time.RFC3339, testBreakResumeTime)
+	_, err = db.PauseBlock(ctx, testUserId, resume)
+	assert.ErrorIs(t, err, ErrAlreadyPaused)
+	if _, err := db.ResumeBlock(ctx, testUserId, resume); err != nil {
+		t.Fatalf("could not resume block, %v", err)
+	}
+	pause, err := db.GetPause(ctx, pauseId)
+	if err != nil {
+		t.Fatalf("could not get pause, %v", err)
+	}
+	assert.Equal(t, testBreakResumeTime, pause.EndTime)
+
+	if _, err := db.UpdatePause(ctx, pauseId, 0, testBreakPauseStart, testBreakPauseEnd); err != nil {
+		t.Fatalf("could not update pause, %v", err)
+	}
+	stop, _ := time.Parse(time.RFC3339, testBreakStopTime)
+	if _, err := db.StopBlock(ctx, testUserId, stop); err != nil {
+		t.Fatalf("could not stop block, %v", err)
+	}
+	pause, err = db.GetPause(ctx, pauseId)
+	if err != nil {
+		t.Fatalf("could not get pause, %v", err)
+	}
+	assert.Equal(t, testBreakStopTime, pause.EndTime)
+}
+
+func TestWebhooks(t *testing.T) {
+	id, err := db.AddWebhook(ctx, testUserId, testWebhookUrl, testWebhookSecret, []string{testWebhookEvent})
+	if err != nil {
+		t.Fatalf("could not add webhook, %v", err)
+	}
+	webhooks, err := db.GetWebhooks(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not retrieve webhooks, %v", err)
+	}
+	assert.Equal(t, 1, len(webhooks))
+	assert.Equal(t, id, webhooks[0].Id)
+	assert.Equal(t, testWebhookUrl, webhooks[0].Url)
+	assert.Equal(t, testWebhookSecret, webhooks[0].Secret)
+	assert.Equal(t, []string{testWebhookEvent}, webhooks[0].Events)
+
+	now := time.Date(2023, 5, 4, 9, 0, 0, 0, time.UTC)
+	for {
+		outbox, err := db.ReadWebhookOutbox(ctx, 100)
+		if err != nil {
+			t.Fatalf("could not read webhook outbox, %v", err)
+		}
+		if len(outbox.Changes) == 0 {
+			break
+		}
+		if err := db.EnqueueWebhookEvents(ctx, outbox, nil, now); err != nil {
+			t.Fatalf("could not enqueue webhook events, %v", err)
+		}
+	}
+	blockId, err := db.StartBlock(ctx, testUserId, testActivityId, now)
+	if err != nil {
+		t.Fatalf("could not start block, %v", err)
+	}
+	outbox, err := db.ReadWebhookOutbox(ctx, 100)
+	if err != nil {
+		t.Fatalf("could not read webhook outbox, %v", err)
+	}
+	assert.Equal(t, 1, len(outbox.Changes))
+	assert.Equal(t, "block", outbox.Changes[0].Entity)
+	assert.Equal(t, blockId, outbox.Changes[0].Id)
+	assert.Equal(t, testUserId, outbox.Changes[0].UserId)
+	assert.True(t, outbox.Changes[0].Open)
+	events := []WebhookEvent{
+		{UserId: testUserId, Event: testWebhookEvent, Payload: []byte(testWebhookPayload)},
+		{UserId: testUserId, Event: "block.stopped", Payload: []byte(testWebhookPayload)},
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.EnqueueWebhookEvents(ctx, outbox, events, now); err != nil {
+			t.Fatalf("could not enqueue webhook events, %v", err)
+		}
+	}
+	outbox, err = db.ReadWebhookOutbox(ctx, 100)
+	if err != nil {
+		t.Fatalf("could not read webhook outbox, %v", err)
+	}
+	assert.Equal(t, 0, len(outbox.Changes))
+	if _, err := db.StopBlock(ctx, testUserId, now.Add(time.Minute)); err != nil {
+		t.Fatalf("could not stop block, %v", err)
+	}
+
+	deliveries, err := db.ClaimWebhookDeliveries(ctx, now, now.Add(time.Minute), 10)
+	if err != nil {
+		t.Fatalf("could not claim webhook deliveries, %v", err)
+	}
+	assert.Equal(t, 1, len(deliveries))
+	delivery := deliveries[0]
+	assert.Equal(t, id, delivery.WebhookId)
+	assert.Equal(t, testWebhookEvent, delivery.Event)
+	assert.Equal(t, DeliveryPending, delivery.Status)
+	assert.JSONEq(t, testWebhookPayload, string(delivery.Payload))
+
+	deliveries, err = db.ClaimWebhookDeliveries(ctx, now, now.Add(time.Minute), 10)
+	if err != nil {
+		t.Fatalf("could not claim webhook deliveries, %v", err)
+	}
+	assert.Equal(t, 0, len(deliveries))
+
+	if err := db.RecordWebhookAttempt(ctx, delivery.Id, DeliveryDelivered, 200, "", now, now); err != nil {
+		t.Fatalf("could not record webhook attempt, %v", err)
+	}
+	deliveries, err = db.GetWebhookDeliveries(ctx, id)
+	if err != nil {
+		t.Fatalf("could not retrieve webhook deliveries, %v", err)
+	}
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, DeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Equal(t, 200, deliveries[0].LastStatusCode)
+	assert.Equal(t, "2023-05-04T09:00:00Z", deliveries[0].DeliveredAt)
+}
+
+func TestCountRunningBlocks(t *testing.T) {
+	before, err := db.CountRunningBlocks(ctx)
+	if err != nil {
+		t.Fatalf("could not count running blocks, %v", err)
+	}
+	start, _ := time.Parse(time.RFC3339, testTimerStartTime)
+	if _, err := db.StartBlock(ctx, testUserId, testActivityId, start); err != nil {
+		t.Fatalf("could not start block, %v", err)
+	}
+	count, err := db.CountRunningBlocks(ctx)
+	if err != nil {
+		t.Fatalf("could not count running blocks, %v", err)
+	}
+	assert.Equal(t, before+1, count)
+
+	stop, _ := time.Parse(time.RFC3339, testTimerStopTime)
+	if _, err := db.StopBlock(ctx, testUserId, stop); err != nil {
+		t.Fatalf("could not stop block, %v", err)
+	}
+	count, err = db.CountRunningBlocks(ctx)
+	if err != nil {
+		t.Fatalf("could not count running blocks, %v", err)
+	}
+	assert.Equal(t, before, count)
+}
+
+func TestReadiness(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		t.Fatalf("could not ping database, %v", err)
+	}
+	pending, err := db.PendingMigrations(ctx)
+	if err != nil {
+		t.Fatalf("could not check migrations, %v", err)
+	}
+	assert.Equal(t, 0, pending)
+}
+
+func TestWorkspaces(t *testing.T) {
+	now := time.Now()
+	workspaceId, err := db.AddWorkspace(ctx, testUserId, testWorkspaceName, now)
+	if err != nil {
+		t.Fatalf("could not add workspace, %v", err)
+	}
+	memberId, err := db.AddUser(ctx, testMemberName, testMemberEmail, testUserPassword)
+	if err != nil {
+		t.Fatalf("could not add user, %v", err)
+	}
+	_, err = db.AddInvitation(ctx, memberId, workspaceId, testMemberEmail, RoleMember, now)
+	assert.ErrorIs(t, err, ErrNotMember)
+	_, err = db.AddInvitation(ctx, testUserId, workspaceId, testMemberEmail, RoleOwner, now)
+	assert.ErrorIs(t, err, ErrInvalidRole)
+	invitation, err := db.AddInvitation(ctx, testUserId, workspaceId, testMemberEmail, RoleMember, now)
+	if err != nil {
+		t.Fatalf("could not add invitation, %v", err)
+	}
+	invitations, err := db.GetInvitations(ctx, memberId)
+	if err != nil {
+		t.Fatalf("could not get invitations, %v", err)
+	}
+	assert.Equal(t, 1, len(invitations))
+	assert.Equal(t, testWorkspaceName, invitations[0].WorkspaceName)
+
+	_, err = db.AcceptInvitation(ctx, testUserId, invitation.Token, now)
+	assert.ErrorIs(t, err, ErrInvitationEmail)
+	accepted, err := db.AcceptInvitation(ctx, memberId, invitation.Token, now)
+	if err != nil {
+		t.Fatalf("could not accept invitation, %v", err)
+	}
+	assert.Equal(t, workspaceId, accepted)
+	workspace, err := db.GetWorkspace(ctx, memberId, workspaceId)
+	if err != nil {
+		t.Fatalf("could not get workspace, %v", err)
+	}
+	assert.Equal(t, RoleMember, workspace.Role)
+	assert.Equal(t, 2, len(workspace.Members))
+
+	_, err = db.AddWorkspaceActivity(ctx, memberId, workspaceId, testWorkspaceActivity, "")
+	assert.ErrorIs(t, err, ErrRoleNotAllowed)
+	activityId, err := db.AddWorkspaceActivity(ctx, testUserId, workspaceId, testWorkspaceActivity, "")
+	if err != nil {
+		t.Fatalf("could not add workspace activity, %v", err)
+	}
+	activities, err := db.GetActivities(ctx, memberId)
+	if err != nil {
+		t.Fatalf("could not get activities, %v", err)
+	}
+	assert.Equal(t, 1, len(activities))
+	assert.Equal(t, workspaceId, activities[0].WorkspaceId)
+
+	_, err = db.AddBlock(ctx, memberId, testWorkspaceStartTime, testWorkspaceEndTime, testActivityId, "")
+	assert.ErrorIs(t, err, ErrForeignActivity)
+	blockId, err := db.AddBlock(ctx, memberId, testWorkspaceStartTime, testWorkspaceEndTime, activityId, "")
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	block, err := db.GetBlock(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, memberId, block.UserId)
+
+	_, err = db.GetWorkspaceReport(ctx, memberId, workspaceId, "", "")
+	assert.ErrorIs(t, err, ErrRoleNotAllowed)
+	report, err := db.GetWorkspaceReport(ctx, testUserId, workspaceId, "", "")
+	if err != nil {
+		t.Fatalf("could not get report, %v", err)
+	}
+	assert.Equal(t, 1800, report.TotalSeconds)
+	assert.Equal(t, 1, len(report.Entries))
+	assert.Equal(t, testMemberName, report.Entries[0].UserName)
+
+	// Members only see their own blocks of workspace activities, owners and
+	// admins those of everyone.
+	if _, err := db.AddBlock(ctx, testUserId, testWorkspaceStartTime, testWorkspaceEndTime, activityId, ""); err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	activities, err = db.GetActivities(ctx, memberId)
+	if err != nil {
+		t.Fatalf("could not get activities, %v", err)
+	}
+	assert.Equal(t, 1, len(activities[0].Blocks))
+	assert.Equal(t, blockId, activities[0].Blocks[0].Id)
+	activities, err = db.GetWorkspaceActivities(ctx, memberId, workspaceId)
+	if err != nil {
+		t.Fatalf("could not get workspace activities, %v", err)
+	}
+	assert.Equal(t, 1, len(activities[0].Blocks))
+	activities, err = db.GetWorkspaceActivities(ctx, testUserId, workspaceId)
+	if err != nil {
+		t.Fatalf("could not get workspace activities, %v", err)
+	}
+	assert.Equal(t, 2, len(activities[0].Blocks))
+
+	assert.ErrorIs(t, db.RemoveMember(ctx, memberId, workspaceId, testUserId), ErrRoleNotAllowed)
+	assert.ErrorIs(t, db.RemoveMember(ctx, testUserId, workspaceId, testUserId), ErrOwnerLeaves)
+	if err := db.RemoveMember(ctx, memberId, workspaceId, memberId); err != nil {
+		t.Fatalf("could not leave workspace, %v", err)
+	}
+	_, err = db.GetWorkspace(ctx, memberId, workspaceId)
+	assert.ErrorIs(t, err, ErrNotMember)
+
+	if err := db.DeleteWorkspace(ctx, testUserId, workspaceId); err != nil {
+		t.Fatalf("could not delete workspace, %v", err)
+	}
+	_, err = db.GetActivity(ctx, activityId)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestWeekStart(t *testing.T) {
+	for _, day := range []string{"2023-05-08", "2023-05-10", "2023-05-14"} {
+		date, _ := time.Parse(time.DateOnly, day)
+		assert.Equal(t, testTimesheetMonday, WeekStart(date).Format(time.DateOnly))
+	}
+}
+
+func TestTimesheets(t *testing.T) {
+	now := time.Now()
+	member, err := db.GetUserByLogin(ctx, testMemberEmail, testUserPassword)
+	if err != nil {
+		t.Fatalf("could not get member, %v", err)
+	}
+	workspaceId, err := db.AddWorkspace(ctx, testUserId, testWorkspaceName, now)
+	if err != nil {
+		t.Fatalf("could not add workspace, %v", err)
+	}
+	invitation, err := db.AddInvitation(ctx, testUserId, workspaceId, testMemberEmail, RoleMember, now)
+	if err != nil {
+		t.Fatalf("could not add invitation, %v", err)
+	}
+	if _, err := db.AcceptInvitation(ctx, member.Id, invitation.Token, now); err != nil {
+		t.Fatalf("could not accept invitation, %v", err)
+	}
+	activityId, err := db.AddActivity(ctx, testActivityName, member.Id, "")
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	blockId, err := db.AddBlock(ctx, member.Id, testTimesheetStartTime, testTimesheetEndTime, activityId, "")
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+
+	week, _ := time.Parse(time.DateOnly, testTimesheetWeek)
+	timesheet, err := db.GetTimesheet(ctx, member.Id, week)
+	if err != nil {
+		t.Fatalf("could not get timesheet, %v", err)
+	}
+	assert.Equal(t, TimesheetOpen, timesheet.Status)
+	assert.Equal(t, testTimesheetMonday, timesheet.WeekStart)
+	assert.Equal(t, 1, len(timesheet.Blocks))
+	assert.Equal(t, 3600, timesheet.TotalSeconds)
+
+	assert.ErrorIs(t, db.ReviewTimesheet(ctx, testUserId, member.Id, week, true, "", now), ErrInvalidTransition)
+	if err := db.SubmitTimesheet(ctx, member.Id, week, "", now); err != nil {
+		t.Fatalf("could not submit timesheet, %v", err)
+	}
+	assert.ErrorIs(t, db.ReviewTimesheet(ctx, member.Id, member.Id, week, true, "", now), ErrNotApprover)
+	assert.ErrorIs(t, db.ReviewTimesheet(ctx, testUserId, member.Id, week, false, "", now), ErrCommentRequired)
+	if err := db.ReviewTimesheet(ctx, testUserId, member.Id, week, false, testTimesheetComment, now); err != nil {
+		t.Fatalf("could not reject timesheet, %v", err)
+	}
+	if err := db.SubmitTimesheet(ctx, member.Id, week, "", now); err != nil {
+		t.Fatalf("could not submit timesheet, %v", err)
+	}
+	pending, err := db.GetPendingTimesheets(ctx, testUserId)
+	if err != nil {
+		t.Fatalf("could not get pending timesheets, %v", err)
+	}
+	assert.Equal(t, 1, len(pending))
+	if err := db.ReviewTimesheet(ctx, testUserId, member.Id, week, true, "", now); err != nil {
+		t.Fatalf("could not approve timesheet, %v", err)
+	}
+
+	timesheet, err = db.GetTimesheet(ctx, member.Id, week)
+	if err != nil {
+		t.Fatalf("could not get timesheet, %v", err)
+	}
+	assert.Equal(t, TimesheetApproved, timesheet.Status)
+	assert.Equal(t, 4, len(timesheet.Events))
+	assert.Equal(t, testTimesheetComment, timesheet.Events[1].Comment)
+	assert.Equal(t, TimesheetApprove, timesheet.Events[3].Action)
+	assert.Equal(t, testUserId, timesheet.Events[3].UserId)
+
+	err = db.UpdateBlock(ctx, blockId, testTimesheetStartTime, testTimesheetEndTime)
+	assert.ErrorIs(t, err, ErrTimesheetApproved)
+	_, err = db.AddPause(ctx, testTimesheetStartTime, testTimesheetEndTime, blockId, "")
+	assert.ErrorIs(t, err, ErrTimesheetApproved)
+	_, err = db.AddBlock(ctx, member.Id, testTimesheetStartTime, testTimesheetEndTime, activityId, "")
+	assert.ErrorIs(t, err, ErrTimesheetApproved)
+	assert.ErrorIs(t, db.DeleteByTableAndId(ctx, "blocks", blockId), ErrTimesheetApproved)
+	assert.ErrorIs(t, db.DeleteByTableAndId(ctx, "activities", activityId), ErrTimesheetApproved)
+}
+
+func TestLockDates(t *testing.T) {
+	now := time.Now()
+	// The lock dates of a user are administered by the owners and admins of
+	// their workspaces, not by the user.
+	reviewWorkspaceId, _, memberId := addTestWorkspace(t)
+	activityId, err := db.AddActivity(ctx, testActivityName, memberId, "")
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	blockId, err := db.AddBlock(ctx, memberId, testLockedTime, testLockedEndTime, activityId, "")
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+
+	assert.ErrorIs(t, db.SetUserLockDate(ctx, testUserId, memberId, "April", now), ErrInvalidLockDate)
+	assert.ErrorIs(t, db.SetUserLockDate(ctx, memberId, memberId, testLockDate, now), ErrRoleNotAllowed)
+	assert.ErrorIs(t, db.SetUserLockDate(ctx, memberId, testUserId, testLockDate, now), ErrRoleNotAllowed)
+	if err := db.SetUserLockDate(ctx, testUserId, memberId, testLockDate, now); err != nil {
+		t.Fatalf("could not set lock date, %v", err)
+	}
+	locks, err := db.GetLockDates(ctx, memberId)
+	if err != nil {
+		t.Fatalf("could not get lock dates, %v", err)
+	}
+	assert.Equal(t, 1, len(locks))
+	assert.Equal(t, testLockDate, locks[0].LockDate)
+	assert.Equal(t, testUserId, locks[0].SetBy)
+
+	_, err = db.AddBlock(ctx, memberId, testLockedTime, testLockedEndTime, activityId, "")
+	assert.ErrorIs(t, err, ErrPeriodLocked)
+	assert.ErrorIs(t, db.UpdateBlock(ctx, blockId, testLockedTime, testLockedEndTime), ErrPeriodLocked)
+	_, err = db.AddPause(ctx, testLockedTime, testLockedEndTime, blockId, "")
+	assert.ErrorIs(t, err, ErrPeriodLocked)
+	lockedStart, _ := time.Parse(time.RFC3339, testLockedTime)
+	_, err = db.StartBlock(ctx, memberId, activityId, lockedStart)
+	assert.ErrorIs(t, err, ErrPeriodLocked)
+	assert.ErrorIs(t, db.DeleteByTableAndId(ctx, "blocks", blockId), ErrPeriodLocked)
+
+	denied := WithLockOverride(ctx, memberId)
+	assert.ErrorIs(t, db.UpdateBlock(denied, blockId, testLockedTime, testLockedEndTime), ErrLockOverrideDenied)
+	assert.ErrorIs(t, db.DeleteByTableAndId(denied, "blocks", blockId), ErrLockOverrideDenied)
+	override := WithLockOverride(ctx, testUserId)
+	if err := db.UpdateBlock(override, blockId, testLockedTime, testLockedEndTime); err != nil {
+		t.Fatalf("could not override lock date, %v", err)
+	}
+	assert.ErrorIs(t, db.DeleteUserLockDate(ctx, memberId, memberId), ErrRoleNotAllowed)
+	if err := db.DeleteUserLockDate(ctx, testUserId, memberId); err != nil {
+		t.Fatalf("could not delete lock date, %v", err)
+	}
+	if err := db.DeleteWorkspace(ctx, testUserId, reviewWorkspaceId); err != nil {
+		t.Fatalf("could not delete workspace, %v", err)
+	}
+
+	workspaceId, err := db.AddWorkspace(ctx, testUserId, testWorkspaceName, now)
+	if err != nil {
+		t.Fatalf("could not add workspace, %v", err)
+	}
+	workspaceActivityId, err := db.AddWorkspaceActivity(ctx, testUserId, workspaceId, testActivityName, "")
+	if err != nil {
+		t.Fatalf("could not add workspace activity, %v", err)
+	}
+	assert.ErrorIs(t, db.SetWorkspaceLockDate(ctx, memberId, workspaceId, testLockDate, now), ErrNotMember)
+	if err := db.SetWorkspaceLockDate(ctx, testUserId, workspaceId, testLockDate, now); err != nil {
+		t.Fatalf("could not set lock date, %v", err)
+	}
+	_, err = db.AddBlock(ctx, testUserId, testLockedTime, testLockedEndTime, workspaceActivityId, "")
+	assert.ErrorIs(t, err, ErrPeriodLocked)
+	assert.ErrorIs(t, db.MoveBlocks(ctx, memberId, []int{blockId}, workspaceActivityId), ErrPeriodLocked)
+	if err := db.UpdateBlock(ctx, blockId, testLockedTime, testLockedEndTime); err != nil {
+		t.Fatalf("could not update unlocked block, %v", err)
+	}
+	if _, err := db.AddBlock(override, testUserId, testLockedTime, testLockedEndTime, workspaceActivityId, ""); err != nil {
+		t.Fatalf("could not override lock date, %v", err)
+	}
+	assert.ErrorIs(t, db.DeleteWorkspace(ctx, testUserId, workspaceId), ErrPeriodLocked)
+	if err := db.DeleteWorkspaceLockDate(ctx, testUserId, workspaceId); err != nil {
+		t.Fatalf("could not delete lock date, %v", err)
+	}
+	if err := db.DeleteWorkspace(ctx, testUserId, workspaceId); err != nil {
+		t.Fatalf("could not delete workspace, %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	actorCtx := WithActor(ctx, testUserId)
+	activityId, err := db.AddActivity(actorCtx, testActivityName, testUserId, "")
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	blockId, err := db.AddBlock(actorCtx, testUserId, testAuditStartTime, testAuditEndTime, activityId, "")
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	if err := db.UpdateBlock(actorCtx, blockId, testAuditStartTime, testAuditUpdatedTime); err != nil {
+		t.Fatalf("could not update block, %v", err)
+	}
+	if err := db.DeleteByTableAndId(actorCtx, "activities", activityId); err != nil {
+		t.Fatalf("could not delete activity, %v", err)
+	}
+
+	entries, err := db.GetAuditLog(ctx, "block", blockId)
+	if err != nil {
+		t.Fatalf("could not get audit log, %v", err)
+	}
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, []string{"insert", "update", "delete"}, []string{entries[0].Action, entries[1].Action, entries[2].Action})
+	assert.Equal(t, "null", string(entries[0].Before))
+	assert.Equal(t, "null", string(entries[2].After))
+	assert.Equal(t, testUserId, entries[2].UserId)
+	var after map[string]any
+	if err := json.Unmarshal(entries[1].After, &after); err != nil {
+		t.Fatalf("could not read audit entry, %v", err)
+	}
+	assert.Equal(t, "2023-06-01T11:00:00", after["end_time"])
+
+	users, err := db.GetAuditLog(ctx, "user", testUserId)
+	if err != nil {
+		t.Fatalf("could not get audit log, %v", err)
+	}
+	assert.NotContains(t, string(users[0].After), testUserPassword)
+
+	_, err = db.GetAuditLog(ctx, "tag", 1)
+	assert.ErrorIs(t, err, ErrUnknownEntity)
+	_, err = db.db.ExecContext(ctx, "DELETE FROM audit_log")
+	assert.NotNil(t, err)
+}
+
+func TestBlockRevisions(t *testing.T) {
+	now := time.Now()
+	activityId, err := db.AddActivity(ctx, testActivityName, testUserId, "")
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	blockId, err := db.AddBlock(ctx, testUserId, testRevisionStartTime, testRevisionEndTime, activityId, "")
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	pauseId, err := db.AddPause(ctx, testRevisionPauseStart, testRevisionPauseEnd, blockId, "")
+	if err != nil {
+		t.Fatalf("could not add pause, %v", err)
+	}
+	pause, err := db.GetPause(ctx, pauseId)
+	if err != nil {
+		t.Fatalf("could not get pause, %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		revision, err := db.SaveBlockRevision(ctx, blockId, now)
+		if err != nil {
+			t.Fatalf("could not save revision, %v", err)
+		}
+		assert.Equal(t, 2, revision)
+	}
+
+	editor := WithActor(ctx, testUserId)
+	if err := db.UpdateBlock(editor, blockId, testRevisionStartTime, testRevisionUpdatedEndTime); err != nil {
+		t.Fatalf("could not update block, %v", err)
+	}
+	if err := db.DeletePauses(editor, blockId); err != nil {
+		t.Fatalf("could not delete pauses, %v", err)
+	}
+	revision, err := db.SaveBlockRevision(ctx, blockId, now)
+	if err != nil {
+		t.Fatalf("could not save revision, %v", err)
+	}
+	assert.Equal(t, 4, revision)
+
+	diff, err := db.DiffBlockRevisions(ctx, blockId, 2, 4)
+	if err != nil {
+		t.Fatalf("could not diff revisions, %v", err)
+	}
+	assert.Equal(t, 2, len(diff.Changes))
+	assert.Equal(t, "endTime", diff.Changes[0].Field)
+	assert.Equal(t, testRevisionEndTime, diff.Changes[0].Before)
+	assert.Equal(t, "pauses", diff.Changes[1].Field)
+
+	revision, err = db.RevertBlock(ctx, blockId, 2, now)
+	if err != nil {
+		t.Fatalf("could not revert block, %v", err)
+	}
+	assert.Equal(t, 5, revision)
+	block, err := db.GetBlock(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, testRevisionEndTime, block.EndTime)
+	assert.Equal(t, 1, len(block.Pauses))
+	assert.Equal(t, testRevisionPauseStart, block.Pauses[0].StartTime)
+	assert.Equal(t, pause.Uuid, block.Pauses[0].Uuid)
+
+	revisions, err := db.GetBlockRevisions(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get revisions, %v", err)
+	}
+	assert.Equal(t, 5, len(revisions))
+	assert.Equal(t, 0, revisions[1].UserId)
+	assert.Equal(t, testUserId, revisions[2].UserId)
+	assert.Equal(t, testUserId, revisions[3].UserId)
+
+	otherActivityId, err := db.AddActivity(ctx, testActivityName, testUserId, "")
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	if err := db.MoveBlocks(editor, testUserId, []int{blockId}, otherActivityId); err != nil {
+		t.Fatalf("could not move block, %v", err)
+	}
+	if _, err := db.UpdatePause(editor, block.Pauses[0].Id, 0, testRevisionPauseStart, testRevisionEndTime); err != nil {
+		t.Fatalf("could not update pause, %v", err)
+	}
+	revisions, err = db.GetBlockRevisions(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get revisions, %v", err)
+	}
+	assert.Equal(t, 7, len(revisions))
+	assert.Equal(t, otherActivityId, revisions[5].ActivityId)
+	assert.Equal(t, testRevisionEndTime, revisions[6].Pauses[0].EndTime)
+	assert.Equal(t, testUserId, revisions[6].UserId)
+	_, err = db.GetBlockRevision(ctx, blockId, 9)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestVersions(t *testing.T) {
+	activityId, err := db.AddActivity(ctx, testActivityName, testUserId, "")
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	version, err := db.UpdateActivity(ctx, activityId, 1, testActivityNameUpdated)
+	if err != nil {
+		t.Fatalf("could not update activity, %v", err)
+	}
+	assert.Equal(t, 2, version)
+	_, err = db.UpdateActivity(ctx, activityId, 1, testActivityName)
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	activity, err := db.GetActivity(ctx, activityId)
+	if err != nil {
+		t.Fatalf("could not get activity, %v", err)
+	}
+	assert.Equal(t, testActivityNameUpdated, activity.Name)
+	assert.Equal(t, 2, activity.Version)
+
+	blockId, err := db.AddBlock(ctx, testUserId, testVersionStartTime, testVersionEndTime, activityId, "")
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	pauseId, err := db.AddPause(ctx, testVersionPauseStart, testVersionPauseEnd, blockId, "")
+	if err != nil {
+		t.Fatalf("could not add pause, %v", err)
+	}
+	block, err := db.GetBlock(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, 2, block.Version)
+
+	version, err = db.UpdatePause(ctx, pauseId, 1, testVersionPauseStart, testVersionEndTime)
+	if err != nil {
+		t.Fatalf("could not update pause, %v", err)
+	}
+	assert.Equal(t, 2, version)
+	_, err = db.UpdatePause(ctx, pauseId, 1, testVersionPauseStart, testVersionPauseEnd)
+	assert.ErrorIs(t, err, ErrVersionConflict)
+
+	block.Note = testBlockNote
+	block.Pauses = nil
+	_, err = db.ReplaceBlock(ctx, block, block.Version, time.Now())
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	block, err = db.GetBlock(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	pause := block.Pauses[0]
+	block.Note = testBlockNote
+	block.Pauses[0].Id = 0
+	block.Pauses[0].EndTime = testVersionPauseEnd
+	version, err = db.ReplaceBlock(ctx, block, block.Version, time.Now())
+	if err != nil {
+		t.Fatalf("could not replace block, %v", err)
+	}
+	assert.Greater(t, version, block.Version)
+	block, err = db.GetBlock(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, version, block.Version)
+	assert.Equal(t, testBlockNote, block.Note)
+	assert.Equal(t, 1, len(block.Pauses))
+	assert.Equal(t, pause.Id, block.Pauses[0].Id)
+	assert.Equal(t, pause.Uuid, block.Pauses[0].Uuid)
+	assert.Equal(t, testVersionPauseEnd, block.Pauses[0].EndTime)
+
+	block.Pauses = nil
+	if _, err := db.ReplaceBlock(ctx, block, block.Version, time.Now()); err != nil {
+		t.Fatalf("could not replace block, %v", err)
+	}
+	block, err = db.GetBlock(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, 0, len(block.Pauses))
+}
+
+// addTestWorkspace adds a workspace of the test user with an activity and the
+// member of the other tests as a member.
+func addTestWorkspace(t *testing.T) (workspaceId int, activityId int, memberId int) {
+	now := time.Now()
+	member, err := db.GetUserByLogin(ctx, testMemberEmail, testUserPassword)
+	if err != nil {
+		t.Fatalf("could not get member, %v", err)
+	}
+	workspaceId, err = db.AddWorkspace(ctx, testUserId, testWorkspaceName, now)
+	if err != nil {
+		t.Fatalf("could not add workspace, %v", err)
+	}
+	invitation, err := db.AddInvitation(ctx, testUserId, workspaceId, testMemberEmail, RoleMember, now)
+	if err != nil {
+		t.Fatalf("could not add invitation, %v", err)
+	}
+	if _, err := db.AcceptInvitation(ctx, member.Id, invitation.Token, now); err != nil {
+		t.Fatalf("could not accept invitation, %v", err)
+	}
+	activityId, err = db.AddWorkspaceActivity(ctx, testUserId, workspaceId, testWorkspaceActivity, "")
+	if err != nil {
+		t.Fatalf("could not add workspace activity, %v", err)
+	}
+	return workspaceId, activityId, member.Id
+}
+
+func TestSync(t *testing.T) {
+	start, err := db.GetChanges(ctx, testUserId, "")
+	if err != nil {
+		t.Fatalf("could not get changes, %v", err)
+	}
+	for start.HasMore {
+		if start, err = db.GetChanges(ctx, testUserId, start.Cursor); err != nil {
+			t.Fatalf("could not get changes, %v", err)
+		}
+	}
+
+	mutations := []schemas.SyncMutation{
+		{Entity: "activity", Action: MutationCreate, ClientId: testSyncActivityId, Name: testActivityName},
+		{Entity: "block", Action: MutationCreate, ClientId: testSyncBlockId, ActivityClientId: testSyncActivityId, StartTime: testSyncStartTime, EndTime: testSyncEndTime},
+		{Entity: "pause", Action: MutationCreate, ClientId: testSyncPauseId, BlockClientId: testSyncBlockId, StartTime: testSyncPauseStart, EndTime: testSyncPauseEnd},
+		{Entity: "activity", Action: MutationUpdate, ClientId: testSyncActivityId, Version: 9, Name: testActivityNameUpdated},
+		{Entity: "block", Action: MutationCreate, ClientId: "not a uuid"},
+	}
+	results, err := db.ApplyMutations(ctx, testUserId, mutations)
+	if err != nil {
+		t.Fatalf("could not apply mutations, %v", err)
+	}
+	assert.Equal(t, 5, len(results))
+	for _, result := range results[:3] {
+		assert.Equal(t, SyncApplied, result.Status)
+	}
+	assert.Equal(t, SyncConflict, results[3].Status)
+	assert.Equal(t, testActivityName, results[3].Current.Activity.Name)
+	assert.Equal(t, SyncRejected, results[4].Status)
+
+	replayed, err := db.ApplyMutations(ctx, testUserId, mutations[:1])
+	if err != nil {
+		t.Fatalf("could not apply mutations, %v", err)
+	}
+	assert.Equal(t, results[0].Id, replayed[0].Id)
+
+	changes, err := db.GetChanges(ctx, testUserId, start.Cursor)
+	if err != nil {
+		t.Fatalf("could not get changes, %v", err)
+	}
+	assert.Equal(t, 3, len(changes.Changes))
+	assert.Equal(t, ChangeCreated, changes.Changes[0].Action)
+	assert.Equal(t, testSyncActivityId, changes.Changes[0].ClientId)
+	assert.Equal(t, testSyncBlockId, changes.Changes[1].ClientId)
+	assert.Equal(t, testSyncEndTime, changes.Changes[1].Block.EndTime)
+
+	block, err := db.GetBlock(ctx, results[1].Id)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	results, err = db.ApplyMutations(ctx, testUserId, []schemas.SyncMutation{
+		{Entity: "block", Action: MutationDelete, ClientId: testSyncBlockId, Version: block.Version},
+	})
+	if err != nil {
+		t.Fatalf("could not apply mutations, %v", err)
+	}
+	assert.Equal(t, SyncApplied, results[0].Status)
+
+	changes, err = db.GetChanges(ctx, testUserId, changes.Cursor)
+	if err != nil {
+		t.Fatalf("could not get changes, %v", err)
+	}
+	assert.Equal(t, 2, len(changes.Changes))
+	for _, change := range changes.Changes {
+		assert.Equal(t, ChangeDeleted, change.Action)
+	}
+	_, err = db.GetChanges(ctx, testUserId, "yesterday")
+	assert.ErrorIs(t, err, ErrInvalidSyncToken)
+
+	// Deleting a workspace activity removes the blocks of all members, so
+	// only owners and admins may rename or delete it.
+	workspaceId, activityId, memberId := addTestWorkspace(t)
+	activity, err := db.GetActivity(ctx, activityId)
+	if err != nil {
+		t.Fatalf("could not get activity, %v", err)
+	}
+	results, err = db.ApplyMutations(ctx, memberId, []schemas.SyncMutation{
+		{Entity: "activity", Action: MutationDelete, Id: activityId, Version: activity.Version},
+		{Entity: "activity", Action: MutationUpdate, Id: activityId, Version: activity.Version, Name: testActivityNameUpdated},
+	})
+	if err != nil {
+		t.Fatalf("could not apply mutations, %v", err)
+	}
+	for _, result := range results {
+		assert.Equal(t, SyncRejected, result.Status)
+		assert.Equal(t, ErrRoleNotAllowed.Error(), result.Error)
+	}
+	results, err = db.ApplyMutations(ctx, testUserId, []schemas.SyncMutation{
+		{Entity: "activity", Action: MutationDelete, Id: activityId, Version: activity.Version},
+	})
+	if err != nil {
+		t.Fatalf("could not apply mutations, %v", err)
+	}
+	assert.Equal(t, SyncApplied, results[0].Status)
+	if err := db.DeleteWorkspace(ctx, testUserId, workspaceId); err != nil {
+		t.Fatalf("could not delete workspace, %v", err)
+	}
+}
+
+// TestSyncOverlappingTransactions makes sure a change committed after a
+// cursor has passed the entries written after it is still returned.
+func TestSyncOverlappingTransactions(t *testing.T) {
+	start, err := db.GetChanges(ctx, testUserId, "")
+	if err != nil {
+		t.Fatalf("could not get changes, %v", err)
+	}
+	for start.HasMore {
+		if start, err = db.GetChanges(ctx, testUserId, start.Cursor); err != nil {
+			t.Fatalf("could not get changes, %v", err)
+		}
+	}
+
+	// The second transaction takes its id first, but writes to the log after
+	// the first one and commits before it.
+	second, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("could not begin transaction, %v", err)
+	}
+	defer second.Rollback()
+	if _, err := second.ExecContext(ctx, "SELECT txid_current()"); err != nil {
+		t.Fatalf("could not assign transaction id, %v", err)
+	}
+	first, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("could not begin transaction, %v", err)
+	}
+	defer first.Rollback()
+	insert := "INSERT INTO activities (name, user_id) VALUES ($1, $2) RETURNING id"
+	var firstId, secondId int
+	if err := first.QueryRowContext(ctx, insert, testActivityName, testUserId).Scan(&firstId); err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	if err := second.QueryRowContext(ctx, insert, testOtherActivityName, testUserId).Scan(&secondId); err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	if err := second.Commit(); err != nil {
+		t.Fatalf("could not commit, %v", err)
+	}
+
+	changes, err := db.GetChanges(ctx, testUserId, start.Cursor)
+	if err != nil {
+		t.Fatalf("could not get changes, %v", err)
+	}
+	assert.Equal(t, 1, len(changes.Changes))
+	assert.Equal(t, secondId, changes.Changes[0].Id)
+
+	if err := first.Commit(); err != nil {
+		t.Fatalf("could not commit, %v", err)
+	}
+	changes, err = db.GetChanges(ctx, testUserId, changes.Cursor)
+	if err != nil {
+		t.Fatalf("could not get changes, %v", err)
+	}
+	assert.Equal(t, 1, len(changes.Changes))
+	assert.Equal(t, firstId, changes.Changes[0].Id)
+}
+
+func TestBatch(t *testing.T) {
+	operation := func(entity string, action string, ref string) schemas.BatchOperation {
+		return schemas.BatchOperation{SyncMutation: schemas.SyncMutation{Entity: entity, Action: action}, Ref: ref}
+	}
+	activity := operation("activity", MutationCreate, "activity")
+	activity.Name = testActivityName
+	block := operation("block", MutationCreate, "block")
+	block.ActivityRef = "activity"
+	block.StartTime = testBatchStartTime
+	block.EndTime = testBatchEndTime
+	pause := operation("pause", MutationCreate, "")
+	pause.BlockRef = "block"
+	pause.StartTime = testBatchPauseStart
+	pause.EndTime = testBatchPauseEnd
+	rename := operation("activity", MutationUpdate, "activity")
+	rename.Name = testActivityNameUpdated
+
+	response, err := db.ApplyBatch(ctx, testUserId, []schemas.BatchOperation{activity, block, pause, rename}, true)
+	if err != nil {
+		t.Fatalf("could not apply batch, %v", err)
+	}
+	assert.True(t, response.Committed)
+	for _, result := range response.Results {
+		assert.Equal(t, SyncApplied, result.Status, result.Error)
+	}
+	created, err := db.GetBlock(ctx, response.Results[1].Id)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, response.Results[0].Id, created.ActivityId)
+	assert.Equal(t, 1, len(created.Pauses))
+
+	orphan := operation("pause", MutationCreate, "")
+	orphan.BlockRef = "missing"
+	response, err = db.ApplyBatch(ctx, testUserId, []schemas.BatchOperation{activity, orphan, block}, true)
+	if err != nil {
+		t.Fatalf("could not apply batch, %v", err)
+	}
+	assert.False(t, response.Committed)
+	assert.Equal(t, BatchRolledBack, response.Results[0].Status)
+	assert.Equal(t, SyncRejected, response.Results[1].Status)
+	assert.Equal(t, ErrUnknownRef.Error(), response.Results[1].Error)
+	assert.Equal(t, BatchSkipped, response.Results[2].Status)
+	assert.Equal(t, 0, response.Results[0].Id)
+
+	response, err = db.ApplyBatch(ctx, testUserId, []schemas.BatchOperation{activity, orphan, block}, false)
+	if err != nil {
+		t.Fatalf("could not apply batch, %v", err)
+	}
+	assert.True(t, response.Committed)
+	assert.Equal(t, SyncApplied, response.Results[0].Status)
+	assert.Equal(t, SyncRejected, response.Results[1].Status)
+	assert.Equal(t, SyncApplied, response.Results[2].Status)
+
+	workspaceId, activityId, memberId := addTestWorkspace(t)
+	remove := operation("activity", MutationDelete, "")
+	remove.Id = activityId
+	response, err = db.ApplyBatch(ctx, memberId, []schemas.BatchOperation{remove}, true)
+	if err != nil {
+		t.Fatalf("could not apply batch, %v", err)
+	}
+	assert.False(t, response.Committed)
+	assert.Equal(t, SyncRejected, response.Results[0].Status)
+	assert.Equal(t, ErrRoleNotAllowed.Error(), response.Results[0].Error)
+	if _, err := db.GetActivity(ctx, activityId); err != nil {
+		t.Fatalf("could not get activity, %v", err)
+	}
+	response, err = db.ApplyBatch(ctx, testUserId, []schemas.BatchOperation{remove}, true)
+	if err != nil {
+		t.Fatalf("could not apply batch, %v", err)
+	}
+	assert.True(t, response.Committed)
+	assert.Equal(t, SyncApplied, response.Results[0].Status, response.Results[0].Error)
+	if err := db.DeleteWorkspace(ctx, testUserId, workspaceId); err != nil {
+		t.Fatalf("could not delete workspace, %v", err)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	now := time.Now()
+	const key, route = "retry-1", "/block"
+	recorded, err := db.ReserveIdempotencyKey(ctx, key, route, testUserId, "hash", now, time.Hour)
+	if err != nil {
+		t.Fatalf("could not reserve key, %v", err)
+	}
+	assert.Nil(t, recorded)
+	_, err = db.ReserveIdempotencyKey(ctx, key, route, testUserId, "hash", now, time.Hour)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyInUse)
+	// A reservation outliving its lease has been lost and is claimed anew.
+	recorded, err = db.ReserveIdempotencyKey(ctx, key, route, testUserId, "hash", now.Add(2*time.Minute), time.Hour)
+	if err != nil {
+		t.Fatalf("could not reserve abandoned key, %v", err)
+	}
+	assert.Nil(t, recorded)
+
+	response := IdempotentResponse{Status: 200, ContentType: "application/json", Body: []byte(`{"id":1}`)}
+	if err := db.SaveIdempotentResponse(ctx, key, route, testUserId, response); err != nil {
+		t.Fatalf("could not save response, %v", err)
+	}
+	recorded, err = db.ReserveIdempotencyKey(ctx, key, route, testUserId, "hash", now, time.Hour)
+	if err != nil {
+		t.Fatalf("could not reserve key, %v", err)
+	}
+	assert.Equal(t, response, *recorded)
+	_, err = db.ReserveIdempotencyKey(ctx, key, route, testUserId, "other hash", now, time.Hour)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+	recorded, err = db.ReserveIdempotencyKey(ctx, key, route, testUserId+1, "hash", now, time.Hour)
+	if err != nil {
+		t.Fatalf("could not reserve key of another user, %v", err)
+	}
+	assert.Nil(t, recorded)
+
+	recorded, err = db.ReserveIdempotencyKey(ctx, key, route, testUserId, "other hash", now.Add(2*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatalf("could not reserve expired key, %v", err)
+	}
+	assert.Nil(t, recorded)
+	if err := db.ReleaseIdempotencyKey(ctx, key, route, testUserId); err != nil {
+		t.Fatalf("could not release key, %v", err)
+	}
+	deleted, err := db.DeleteIdempotencyKeys(ctx, now.Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("could not delete keys, %v", err)
+	}
+	assert.Equal(t, 1, deleted)
+}
+
+func TestUuids(t *testing.T) {
+	activityId, err := db.AddActivity(ctx, testActivityName, testUserId, testUuidActivity)
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	blockId, err := db.AddBlock(ctx, testUserId, testUuidStartTime, testUuidEndTime, activityId, testUuidBlock)
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	pauseId, err := db.AddPause(ctx, testUuidStartTime, testUuidEndTime, blockId, "")
+	if err != nil {
+		t.Fatalf("could not add pause, %v", err)
+	}
+
+	activity, err := db.GetActivity(ctx, activityId)
+	if err != nil {
+		t.Fatalf("could not get activity, %v", err)
+	}
+	assert.Equal(t, testUuidActivity, activity.Uuid)
+	block, err := db.GetBlock(ctx, blockId)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, testUuidBlock, block.Uuid)
+	assert.Equal(t, 1, len(block.Pauses))
+	assert.True(t, IsUuid(block.Pauses[0].Uuid))
+
+	id, err := db.ResolveUuid(ctx, "block", testUuidBlock)
+	if err != nil {
+		t.Fatalf("could not resolve uuid, %v", err)
+	}
+	assert.Equal(t, blockId, id)
+	id, err = db.ResolveUuid(ctx, "pause", block.Pauses[0].Uuid)
+	if err != nil {
+		t.Fatalf("could not resolve uuid, %v", err)
+	}
+	assert.Equal(t, pauseId, id)
+	_, err = db.ResolveUuid(ctx, "activity", testUuidBlock)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	_, err = db.AddActivity(ctx, testActivityName, testUserId, testUuidActivity)
+	assert.ErrorIs(t, err, ErrUuidTaken)
+	_, err = db.AddActivity(ctx, testActivityName, testUserId, "not a uuid")
+	assert.ErrorIs(t, err, ErrInvalidUuid)
+}
+
 func TestDeleteByTableAndId(t *testing.T) {
-	if err := db.DeleteByTableAndId("pauses", testPauseId); err != nil {
+	if err := db.DeleteByTableAndId(ctx, "pauses", testPauseId); err != nil {
 		t.Fatalf("could not delete pause, %v", err)
 	}
-	_, err := db.GetPause(testPauseId)
+	_, err := db.GetPause(ctx, testPauseId)
 	assert.NotEqual(t, nil, err)
-	if err := db.DeleteByTableAndId("blocks", testBlockId); err != nil {
+	if err := db.DeleteByTableAndId(ctx, "blocks", testBlockId); err != nil {
 		t.Fatalf("could not delete block, %v", err)
 	}
-	_, err = db.GetBlock(testBlockId)
+	_, err = db.GetBlock(ctx, testBlockId)
 	assert.NotEqual(t, nil, err)
-	if err := db.DeleteByTableAndId("activities", testActivityId); err != nil {
+	if err := db.DeleteByTableAndId(ctx, "activities", testActivityId); err != nil {
 		t.Fatalf("could not delete activity, %v", err)
 	}
-	_, err = db.GetActivity(testActivityId)
+	_, err = db.GetActivity(ctx, testActivityId)
 	assert.NotEqual(t, nil, err)
-	if err := db.DeleteByTableAndId("users", testUserId); err != nil {
+	if err := db.DeleteByTableAndId(ctx, "users", testUserId); err != nil {
 		t.Fatalf("could not delete user, %v", err)
 	}
-	_, err = db.GetUser(testUserId)
+	_, err = db.GetUser(ctx, testUserId)
 	assert.NotEqual(t, nil, err)
 }
 
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrIdempotencyKeyReused = errors.New("idempotency key has been used with another request")
+	ErrIdempotencyKeyInUse  = errors.New("request with the idempotency key is still in progress")
+)
+
+// scopeIdempotencyKeys adds the user to the primary key of the idempotency
+// keys, which used to be shared by all users.
+const scopeIdempotencyKeys = `
+DO $$
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.key_column_usage
+		WHERE table_name = 'idempotency_keys' AND constraint_name = 'idempotency_keys_pkey' AND column_name = 'user_id'
+	) THEN
+		ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+		ALTER TABLE idempotency_keys ADD PRIMARY KEY (key, route, user_id);
+	END IF;
+END $$`
+
+// reservationLease is how long a request may hold its idempotency key without
+// a response. A key still in progress after the lease is claimed anew, as the
+// request holding it has been lost, e.g. with a crashed server.
+const reservationLease = time.Minute
+
+// IdempotentResponse is the response recorded for an idempotency key, which
+// is returned again when the request is repeated.
+type IdempotentResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// ReserveIdempotencyKey claims the key of the user for a request to the
+// route, identified by the hash of the request. Keys of different users never
+// collide. A nil response means the key is new and the request has to be
+// handled, its response is then saved with SaveIdempotentResponse. For a
+// repeated request the recorded response is returned instead. Keys older than
+// the retention are claimed anew, just like reservations without a response
+// older than reservationLease.
+func (db *Database) ReserveIdempotencyKey(ctx context.Context, key string, route string, userId int, hash string, now time.Time, retention time.Duration) (_ *IdempotentResponse, err error) {
+	defer db.observe(ctx, "ReserveIdempotencyKey", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE key = $1 AND route = $2 AND user_id = $3 AND (created_at < $4 OR (status IS NULL AND created_at < $5))`,
+		key,
+		route,
+		userId,
+		now.Add(-retention).UTC(),
+		now.Add(-reservationLease).UTC())
+	if err != nil {
+		return nil, err
+	}
+	row := tx.QueryRowContext(ctx, `
+		INSERT INTO idempotency_keys (key, route, user_id, request_hash, created_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (key, route, user_id) DO NOTHING RETURNING key`,
+		key,
+		route,
+		userId,
+		hash,
+		now.UTC())
+	var inserted string
+	err = row.Scan(&inserted)
+	if err == nil {
+		return nil, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var storedHash string
+	var status sql.NullInt64
+	var contentType sql.NullString
+	var response IdempotentResponse
+	row = tx.QueryRowContext(ctx,
+		"SELECT request_hash, status, content_type, response FROM idempotency_keys WHERE key = $1 AND route = $2 AND user_id = $3",
+		key,
+		route,
+		userId)
+	if err := row.Scan(&storedHash, &status, &contentType, &response.Body); err != nil {
+		return nil, err
+	}
+	if storedHash != hash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if !status.Valid {
+		return nil, ErrIdempotencyKeyInUse
+	}
+	response.Status = int(status.Int64)
+	response.ContentType = contentType.String
+	return &response, nil
+}
+
+// SaveIdempotentResponse records the response of the request the key has been
+// reserved for.
+func (db *Database) SaveIdempotentResponse(ctx context.Context, key string, route string, userId int, response IdempotentResponse) (err error) {
+	defer db.observe(ctx, "SaveIdempotentResponse", time.Now(), &err)
+	_, err = db.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status = $1, content_type = $2, response = $3 WHERE key = $4 AND route = $5 AND user_id = $6",
+		response.Status,
+		response.ContentType,
+		response.Body,
+		key,
+		route,
+		userId)
+	return err
+}
+
+// ReleaseIdempotencyKey gives up a reserved key without a response, so that
+// the request can be retried after a failure.
+func (db *Database) ReleaseIdempotencyKey(ctx context.Context, key string, route string, userId int) (err error) {
+	defer db.observe(ctx, "ReleaseIdempotencyKey", time.Now(), &err)
+	_, err = db.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE key = $1 AND route = $2 AND user_id = $3 AND status IS NULL",
+		key,
+		route,
+		userId)
+	return err
+}
+
+// DeleteIdempotencyKeys removes the keys created before the given time and
+// returns how many there were.
+func (db *Database) DeleteIdempotencyKeys(ctx context.Context, before time.Time) (_ int, err error) {
+	defer db.observe(ctx, "DeleteIdempotencyKeys", time.Now(), &err)
+	result, err := db.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < $1", before.UTC())
+	if err != nil {
+		return -1, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
@@ -0,0 +1,261 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/kilianmandscharo/activities/logging"
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+var (
+	ErrPeriodLocked       = errors.New("blocks before the lock date cannot be changed")
+	ErrInvalidLockDate    = errors.New("lock date is not a valid date")
+	ErrLockOverrideDenied = errors.New("user may not override the lock date")
+)
+
+type lockOverrideKey struct{}
+
+// WithLockOverride returns a context whose changes may ignore the lock dates
+// administered by the given user. Every lock ignored that way is logged.
+func WithLockOverride(ctx context.Context, userId int) context.Context {
+	return context.WithValue(ctx, lockOverrideKey{}, userId)
+}
+
+func lockOverride(ctx context.Context) (int, bool) {
+	userId, ok := ctx.Value(lockOverrideKey{}).(int)
+	return userId, ok && userId != 0
+}
+
+const lockDateColumns = "l.id, coalesce(l.user_id, 0), coalesce(l.workspace_id, 0), to_char(l.lock_date, 'YYYY-MM-DD'), coalesce(l.set_by, 0), l.updated_at"
+
+// GetLockDates returns the lock dates applying to the blocks of the user:
+// their own and those of the workspaces they are a member of.
+func (db *Database) GetLockDates(ctx context.Context, userId int) (_ []schemas.LockDate, err error) {
+	defer db.observe(ctx, "GetLockDates", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT `+lockDateColumns+` FROM lock_dates l
+		WHERE l.user_id = $1 OR l.workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = $1)
+		ORDER BY l.id`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locks []schemas.LockDate
+	for rows.Next() {
+		lock, err := scanLockDate(rows)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, rows.Err()
+}
+
+// SetUserLockDate locks the blocks of the user starting before the date.
+// The lock is administered by the timesheet reviewers of the user.
+func (db *Database) SetUserLockDate(ctx context.Context, actorId int, userId int, date string, now time.Time) (err error) {
+	defer db.observe(ctx, "SetUserLockDate", time.Now(), &err)
+	return db.setLockDate(ctx, actorId, userId, 0, date, now)
+}
+
+// SetWorkspaceLockDate locks the blocks of the workspace activities starting
+// before the date. Only owners and admins of the workspace may set it.
+func (db *Database) SetWorkspaceLockDate(ctx context.Context, actorId int, workspaceId int, date string, now time.Time) (err error) {
+	defer db.observe(ctx, "SetWorkspaceLockDate", time.Now(), &err)
+	return db.setLockDate(ctx, actorId, 0, workspaceId, date, now)
+}
+
+// DeleteUserLockDate removes the lock date of the user.
+func (db *Database) DeleteUserLockDate(ctx context.Context, actorId int, userId int) (err error) {
+	defer db.observe(ctx, "DeleteUserLockDate", time.Now(), &err)
+	if err := checkLockAdmin(ctx, db.db, actorId, userId, 0); err != nil {
+		return err
+	}
+	_, err = db.db.ExecContext(ctx, "DELETE FROM lock_dates WHERE user_id = $1", userId)
+	return err
+}
+
+// DeleteWorkspaceLockDate removes the lock date of the workspace.
+func (db *Database) DeleteWorkspaceLockDate(ctx context.Context, actorId int, workspaceId int) (err error) {
+	defer db.observe(ctx, "DeleteWorkspaceLockDate", time.Now(), &err)
+	if err := checkLockAdmin(ctx, db.db, actorId, 0, workspaceId); err != nil {
+		return err
+	}
+	_, err = db.db.ExecContext(ctx, "DELETE FROM lock_dates WHERE workspace_id = $1", workspaceId)
+	return err
+}
+
+func (db *Database) setLockDate(ctx context.Context, actorId int, userId int, workspaceId int, date string, now time.Time) error {
+	if _, err := time.Parse(time.DateOnly, date); err != nil {
+		return ErrInvalidLockDate
+	}
+	if err := checkLockAdmin(ctx, db.db, actorId, userId, workspaceId); err != nil {
+		return err
+	}
+	conflict := "user_id"
+	if workspaceId != 0 {
+		conflict = "workspace_id"
+	}
+	_, err := db.db.ExecContext(ctx, `
+		INSERT INTO lock_dates (lock_date, updated_at, set_by, user_id, workspace_id) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (`+conflict+`) DO UPDATE SET lock_date = excluded.lock_date, updated_at = excluded.updated_at, set_by = excluded.set_by`,
+		date,
+		now.UTC(),
+		actorId,
+		newNullInt(userId),
+		newNullInt(workspaceId))
+	return err
+}
+
+// checkLockAdmin returns an error unless the actor may administer the lock
+// date of the user or of the workspace. The lock date of a user is
+// administered by their reviewers, never by the user themselves.
+func checkLockAdmin(ctx context.Context, q queryRower, actorId int, userId int, workspaceId int) error {
+	if workspaceId != 0 {
+		_, err := requireRole(ctx, q, workspaceId, actorId, RoleOwner, RoleAdmin)
+		return err
+	}
+	reviewer, err := isReviewer(ctx, q, actorId, userId)
+	if err != nil {
+		return err
+	}
+	if !reviewer {
+		return ErrRoleNotAllowed
+	}
+	return nil
+}
+
+// checkUnlocked returns an error when a block of the user and the activity
+// starting at the given time would lie in an approved week or before a lock
+// date.
+func checkUnlocked(ctx context.Context, q querier, userId int, activityId int, at string) error {
+	if at == "" {
+		return nil
+	}
+	row := q.QueryRowContext(ctx, `
+		SELECT count(*) FROM timesheets
+		WHERE user_id = $1 AND status = $2 AND $3::timestamp >= week_start AND $3::timestamp < week_start + interval '7 days'`,
+		userId,
+		TimesheetApproved,
+		at)
+	if err := lockedError(row, ErrTimesheetApproved); err != nil {
+		return err
+	}
+	return checkLockDates(ctx, q, `
+		SELECT `+lockDateColumns+` FROM lock_dates l
+		WHERE (l.user_id = $1 OR l.workspace_id = (SELECT workspace_id FROM activities WHERE id = $2))
+			AND $3::timestamp < l.lock_date`,
+		userId,
+		activityId,
+		at)
+}
+
+// checkBlocksUnlocked returns an error when one of the blocks matched by the
+// condition lies in an approved week of its user or before a lock date.
+func checkBlocksUnlocked(ctx context.Context, q querier, condition string, args ...any) error {
+	row := q.QueryRowContext(ctx, `
+		SELECT count(*) FROM blocks b JOIN timesheets t
+			ON t.user_id = b.user_id AND t.status = 'approved'
+			AND b.start_time >= t.week_start AND b.start_time < t.week_start + interval '7 days'
+		WHERE `+condition,
+		args...)
+	if err := lockedError(row, ErrTimesheetApproved); err != nil {
+		return err
+	}
+	return checkLockDates(ctx, q, `
+		SELECT DISTINCT `+lockDateColumns+` FROM blocks b
+		JOIN activities a ON a.id = b.activity_id
+		JOIN lock_dates l ON (l.user_id = b.user_id OR l.workspace_id = a.workspace_id) AND b.start_time < l.lock_date
+		WHERE `+condition,
+		args...)
+}
+
+// checkLockDates returns ErrPeriodLocked when the query selects a lock date.
+// With an override in the context, the locks are ignored instead if the
+// overriding user administers all of them, and every override is logged.
+func checkLockDates(ctx context.Context, q querier, query string, args ...any) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	var locks []schemas.LockDate
+	for rows.Next() {
+		lock, err := scanLockDate(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		locks = append(locks, lock)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(locks) == 0 {
+		return nil
+	}
+
+	actorId, ok := lockOverride(ctx)
+	if !ok {
+		return ErrPeriodLocked
+	}
+	for _, lock := range locks {
+		err := checkLockAdmin(ctx, q, actorId, lock.UserId, lock.WorkspaceId)
+		if errors.Is(err, ErrNotMember) || errors.Is(err, ErrRoleNotAllowed) {
+			return ErrLockOverrideDenied
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, lock := range locks {
+		row := q.QueryRowContext(ctx,
+			"INSERT INTO lock_overrides (lock_date, request_id, created_at, user_id, lock_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			lock.LockDate,
+			newNullString(logging.RequestId(ctx)),
+			time.Now().UTC(),
+			actorId,
+			lock.Id)
+		var id int
+		if err := row.Scan(&id); err != nil {
+			return err
+		}
+		slog.WarnContext(ctx, "lock date overridden",
+			"user_id", actorId,
+			"lock_id", lock.Id,
+			"lock_date", lock.LockDate,
+			"locked_user_id", lock.UserId,
+			"locked_workspace_id", lock.WorkspaceId)
+	}
+	return nil
+}
+
+// isLocked reports whether the error rejects a change of locked blocks.
+func isLocked(err error) bool {
+	return errors.Is(err, ErrPeriodLocked) || errors.Is(err, ErrTimesheetApproved)
+}
+
+func scanLockDate(row rowScanner) (schemas.LockDate, error) {
+	var lock schemas.LockDate
+	var updatedAt sql.NullString
+	err := row.Scan(&lock.Id, &lock.UserId, &lock.WorkspaceId, &lock.LockDate, &lock.SetBy, &updatedAt)
+	lock.UpdatedAt = updatedAt.String
+	return lock, err
+}
+
+func lockedError(row *sql.Row, locked error) error {
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return locked
+	}
+	return nil
+}
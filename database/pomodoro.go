@@ -0,0 +1,235 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+const (
+	PhaseWork       = "work"
+	PhaseShortBreak = "shortBreak"
+	PhaseLongBreak  = "longBreak"
+)
+
+type pomodoroPhase struct {
+	name  string
+	cycle int
+	start time.Time
+	end   time.Time
+}
+
+// InsertPomodoroPauses adds a pause for every break that has started on a
+// running block of a user with the pomodoro mode enabled and returns the ids
+// of the blocks that received a pause. Breaks that already have a pause are
+// skipped, so the method can be called repeatedly.
+func (db *Database) InsertPomodoroPauses(ctx context.Context, now time.Time) (_ []int, err error) {
+	defer db.observe(ctx, "InsertPomodoroPauses", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT b.id, b.start_time, s.pomodoro_work_minutes, s.pomodoro_short_break_minutes,
+			s.pomodoro_long_break_minutes, s.pomodoro_cycles
+		FROM blocks b
+		JOIN settings s ON s.user_id = b.user_id
+		WHERE b.end_time IS NULL AND s.pomodoro_enabled`)
+	if err != nil {
+		return nil, err
+	}
+	breaks := make(map[int][]pomodoroPhase)
+	for rows.Next() {
+		var (
+			id        int
+			startTime string
+			pomodoro  schemas.Pomodoro
+		)
+		err := rows.Scan(
+			&id,
+			&startTime,
+			&pomodoro.WorkMinutes,
+			&pomodoro.ShortBreakMinutes,
+			&pomodoro.LongBreakMinutes,
+			&pomodoro.Cycles)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		start, err := time.Parse(time.RFC3339Nano, startTime)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		breaks[id] = pomodoroBreaks(start, now, pomodoro)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var blockIds []int
+	for blockId, phases := range breaks {
+		inserted := false
+		err := db.changeBlock(ctx, blockId, func(tx *sql.Tx) error {
+			if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", blockId); err != nil {
+				return err
+			}
+			for _, phase := range phases {
+				result, err := tx.ExecContext(ctx, `
+					INSERT INTO pauses (start_time, end_time, block_id)
+					SELECT $1::timestamp, $2::timestamp, $3
+					WHERE NOT EXISTS (SELECT 1 FROM pauses WHERE block_id = $3 AND start_time = $1::timestamp)`,
+					phase.start.UTC(),
+					phase.end.UTC(),
+					blockId)
+				if err != nil {
+					return err
+				}
+				if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+					inserted = true
+				}
+			}
+			return nil
+		})
+		if isLocked(err) {
+			continue
+		} else if err != nil {
+			return blockIds, err
+		}
+		if inserted {
+			blockIds = append(blockIds, blockId)
+		}
+	}
+	return blockIds, nil
+}
+
+// GetResumedBlocks returns the running blocks with a pause that ended after
+// since and up to now, such as a pomodoro break, and no other pause still
+// going on at now.
+func (db *Database) GetResumedBlocks(ctx context.Context, since time.Time, now time.Time) (_ []int, err error) {
+	defer db.observe(ctx, "GetResumedBlocks", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT DISTINCT b.id
+		FROM blocks b
+		JOIN pauses p ON p.block_id = b.id
+		WHERE b.end_time IS NULL AND p.end_time > $1 AND p.end_time <= $2
+		AND NOT EXISTS (
+			SELECT 1 FROM pauses o
+			WHERE o.block_id = b.id AND o.start_time <= $2 AND (o.end_time IS NULL OR o.end_time > $2)
+		)
+		ORDER BY b.id`,
+		since.UTC(),
+		now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var blockIds []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		blockIds = append(blockIds, id)
+	}
+	return blockIds, rows.Err()
+}
+
+// GetPomodoroState returns the current pomodoro phase of the block, or nil if
+// the block is not running or its user has the pomodoro mode disabled.
+func (db *Database) GetPomodoroState(ctx context.Context, block schemas.Block, now time.Time) (_ *schemas.PomodoroState, err error) {
+	defer db.observe(ctx, "GetPomodoroState", time.Now(), &err)
+	if block.Id == 0 || block.EndTime != "" {
+		return nil, nil
+	}
+	settings, err := db.GetSettings(ctx, block.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.Pomodoro.Enabled {
+		return nil, nil
+	}
+	start, err := time.Parse(time.RFC3339Nano, block.StartTime)
+	if err != nil {
+		return nil, err
+	}
+	phase := pomodoroPhaseAt(start, now, settings.Pomodoro)
+	return &schemas.PomodoroState{
+		Phase:            phase.name,
+		Cycle:            phase.cycle,
+		PhaseEnd:         phase.end.UTC().Format(time.RFC3339),
+		RemainingSeconds: int(phase.end.Sub(now).Seconds()),
+	}, nil
+}
+
+// pomodoroPhaseAt walks the schedule of work and break phases from start and
+// returns the phase containing now. Every cycles-th break is a long one.
+func pomodoroPhaseAt(start time.Time, now time.Time, pomodoro schemas.Pomodoro) pomodoroPhase {
+	pomodoro = pomodoroDefaults(pomodoro)
+	phase := pomodoroPhase{name: PhaseWork, cycle: 1, start: start}
+	for {
+		phase.end = phase.start.Add(pomodoroLength(phase.name, pomodoro))
+		if now.Before(phase.end) {
+			return phase
+		}
+		phase = nextPomodoroPhase(phase, pomodoro)
+	}
+}
+
+// pomodoroBreaks returns all break phases of the schedule starting at start
+// that have begun before now.
+func pomodoroBreaks(start time.Time, now time.Time, pomodoro schemas.Pomodoro) []pomodoroPhase {
+	pomodoro = pomodoroDefaults(pomodoro)
+	var breaks []pomodoroPhase
+	phase := pomodoroPhase{name: PhaseWork, cycle: 1, start: start}
+	for phase.start.Before(now) {
+		phase.end = phase.start.Add(pomodoroLength(phase.name, pomodoro))
+		if phase.name != PhaseWork {
+			breaks = append(breaks, phase)
+		}
+		phase = nextPomodoroPhase(phase, pomodoro)
+	}
+	return breaks
+}
+
+func nextPomodoroPhase(phase pomodoroPhase, pomodoro schemas.Pomodoro) pomodoroPhase {
+	next := pomodoroPhase{start: phase.end, cycle: phase.cycle}
+	switch {
+	case phase.name != PhaseWork:
+		next.name = PhaseWork
+		next.cycle++
+	case phase.cycle%pomodoro.Cycles == 0:
+		next.name = PhaseLongBreak
+	default:
+		next.name = PhaseShortBreak
+	}
+	return next
+}
+
+func pomodoroLength(name string, pomodoro schemas.Pomodoro) time.Duration {
+	switch name {
+	case PhaseShortBreak:
+		return time.Duration(pomodoro.ShortBreakMinutes) * time.Minute
+	case PhaseLongBreak:
+		return time.Duration(pomodoro.LongBreakMinutes) * time.Minute
+	default:
+		return time.Duration(pomodoro.WorkMinutes) * time.Minute
+	}
+}
+
+// pomodoroDefaults fills in the classic 25/5/15 minute schedule with a long
+// break after four cycles for every value that is not set.
+func pomodoroDefaults(pomodoro schemas.Pomodoro) schemas.Pomodoro {
+	if pomodoro.WorkMinutes <= 0 {
+		pomodoro.WorkMinutes = 25
+	}
+	if pomodoro.ShortBreakMinutes <= 0 {
+		pomodoro.ShortBreakMinutes = 5
+	}
+	if pomodoro.LongBreakMinutes <= 0 {
+		pomodoro.LongBreakMinutes = 15
+	}
+	if pomodoro.Cycles <= 0 {
+		pomodoro.Cycles = 4
+	}
+	return pomodoro
+}
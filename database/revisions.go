@@ -0,0 +1,325 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+	"github.com/lib/pq"
+)
+
+// SaveBlockRevision records the current state of the block, including its
+// tags and pauses, as a new revision and returns its number. If the block has
+// not changed since the latest revision, that revision is returned instead.
+func (db *Database) SaveBlockRevision(ctx context.Context, blockId int, now time.Time) (_ int, err error) {
+	defer db.observe(ctx, "SaveBlockRevision", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	revision, err := saveBlockRevision(ctx, tx, blockId, now)
+	if err != nil {
+		return -1, err
+	}
+	return revision, tx.Commit()
+}
+
+// GetBlockRevisions returns all revisions of the block, oldest first.
+func (db *Database) GetBlockRevisions(ctx context.Context, blockId int) (_ []schemas.BlockRevision, err error) {
+	defer db.observe(ctx, "GetBlockRevisions", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+revisionColumns+" FROM block_revisions WHERE block_id = $1 ORDER BY revision",
+		blockId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []schemas.BlockRevision
+	for rows.Next() {
+		revision, err := scanBlockRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+func (db *Database) GetBlockRevision(ctx context.Context, blockId int, revision int) (_ schemas.BlockRevision, err error) {
+	defer db.observe(ctx, "GetBlockRevision", time.Now(), &err)
+	return getBlockRevision(ctx, db.db, blockId, revision)
+}
+
+// DiffBlockRevisions lists the fields that differ between two revisions of
+// the block.
+func (db *Database) DiffBlockRevisions(ctx context.Context, blockId int, from int, to int) (_ schemas.BlockDiff, err error) {
+	defer db.observe(ctx, "DiffBlockRevisions", time.Now(), &err)
+	diff := schemas.BlockDiff{BlockId: blockId, From: from, To: to, Changes: []schemas.FieldChange{}}
+	before, err := getBlockRevision(ctx, db.db, blockId, from)
+	if err != nil {
+		return diff, err
+	}
+	after, err := getBlockRevision(ctx, db.db, blockId, to)
+	if err != nil {
+		return diff, err
+	}
+	fields := []struct {
+		name          string
+		before, after any
+	}{
+		{"startTime", before.StartTime, after.StartTime},
+		{"endTime", before.EndTime, after.EndTime},
+		{"activityId", before.ActivityId, after.ActivityId},
+		{"note", before.Note, after.Note},
+		{"tags", before.Tags, after.Tags},
+		{"pauses", before.Pauses, after.Pauses},
+	}
+	for _, field := range fields {
+		if !reflect.DeepEqual(field.before, field.after) {
+			diff.Changes = append(diff.Changes, schemas.FieldChange{Field: field.name, Before: field.before, After: field.after})
+		}
+	}
+	return diff, nil
+}
+
+// RevertBlock restores the times, activity, note, tags and pauses of the
+// block to those of an earlier revision. The restored state is recorded as a
+// new revision, whose number is returned. Locks and activity access are
+// checked like for any other change of the block.
+func (db *Database) RevertBlock(ctx context.Context, blockId int, revision int, now time.Time) (_ int, err error) {
+	defer db.observe(ctx, "RevertBlock", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	if err := saveBaseRevision(ctx, tx, blockId, now); err != nil {
+		return -1, err
+	}
+	target, err := getBlockRevision(ctx, tx, blockId, revision)
+	if err != nil {
+		return -1, err
+	}
+	var userId int
+	if err := tx.QueryRowContext(ctx, "SELECT coalesce(user_id, 0) FROM blocks WHERE id = $1", blockId).Scan(&userId); err != nil {
+		return -1, err
+	}
+	if err := checkActivityAccess(ctx, tx, userId, target.ActivityId); err != nil {
+		return -1, err
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", blockId); err != nil {
+		return -1, err
+	}
+	if err := checkUnlocked(ctx, tx, userId, target.ActivityId, target.StartTime); err != nil {
+		return -1, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE blocks SET start_time = $1, end_time = $2, activity_id = $3, note = $4, auto_stopped = false WHERE id = $5",
+		target.StartTime,
+		newNullString(target.EndTime),
+		target.ActivityId,
+		newNullString(target.Note),
+		blockId)
+	if err != nil {
+		return -1, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE block_id = $1", blockId); err != nil {
+		return -1, err
+	}
+	for _, tag := range target.Tags {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tags (name, block_id) VALUES ($1, $2)", tag, blockId); err != nil {
+			return -1, err
+		}
+	}
+	pauses := make([]schemas.Pause, len(target.Pauses))
+	for i, pause := range target.Pauses {
+		pauses[i] = schemas.Pause{Uuid: pause.Uuid, StartTime: pause.StartTime, EndTime: pause.EndTime}
+	}
+	if err := replacePauses(ctx, tx, blockId, pauses); err != nil {
+		return -1, err
+	}
+
+	reverted, err := saveBlockRevision(ctx, tx, blockId, now)
+	if err != nil {
+		return -1, err
+	}
+	return reverted, tx.Commit()
+}
+
+// saveBlockRevision records the state of the block after a change made in the
+// transaction as a new revision, attributed to the actor of the context, and
+// returns its number. If the change left the block as it was, the latest
+// revision is returned instead.
+func saveBlockRevision(ctx context.Context, tx *sql.Tx, blockId int, now time.Time) (int, error) {
+	return recordBlockRevision(ctx, tx, blockId, actorId(ctx), now)
+}
+
+// saveBaseRevision records the state of the block before a change made in
+// the transaction, unless the latest revision has it already. Since every
+// change saves a revision, that is only the case for blocks last changed
+// before revisions were kept. Who made that change is not known, so the
+// revision is attributed to no one.
+func saveBaseRevision(ctx context.Context, tx *sql.Tx, blockId int, now time.Time) error {
+	_, err := recordBlockRevision(ctx, tx, blockId, 0, now)
+	return err
+}
+
+// changeBlock runs a change of the block in a transaction of its own, which
+// records revisions of the block before and after the change.
+func (db *Database) changeBlock(ctx context.Context, blockId int, change func(tx *sql.Tx) error) error {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if err := saveBaseRevision(ctx, tx, blockId, now); err != nil {
+		return err
+	}
+	if err := change(tx); err != nil {
+		return err
+	}
+	if _, err := saveBlockRevision(ctx, tx, blockId, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func recordBlockRevision(ctx context.Context, tx *sql.Tx, blockId int, userId int, now time.Time) (int, error) {
+	current, err := blockSnapshot(ctx, tx, blockId)
+	if err != nil {
+		return -1, err
+	}
+	latest, err := getBlockRevision(ctx, tx, blockId, 0)
+	if err != nil && err != sql.ErrNoRows {
+		return -1, err
+	}
+	if err == nil && sameBlockState(latest, current) {
+		return latest.Revision, nil
+	}
+	pauses, err := json.Marshal(current.Pauses)
+	if err != nil {
+		return -1, err
+	}
+	row := tx.QueryRowContext(ctx, `
+		INSERT INTO block_revisions (revision, start_time, end_time, activity_id, note, tags, pauses, created_at, user_id, block_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING revision`,
+		latest.Revision+1,
+		current.StartTime,
+		newNullString(current.EndTime),
+		current.ActivityId,
+		newNullString(current.Note),
+		pq.Array(current.Tags),
+		pauses,
+		now.UTC(),
+		newNullInt(userId),
+		blockId)
+	var revision int
+	if err := row.Scan(&revision); err != nil {
+		return -1, err
+	}
+	return revision, nil
+}
+
+// blockSnapshot reads the current state of the block in the form of a
+// revision. The block is locked until the transaction ends.
+func blockSnapshot(ctx context.Context, tx *sql.Tx, blockId int) (schemas.BlockRevision, error) {
+	snapshot := schemas.BlockRevision{BlockId: blockId, Tags: []string{}, Pauses: []schemas.RevisionPause{}}
+	var endTime sql.NullString
+	row := tx.QueryRowContext(ctx,
+		"SELECT start_time, end_time, activity_id, coalesce(note, '') FROM blocks WHERE id = $1 FOR UPDATE",
+		blockId)
+	if err := row.Scan(&snapshot.StartTime, &endTime, &snapshot.ActivityId, &snapshot.Note); err != nil {
+		return snapshot, err
+	}
+	snapshot.EndTime = endTime.String
+
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM tags WHERE block_id = $1 ORDER BY id", blockId)
+	if err != nil {
+		return snapshot, err
+	}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			rows.Close()
+			return snapshot, err
+		}
+		snapshot.Tags = append(snapshot.Tags, tag)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return snapshot, err
+	}
+
+	rows, err = tx.QueryContext(ctx, "SELECT uuid, start_time, end_time FROM pauses WHERE block_id = $1 ORDER BY start_time, id", blockId)
+	if err != nil {
+		return snapshot, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pause schemas.RevisionPause
+		var endTime sql.NullString
+		if err := rows.Scan(&pause.Uuid, &pause.StartTime, &endTime); err != nil {
+			return snapshot, err
+		}
+		pause.EndTime = endTime.String
+		snapshot.Pauses = append(snapshot.Pauses, pause)
+	}
+	return snapshot, rows.Err()
+}
+
+const revisionColumns = "block_id, revision, start_time, end_time, activity_id, coalesce(note, ''), tags, pauses, coalesce(user_id, 0), created_at"
+
+// getBlockRevision returns the given revision of the block, or its latest
+// revision for 0.
+func getBlockRevision(ctx context.Context, q queryRower, blockId int, revision int) (schemas.BlockRevision, error) {
+	row := q.QueryRowContext(ctx,
+		"SELECT "+revisionColumns+" FROM block_revisions WHERE block_id = $1 AND ($2 = 0 OR revision = $2) ORDER BY revision DESC LIMIT 1",
+		blockId,
+		revision)
+	return scanBlockRevision(row)
+}
+
+func scanBlockRevision(row rowScanner) (schemas.BlockRevision, error) {
+	var revision schemas.BlockRevision
+	var endTime sql.NullString
+	var pauses []byte
+	err := row.Scan(
+		&revision.BlockId,
+		&revision.Revision,
+		&revision.StartTime,
+		&endTime,
+		&revision.ActivityId,
+		&revision.Note,
+		pq.Array(&revision.Tags),
+		&pauses,
+		&revision.UserId,
+		&revision.CreatedAt)
+	if err != nil {
+		return revision, err
+	}
+	revision.EndTime = endTime.String
+	if revision.Tags == nil {
+		revision.Tags = []string{}
+	}
+	revision.Pauses = []schemas.RevisionPause{}
+	return revision, json.Unmarshal(pauses, &revision.Pauses)
+}
+
+func sameBlockState(a schemas.BlockRevision, b schemas.BlockRevision) bool {
+	return a.StartTime == b.StartTime &&
+		a.EndTime == b.EndTime &&
+		a.ActivityId == b.ActivityId &&
+		a.Note == b.Note &&
+		reflect.DeepEqual(a.Tags, b.Tags) &&
+		reflect.DeepEqual(a.Pauses, b.Pauses)
+}
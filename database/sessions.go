@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashPassword returns the bcrypt hash stored for a password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether the password matches the stored one, and
+// whether the stored one still is plaintext from before passwords were hashed
+// and has to be replaced by its hash.
+func checkPassword(stored string, password string) (ok bool, rehash bool) {
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, ok
+}
+
+// AddSession starts a session of the user lasting for the given duration and
+// returns its token. Only a hash of the token is stored.
+func (db *Database) AddSession(ctx context.Context, userId int, now time.Time, lifetime time.Duration) (_ string, err error) {
+	defer db.observe(ctx, "AddSession", time.Now(), &err)
+	var token [32]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+	encoded := hex.EncodeToString(token[:])
+	_, err = db.db.ExecContext(ctx,
+		"INSERT INTO sessions (token_hash, created_at, expires_at, user_id) VALUES ($1, $2, $3, $4)",
+		hashToken(encoded),
+		now.UTC(),
+		now.Add(lifetime).UTC(),
+		userId)
+	if err != nil {
+		return "", err
+	}
+	return encoded, nil
+}
+
+// GetSessionUser returns the user of the session with the token, or
+// sql.ErrNoRows if the token is unknown or the session has expired.
+func (db *Database) GetSessionUser(ctx context.Context, token string, now time.Time) (_ int, err error) {
+	defer db.observe(ctx, "GetSessionUser", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx,
+		"SELECT user_id FROM sessions WHERE token_hash = $1 AND expires_at > $2",
+		hashToken(token),
+		now.UTC())
+	var userId int
+	if err := row.Scan(&userId); err != nil {
+		return -1, err
+	}
+	return userId, nil
+}
+
+// DeleteSessions removes the sessions that expired before now and returns
+// how many were removed.
+func (db *Database) DeleteSessions(ctx context.Context, now time.Time) (_ int, err error) {
+	defer db.observe(ctx, "DeleteSessions", time.Now(), &err)
+	result, err := db.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= $1", now.UTC())
+	if err != nil {
+		return -1, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,511 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrInvalidSyncToken = errors.New("sync token is not valid")
+	ErrInvalidMutation  = errors.New("mutation has an unknown entity or action")
+	ErrInvalidClientId  = errors.New("client id is not a valid UUID")
+	ErrUnknownClientId  = errors.New("client id is unknown")
+	ErrForeignEntity    = errors.New("entity belongs to another user")
+	ErrVersionRequired  = errors.New("version is required")
+)
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+const (
+	MutationCreate = "create"
+	MutationUpdate = "update"
+	MutationDelete = "delete"
+)
+
+const (
+	SyncApplied  = "applied"
+	SyncConflict = "conflict"
+	SyncRejected = "rejected"
+)
+
+// syncPageSize bounds the number of recorded changes read for one page of the
+// change feed.
+const syncPageSize = 500
+
+// syncTables are the tables of the entities taking part in the sync.
+var syncTables = map[string]string{
+	"activity": "activities",
+	"block":    "blocks",
+	"pause":    "pauses",
+}
+
+// GetChanges returns the activities, blocks and pauses of the user changed
+// after the sync token, read from the audit log. Every entity appears once
+// with its current state, or as a tombstone if it has been deleted, in the
+// order of its first change. The returned cursor is the token of the next
+// call; an empty token starts at the beginning of the log.
+//
+// The log is read in the order of the transactions that wrote it, and only
+// up to the oldest transaction still running. A change therefore shows up
+// only once every transaction that could have written before it has ended,
+// but a transaction that commits late can never fall behind a cursor that
+// has already been handed out.
+func (db *Database) GetChanges(ctx context.Context, userId int, since string) (_ schemas.SyncChanges, err error) {
+	defer db.observe(ctx, "GetChanges", time.Now(), &err)
+	feed := schemas.SyncChanges{Changes: []schemas.Change{}, Cursor: since}
+	cursor, err := parseSyncToken(since)
+	if err != nil {
+		return feed, err
+	}
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT a.xid, a.id, a.entity, a.entity_id, a.action, a.created_at, coalesce(coalesce(a.after, a.before)->>'uuid', '')
+		FROM audit_log a
+		WHERE (a.xid, a.id) > ($1, $2)
+			AND a.xid < txid_snapshot_xmin(txid_current_snapshot())
+			AND a.entity IN ('activity', 'block', 'pause') AND (a.owner_id = $3
+			OR (a.entity = 'activity' AND (coalesce(a.after, a.before)->>'workspace_id')::int IN
+				(SELECT workspace_id FROM workspace_members WHERE user_id = $3)))
+		ORDER BY a.xid, a.id
+		LIMIT $4`,
+		cursor.xid,
+		cursor.id,
+		userId,
+		syncPageSize)
+	if err != nil {
+		return feed, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]int)
+	read := 0
+	for rows.Next() {
+		var change schemas.Change
+		var action string
+		if err := rows.Scan(&cursor.xid, &cursor.id, &change.Entity, &change.Id, &action, &change.ChangedAt, &change.ClientId); err != nil {
+			return feed, err
+		}
+		read++
+		change.Action = changeAction(action)
+		key := change.Entity + "/" + strconv.Itoa(change.Id)
+		i, ok := seen[key]
+		if !ok {
+			seen[key] = len(feed.Changes)
+			feed.Changes = append(feed.Changes, change)
+			continue
+		}
+		if change.Action == ChangeUpdated && feed.Changes[i].Action == ChangeCreated {
+			change.Action = ChangeCreated
+		}
+		feed.Changes[i] = change
+	}
+	if err := rows.Err(); err != nil {
+		return feed, err
+	}
+	rows.Close()
+
+	for i := range feed.Changes {
+		if err := db.loadChange(ctx, &feed.Changes[i]); err != nil {
+			return feed, err
+		}
+	}
+	if read > 0 {
+		feed.Cursor = cursor.String()
+	}
+	feed.HasMore = read == syncPageSize
+	return feed, nil
+}
+
+// syncToken is the position in the audit log a client has read up to: the
+// transaction that wrote the last entry it received and the id of the entry.
+type syncToken struct {
+	xid int64
+	id  int64
+}
+
+func (token syncToken) String() string {
+	return strconv.FormatInt(token.xid, 10) + "." + strconv.FormatInt(token.id, 10)
+}
+
+// parseSyncToken reads a token returned by GetChanges, an empty token is the
+// beginning of the log.
+func parseSyncToken(token string) (syncToken, error) {
+	var parsed syncToken
+	if token == "" {
+		return parsed, nil
+	}
+	xid, id, ok := strings.Cut(token, ".")
+	if !ok {
+		return parsed, ErrInvalidSyncToken
+	}
+	var err error
+	if parsed.xid, err = strconv.ParseInt(xid, 10, 64); err != nil || parsed.xid < 0 {
+		return parsed, ErrInvalidSyncToken
+	}
+	if parsed.id, err = strconv.ParseInt(id, 10, 64); err != nil || parsed.id < 0 {
+		return parsed, ErrInvalidSyncToken
+	}
+	return parsed, nil
+}
+
+// ApplyMutations applies the changes a client recorded while offline in one
+// transaction and returns a result for each of them. A mutation that cannot
+// be applied is rolled back on its own: stale versions and changes of
+// deleted entities are reported as conflicts along with the current state,
+// invalid ones as rejected. Entities created through a mutation are known by
+// the UUID the client generated, so later mutations can refer to them, and
+// repeating a create returns the entity created the first time.
+func (db *Database) ApplyMutations(ctx context.Context, userId int, mutations []schemas.SyncMutation) (_ []schemas.SyncResult, err error) {
+	defer db.observe(ctx, "ApplyMutations", time.Now(), &err)
+	operations := make([]schemas.BatchOperation, len(mutations))
+	for i, mutation := range mutations {
+		operations[i] = schemas.BatchOperation{SyncMutation: mutation}
+	}
+	batchResults, _, err := db.applyOperations(ctx, userId, operations, false, true)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]schemas.SyncResult, len(batchResults))
+	for i, result := range batchResults {
+		results[i] = result.SyncResult
+	}
+	return results, nil
+}
+
+// applyMutation applies a single mutation and returns the id and the new
+// version of the entity. Updating an entity that has been deleted conflicts,
+// deleting it again succeeds.
+func applyMutation(ctx context.Context, tx *sql.Tx, userId int, mutation schemas.SyncMutation) (int, int, error) {
+	table, ok := syncTables[mutation.Entity]
+	if !ok {
+		return 0, 0, ErrInvalidMutation
+	}
+	if mutation.Action == MutationCreate {
+		return createEntity(ctx, tx, userId, mutation)
+	}
+	if mutation.Action != MutationUpdate && mutation.Action != MutationDelete {
+		return 0, 0, ErrInvalidMutation
+	}
+
+	id, err := resolveId(ctx, tx, mutation.Entity, mutation.Id, mutation.ClientId)
+	if err != nil {
+		return 0, 0, err
+	}
+	if mutation.Version == 0 {
+		return id, 0, ErrVersionRequired
+	}
+	err = checkVersion(ctx, tx, table, id, mutation.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		if mutation.Action == MutationDelete {
+			return id, 0, nil
+		}
+		return id, 0, ErrVersionConflict
+	}
+	if err != nil {
+		return id, 0, err
+	}
+	if mutation.Entity == "activity" {
+		err = checkActivityAdmin(ctx, tx, userId, id)
+	} else {
+		err = checkOwner(ctx, tx, userId, mutation.Entity, id)
+	}
+	if err != nil {
+		return id, 0, err
+	}
+	if mutation.Entity != "activity" || mutation.Action == MutationDelete {
+		if err := checkBlocksUnlocked(ctx, tx, lockedBlocks[table], id); err != nil {
+			return id, 0, err
+		}
+	}
+
+	// Changing a block or one of its pauses records revisions of the block,
+	// deleting the block drops them along with it.
+	blockId := 0
+	switch {
+	case mutation.Entity == "block" && mutation.Action == MutationUpdate:
+		blockId = id
+	case mutation.Entity == "pause":
+		if blockId, err = pauseBlockId(ctx, tx, id); err != nil {
+			return id, 0, err
+		}
+	}
+	now := time.Now()
+	if blockId != 0 {
+		if err := saveBaseRevision(ctx, tx, blockId, now); err != nil {
+			return id, 0, err
+		}
+	}
+
+	if mutation.Action == MutationDelete {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = $1", table), id); err != nil {
+			return id, 0, err
+		}
+		if blockId != 0 {
+			if _, err := saveBlockRevision(ctx, tx, blockId, now); err != nil {
+				return id, 0, err
+			}
+		}
+		return id, 0, nil
+	}
+	var row *sql.Row
+	switch mutation.Entity {
+	case "activity":
+		row = tx.QueryRowContext(ctx, "UPDATE activities SET name = $1 WHERE id = $2 RETURNING version", mutation.Name, id)
+	case "block":
+		activityId, err := resolveId(ctx, tx, "activity", mutation.ActivityId, mutation.ActivityClientId)
+		if err != nil {
+			return id, 0, err
+		}
+		if activityId != 0 {
+			if err := checkActivityAccess(ctx, tx, userId, activityId); err != nil {
+				return id, 0, err
+			}
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE blocks SET start_time = $1, end_time = $2, note = $3, activity_id = coalesce($4, activity_id), auto_stopped = false
+			WHERE id = $5`,
+			mutation.StartTime,
+			newNullString(mutation.EndTime),
+			newNullString(mutation.Note),
+			newNullInt(activityId),
+			id)
+		if err != nil {
+			return id, 0, err
+		}
+		if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", id); err != nil {
+			return id, 0, err
+		}
+		row = tx.QueryRowContext(ctx, "SELECT version FROM blocks WHERE id = $1", id)
+	case "pause":
+		row = tx.QueryRowContext(ctx,
+			"UPDATE pauses SET start_time = $1, end_time = $2 WHERE id = $3 RETURNING version",
+			mutation.StartTime,
+			newNullString(mutation.EndTime),
+			id)
+	}
+	var version int
+	if err := row.Scan(&version); err != nil {
+		return id, 0, err
+	}
+	if blockId != 0 {
+		if _, err := saveBlockRevision(ctx, tx, blockId, now); err != nil {
+			return id, 0, err
+		}
+	}
+	return id, version, nil
+}
+
+// createEntity inserts the entity of a create mutation with the client id as
+// its UUID if it has one, or returns the entity created for the client id
+// before.
+func createEntity(ctx context.Context, tx *sql.Tx, userId int, mutation schemas.SyncMutation) (int, int, error) {
+	if mutation.ClientId != "" && !IsUuid(mutation.ClientId) {
+		return 0, 0, ErrInvalidClientId
+	}
+	clientId := newNullString(mutation.ClientId)
+	var id, version int
+	row := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT id, version FROM %s WHERE uuid = $1", syncTables[mutation.Entity]), clientId)
+	err := row.Scan(&id, &version)
+	if err == nil {
+		if err := checkOwner(ctx, tx, userId, mutation.Entity, id); errors.Is(err, ErrForeignEntity) || errors.Is(err, ErrForeignActivity) {
+			return 0, 0, ErrInvalidClientId
+		} else if err != nil {
+			return 0, 0, err
+		}
+		return id, version, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+	if mutation.ClientId != "" {
+		if id, err := deletedId(ctx, tx, mutation.Entity, mutation.ClientId); err == nil {
+			return id, 0, sql.ErrNoRows
+		} else if err != sql.ErrNoRows {
+			return 0, 0, err
+		}
+	}
+
+	blockId := 0
+	switch mutation.Entity {
+	case "activity":
+		row = tx.QueryRowContext(ctx,
+			"INSERT INTO activities (name, user_id, uuid) VALUES ($1, $2, coalesce($3::uuid, gen_random_uuid())) RETURNING id, version",
+			mutation.Name,
+			userId,
+			clientId)
+	case "block":
+		activityId, err := resolveId(ctx, tx, "activity", mutation.ActivityId, mutation.ActivityClientId)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := checkActivityAccess(ctx, tx, userId, activityId); err != nil {
+			return 0, 0, err
+		}
+		if err := checkUnlocked(ctx, tx, userId, activityId, mutation.StartTime); err != nil {
+			return 0, 0, err
+		}
+		row = tx.QueryRowContext(ctx,
+			"INSERT INTO blocks (start_time, end_time, note, activity_id, user_id, uuid) VALUES ($1, $2, $3, $4, $5, coalesce($6::uuid, gen_random_uuid())) RETURNING id, version",
+			mutation.StartTime,
+			newNullString(mutation.EndTime),
+			newNullString(mutation.Note),
+			activityId,
+			userId,
+			clientId)
+	case "pause":
+		blockId, err = resolveId(ctx, tx, "block", mutation.BlockId, mutation.BlockClientId)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := checkOwner(ctx, tx, userId, "block", blockId); err != nil {
+			return 0, 0, err
+		}
+		if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", blockId); err != nil {
+			return 0, 0, err
+		}
+		if err := saveBaseRevision(ctx, tx, blockId, time.Now()); err != nil {
+			return 0, 0, err
+		}
+		row = tx.QueryRowContext(ctx,
+			"INSERT INTO pauses (start_time, end_time, block_id, uuid) VALUES ($1, $2, $3, coalesce($4::uuid, gen_random_uuid())) RETURNING id, version",
+			mutation.StartTime,
+			newNullString(mutation.EndTime),
+			blockId,
+			clientId)
+	}
+	if err := row.Scan(&id, &version); err != nil {
+		return 0, 0, uuidTaken(err)
+	}
+	if mutation.Entity == "block" {
+		blockId = id
+	}
+	if blockId != 0 {
+		if _, err := saveBlockRevision(ctx, tx, blockId, time.Now()); err != nil {
+			return 0, 0, err
+		}
+	}
+	return id, version, nil
+}
+
+// resolveId returns the id of the entity, which a mutation names by its id
+// or by its UUID, the client id it was created with. An entity deleted since
+// is still found through the audit log. It returns 0 for neither.
+func resolveId(ctx context.Context, q queryRower, entity string, id int, clientId string) (int, error) {
+	if id != 0 || clientId == "" {
+		return id, nil
+	}
+	if !IsUuid(clientId) {
+		return 0, ErrInvalidClientId
+	}
+	row := q.QueryRowContext(ctx, fmt.Sprintf("SELECT id FROM %s WHERE uuid = $1", syncTables[entity]), clientId)
+	err := row.Scan(&id)
+	if err == sql.ErrNoRows {
+		id, err = deletedId(ctx, q, entity, clientId)
+	}
+	if err == sql.ErrNoRows {
+		return 0, ErrUnknownClientId
+	} else if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// deletedId returns the id of the deleted entity that had the UUID.
+func deletedId(ctx context.Context, q queryRower, entity string, uuid string) (int, error) {
+	row := q.QueryRowContext(ctx,
+		"SELECT entity_id FROM audit_log WHERE entity = $1 AND action = 'delete' AND before->>'uuid' = $2 ORDER BY id DESC LIMIT 1",
+		entity,
+		uuid)
+	var id int
+	err := row.Scan(&id)
+	return id, err
+}
+
+// checkOwner returns an error unless the user may use the entity. The
+// activities of a workspace may be used by all of its members, blocks and
+// pauses only by the user tracking them. Renaming or deleting activities is
+// checked by checkActivityAdmin.
+func checkOwner(ctx context.Context, q queryRower, userId int, entity string, id int) error {
+	if entity == "activity" {
+		return checkActivityAccess(ctx, q, userId, id)
+	}
+	query := "SELECT coalesce(user_id, 0) FROM blocks WHERE id = $1"
+	if entity == "pause" {
+		query = "SELECT coalesce(b.user_id, 0) FROM pauses p JOIN blocks b ON b.id = p.block_id WHERE p.id = $1"
+	}
+	var owner int
+	if err := q.QueryRowContext(ctx, query, id).Scan(&owner); err != nil {
+		return err
+	}
+	if owner != userId {
+		return ErrForeignEntity
+	}
+	return nil
+}
+
+// loadChange fills in the current state of the changed entity, or turns the
+// change into a tombstone if the entity no longer exists.
+func (db *Database) loadChange(ctx context.Context, change *schemas.Change) error {
+	if change.Action == ChangeDeleted {
+		return nil
+	}
+	var err error
+	switch change.Entity {
+	case "activity":
+		var activity schemas.Activity
+		row := db.db.QueryRowContext(ctx, "SELECT "+activityColumns+" FROM activities WHERE id = $1", change.Id)
+		err = row.Scan(&activity.Id, &activity.Uuid, &activity.Name, &activity.UserId, &activity.WorkspaceId, &activity.Version)
+		change.Activity = &activity
+	case "block":
+		var block schemas.Block
+		block, err = db.GetBlock(ctx, change.Id)
+		change.Block = &block
+	case "pause":
+		var pause schemas.Pause
+		pause, err = db.GetPause(ctx, change.Id)
+		change.Pause = &pause
+	}
+	if err == sql.ErrNoRows {
+		*change = schemas.Change{Entity: change.Entity, Id: change.Id, ClientId: change.ClientId, Action: ChangeDeleted, ChangedAt: change.ChangedAt}
+		return nil
+	}
+	return err
+}
+
+func changeAction(action string) string {
+	switch action {
+	case "insert":
+		return ChangeCreated
+	case "delete":
+		return ChangeDeleted
+	}
+	return ChangeUpdated
+}
+
+// isRejected reports whether the error rejects a mutation, rather than
+// reporting a failing database. Invalid input and violated constraints are
+// rejections as well.
+func isRejected(err error) bool {
+	for _, sentinel := range sentinels {
+		if errors.Is(err, sentinel) {
+			return true
+		}
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		class := pqErr.Code.Class()
+		return class == "22" || class == "23"
+	}
+	return false
+}
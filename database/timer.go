@@ -0,0 +1,198 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+var (
+	ErrNoRunningBlock = errors.New("no block is running")
+	ErrAlreadyPaused  = errors.New("running block is already paused")
+	ErrNotPaused      = errors.New("running block is not paused")
+	ErrTimeBeforeRun  = errors.New("time lies before the start of the running block or its pause")
+)
+
+// openPause matches the pauses that are ongoing at the time given as $1 in
+// the query: pauses without an end, and pomodoro breaks ending later on.
+const openPause = "(end_time IS NULL OR end_time > $1)"
+
+func (db *Database) GetRunningBlock(ctx context.Context, userId int) (_ schemas.Block, err error) {
+	defer db.observe(ctx, "GetRunningBlock", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx,
+		"SELECT "+blockColumns+" FROM blocks WHERE end_time IS NULL AND user_id = $1 ORDER BY start_time DESC LIMIT 1",
+		userId)
+	block, err := db.scanBlock(ctx, row)
+	if err == sql.ErrNoRows {
+		return block, ErrNoRunningBlock
+	}
+	return block, err
+}
+
+// StartBlock starts a new block of the activity for the user, which is either
+// an activity of the user or of one of their workspaces. A block of the user
+// that is still running is stopped at the same time.
+func (db *Database) StartBlock(ctx context.Context, userId int, activityId int, at time.Time) (_ int, err error) {
+	defer db.observe(ctx, "StartBlock", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	if err := checkActivityAccess(ctx, tx, userId, activityId); err != nil {
+		return -1, err
+	}
+	if _, err := stopRunningBlock(ctx, tx, userId, at); err != nil && err != ErrNoRunningBlock {
+		return -1, err
+	}
+	if err := checkUnlocked(ctx, tx, userId, activityId, at.UTC().Format(time.RFC3339Nano)); err != nil {
+		return -1, err
+	}
+	row := tx.QueryRowContext(ctx,
+		"INSERT INTO blocks (start_time, activity_id, user_id) VALUES ($1, $2, $3) RETURNING id",
+		at.UTC(),
+		activityId,
+		userId)
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return -1, err
+	}
+	if _, err := saveBlockRevision(ctx, tx, id, at); err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// StopBlock stops the running block of the user, ending an open pause as well.
+func (db *Database) StopBlock(ctx context.Context, userId int, at time.Time) (_ int, err error) {
+	defer db.observe(ctx, "StopBlock", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	id, err := stopRunningBlock(ctx, tx, userId, at)
+	if err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// PauseBlock opens a pause on the running block of the user.
+func (db *Database) PauseBlock(ctx context.Context, userId int, at time.Time) (_ int, err error) {
+	defer db.observe(ctx, "PauseBlock", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	id, err := lockRunningBlock(ctx, tx, userId, at)
+	if err != nil {
+		return -1, err
+	}
+	row := tx.QueryRowContext(ctx, "SELECT count(*) FROM pauses WHERE block_id = $2 AND "+openPause, at.UTC(), id)
+	var open int
+	if err := row.Scan(&open); err != nil {
+		return -1, err
+	}
+	if open > 0 {
+		return -1, ErrAlreadyPaused
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO pauses (start_time, block_id) VALUES ($1, $2)", at.UTC(), id); err != nil {
+		return -1, err
+	}
+	if _, err := saveBlockRevision(ctx, tx, id, at); err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// ResumeBlock ends the open pause of the running block of the user, which
+// may also be a pomodoro break that is not over yet.
+func (db *Database) ResumeBlock(ctx context.Context, userId int, at time.Time) (_ int, err error) {
+	defer db.observe(ctx, "ResumeBlock", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	id, err := lockRunningBlock(ctx, tx, userId, at)
+	if err != nil {
+		return -1, err
+	}
+	result, err := tx.ExecContext(ctx, "UPDATE pauses SET end_time = $1 WHERE block_id = $2 AND "+openPause, at.UTC(), id)
+	if err != nil {
+		return -1, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	if affected == 0 {
+		return -1, ErrNotPaused
+	}
+	if _, err := saveBlockRevision(ctx, tx, id, at); err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// lockRunningBlock locks the running block of the user for an update, which
+// the lock dates and approved timesheets have to allow, and records its state
+// before the update as a revision. The update may not happen before the
+// block or its open pause started.
+func lockRunningBlock(ctx context.Context, tx *sql.Tx, userId int, at time.Time) (int, error) {
+	row := tx.QueryRowContext(ctx,
+		"SELECT id, start_time > $2 FROM blocks WHERE end_time IS NULL AND user_id = $1 ORDER BY start_time DESC LIMIT 1 FOR UPDATE",
+		userId,
+		at.UTC())
+	var id int
+	var early bool
+	err := row.Scan(&id, &early)
+	if err == sql.ErrNoRows {
+		return -1, ErrNoRunningBlock
+	}
+	if err != nil {
+		return -1, err
+	}
+	if !early {
+		row := tx.QueryRowContext(ctx, "SELECT count(*) > 0 FROM pauses WHERE block_id = $2 AND start_time > $1 AND "+openPause, at.UTC(), id)
+		if err := row.Scan(&early); err != nil {
+			return -1, err
+		}
+	}
+	if early {
+		return -1, ErrTimeBeforeRun
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", id); err != nil {
+		return -1, err
+	}
+	if err := saveBaseRevision(ctx, tx, id, at); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+func stopRunningBlock(ctx context.Context, tx *sql.Tx, userId int, at time.Time) (int, error) {
+	id, err := lockRunningBlock(ctx, tx, userId, at)
+	if err != nil {
+		return -1, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE pauses SET end_time = $1 WHERE block_id = $2 AND "+openPause, at.UTC(), id); err != nil {
+		return -1, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE blocks SET end_time = $1 WHERE id = $2", at.UTC(), id); err != nil {
+		return -1, err
+	}
+	if _, err := saveBlockRevision(ctx, tx, id, at); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
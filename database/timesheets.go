@@ -0,0 +1,299 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+const (
+	TimesheetOpen      = "open"
+	TimesheetSubmitted = "submitted"
+	TimesheetApproved  = "approved"
+	TimesheetRejected  = "rejected"
+)
+
+// The actions recorded in the history of a timesheet.
+const (
+	TimesheetSubmit  = "submit"
+	TimesheetApprove = "approve"
+	TimesheetReject  = "reject"
+	TimesheetComment = "comment"
+)
+
+var (
+	ErrTimesheetApproved = errors.New("blocks of an approved timesheet cannot be changed")
+	ErrInvalidTransition = errors.New("timesheet is not in a state that allows this")
+	ErrForeignTimesheet  = errors.New("timesheet belongs to another user")
+	ErrNotApprover       = errors.New("user may not review this timesheet")
+	ErrCommentRequired   = errors.New("comment is required")
+)
+
+// WeekStart returns the monday starting the week of t, in UTC. Blocks belong
+// to the week they started in.
+func WeekStart(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+}
+
+// GetTimesheet assembles the timesheet of the user for the week containing
+// the given time from the blocks started within the week. Weeks that have
+// never been submitted are open.
+func (db *Database) GetTimesheet(ctx context.Context, userId int, week time.Time) (_ schemas.Timesheet, err error) {
+	defer db.observe(ctx, "GetTimesheet", time.Now(), &err)
+	start := WeekStart(week)
+	timesheet := schemas.Timesheet{
+		UserId:    userId,
+		WeekStart: start.Format(time.DateOnly),
+		WeekEnd:   start.AddDate(0, 0, 7).Format(time.DateOnly),
+		Status:    TimesheetOpen,
+	}
+	var id int
+	row := db.db.QueryRowContext(ctx,
+		"SELECT id, status FROM timesheets WHERE user_id = $1 AND week_start = $2",
+		userId,
+		timesheet.WeekStart)
+	if err := row.Scan(&id, &timesheet.Status); err != nil && err != sql.ErrNoRows {
+		return timesheet, err
+	}
+
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+blockColumns+" FROM blocks WHERE user_id = $1 AND start_time >= $2 AND start_time < $3 ORDER BY start_time",
+		userId,
+		start,
+		start.AddDate(0, 0, 7))
+	if err != nil {
+		return timesheet, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		block, err := db.scanBlock(ctx, rows)
+		if err != nil {
+			return timesheet, err
+		}
+		timesheet.Blocks = append(timesheet.Blocks, block)
+		timesheet.TotalSeconds += blockSeconds(block)
+	}
+	if err := rows.Err(); err != nil {
+		return timesheet, err
+	}
+
+	if id != 0 {
+		timesheet.Events, err = db.getTimesheetEvents(ctx, id)
+	}
+	return timesheet, err
+}
+
+// GetPendingTimesheets returns the submitted timesheets the user may review,
+// without their blocks.
+func (db *Database) GetPendingTimesheets(ctx context.Context, reviewerId int) (_ []schemas.Timesheet, err error) {
+	defer db.observe(ctx, "GetPendingTimesheets", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT t.user_id, t.week_start FROM timesheets t
+		WHERE t.status = $2 AND t.user_id IN (`+reviewedUsers+`)
+		ORDER BY t.week_start, t.user_id`,
+		reviewerId,
+		TimesheetSubmitted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var timesheets []schemas.Timesheet
+	for rows.Next() {
+		var timesheet schemas.Timesheet
+		var weekStart time.Time
+		if err := rows.Scan(&timesheet.UserId, &weekStart); err != nil {
+			return nil, err
+		}
+		timesheet.WeekStart = weekStart.Format(time.DateOnly)
+		timesheet.WeekEnd = weekStart.AddDate(0, 0, 7).Format(time.DateOnly)
+		timesheet.Status = TimesheetSubmitted
+		timesheets = append(timesheets, timesheet)
+	}
+	return timesheets, rows.Err()
+}
+
+// SubmitTimesheet submits an open or rejected timesheet of the user for
+// review.
+func (db *Database) SubmitTimesheet(ctx context.Context, userId int, week time.Time, comment string, now time.Time) (err error) {
+	defer db.observe(ctx, "SubmitTimesheet", time.Now(), &err)
+	return db.transitionTimesheet(ctx, userId, userId, week, TimesheetSubmit, comment, now)
+}
+
+// ReviewTimesheet approves or rejects a submitted timesheet. Reviewers are
+// the owners and admins of the workspaces the user is a member of, but never
+// the user themselves. Rejections need a comment.
+func (db *Database) ReviewTimesheet(ctx context.Context, reviewerId int, userId int, week time.Time, approve bool, comment string, now time.Time) (err error) {
+	defer db.observe(ctx, "ReviewTimesheet", time.Now(), &err)
+	action := TimesheetReject
+	if approve {
+		action = TimesheetApprove
+	} else if comment == "" {
+		return ErrCommentRequired
+	}
+	return db.transitionTimesheet(ctx, reviewerId, userId, week, action, comment, now)
+}
+
+// CommentTimesheet adds a comment of the user or of one of its reviewers to
+// the history of the timesheet, without changing its status.
+func (db *Database) CommentTimesheet(ctx context.Context, authorId int, userId int, week time.Time, comment string, now time.Time) (err error) {
+	defer db.observe(ctx, "CommentTimesheet", time.Now(), &err)
+	return db.transitionTimesheet(ctx, authorId, userId, week, TimesheetComment, comment, now)
+}
+
+// transitionTimesheet applies the action of the actor to the timesheet and
+// records it in the history of the timesheet, in the same transaction.
+func (db *Database) transitionTimesheet(ctx context.Context, actorId int, userId int, week time.Time, action string, comment string, now time.Time) error {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	reviewer, err := isReviewer(ctx, tx, actorId, userId)
+	if err != nil {
+		return err
+	}
+	var allowed []string
+	status := ""
+	switch action {
+	case TimesheetSubmit:
+		if actorId != userId {
+			return ErrForeignTimesheet
+		}
+		allowed = []string{TimesheetOpen, TimesheetRejected}
+		status = TimesheetSubmitted
+	case TimesheetApprove, TimesheetReject:
+		if !reviewer {
+			return ErrNotApprover
+		}
+		allowed = []string{TimesheetSubmitted}
+		status = TimesheetApproved
+		if action == TimesheetReject {
+			status = TimesheetRejected
+		}
+	case TimesheetComment:
+		if actorId != userId && !reviewer {
+			return ErrNotApprover
+		}
+		if comment == "" {
+			return ErrCommentRequired
+		}
+	}
+
+	weekStart := WeekStart(week).Format(time.DateOnly)
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO timesheets (user_id, week_start, status) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, week_start) DO NOTHING`,
+		userId,
+		weekStart,
+		TimesheetOpen)
+	if err != nil {
+		return err
+	}
+	row := tx.QueryRowContext(ctx,
+		"SELECT id, status FROM timesheets WHERE user_id = $1 AND week_start = $2 FOR UPDATE",
+		userId,
+		weekStart)
+	var id int
+	var current string
+	if err := row.Scan(&id, &current); err != nil {
+		return err
+	}
+	if status != "" {
+		if !contains(allowed, current) {
+			return ErrInvalidTransition
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE timesheets SET status = $1 WHERE id = $2", status, id); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO timesheet_events (action, comment, created_at, user_id, timesheet_id) VALUES ($1, $2, $3, $4, $5)",
+		action,
+		newNullString(comment),
+		now.UTC(),
+		actorId,
+		id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *Database) getTimesheetEvents(ctx context.Context, timesheetId int) ([]schemas.TimesheetEvent, error) {
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT e.id, coalesce(e.user_id, 0), coalesce(u.name, ''), e.action, coalesce(e.comment, ''), e.created_at
+		FROM timesheet_events e LEFT JOIN users u ON u.id = e.user_id
+		WHERE e.timesheet_id = $1 ORDER BY e.id`,
+		timesheetId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []schemas.TimesheetEvent
+	for rows.Next() {
+		var event schemas.TimesheetEvent
+		err := rows.Scan(&event.Id, &event.UserId, &event.UserName, &event.Action, &event.Comment, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// reviewedUsers selects the users whose timesheets the user given by $1 may
+// review.
+const reviewedUsers = `
+	SELECT m.user_id FROM workspace_members r JOIN workspace_members m ON m.workspace_id = r.workspace_id
+	WHERE r.user_id = $1 AND r.role IN ('owner', 'admin') AND m.user_id <> $1`
+
+func isReviewer(ctx context.Context, q queryRower, reviewerId int, userId int) (bool, error) {
+	row := q.QueryRowContext(ctx, "SELECT $2::int IN ("+reviewedUsers+")", reviewerId, userId)
+	var reviewer bool
+	err := row.Scan(&reviewer)
+	return reviewer, err
+}
+
+// blockSeconds returns the duration of a finished block without its pauses.
+func blockSeconds(block schemas.Block) int {
+	start, err := time.Parse(time.RFC3339Nano, block.StartTime)
+	if err != nil {
+		return 0
+	}
+	end, err := time.Parse(time.RFC3339Nano, block.EndTime)
+	if err != nil {
+		return 0
+	}
+	duration := end.Sub(start)
+	for _, pause := range block.Pauses {
+		pauseStart, err := time.Parse(time.RFC3339Nano, pause.StartTime)
+		if err != nil {
+			continue
+		}
+		pauseEnd, err := time.Parse(time.RFC3339Nano, pause.EndTime)
+		if err != nil || pauseEnd.After(end) {
+			pauseEnd = end
+		}
+		if pauseEnd.After(pauseStart) {
+			duration -= pauseEnd.Sub(pauseStart)
+		}
+	}
+	return int(duration.Seconds())
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrInvalidUuid = errors.New("uuid is not valid")
+	ErrUuidTaken   = errors.New("uuid is already used by another entity")
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// copySyncIds moves the client ids the sync used to record in a table of its
+// own into the uuid columns, so that entities created offline keep the id
+// their clients know them by.
+const copySyncIds = `
+DO $$
+BEGIN
+	IF to_regclass('sync_ids') IS NOT NULL THEN
+		UPDATE activities a SET uuid = s.client_id FROM sync_ids s WHERE s.entity = 'activity' AND s.entity_id = a.id;
+		UPDATE blocks b SET uuid = s.client_id FROM sync_ids s WHERE s.entity = 'block' AND s.entity_id = b.id;
+		UPDATE pauses p SET uuid = s.client_id FROM sync_ids s WHERE s.entity = 'pause' AND s.entity_id = p.id;
+	END IF;
+END $$`
+
+// IsUuid reports whether the value is formatted as a UUID, as opposed to a
+// serial id.
+func IsUuid(value string) bool {
+	return uuidPattern.MatchString(value)
+}
+
+// ResolveUuid returns the id of the activity, block or pause with the UUID.
+func (db *Database) ResolveUuid(ctx context.Context, entity string, uuid string) (_ int, err error) {
+	defer db.observe(ctx, "ResolveUuid", time.Now(), &err)
+	table, ok := syncTables[entity]
+	if !ok {
+		return -1, ErrUnknownEntity
+	}
+	if !IsUuid(uuid) {
+		return -1, ErrInvalidUuid
+	}
+	row := db.db.QueryRowContext(ctx, fmt.Sprintf("SELECT id FROM %s WHERE uuid = $1", table), uuid)
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+// newUuid checks the UUID a client chose for a new entity. An empty one is
+// NULL, for which the database generates a UUID.
+func newUuid(uuid string) (sql.NullString, error) {
+	if uuid != "" && !IsUuid(uuid) {
+		return sql.NullString{}, ErrInvalidUuid
+	}
+	return newNullString(uuid), nil
+}
+
+// uuidTaken turns the violation of a unique uuid index into ErrUuidTaken.
+func uuidTaken(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && strings.HasSuffix(pqErr.Constraint, "_uuid_idx") {
+		return ErrUuidTaken
+	}
+	return err
+}
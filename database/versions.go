@@ -0,0 +1,195 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+var ErrVersionConflict = errors.New("entity has been changed in the meantime")
+
+// bumpVersion increments the version of every changed row of activities,
+// blocks and pauses, unless the update sets the version itself.
+const bumpVersion = `CREATE OR REPLACE FUNCTION bump_version() RETURNS trigger AS $$
+BEGIN
+	IF NEW.version = OLD.version AND NEW IS DISTINCT FROM OLD THEN
+		NEW.version := OLD.version + 1;
+	END IF;
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql`
+
+// touchBlock increments the version of the blocks whose pauses or tags
+// change, so that the version of a block covers all of its state.
+const touchBlock = `CREATE OR REPLACE FUNCTION touch_block() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'UPDATE' AND OLD IS NOT DISTINCT FROM NEW THEN
+		RETURN NULL;
+	END IF;
+	IF TG_OP <> 'INSERT' THEN
+		UPDATE blocks SET version = version + 1 WHERE id = OLD.block_id;
+	END IF;
+	IF TG_OP = 'INSERT' OR (TG_OP = 'UPDATE' AND NEW.block_id IS DISTINCT FROM OLD.block_id) THEN
+		UPDATE blocks SET version = version + 1 WHERE id = NEW.block_id;
+	END IF;
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql`
+
+// ReplaceBlock replaces the times, activity, note, tags and pauses of the
+// block in one transaction and returns its new version. The change is
+// rejected with ErrVersionConflict unless the block still has the given
+// version, a version of 0 skips the check. A zero activity id keeps the
+// activity of the block. Pauses keep their id and UUID when they are given
+// with either. The states before and after are saved as revisions.
+func (db *Database) ReplaceBlock(ctx context.Context, block schemas.Block, version int, now time.Time) (_ int, err error) {
+	defer db.observe(ctx, "ReplaceBlock", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	if err := checkVersion(ctx, tx, "blocks", block.Id, version); err != nil {
+		return -1, err
+	}
+	if err := saveBaseRevision(ctx, tx, block.Id, now); err != nil {
+		return -1, err
+	}
+	var userId int
+	if err := tx.QueryRowContext(ctx, "SELECT coalesce(user_id, 0) FROM blocks WHERE id = $1", block.Id).Scan(&userId); err != nil {
+		return -1, err
+	}
+	if block.ActivityId != 0 {
+		if err := checkActivityAccess(ctx, tx, userId, block.ActivityId); err != nil {
+			return -1, err
+		}
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", block.Id); err != nil {
+		return -1, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE blocks SET start_time = $1, end_time = $2, activity_id = coalesce($3, activity_id), note = $4, auto_stopped = false
+		WHERE id = $5`,
+		block.StartTime,
+		newNullString(block.EndTime),
+		newNullInt(block.ActivityId),
+		newNullString(block.Note),
+		block.Id)
+	if err != nil {
+		return -1, err
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.id = $1", block.Id); err != nil {
+		return -1, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE block_id = $1", block.Id); err != nil {
+		return -1, err
+	}
+	for _, tag := range block.Tags {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO tags (name, block_id) VALUES ($1, $2)", tag, block.Id); err != nil {
+			return -1, err
+		}
+	}
+	if err := replacePauses(ctx, tx, block.Id, block.Pauses); err != nil {
+		return -1, err
+	}
+	if _, err := saveBlockRevision(ctx, tx, block.Id, now); err != nil {
+		return -1, err
+	}
+
+	var newVersion int
+	if err := tx.QueryRowContext(ctx, "SELECT version FROM blocks WHERE id = $1", block.Id).Scan(&newVersion); err != nil {
+		return -1, err
+	}
+	return newVersion, tx.Commit()
+}
+
+// replacePauses makes the given pauses those of the block. A pause matching
+// one of the block by its id or UUID is updated in place, keeping both; the
+// others are added, with their UUID if they have one, and the pauses of the
+// block not matched are deleted.
+func replacePauses(ctx context.Context, tx *sql.Tx, blockId int, pauses []schemas.Pause) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, uuid FROM pauses WHERE block_id = $1", blockId)
+	if err != nil {
+		return err
+	}
+	existing := make(map[int]bool)
+	byUuid := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var uuid string
+		if err := rows.Scan(&id, &uuid); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[id] = true
+		byUuid[uuid] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	kept := make(map[int]bool)
+	for _, pause := range pauses {
+		id := byUuid[strings.ToLower(pause.Uuid)]
+		if existing[pause.Id] {
+			id = pause.Id
+		}
+		if id != 0 && !kept[id] {
+			kept[id] = true
+			_, err := tx.ExecContext(ctx,
+				"UPDATE pauses SET start_time = $1, end_time = $2 WHERE id = $3",
+				pause.StartTime,
+				newNullString(pause.EndTime),
+				id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		publicId, err := newUuid(pause.Uuid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO pauses (start_time, end_time, block_id, uuid) VALUES ($1, $2, $3, coalesce($4::uuid, gen_random_uuid()))",
+			pause.StartTime,
+			newNullString(pause.EndTime),
+			blockId,
+			publicId)
+		if err != nil {
+			return uuidTaken(err)
+		}
+	}
+	for id := range existing {
+		if kept[id] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM pauses WHERE id = $1", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVersion locks the row of the table for the transaction and returns
+// ErrVersionConflict unless it has the given version. A version of 0 skips
+// the comparison.
+func checkVersion(ctx context.Context, tx *sql.Tx, table string, id int, version int) error {
+	row := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT version FROM %s WHERE id = $1 FOR UPDATE", table), id)
+	var current int
+	if err := row.Scan(&current); err != nil {
+		return err
+	}
+	if version != 0 && version != current {
+		return ErrVersionConflict
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+	"github.com/lib/pq"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const webhookDeliveryColumns = `id, webhook_id, event, payload, status, attempts,
+	next_attempt_at, coalesce(last_status_code, 0), coalesce(last_error, ''),
+	created_at, delivered_at`
+
+func (db *Database) AddWebhook(ctx context.Context, userId int, url string, secret string, events []string) (_ int, err error) {
+	defer db.observe(ctx, "AddWebhook", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx,
+		"INSERT INTO webhooks (url, secret, events, user_id) VALUES ($1, $2, $3, $4) RETURNING id",
+		url,
+		secret,
+		pq.Array(events),
+		userId)
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+func (db *Database) GetWebhooks(ctx context.Context, userId int) (_ []schemas.Webhook, err error) {
+	defer db.observe(ctx, "GetWebhooks", time.Now(), &err)
+	var webhooks []schemas.Webhook
+
+	rows, err := db.db.QueryContext(ctx, "SELECT id, url, secret, events, user_id FROM webhooks WHERE user_id = $1 ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var webhook schemas.Webhook
+		err := rows.Scan(&webhook.Id, &webhook.Url, &webhook.Secret, pq.Array(&webhook.Events), &webhook.UserId)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *Database) GetWebhook(ctx context.Context, webhookId int) (_ schemas.Webhook, err error) {
+	defer db.observe(ctx, "GetWebhook", time.Now(), &err)
+	var webhook schemas.Webhook
+	row := db.db.QueryRowContext(ctx, "SELECT id, url, secret, events, user_id FROM webhooks WHERE id = $1", webhookId)
+	err = row.Scan(&webhook.Id, &webhook.Url, &webhook.Secret, pq.Array(&webhook.Events), &webhook.UserId)
+	return webhook, err
+}
+
+// WebhookOutbox is a page of the changes recorded in the audit log that have
+// not been turned into webhook deliveries yet.
+type WebhookOutbox struct {
+	Changes  []OutboxChange
+	from, to syncToken
+}
+
+// OutboxChange is a change of an activity, block or pause. For blocks and
+// pauses, Open and WasOpen tell whether the block was running or the pause
+// ongoing after and before the change.
+type OutboxChange struct {
+	Xid     int64
+	Entity  string
+	Id      int
+	BlockId int
+	Action  string
+	UserId  int
+	Open    bool
+	WasOpen bool
+}
+
+// WebhookEvent is an event to be delivered to the webhooks of the user that
+// are subscribed to it.
+type WebhookEvent struct {
+	UserId  int
+	Event   string
+	Payload []byte
+}
+
+// initWebhookOutbox starts the webhooks at the end of the audit log, so that
+// the changes made before they were delivered this way are not sent again.
+const initWebhookOutbox = `
+INSERT INTO webhook_outbox (id, xid, audit_id)
+SELECT 1, txid_snapshot_xmin(txid_current_snapshot()) - 1, coalesce((SELECT max(id) FROM audit_log), 0)
+ON CONFLICT (id) DO NOTHING`
+
+// ReadWebhookOutbox returns up to limit changes of activities, blocks and
+// pauses recorded after those EnqueueWebhookEvents has been called for. Like
+// the sync feed, the log is read in the order of the transactions that wrote
+// it and only up to the oldest one still running, so a change committing late
+// is not passed over. Updates of blocks that only bump their version are left
+// out, the change of the pause or tag behind them is read instead.
+func (db *Database) ReadWebhookOutbox(ctx context.Context, limit int) (_ WebhookOutbox, err error) {
+	defer db.observe(ctx, "ReadWebhookOutbox", time.Now(), &err)
+	var outbox WebhookOutbox
+	row := db.db.QueryRowContext(ctx, "SELECT xid, audit_id FROM webhook_outbox WHERE id = 1")
+	if err := row.Scan(&outbox.from.xid, &outbox.from.id); err != nil {
+		return outbox, err
+	}
+	outbox.to = outbox.from
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT a.xid, a.id, a.entity, a.entity_id, a.action, coalesce(a.owner_id, a.user_id, 0),
+			coalesce((coalesce(a.after, a.before)->>'block_id')::int, 0),
+			`+openState("a.after")+`,
+			`+openState("a.before")+`
+		FROM audit_log a
+		WHERE (a.xid, a.id) > ($1, $2)
+			AND a.xid < txid_snapshot_xmin(txid_current_snapshot())
+			AND a.entity IN ('activity', 'block', 'pause')
+			AND NOT (a.entity = 'block' AND a.action = 'update' AND (a.before - 'version') = (a.after - 'version'))
+		ORDER BY a.xid, a.id
+		LIMIT $3`,
+		outbox.from.xid,
+		outbox.from.id,
+		limit)
+	if err != nil {
+		return outbox, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change OutboxChange
+		err := rows.Scan(
+			&change.Xid,
+			&outbox.to.id,
+			&change.Entity,
+			&change.Id,
+			&change.Action,
+			&change.UserId,
+			&change.BlockId,
+			&change.Open,
+			&change.WasOpen)
+		if err != nil {
+			return outbox, err
+		}
+		outbox.to.xid = change.Xid
+		outbox.Changes = append(outbox.Changes, change)
+	}
+	return outbox, rows.Err()
+}
+
+// openState returns an expression telling whether the recorded state of a
+// block has no end time yet, or that of a pause had not ended at the time of
+// the change.
+func openState(state string) string {
+	return fmt.Sprintf(`CASE a.entity
+				WHEN 'block' THEN %[1]s IS NOT NULL AND %[1]s->>'end_time' IS NULL
+				WHEN 'pause' THEN %[1]s IS NOT NULL AND (%[1]s->>'end_time' IS NULL OR (%[1]s->>'end_time')::timestamp > a.created_at)
+				ELSE false END`, state)
+}
+
+// EnqueueWebhookEvents creates a pending delivery of every event for the
+// webhooks of its user that are subscribed to it, and marks the changes of
+// the outbox as done in the same transaction. Webhooks without any event
+// types receive all events. If another worker has handled the outbox in the
+// meantime, nothing is stored.
+func (db *Database) EnqueueWebhookEvents(ctx context.Context, outbox WebhookOutbox, events []WebhookEvent, now time.Time) (err error) {
+	defer db.observe(ctx, "EnqueueWebhookEvents", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current syncToken
+	row := tx.QueryRowContext(ctx, "SELECT xid, audit_id FROM webhook_outbox WHERE id = 1 FOR UPDATE")
+	if err := row.Scan(&current.xid, &current.id); err != nil {
+		return err
+	}
+	if current != outbox.from {
+		return nil
+	}
+	for _, event := range events {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO webhook_deliveries (event, payload, status, next_attempt_at, created_at, webhook_id)
+			SELECT $2, $3, $4, $5, $5, id FROM webhooks
+			WHERE user_id = $1 AND (cardinality(events) = 0 OR $2 = ANY(events))`,
+			event.UserId,
+			event.Event,
+			string(event.Payload),
+			DeliveryPending,
+			now.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE webhook_outbox SET xid = $1, audit_id = $2 WHERE id = 1", outbox.to.xid, outbox.to.id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *Database) AddWebhookDelivery(ctx context.Context, webhookId int, event string, payload []byte, now time.Time) (_ int, err error) {
+	defer db.observe(ctx, "AddWebhookDelivery", time.Now(), &err)
+	row := db.db.QueryRowContext(ctx, `
+		INSERT INTO webhook_deliveries (event, payload, status, next_attempt_at, created_at, webhook_id)
+		VALUES ($1, $2, $3, $4, $4, $5) RETURNING id`,
+		event,
+		string(payload),
+		DeliveryPending,
+		now.UTC(),
+		webhookId)
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are due
+// and postpones their next attempt to leaseUntil, so that concurrent workers
+// do not pick up the same deliveries.
+func (db *Database) ClaimWebhookDeliveries(ctx context.Context, now time.Time, leaseUntil time.Time, limit int) (_ []schemas.WebhookDelivery, err error) {
+	defer db.observe(ctx, "ClaimWebhookDeliveries", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, `
+		UPDATE webhook_deliveries SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $3 AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+webhookDeliveryColumns,
+		now.UTC(),
+		leaseUntil.UTC(),
+		DeliveryPending,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanWebhookDeliveries(rows)
+}
+
+// RecordWebhookAttempt stores the outcome of a delivery attempt. The next
+// attempt is only relevant for deliveries that are still pending.
+func (db *Database) RecordWebhookAttempt(
+	ctx context.Context,
+	id int,
+	status string,
+	statusCode int,
+	lastError string,
+	nextAttempt time.Time,
+	now time.Time,
+) (err error) {
+	defer db.observe(ctx, "RecordWebhookAttempt", time.Now(), &err)
+	var deliveredAt sql.NullTime
+	if status == DeliveryDelivered {
+		deliveredAt = sql.NullTime{Time: now.UTC(), Valid: true}
+	}
+	_, err = db.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = attempts + 1, last_status_code = $2, last_error = $3,
+			next_attempt_at = $4, delivered_at = $5
+		WHERE id = $6`,
+		status,
+		newNullInt(statusCode),
+		newNullString(lastError),
+		nextAttempt.UTC(),
+		deliveredAt,
+		id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *Database) GetWebhookDelivery(ctx context.Context, id int) (_ schemas.WebhookDelivery, err error) {
+	defer db.observe(ctx, "GetWebhookDelivery", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = $1", id)
+	if err != nil {
+		return schemas.WebhookDelivery{}, err
+	}
+	defer rows.Close()
+	deliveries, err := scanWebhookDeliveries(rows)
+	if err != nil {
+		return schemas.WebhookDelivery{}, err
+	}
+	if len(deliveries) == 0 {
+		return schemas.WebhookDelivery{}, sql.ErrNoRows
+	}
+	return deliveries[0], nil
+}
+
+func (db *Database) GetWebhookDeliveries(ctx context.Context, webhookId int) (_ []schemas.WebhookDelivery, err error) {
+	defer db.observe(ctx, "GetWebhookDeliveries", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY created_at DESC, id DESC LIMIT 100",
+		webhookId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanWebhookDeliveries(rows)
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]schemas.WebhookDelivery, error) {
+	var deliveries []schemas.WebhookDelivery
+	for rows.Next() {
+		var delivery schemas.WebhookDelivery
+		var payload []byte
+		var nextAttemptAt sql.NullString
+		var deliveredAt sql.NullString
+		err := rows.Scan(
+			&delivery.Id,
+			&delivery.WebhookId,
+			&delivery.Event,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&nextAttemptAt,
+			&delivery.LastStatusCode,
+			&delivery.LastError,
+			&delivery.CreatedAt,
+			&deliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = payload
+		delivery.NextAttemptAt = nextAttemptAt.String
+		delivery.DeliveredAt = deliveredAt.String
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
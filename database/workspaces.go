@@ -0,0 +1,491 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+var (
+	ErrNotMember       = errors.New("user is not a member of the workspace")
+	ErrRoleNotAllowed  = errors.New("role of the user does not allow this")
+	ErrInvalidRole     = errors.New("role has to be admin or member")
+	ErrAlreadyMember   = errors.New("user is already a member of the workspace")
+	ErrOwnerLeaves     = errors.New("owner cannot leave the workspace")
+	ErrInvitationEmail = errors.New("invitation is addressed to another email")
+)
+
+const invitationColumns = `i.id, i.workspace_id, w.name, i.email, i.role, i.token,
+	coalesce(i.invited_by, 0), i.created_at, i.accepted_at`
+
+// AddWorkspace creates a workspace with the user as its owner.
+func (db *Database) AddWorkspace(ctx context.Context, userId int, name string, now time.Time) (_ int, err error) {
+	defer db.observe(ctx, "AddWorkspace", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "INSERT INTO workspaces (name, created_at) VALUES ($1, $2) RETURNING id", name, now.UTC())
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return -1, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)",
+		id,
+		userId,
+		RoleOwner)
+	if err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// GetWorkspaces returns the workspaces the user is a member of, together with
+// the role of the user in each of them.
+func (db *Database) GetWorkspaces(ctx context.Context, userId int) (_ []schemas.Workspace, err error) {
+	defer db.observe(ctx, "GetWorkspaces", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT w.id, w.name, w.created_at, m.role
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = $1 ORDER BY w.id`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var workspaces []schemas.Workspace
+	for rows.Next() {
+		var workspace schemas.Workspace
+		if err := rows.Scan(&workspace.Id, &workspace.Name, &workspace.CreatedAt, &workspace.Role); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, workspace)
+	}
+	return workspaces, rows.Err()
+}
+
+// GetWorkspace returns the workspace with its members, as seen by the user,
+// who has to be a member.
+func (db *Database) GetWorkspace(ctx context.Context, userId int, workspaceId int) (_ schemas.Workspace, err error) {
+	defer db.observe(ctx, "GetWorkspace", time.Now(), &err)
+	var workspace schemas.Workspace
+	role, err := memberRole(ctx, db.db, workspaceId, userId)
+	if err != nil {
+		return workspace, err
+	}
+	row := db.db.QueryRowContext(ctx, "SELECT id, name, created_at FROM workspaces WHERE id = $1", workspaceId)
+	if err := row.Scan(&workspace.Id, &workspace.Name, &workspace.CreatedAt); err != nil {
+		return workspace, err
+	}
+	workspace.Role = role
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT u.id, u.name, u.email, m.role
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1 ORDER BY u.id`,
+		workspaceId)
+	if err != nil {
+		return workspace, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member schemas.WorkspaceMember
+		if err := rows.Scan(&member.UserId, &member.Name, &member.Email, &member.Role); err != nil {
+			return workspace, err
+		}
+		workspace.Members = append(workspace.Members, member)
+	}
+	return workspace, rows.Err()
+}
+
+// DeleteWorkspace deletes the workspace with its activities and their
+// blocks. Only the owner may do so, and none of the blocks may be locked.
+func (db *Database) DeleteWorkspace(ctx context.Context, userId int, workspaceId int) (err error) {
+	defer db.observe(ctx, "DeleteWorkspace", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := requireRole(ctx, tx, workspaceId, userId, RoleOwner); err != nil {
+		return err
+	}
+	if err := checkBlocksUnlocked(ctx, tx, "b.activity_id IN (SELECT id FROM activities WHERE workspace_id = $1)", workspaceId); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM workspaces WHERE id = $1", workspaceId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateMemberRole changes the role of a member to admin or member. Only the
+// owner may change roles, and the role of the owner cannot be changed.
+func (db *Database) UpdateMemberRole(ctx context.Context, userId int, workspaceId int, memberId int, role string) (err error) {
+	defer db.observe(ctx, "UpdateMemberRole", time.Now(), &err)
+	if role != RoleAdmin && role != RoleMember {
+		return ErrInvalidRole
+	}
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := requireRole(ctx, tx, workspaceId, userId, RoleOwner); err != nil {
+		return err
+	}
+	current, err := memberRole(ctx, tx, workspaceId, memberId)
+	if err != nil {
+		return err
+	}
+	if current == RoleOwner {
+		return ErrRoleNotAllowed
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE workspace_members SET role = $1 WHERE workspace_id = $2 AND user_id = $3",
+		role,
+		workspaceId,
+		memberId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMember removes a member from the workspace. Every member but the
+// owner may leave, admins may remove members and the owner may remove
+// admins as well. The blocks of the member stay in the workspace.
+func (db *Database) RemoveMember(ctx context.Context, userId int, workspaceId int, memberId int) (err error) {
+	defer db.observe(ctx, "RemoveMember", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	role, err := memberRole(ctx, tx, workspaceId, userId)
+	if err != nil {
+		return err
+	}
+	target, err := memberRole(ctx, tx, workspaceId, memberId)
+	if err != nil {
+		return err
+	}
+	switch {
+	case target == RoleOwner && memberId == userId:
+		return ErrOwnerLeaves
+	case memberId == userId:
+	case target == RoleOwner || role == RoleMember:
+		return ErrRoleNotAllowed
+	case target == RoleAdmin && role != RoleOwner:
+		return ErrRoleNotAllowed
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2", workspaceId, memberId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddInvitation invites the email into the workspace with the given role.
+// Owners and admins may invite, the returned invitation carries the token
+// the invited user accepts it with.
+func (db *Database) AddInvitation(ctx context.Context, userId int, workspaceId int, email string, role string, now time.Time) (_ schemas.Invitation, err error) {
+	defer db.observe(ctx, "AddInvitation", time.Now(), &err)
+	if role != RoleAdmin && role != RoleMember {
+		return schemas.Invitation{}, ErrInvalidRole
+	}
+	if _, err := requireRole(ctx, db.db, workspaceId, userId, RoleOwner, RoleAdmin); err != nil {
+		return schemas.Invitation{}, err
+	}
+	row := db.db.QueryRowContext(ctx, `
+		SELECT count(*) FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1 AND lower(u.email) = lower($2)`,
+		workspaceId,
+		email)
+	var members int
+	if err := row.Scan(&members); err != nil {
+		return schemas.Invitation{}, err
+	}
+	if members > 0 {
+		return schemas.Invitation{}, ErrAlreadyMember
+	}
+
+	token, err := newInvitationToken()
+	if err != nil {
+		return schemas.Invitation{}, err
+	}
+	row = db.db.QueryRowContext(ctx, `
+		INSERT INTO workspace_invitations (email, role, token, created_at, invited_by, workspace_id)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		email,
+		role,
+		token,
+		now.UTC(),
+		userId,
+		workspaceId)
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return schemas.Invitation{}, err
+	}
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+invitationColumns+" FROM workspace_invitations i JOIN workspaces w ON w.id = i.workspace_id WHERE i.id = $1",
+		id)
+	if err != nil {
+		return schemas.Invitation{}, err
+	}
+	defer rows.Close()
+	invitations, err := scanInvitations(rows)
+	if err != nil {
+		return schemas.Invitation{}, err
+	}
+	if len(invitations) == 0 {
+		return schemas.Invitation{}, sql.ErrNoRows
+	}
+	return invitations[0], nil
+}
+
+// GetWorkspaceInvitations returns the pending invitations of the workspace
+// to its owner and admins.
+func (db *Database) GetWorkspaceInvitations(ctx context.Context, userId int, workspaceId int) (_ []schemas.Invitation, err error) {
+	defer db.observe(ctx, "GetWorkspaceInvitations", time.Now(), &err)
+	if _, err := requireRole(ctx, db.db, workspaceId, userId, RoleOwner, RoleAdmin); err != nil {
+		return nil, err
+	}
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT `+invitationColumns+` FROM workspace_invitations i JOIN workspaces w ON w.id = i.workspace_id
+		WHERE i.workspace_id = $1 AND i.accepted_at IS NULL ORDER BY i.id`,
+		workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanInvitations(rows)
+}
+
+// GetInvitations returns the pending invitations addressed to the email of
+// the user.
+func (db *Database) GetInvitations(ctx context.Context, userId int) (_ []schemas.Invitation, err error) {
+	defer db.observe(ctx, "GetInvitations", time.Now(), &err)
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT `+invitationColumns+` FROM workspace_invitations i JOIN workspaces w ON w.id = i.workspace_id
+		WHERE i.accepted_at IS NULL AND lower(i.email) = (SELECT lower(email) FROM users WHERE id = $1)
+		ORDER BY i.id`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanInvitations(rows)
+}
+
+// AcceptInvitation adds the user to the workspace of the invitation with the
+// invited role and returns the id of the workspace. The invitation has to be
+// pending and addressed to the email of the user.
+func (db *Database) AcceptInvitation(ctx context.Context, userId int, token string, now time.Time) (_ int, err error) {
+	defer db.observe(ctx, "AcceptInvitation", time.Now(), &err)
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		SELECT id, workspace_id, role, lower(email) = (SELECT lower(email) FROM users WHERE id = $2)
+		FROM workspace_invitations WHERE token = $1 AND accepted_at IS NULL FOR UPDATE`,
+		token,
+		userId)
+	var (
+		id          int
+		workspaceId int
+		role        string
+		addressed   sql.NullBool
+	)
+	if err := row.Scan(&id, &workspaceId, &role, &addressed); err != nil {
+		return -1, err
+	}
+	if !addressed.Bool {
+		return -1, ErrInvitationEmail
+	}
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO NOTHING`,
+		workspaceId,
+		userId,
+		role)
+	if err != nil {
+		return -1, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return -1, err
+	} else if affected == 0 {
+		return -1, ErrAlreadyMember
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE workspace_invitations SET accepted_at = $1 WHERE id = $2", now.UTC(), id); err != nil {
+		return -1, err
+	}
+	return workspaceId, tx.Commit()
+}
+
+// AddWorkspaceActivity adds an activity all members of the workspace can log
+// blocks against. Owners and admins may add activities.
+func (db *Database) AddWorkspaceActivity(ctx context.Context, userId int, workspaceId int, name string, uuid string) (_ int, err error) {
+	defer db.observe(ctx, "AddWorkspaceActivity", time.Now(), &err)
+	publicId, err := newUuid(uuid)
+	if err != nil {
+		return -1, err
+	}
+	if _, err := requireRole(ctx, db.db, workspaceId, userId, RoleOwner, RoleAdmin); err != nil {
+		return -1, err
+	}
+	id, err := db.insert(ctx,
+		"INSERT INTO activities (name, user_id, workspace_id, uuid) VALUES ($1, $2, $3, coalesce($4::uuid, gen_random_uuid())) RETURNING id",
+		name,
+		userId,
+		workspaceId,
+		publicId)
+	if err != nil {
+		return -1, uuidTaken(err)
+	}
+	return id, nil
+}
+
+// GetWorkspaceActivities returns the activities of the workspace with the
+// blocks of all members for owners and admins, and with their own blocks for
+// other members.
+func (db *Database) GetWorkspaceActivities(ctx context.Context, userId int, workspaceId int) (_ []schemas.Activity, err error) {
+	defer db.observe(ctx, "GetWorkspaceActivities", time.Now(), &err)
+	if _, err := memberRole(ctx, db.db, workspaceId, userId); err != nil {
+		return nil, err
+	}
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+activityColumns+" FROM activities WHERE workspace_id = $1 ORDER BY id",
+		workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return db.scanActivities(ctx, rows, userId)
+}
+
+// GetWorkspaceReport sums up the finished blocks of the workspace activities
+// per activity and member, without their pauses. The optional from and to
+// timestamps restrict the report to blocks started within that range. Owners
+// and admins may see the report.
+func (db *Database) GetWorkspaceReport(ctx context.Context, userId int, workspaceId int, from string, to string) (_ schemas.WorkspaceReport, err error) {
+	defer db.observe(ctx, "GetWorkspaceReport", time.Now(), &err)
+	report := schemas.WorkspaceReport{WorkspaceId: workspaceId, From: from, To: to}
+	if _, err := requireRole(ctx, db.db, workspaceId, userId, RoleOwner, RoleAdmin); err != nil {
+		return report, err
+	}
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT a.id, a.name, u.id, u.name, count(b.id),
+			coalesce(sum(extract(epoch FROM b.end_time - b.start_time) - coalesce(p.paused, 0)), 0)::int
+		FROM blocks b
+		JOIN activities a ON a.id = b.activity_id
+		JOIN users u ON u.id = b.user_id
+		LEFT JOIN LATERAL (
+			SELECT sum(extract(epoch FROM least(coalesce(end_time, b.end_time), b.end_time) - start_time)) AS paused
+			FROM pauses WHERE block_id = b.id
+		) p ON true
+		WHERE a.workspace_id = $1 AND b.end_time IS NOT NULL
+			AND ($2::timestamp IS NULL OR b.start_time >= $2::timestamp)
+			AND ($3::timestamp IS NULL OR b.start_time < $3::timestamp)
+		GROUP BY a.id, a.name, u.id, u.name
+		ORDER BY a.name, u.name`,
+		workspaceId,
+		newNullString(from),
+		newNullString(to))
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry schemas.ReportEntry
+		err := rows.Scan(&entry.ActivityId, &entry.ActivityName, &entry.UserId, &entry.UserName, &entry.Blocks, &entry.Seconds)
+		if err != nil {
+			return report, err
+		}
+		report.TotalSeconds += entry.Seconds
+		report.Entries = append(report.Entries, entry)
+	}
+	return report, rows.Err()
+}
+
+// memberRole returns the role of the user in the workspace, or ErrNotMember.
+func memberRole(ctx context.Context, q queryRower, workspaceId int, userId int) (string, error) {
+	row := q.QueryRowContext(ctx,
+		"SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+		workspaceId,
+		userId)
+	var role string
+	err := row.Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotMember
+	}
+	return role, err
+}
+
+// requireRole returns the role of the user in the workspace if it is one of
+// the given roles, otherwise ErrNotMember or ErrRoleNotAllowed.
+func requireRole(ctx context.Context, q queryRower, workspaceId int, userId int, roles ...string) (string, error) {
+	role, err := memberRole(ctx, q, workspaceId, userId)
+	if err != nil {
+		return "", err
+	}
+	for _, allowed := range roles {
+		if role == allowed {
+			return role, nil
+		}
+	}
+	return "", ErrRoleNotAllowed
+}
+
+func newInvitationToken() (string, error) {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token[:]), nil
+}
+
+func scanInvitations(rows *sql.Rows) ([]schemas.Invitation, error) {
+	var invitations []schemas.Invitation
+	for rows.Next() {
+		var invitation schemas.Invitation
+		var acceptedAt sql.NullString
+		err := rows.Scan(
+			&invitation.Id,
+			&invitation.WorkspaceId,
+			&invitation.WorkspaceName,
+			&invitation.Email,
+			&invitation.Role,
+			&invitation.Token,
+			&invitation.InvitedBy,
+			&invitation.CreatedAt,
+			&acceptedAt)
+		if err != nil {
+			return nil, err
+		}
+		invitation.AcceptedAt = acceptedAt.String
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
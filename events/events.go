@@ -0,0 +1,207 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	BlockStarted    = "block.started"
+	BlockPaused     = "block.paused"
+	BlockResumed    = "block.resumed"
+	BlockStopped    = "block.stopped"
+	BlockChanged    = "block.changed"
+	BlockDeleted    = "block.deleted"
+	ActivityChanged = "activity.changed"
+)
+
+// Resync tells a reconnecting subscriber that events it missed are no longer
+// known, so it has to reload its state instead of relying on the replay. It
+// is only sent to subscribers and cannot be subscribed to by webhooks.
+const Resync = "resync"
+
+var Types = []string{
+	BlockStarted,
+	BlockPaused,
+	BlockResumed,
+	BlockStopped,
+	BlockChanged,
+	BlockDeleted,
+	ActivityChanged,
+}
+
+func IsType(eventType string) bool {
+	for _, t := range Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// historySize is the number of events kept per user to replay them to
+// clients reconnecting with a Last-Event-ID.
+const historySize = 100
+
+const subscriberBuffer = 16
+
+type Event struct {
+	Id     int    `json:"id"`
+	UserId int    `json:"userId"`
+	Type   string `json:"type"`
+	Data   any    `json:"data"`
+}
+
+// Ref is the data of events about entities that are only referenced by id,
+// for example because they have been deleted.
+type Ref struct {
+	Id int `json:"id"`
+}
+
+// Hub distributes events to all subscribers of a user. Event ids are at
+// least the time of publishing in microseconds, so they keep increasing
+// across restarts, and ids from before the hub was created are recognized.
+type Hub struct {
+	mu          sync.Mutex
+	firstId     int
+	lastIds     map[int]int
+	trimmedIds  map[int]int
+	history     map[int][]Event
+	subscribers map[int]map[chan Event]struct{}
+	listeners   []func(Event)
+	closed      bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		firstId:     int(time.Now().UnixMicro()),
+		lastIds:     make(map[int]int),
+		trimmedIds:  make(map[int]int),
+		history:     make(map[int][]Event),
+		subscribers: make(map[int]map[chan Event]struct{}),
+	}
+}
+
+// Publish sends the event to every subscriber of the user. Subscribers that
+// cannot keep up are closed instead of missing the event, so they reconnect
+// with their Last-Event-ID and catch up from the history.
+func (h *Hub) Publish(userId int, eventType string, data any) Event {
+	h.mu.Lock()
+
+	event := Event{Id: h.nextId(userId), UserId: userId, Type: eventType, Data: data}
+	history := append(h.history[userId], event)
+	if len(history) > historySize {
+		h.trimmedIds[userId] = history[len(history)-historySize-1].Id
+		history = history[len(history)-historySize:]
+	}
+	h.history[userId] = history
+
+	for subscriber := range h.subscribers[userId] {
+		select {
+		case subscriber <- event:
+		default:
+			close(subscriber)
+			h.unsubscribe(userId, subscriber)
+		}
+	}
+	listeners := h.listeners
+	h.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+	return event
+}
+
+// Listen registers a function that is called synchronously with every
+// published event, regardless of the user. Listeners run inside the request
+// publishing the event, so they must not block; slow work belongs on a queue
+// of their own.
+func (h *Hub) Listen(listener func(Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, listener)
+}
+
+// Subscribe registers a subscriber for the events of the user. The events
+// published after lastEventId are returned separately. If some of them are no
+// longer in the history, for example after a restart, a Resync event with the
+// id of the last event is returned instead. The returned function removes the
+// subscription again.
+func (h *Hub) Subscribe(userId int, lastEventId int) (<-chan Event, []Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var missed []Event
+	if lastEventId > 0 {
+		lastId := h.lastId(userId)
+		complete := lastEventId >= h.firstId && lastEventId <= lastId && lastEventId >= h.trimmedIds[userId]
+		if !complete {
+			missed = []Event{{Id: lastId, UserId: userId, Type: Resync}}
+		} else {
+			for _, event := range h.history[userId] {
+				if event.Id > lastEventId {
+					missed = append(missed, event)
+				}
+			}
+		}
+	}
+
+	subscriber := make(chan Event, subscriberBuffer)
+	if h.closed {
+		close(subscriber)
+		return subscriber, missed, func() {}
+	}
+	if h.subscribers[userId] == nil {
+		h.subscribers[userId] = make(map[chan Event]struct{})
+	}
+	h.subscribers[userId][subscriber] = struct{}{}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.unsubscribe(userId, subscriber)
+	}
+	return subscriber, missed, unsubscribe
+}
+
+// unsubscribe removes the subscriber, which may already have been removed
+// for lagging behind. The caller must hold the lock.
+func (h *Hub) unsubscribe(userId int, subscriber chan Event) {
+	delete(h.subscribers[userId], subscriber)
+	if len(h.subscribers[userId]) == 0 {
+		delete(h.subscribers, userId)
+	}
+}
+
+// lastId returns the id of the last event of the user. The caller must hold
+// the lock.
+func (h *Hub) lastId(userId int) int {
+	if id, ok := h.lastIds[userId]; ok {
+		return id
+	}
+	return h.firstId
+}
+
+// nextId returns the id of the next event of the user. The caller must hold
+// the lock.
+func (h *Hub) nextId(userId int) int {
+	id := max(h.lastId(userId)+1, int(time.Now().UnixMicro()))
+	h.lastIds[userId] = id
+	return id
+}
+
+// Close ends all subscriptions by closing their channels, so streaming
+// handlers return when the server shuts down. Later subscriptions are closed
+// right away, publishing still reaches the history and the listeners.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for userId, subscribers := range h.subscribers {
+		for subscriber := range subscribers {
+			close(subscriber)
+		}
+		delete(h.subscribers, userId)
+	}
+}
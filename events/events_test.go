@@ -0,0 +1,105 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testUserId      = 1
+	testOtherUserId = 2
+)
+
+func TestPublish(t *testing.T) {
+	hub := NewHub()
+	subscription, missed, unsubscribe := hub.Subscribe(testUserId, 0)
+	defer unsubscribe()
+	assert.Equal(t, 0, len(missed))
+
+	hub.Publish(testOtherUserId, BlockStarted, nil)
+	published := hub.Publish(testUserId, BlockStarted, nil)
+	event := <-subscription
+	assert.Equal(t, published, event)
+	assert.Equal(t, 0, len(subscription))
+}
+
+func TestSubscribeReplaysMissedEvents(t *testing.T) {
+	hub := NewHub()
+	first := hub.Publish(testUserId, BlockStarted, nil)
+	second := hub.Publish(testUserId, BlockPaused, nil)
+	third := hub.Publish(testUserId, BlockStopped, nil)
+
+	_, missed, unsubscribe := hub.Subscribe(testUserId, first.Id)
+	defer unsubscribe()
+	assert.Equal(t, []Event{second, third}, missed)
+}
+
+func TestSubscribeResyncsUnknownEvents(t *testing.T) {
+	hub := NewHub()
+	first := hub.Publish(testUserId, BlockStarted, nil)
+	var last Event
+	for i := 0; i <= historySize; i++ {
+		last = hub.Publish(testUserId, BlockChanged, nil)
+	}
+
+	_, missed, unsubscribe := hub.Subscribe(testUserId, first.Id)
+	defer unsubscribe()
+	assert.Equal(t, []Event{{Id: last.Id, UserId: testUserId, Type: Resync}}, missed)
+
+	restarted := NewHub()
+	_, missed, unsubscribe = restarted.Subscribe(testUserId, last.Id)
+	defer unsubscribe()
+	assert.Equal(t, 1, len(missed))
+	assert.Equal(t, Resync, missed[0].Type)
+	assert.Less(t, first.Id, restarted.Publish(testUserId, BlockStarted, nil).Id)
+}
+
+func TestPublishClosesLaggingSubscribers(t *testing.T) {
+	hub := NewHub()
+	subscription, _, unsubscribe := hub.Subscribe(testUserId, 0)
+	defer unsubscribe()
+	for i := 0; i <= subscriberBuffer; i++ {
+		hub.Publish(testUserId, BlockChanged, nil)
+	}
+	received := 0
+	for range subscription {
+		received++
+	}
+	assert.Equal(t, subscriberBuffer, received)
+	assert.Equal(t, 0, len(hub.subscribers))
+}
+
+func TestUnsubscribe(t *testing.T) {
+	hub := NewHub()
+	subscription, _, unsubscribe := hub.Subscribe(testUserId, 0)
+	unsubscribe()
+	hub.Publish(testUserId, BlockStarted, nil)
+	assert.Equal(t, 0, len(subscription))
+	assert.Equal(t, 0, len(hub.subscribers))
+}
+
+func TestListen(t *testing.T) {
+	hub := NewHub()
+	var received []Event
+	hub.Listen(func(event Event) {
+		received = append(received, event)
+	})
+	first := hub.Publish(testUserId, BlockStarted, nil)
+	second := hub.Publish(testOtherUserId, BlockStarted, nil)
+	assert.Equal(t, []Event{first, second}, received)
+}
+
+func TestClose(t *testing.T) {
+	hub := NewHub()
+	subscription, _, unsubscribe := hub.Subscribe(testUserId, 0)
+	hub.Close()
+	_, ok := <-subscription
+	assert.False(t, ok)
+	unsubscribe()
+
+	hub.Publish(testUserId, BlockStarted, nil)
+	late, _, _ := hub.Subscribe(testUserId, 0)
+	_, ok = <-late
+	assert.False(t, ok)
+}
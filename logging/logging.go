@@ -0,0 +1,64 @@
+// Package logging sets up structured logging and carries the id of a
+// request through its context, so every record logged while handling the
+// request can be correlated.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+)
+
+type requestIdKey struct{}
+
+// WithRequestId returns a copy of the context carrying the request id.
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the request id of the context or an empty string.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// NewRequestId returns a random id of 16 hex characters.
+func NewRequestId() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// Handler adds the request id of the context to every record, when there is
+// one.
+type Handler struct {
+	slog.Handler
+}
+
+func (h Handler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestId(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return Handler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h Handler) WithGroup(name string) slog.Handler {
+	return Handler{h.Handler.WithGroup(name)}
+}
+
+// New returns a logger writing JSON records of at least the given level,
+// one of debug, info, warn or error.
+func New(w io.Writer, level string) (*slog.Logger, error) {
+	var minimum slog.Level
+	if err := minimum.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: minimum})
+	return slog.New(Handler{handler}), nil
+}
@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIdInRecords(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(&out, "info")
+	if err != nil {
+		t.Fatalf("could not create logger, %v", err)
+	}
+	ctx := WithRequestId(context.Background(), "abc")
+	logger.With("component", "test").InfoContext(ctx, "handled")
+	logger.DebugContext(ctx, "hidden")
+
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("could not read record, %v", err)
+	}
+	assert.Equal(t, "handled", record["msg"])
+	assert.Equal(t, "abc", record["request_id"])
+	assert.Equal(t, "test", record["component"])
+	assert.Equal(t, 1, bytes.Count(out.Bytes(), []byte("\n")))
+}
+
+func TestNewRejectsUnknownLevel(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, "verbose")
+	assert.Error(t, err)
+}
+
+func TestNewRequestId(t *testing.T) {
+	id := NewRequestId()
+	assert.Len(t, id, 16)
+	assert.NotEqual(t, id, NewRequestId())
+}
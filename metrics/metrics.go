@@ -0,0 +1,120 @@
+// Package metrics exposes Prometheus metrics of the HTTP server and the
+// database layer.
+package metrics
+
+import (
+	"database/sql"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "activities"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of database calls by method of the Database type.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"method"})
+
+	queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_query_errors_total",
+		Help:      "Number of failed database calls by method of the Database type.",
+	}, []string{"method"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the count and latency of requests, labelled with the
+// route pattern rather than the path so ids don't create new series.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveQuery records a call of a Database method.
+func ObserveQuery(method string, duration time.Duration, failed bool) {
+	queryDuration.WithLabelValues(method).Observe(duration.Seconds())
+	if failed {
+		queryErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// RegisterDatabase adds gauges for the connection pool and the number of
+// running blocks, read on every scrape.
+func RegisterDatabase(stats func() sql.DBStats, runningBlocks func() (int, error)) {
+	gauge := func(name string, help string, value func(sql.DBStats) float64) prometheus.Collector {
+		opts := prometheus.GaugeOpts{Namespace: namespace, Subsystem: "db_pool", Name: name, Help: help}
+		return prometheus.NewGaugeFunc(opts, func() float64 { return value(stats()) })
+	}
+	counter := func(name string, help string, value func(sql.DBStats) float64) prometheus.Collector {
+		opts := prometheus.CounterOpts{Namespace: namespace, Subsystem: "db_pool", Name: name, Help: help}
+		return prometheus.NewCounterFunc(opts, func() float64 { return value(stats()) })
+	}
+	prometheus.MustRegister(
+		gauge("max_open_connections", "Maximum number of open connections.",
+			func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }),
+		gauge("open_connections", "Number of open connections.",
+			func(s sql.DBStats) float64 { return float64(s.OpenConnections) }),
+		gauge("in_use_connections", "Number of connections in use.",
+			func(s sql.DBStats) float64 { return float64(s.InUse) }),
+		gauge("idle_connections", "Number of idle connections.",
+			func(s sql.DBStats) float64 { return float64(s.Idle) }),
+		counter("wait_count_total", "Number of connections waited for.",
+			func(s sql.DBStats) float64 { return float64(s.WaitCount) }),
+		counter("wait_duration_seconds_total", "Total time blocked waiting for a connection.",
+			func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }),
+		counter("max_idle_closed_total", "Number of connections closed due to the idle limit.",
+			func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }),
+		counter("max_lifetime_closed_total", "Number of connections closed due to the lifetime limit.",
+			func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "running_blocks",
+			Help:      "Number of blocks without an end time.",
+		}, func() float64 {
+			count, err := runningBlocks()
+			if err != nil {
+				slog.Error("could not count running blocks", "err", err)
+				return math.NaN()
+			}
+			return float64(count)
+		}),
+	)
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/block/:id", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for _, path := range []string{"/block/1", "/block/2", "/missing"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(httpRequests.WithLabelValues("GET", "/block/:id", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("GET", "unmatched", "404")))
+}
+
+func TestObserveQuery(t *testing.T) {
+	ObserveQuery("GetBlock", time.Millisecond, false)
+	ObserveQuery("GetBlock", time.Millisecond, true)
+	assert.Equal(t, 1.0, testutil.ToFloat64(queryErrors.WithLabelValues("GetBlock")))
+}
+
+func TestRegisterDatabase(t *testing.T) {
+	RegisterDatabase(
+		func() sql.DBStats { return sql.DBStats{OpenConnections: 3, InUse: 1} },
+		func() (int, error) { return 2, nil },
+	)
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("could not get metrics, %v", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	for _, line := range []string{
+		"activities_db_pool_open_connections 3",
+		"activities_db_pool_in_use_connections 1",
+		"activities_running_blocks 2",
+		`activities_db_query_errors_total{method="GetBlock"} 1`,
+	} {
+		assert.True(t, strings.Contains(string(body), line), "missing %q", line)
+	}
+}
@@ -1,6 +1,6 @@
 package schemas
 
-import "database/sql"
+import "encoding/json"
 
 type TableSchema struct {
 	Name    string
@@ -9,24 +9,35 @@ type TableSchema struct {
 
 type Pause struct {
 	Id        int    `json:"id"`
+	Uuid      string `json:"uuid"`
 	StartTime string `json:"startTime"`
 	EndTime   string `json:"endTime"`
 	BlockId   int    `json:"blockId"`
+	Version   int    `json:"version"`
 }
 
 type Block struct {
-	Id         int     `json:"id"`
-	StartTime  string  `json:"startTime"`
-	EndTime    string  `json:"endTime"`
-	ActivityId int     `json:"activityId"`
-	Pauses     []Pause `json:"pauses"`
+	Id          int      `json:"id"`
+	Uuid        string   `json:"uuid"`
+	StartTime   string   `json:"startTime"`
+	EndTime     string   `json:"endTime"`
+	ActivityId  int      `json:"activityId"`
+	Note        string   `json:"note"`
+	Tags        []string `json:"tags"`
+	AutoStopped bool     `json:"autoStopped"`
+	Pauses      []Pause  `json:"pauses"`
+	UserId      int      `json:"userId"`
+	Version     int      `json:"version"`
 }
 
 type Activity struct {
-	Id     int     `json:"id"`
-	Name   string  `json:"name"`
-	UserId int     `json:"userId"`
-	Blocks []Block `json:"blocks"`
+	Id          int     `json:"id"`
+	Uuid        string  `json:"uuid"`
+	Name        string  `json:"name"`
+	UserId      int     `json:"userId"`
+	WorkspaceId int     `json:"workspaceId"`
+	Version     int     `json:"version"`
+	Blocks      []Block `json:"blocks"`
 }
 
 type User struct {
@@ -43,27 +54,372 @@ type UserCreate struct {
 }
 
 type ActivityCreate struct {
+	Uuid   string `json:"uuid"`
 	Name   string `json:"name" binding:"required"`
 	UserId int    `json:"userId" binding:"required"`
 }
 
 type BlockCreate struct {
-	StartTime  string        `json:"startTime" binding:"required"`
-	EndTime    string        `json:"endTime" binding:"required"`
-	ActivityId int           `json:"activityId" binding:"required"`
-	Pauses     []PauseCreate `json:"pauses"`
+	Uuid         string        `json:"uuid"`
+	StartTime    string        `json:"startTime" binding:"required"`
+	EndTime      string        `json:"endTime"`
+	ActivityId   int           `json:"activityId"`
+	ActivityUuid string        `json:"activityUuid"`
+	Note         string        `json:"note"`
+	Tags         []string      `json:"tags"`
+	Pauses       []PauseCreate `json:"pauses"`
+	UserId       int           `json:"userId"`
 }
 
 type PauseCreate struct {
+	Uuid      string `json:"uuid"`
 	StartTime string `json:"startTime" binding:"required"`
 	EndTime   string `json:"endTime" binding:"required"`
 	BlockId   int    `json:"blockId"`
+	BlockUuid string `json:"blockUuid"`
 }
 
 type CurrentBlock struct {
-	Id         int            `json:"id"`
-	StartTime  string         `json:"startTime"`
-	EndTime    sql.NullString `json:"endTime"`
-	ActivityId int            `json:"activityId"`
-	Pauses     []Pause        `json:"pauses"`
+	Block
+	Pomodoro *PomodoroState `json:"pomodoro"`
+}
+
+type SearchResult struct {
+	Kind       string  `json:"kind"`
+	ActivityId int     `json:"activityId"`
+	BlockId    int     `json:"blockId"`
+	StartTime  string  `json:"startTime"`
+	Snippet    string  `json:"snippet"`
+	Rank       float64 `json:"rank"`
+}
+
+type BlockSplit struct {
+	At              string `json:"at" binding:"required"`
+	NewActivityId   int    `json:"newActivityId"`
+	NewActivityUuid string `json:"newActivityUuid"`
+}
+
+type BlockMerge struct {
+	Ids   []int    `json:"ids"`
+	Uuids []string `json:"uuids"`
+}
+
+type BlockMove struct {
+	BlockIds     []int    `json:"blockIds"`
+	BlockUuids   []string `json:"blockUuids"`
+	ActivityId   int      `json:"activityId"`
+	ActivityUuid string   `json:"activityUuid"`
+}
+
+type ActivityMerge struct {
+	SourceId   int    `json:"sourceId"`
+	SourceUuid string `json:"sourceUuid"`
+	TargetId   int    `json:"targetId"`
+	TargetUuid string `json:"targetUuid"`
+}
+
+type Settings struct {
+	UserId          int      `json:"userId" binding:"required"`
+	MaxBlockMinutes int      `json:"maxBlockMinutes"`
+	EndOfDay        string   `json:"endOfDay"`
+	Timezone        string   `json:"timezone"`
+	Pomodoro        Pomodoro `json:"pomodoro"`
+}
+
+type Pomodoro struct {
+	Enabled           bool `json:"enabled"`
+	WorkMinutes       int  `json:"workMinutes"`
+	ShortBreakMinutes int  `json:"shortBreakMinutes"`
+	LongBreakMinutes  int  `json:"longBreakMinutes"`
+	Cycles            int  `json:"cycles"`
+}
+
+type PomodoroState struct {
+	Phase            string `json:"phase"`
+	Cycle            int    `json:"cycle"`
+	PhaseEnd         string `json:"phaseEnd"`
+	RemainingSeconds int    `json:"remainingSeconds"`
+}
+
+type Login struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type TimerRequest struct {
+	UserId       int    `json:"userId" binding:"required"`
+	ActivityId   int    `json:"activityId"`
+	ActivityUuid string `json:"activityUuid"`
+	Time         string `json:"time"`
+}
+
+type TimerCommand struct {
+	Id           string `json:"id"`
+	Type         string `json:"type"`
+	ActivityId   int    `json:"activityId"`
+	ActivityUuid string `json:"activityUuid"`
+	Time         string `json:"time"`
+}
+
+type TimerMessage struct {
+	Type      string `json:"type"`
+	CommandId string `json:"commandId,omitempty"`
+	Ok        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	Event     string `json:"event,omitempty"`
+	EventId   int    `json:"eventId,omitempty"`
+	Data      any    `json:"data"`
+}
+
+type Webhook struct {
+	Id     int      `json:"id"`
+	Url    string   `json:"url"`
+	Secret string   `json:"-"`
+	Events []string `json:"events"`
+	UserId int      `json:"userId"`
+}
+
+type WebhookCreate struct {
+	Url    string   `json:"url" binding:"required,url"`
+	Secret string   `json:"secret" binding:"required"`
+	Events []string `json:"events"`
+	UserId int      `json:"userId" binding:"required"`
+}
+
+type WebhookDelivery struct {
+	Id             int             `json:"id"`
+	WebhookId      int             `json:"webhookId"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  string          `json:"nextAttemptAt"`
+	LastStatusCode int             `json:"lastStatusCode"`
+	LastError      string          `json:"lastError"`
+	CreatedAt      string          `json:"createdAt"`
+	DeliveredAt    string          `json:"deliveredAt"`
+}
+
+type WebhookPayload struct {
+	Event     string `json:"event"`
+	Timestamp string `json:"timestamp"`
+	Data      any    `json:"data"`
+}
+
+type Workspace struct {
+	Id        int               `json:"id"`
+	Name      string            `json:"name"`
+	CreatedAt string            `json:"createdAt"`
+	Role      string            `json:"role"`
+	Members   []WorkspaceMember `json:"members"`
+}
+
+type WorkspaceMember struct {
+	UserId int    `json:"userId"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+}
+
+type WorkspaceCreate struct {
+	Name   string `json:"name" binding:"required"`
+	UserId int    `json:"userId" binding:"required"`
+}
+
+type MemberUpdate struct {
+	Role   string `json:"role" binding:"required"`
+	UserId int    `json:"userId" binding:"required"`
+}
+
+type Invitation struct {
+	Id            int    `json:"id"`
+	WorkspaceId   int    `json:"workspaceId"`
+	WorkspaceName string `json:"workspaceName"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	Token         string `json:"token"`
+	InvitedBy     int    `json:"invitedBy"`
+	CreatedAt     string `json:"createdAt"`
+	AcceptedAt    string `json:"acceptedAt"`
+}
+
+type InvitationCreate struct {
+	Email  string `json:"email" binding:"required,email"`
+	Role   string `json:"role" binding:"required"`
+	UserId int    `json:"userId" binding:"required"`
+}
+
+type InvitationAccept struct {
+	UserId int `json:"userId" binding:"required"`
+}
+
+type WorkspaceReport struct {
+	WorkspaceId  int           `json:"workspaceId"`
+	From         string        `json:"from"`
+	To           string        `json:"to"`
+	TotalSeconds int           `json:"totalSeconds"`
+	Entries      []ReportEntry `json:"entries"`
+}
+
+type ReportEntry struct {
+	ActivityId   int    `json:"activityId"`
+	ActivityName string `json:"activityName"`
+	UserId       int    `json:"userId"`
+	UserName     string `json:"userName"`
+	Blocks       int    `json:"blocks"`
+	Seconds      int    `json:"seconds"`
+}
+
+type Timesheet struct {
+	UserId       int              `json:"userId"`
+	WeekStart    string           `json:"weekStart"`
+	WeekEnd      string           `json:"weekEnd"`
+	Status       string           `json:"status"`
+	TotalSeconds int              `json:"totalSeconds"`
+	Blocks       []Block          `json:"blocks"`
+	Events       []TimesheetEvent `json:"events"`
+}
+
+type TimesheetEvent struct {
+	Id        int    `json:"id"`
+	UserId    int    `json:"userId"`
+	UserName  string `json:"userName"`
+	Action    string `json:"action"`
+	Comment   string `json:"comment"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type TimesheetAction struct {
+	UserId  int    `json:"userId" binding:"required"`
+	Comment string `json:"comment"`
+}
+
+type LockDate struct {
+	Id          int    `json:"id"`
+	UserId      int    `json:"userId"`
+	WorkspaceId int    `json:"workspaceId"`
+	LockDate    string `json:"lockDate"`
+	SetBy       int    `json:"setBy"`
+	UpdatedAt   string `json:"updatedAt"`
+}
+
+type LockDateUpdate struct {
+	LockDate string `json:"lockDate" binding:"required"`
+	UserId   int    `json:"userId" binding:"required"`
+}
+
+type AuditEntry struct {
+	Id        int             `json:"id"`
+	Entity    string          `json:"entity"`
+	EntityId  int             `json:"entityId"`
+	Action    string          `json:"action"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	UserId    int             `json:"userId"`
+	RequestId string          `json:"requestId"`
+	CreatedAt string          `json:"createdAt"`
+}
+
+type BlockRevision struct {
+	BlockId    int             `json:"blockId"`
+	Revision   int             `json:"revision"`
+	StartTime  string          `json:"startTime"`
+	EndTime    string          `json:"endTime"`
+	ActivityId int             `json:"activityId"`
+	Note       string          `json:"note"`
+	Tags       []string        `json:"tags"`
+	Pauses     []RevisionPause `json:"pauses"`
+	UserId     int             `json:"userId"`
+	CreatedAt  string          `json:"createdAt"`
+}
+
+type RevisionPause struct {
+	Uuid      string `json:"uuid,omitempty"`
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+}
+
+type BlockDiff struct {
+	BlockId int           `json:"blockId"`
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []FieldChange `json:"changes"`
+}
+
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before any    `json:"before"`
+	After  any    `json:"after"`
+}
+
+type SyncChanges struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+	HasMore bool     `json:"hasMore"`
+}
+
+type Change struct {
+	Entity    string    `json:"entity"`
+	Id        int       `json:"id"`
+	ClientId  string    `json:"clientId,omitempty"`
+	Action    string    `json:"action"`
+	ChangedAt string    `json:"changedAt,omitempty"`
+	Activity  *Activity `json:"activity,omitempty"`
+	Block     *Block    `json:"block,omitempty"`
+	Pause     *Pause    `json:"pause,omitempty"`
+}
+
+type SyncRequest struct {
+	UserId    int            `json:"userId" binding:"required"`
+	Mutations []SyncMutation `json:"mutations" binding:"required"`
+}
+
+type SyncMutation struct {
+	Entity           string `json:"entity"`
+	Action           string `json:"action"`
+	ClientId         string `json:"clientId"`
+	Id               int    `json:"id"`
+	Version          int    `json:"version"`
+	Name             string `json:"name"`
+	StartTime        string `json:"startTime"`
+	EndTime          string `json:"endTime"`
+	Note             string `json:"note"`
+	ActivityId       int    `json:"activityId"`
+	ActivityClientId string `json:"activityClientId"`
+	BlockId          int    `json:"blockId"`
+	BlockClientId    string `json:"blockClientId"`
+}
+
+type SyncResult struct {
+	Entity   string  `json:"entity"`
+	Action   string  `json:"action"`
+	ClientId string  `json:"clientId,omitempty"`
+	Id       int     `json:"id"`
+	Version  int     `json:"version"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Current  *Change `json:"current,omitempty"`
+}
+
+type BatchRequest struct {
+	UserId     int              `json:"userId" binding:"required"`
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations" binding:"required"`
+}
+
+type BatchOperation struct {
+	SyncMutation
+	Ref         string `json:"ref"`
+	ActivityRef string `json:"activityRef"`
+	BlockRef    string `json:"blockRef"`
+}
+
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+type BatchResult struct {
+	SyncResult
+	Ref string `json:"ref,omitempty"`
 }
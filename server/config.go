@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the server. They are read from an optional
+// JSON file, then from environment variables and finally from flags, each
+// source overriding the previous one.
+type Config struct {
+	Listen      string         `json:"listen"`
+	Database    DatabaseConfig `json:"database"`
+	CORSOrigins []string       `json:"corsOrigins"`
+	LogLevel    string         `json:"logLevel"`
+	TLS         TLSConfig      `json:"tls"`
+	Features    Features       `json:"features"`
+	// RequestTimeout bounds the database calls of a request, ShutdownTimeout
+	// the time requests in flight are given to finish on shutdown.
+	RequestTimeout  Duration `json:"requestTimeout"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// IdempotencyRetention is how long the responses to requests with an
+	// Idempotency-Key header are kept for repetitions of the request.
+	IdempotencyRetention Duration `json:"idempotencyRetention"`
+	// SessionLifetime is how long the token returned by /login is valid.
+	SessionLifetime Duration `json:"sessionLifetime"`
+}
+
+// DatabaseConfig either holds a complete connection string in URL or the
+// individual fields it is assembled from.
+type DatabaseConfig struct {
+	URL             string `json:"url"`
+	Host            string `json:"host"`
+	Port            string `json:"port"`
+	User            string `json:"user"`
+	Password        string `json:"password"`
+	Name            string `json:"name"`
+	ConnectAttempts int    `json:"connectAttempts"`
+}
+
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+// Duration is written like "10s" or "1m30s" in the config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type Features struct {
+	IdleStop bool `json:"idleStop"`
+	Pomodoro bool `json:"pomodoro"`
+	Webhooks bool `json:"webhooks"`
+	// PrivateWebhooks allows webhooks to loopback and private addresses,
+	// e.g. to deliver them to a receiver running on the same machine.
+	PrivateWebhooks bool `json:"privateWebhooks"`
+	// ResetDatabase clears all tables at startup and adds a demo user.
+	ResetDatabase bool `json:"resetDatabase"`
+}
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:      ":8080",
+		Database:    DatabaseConfig{Port: "5432", ConnectAttempts: 5},
+		CORSOrigins: []string{"*"},
+		LogLevel:    "info",
+		Features:    Features{IdleStop: true, Pomodoro: true, Webhooks: true},
+
+		RequestTimeout:  Duration(10 * time.Second),
+		ShutdownTimeout: Duration(30 * time.Second),
+
+		IdempotencyRetention: Duration(24 * time.Hour),
+		SessionLifetime:      Duration(30 * 24 * time.Hour),
+	}
+}
+
+// option binds a field of the config to a flag and an environment variable.
+type option struct {
+	flag  string
+	env   string
+	usage string
+	field func(cfg *Config) any
+}
+
+var options = []option{
+	{"listen", "ACTIVITIES_LISTEN", "address to listen on", func(cfg *Config) any { return &cfg.Listen }},
+	{"database-url", "DATABASE_URL", "connection string of the database, replaces the db-* settings", func(cfg *Config) any { return &cfg.Database.URL }},
+	{"db-host", "DB_HOST", "host of the database", func(cfg *Config) any { return &cfg.Database.Host }},
+	{"db-port", "DB_PORT", "port of the database", func(cfg *Config) any { return &cfg.Database.Port }},
+	{"db-user", "DB_USER", "user of the database", func(cfg *Config) any { return &cfg.Database.User }},
+	{"db-password", "DB_PW", "password of the database user", func(cfg *Config) any { return &cfg.Database.Password }},
+	{"db-name", "DB_NAME", "name of the database", func(cfg *Config) any { return &cfg.Database.Name }},
+	{"db-connect-attempts", "DB_CONNECT_ATTEMPTS", "attempts to reach the database at startup", func(cfg *Config) any { return &cfg.Database.ConnectAttempts }},
+	{"cors-origins", "ACTIVITIES_CORS_ORIGINS", "comma separated allowed origins, * allows all except for /ws", func(cfg *Config) any { return &cfg.CORSOrigins }},
+	{"log-level", "ACTIVITIES_LOG_LEVEL", "one of " + strings.Join(logLevels, ", "), func(cfg *Config) any { return &cfg.LogLevel }},
+	{"tls-cert", "ACTIVITIES_TLS_CERT", "certificate file, serves HTTPS together with tls-key", func(cfg *Config) any { return &cfg.TLS.CertFile }},
+	{"tls-key", "ACTIVITIES_TLS_KEY", "private key file of the certificate", func(cfg *Config) any { return &cfg.TLS.KeyFile }},
+	{"idle-stop", "ACTIVITIES_IDLE_STOP", "stop forgotten timers automatically", func(cfg *Config) any { return &cfg.Features.IdleStop }},
+	{"pomodoro", "ACTIVITIES_POMODORO", "insert the pauses of users in pomodoro mode", func(cfg *Config) any { return &cfg.Features.Pomodoro }},
+	{"webhooks", "ACTIVITIES_WEBHOOKS", "deliver webhooks", func(cfg *Config) any { return &cfg.Features.Webhooks }},
+	{"private-webhooks", "ACTIVITIES_PRIVATE_WEBHOOKS", "allow webhooks to loopback and private addresses", func(cfg *Config) any { return &cfg.Features.PrivateWebhooks }},
+	{"request-timeout", "ACTIVITIES_REQUEST_TIMEOUT", "time the database calls of a request may take", func(cfg *Config) any { return &cfg.RequestTimeout }},
+	{"shutdown-timeout", "ACTIVITIES_SHUTDOWN_TIMEOUT", "time requests are given to finish on shutdown", func(cfg *Config) any { return &cfg.ShutdownTimeout }},
+	{"idempotency-retention", "ACTIVITIES_IDEMPOTENCY_RETENTION", "time responses are kept for repeated requests with an idempotency key", func(cfg *Config) any { return &cfg.IdempotencyRetention }},
+	{"session-lifetime", "ACTIVITIES_SESSION_LIFETIME", "time the token returned by a login is valid", func(cfg *Config) any { return &cfg.SessionLifetime }},
+	{"reset-database", "ACTIVITIES_RESET_DATABASE", "clear the database at startup and add a demo user", func(cfg *Config) any { return &cfg.Features.ResetDatabase }},
+}
+
+// flagValue records the value of a flag, to be applied after the file and
+// the environment have been read.
+type flagValue struct {
+	isBool bool
+	value  *string
+}
+
+func (v flagValue) String() string {
+	if v.value == nil {
+		return ""
+	}
+	return *v.value
+}
+
+func (v flagValue) Set(value string) error {
+	*v.value = value
+	return nil
+}
+
+func (v flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// loadConfig reads the config from the file given by --config or
+// ACTIVITIES_CONFIG, the environment and the flags in args, and validates it.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path of a JSON config file, also read from ACTIVITIES_CONFIG")
+	values := make(map[string]*string)
+	for _, opt := range options {
+		_, isBool := opt.field(&cfg).(*bool)
+		values[opt.flag] = new(string)
+		flags.Var(flagValue{isBool: isBool, value: values[opt.flag]}, opt.flag, fmt.Sprintf("%s (%s)", opt.usage, opt.env))
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv("ACTIVITIES_CONFIG")
+	}
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, fmt.Errorf("could not read config file: %w", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("could not parse config file %s: %w", *configFile, err)
+		}
+	}
+
+	for _, opt := range options {
+		if value, ok := lookupEnv(opt.env); ok {
+			if err := setField(opt.field(&cfg), value); err != nil {
+				return cfg, fmt.Errorf("invalid %s: %w", opt.env, err)
+			}
+		}
+	}
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		for _, opt := range options {
+			if opt.flag == f.Name && flagErr == nil {
+				if err := setField(opt.field(&cfg), *values[opt.flag]); err != nil {
+					flagErr = fmt.Errorf("invalid --%s: %w", opt.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+	return cfg, cfg.validate()
+}
+
+func setField(field any, value string) error {
+	switch field := field.(type) {
+	case *string:
+		*field = value
+	case *int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*field = number
+	case *bool:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field = enabled
+	case *Duration:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", value)
+		}
+		*field = Duration(duration)
+	case *[]string:
+		*field = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported field type %T", field)
+	}
+	return nil
+}
+
+// validate reports all problems of the config at once.
+func (cfg Config) validate() error {
+	var problems []string
+	if cfg.Listen == "" {
+		problems = append(problems, "listen address is empty")
+	}
+	if cfg.Database.URL == "" && (cfg.Database.Host == "" || cfg.Database.Name == "") {
+		problems = append(problems, "database needs a url or a host and a name")
+	}
+	if cfg.Database.URL == "" && cfg.Database.Port != "" {
+		if port, err := strconv.Atoi(cfg.Database.Port); err != nil || port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("database port %q is invalid", cfg.Database.Port))
+		}
+	}
+	if cfg.Database.ConnectAttempts < 1 {
+		problems = append(problems, "database connect attempts must be at least 1")
+	}
+	for _, origin := range cfg.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" {
+			problems = append(problems, fmt.Sprintf("cors origin %q is not of the form scheme://host[:port]", origin))
+		}
+	}
+	if !contains(logLevels, cfg.LogLevel) {
+		problems = append(problems, fmt.Sprintf("log level %q is not one of %s", cfg.LogLevel, strings.Join(logLevels, ", ")))
+	}
+	if cfg.RequestTimeout <= 0 {
+		problems = append(problems, "request timeout must be positive")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		problems = append(problems, "shutdown timeout must not be negative")
+	}
+	if cfg.IdempotencyRetention <= 0 {
+		problems = append(problems, "idempotency retention must be positive")
+	}
+	if cfg.SessionLifetime <= 0 {
+		problems = append(problems, "session lifetime must be positive")
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		problems = append(problems, "tls needs both a certificate and a key file")
+	}
+	for _, file := range []string{cfg.TLS.CertFile, cfg.TLS.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			problems = append(problems, fmt.Sprintf("tls file %s is not readable", file))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// connStr returns the connection string of the database.
+func (cfg DatabaseConfig) connStr() string {
+	if cfg.URL != "" {
+		return cfg.URL
+	}
+	var parts []string
+	for _, part := range []struct{ key, value string }{
+		{"host", cfg.Host},
+		{"port", cfg.Port},
+		{"user", cfg.User},
+		{"password", cfg.Password},
+		{"dbname", cfg.Name},
+	} {
+		if part.value != "" {
+			parts = append(parts, part.key+"="+quoteConnValue(part.value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteConnValue quotes values containing spaces or quotes, as required by
+// the key/value format of libpq.
+func quoteConnValue(value string) string {
+	if !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+}
+
+// allowsAllOrigins reports whether the CORS origins contain the wildcard.
+func (cfg Config) allowsAllOrigins() bool {
+	return contains(cfg.CORSOrigins, "*")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
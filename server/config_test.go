@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(nil, env(map[string]string{"DB_HOST": "localhost", "DB_NAME": "activities"}))
+	if err != nil {
+		t.Fatalf("could not load config, %v", err)
+	}
+	assert.Equal(t, ":8080", cfg.Listen)
+	assert.Equal(t, []string{"*"}, cfg.CORSOrigins)
+	assert.True(t, cfg.Features.IdleStop)
+	assert.False(t, cfg.Features.ResetDatabase)
+	assert.Equal(t, Duration(10*time.Second), cfg.RequestTimeout)
+	assert.Equal(t, Duration(24*time.Hour), cfg.IdempotencyRetention)
+	assert.Equal(t, Duration(30*24*time.Hour), cfg.SessionLifetime)
+	assert.Equal(t, "host=localhost port=5432 dbname=activities", cfg.Database.connStr())
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	content := `{
+		"listen": ":9000",
+		"logLevel": "debug",
+		"database": {"host": "file-host", "name": "file-db", "user": "file-user"},
+		"features": {"webhooks": false},
+		"requestTimeout": "5s",
+		"shutdownTimeout": "1m"
+	}`
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write config file, %v", err)
+	}
+
+	cfg, err := loadConfig(
+		[]string{"--listen", ":9002", "--reset-database", "--cors-origins", "https://a.example, https://b.example"},
+		env(map[string]string{
+			"ACTIVITIES_CONFIG":           file,
+			"ACTIVITIES_LISTEN":           ":9001",
+			"DB_HOST":                     "env-host",
+			"DB_PW":                       "secret word",
+			"ACTIVITIES_WEBHOOKS":         "true",
+			"ACTIVITIES_IDLE_STOP":        "false",
+			"ACTIVITIES_SHUTDOWN_TIMEOUT": "45s",
+		}),
+	)
+	if err != nil {
+		t.Fatalf("could not load config, %v", err)
+	}
+	assert.Equal(t, ":9002", cfg.Listen)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.Equal(t, "env-host", cfg.Database.Host)
+	assert.Equal(t, "file-db", cfg.Database.Name)
+	assert.True(t, cfg.Features.Webhooks)
+	assert.False(t, cfg.Features.IdleStop)
+	assert.True(t, cfg.Features.Pomodoro)
+	assert.True(t, cfg.Features.ResetDatabase)
+	assert.Equal(t, Duration(5*time.Second), cfg.RequestTimeout)
+	assert.Equal(t, Duration(45*time.Second), cfg.ShutdownTimeout)
+	assert.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.CORSOrigins)
+	assert.Equal(t,
+		`host=env-host port=5432 user=file-user password='secret word' dbname=file-db`,
+		cfg.Database.connStr())
+}
+
+func TestConfigValidation(t *testing.T) {
+	_, err := loadConfig(
+		[]string{"--log-level", "verbose", "--tls-cert", "cert.pem", "--cors-origins", "example.com", "--db-port", "x"},
+		env(nil),
+	)
+	if err == nil {
+		t.Fatal("expected an invalid config")
+	}
+	for _, problem := range []string{
+		"database needs a url or a host and a name",
+		`database port "x" is invalid`,
+		`cors origin "example.com"`,
+		`log level "verbose"`,
+		"tls needs both a certificate and a key file",
+		"tls file cert.pem is not readable",
+	} {
+		assert.True(t, strings.Contains(err.Error(), problem), "missing %q in %v", problem, err)
+	}
+
+	_, err = loadConfig([]string{"--db-connect-attempts", "many"}, env(nil))
+	assert.ErrorContains(t, err, "--db-connect-attempts")
+	_, err = loadConfig(nil, env(map[string]string{"DATABASE_URL": "postgres://localhost/activities", "ACTIVITIES_POMODORO": "maybe"}))
+	assert.ErrorContains(t, err, "ACTIVITIES_POMODORO")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/kilianmandscharo/activities/database"
+	"github.com/kilianmandscharo/activities/events"
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+const (
+	heartbeatInterval = 15 * time.Second
+	reconnectDelay    = 3 * time.Second
+)
+
+func streamEvents(hub *events.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		lastEventId, _ := strconv.Atoi(c.GetHeader("Last-Event-ID"))
+		subscription, missed, unsubscribe := hub.Subscribe(userId, lastEventId)
+		defer unsubscribe()
+
+		c.Status(http.StatusOK)
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Render(-1, sse.Event{Event: "connected", Retry: uint(reconnectDelay.Milliseconds()), Data: gin.H{"userId": userId}})
+		for _, event := range missed {
+			c.Render(-1, newSSEvent(event))
+		}
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case event, ok := <-subscription:
+				if !ok {
+					return false
+				}
+				c.Render(-1, newSSEvent(event))
+			case <-heartbeat.C:
+				if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+					return false
+				}
+			}
+			return true
+		})
+	}
+}
+
+func newSSEvent(event events.Event) sse.Event {
+	return sse.Event{Id: strconv.Itoa(event.Id), Event: event.Type, Data: event.Data}
+}
+
+// publishBlock publishes the current state of the block to its user.
+func publishBlock(ctx context.Context, hub *events.Hub, db *database.Database, eventType string, blockId int) {
+	userId, err := db.GetBlockUserId(ctx, blockId)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not publish block event", "err", err)
+		return
+	}
+	block, err := db.GetBlock(ctx, blockId)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not publish block event", "err", err)
+		return
+	}
+	hub.Publish(userId, eventType, block)
+}
+
+// publishPause publishes a paused or resumed event when the pause belongs to
+// the running block, depending on whether the pause is still ongoing.
+func publishPause(ctx context.Context, hub *events.Hub, db *database.Database, pause schemas.PauseCreate) {
+	block, err := db.GetBlock(ctx, pause.BlockId)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not publish pause event", "err", err)
+		return
+	}
+	eventType := events.BlockChanged
+	if block.EndTime == "" {
+		eventType = events.BlockResumed
+		end, err := time.Parse(time.RFC3339Nano, pause.EndTime)
+		if pause.EndTime == "" || (err == nil && end.After(time.Now())) {
+			eventType = events.BlockPaused
+		}
+	}
+	publishBlock(ctx, hub, db, eventType, pause.BlockId)
+}
+
+func publishActivity(ctx context.Context, hub *events.Hub, db *database.Database, activityId int) {
+	userId, err := db.GetActivityUserId(ctx, activityId)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not publish activity event", "err", err)
+		return
+	}
+	hub.Publish(userId, events.ActivityChanged, events.Ref{Id: activityId})
+}
+
+// publishSyncResults publishes an event for every applied mutation of a sync,
+// except for deleted pauses, whose block is no longer known.
+func publishSyncResults(ctx context.Context, hub *events.Hub, db *database.Database, userId int, results []schemas.SyncResult) {
+	for _, result := range results {
+		if result.Status != database.SyncApplied {
+			continue
+		}
+		switch {
+		case result.Entity == "activity" && result.Action == database.MutationDelete:
+			hub.Publish(userId, events.ActivityChanged, events.Ref{Id: result.Id})
+		case result.Entity == "activity":
+			publishActivity(ctx, hub, db, result.Id)
+		case result.Entity == "block" && result.Action == database.MutationDelete:
+			hub.Publish(userId, events.BlockDeleted, events.Ref{Id: result.Id})
+		case result.Entity == "block":
+			publishBlock(ctx, hub, db, events.BlockChanged, result.Id)
+		case result.Entity == "pause" && result.Action != database.MutationDelete:
+			if pause, err := db.GetPause(ctx, result.Id); err == nil {
+				publishBlock(ctx, hub, db, events.BlockChanged, pause.BlockId)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+	"github.com/kilianmandscharo/activities/client"
+	"github.com/kilianmandscharo/activities/database"
+	"github.com/kilianmandscharo/activities/events"
+	"github.com/kilianmandscharo/activities/schemas"
+	"github.com/kilianmandscharo/activities/webhooks"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClient starts the server on a cleared database and returns a client
+// for it. The test is skipped when no database is configured.
+func newTestClient(t *testing.T) *client.Client {
+	if err := godotenv.Load("../.env"); err != nil {
+		t.Skip("no ../.env with database settings")
+	}
+	connStr := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PW"),
+		os.Getenv("DB_NAME"))
+	db, err := database.New(connStr)
+	if err != nil {
+		t.Fatalf("could not open database, %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Init(context.Background()); err != nil {
+		t.Fatalf("could not init database, %v", err)
+	}
+	if err := db.Clear(context.Background()); err != nil {
+		t.Fatalf("could not clear database, %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(newRouter(defaultConfig(), db, events.NewHub(), webhooks.NewWorker(db, true)))
+	t.Cleanup(server.Close)
+	return client.New(server.URL, server.Client())
+}
+
+func TestTimerThroughClient(t *testing.T) {
+	c := newTestClient(t)
+
+	user, err := c.CreateUser(schemas.UserCreate{Name: "Apollo", Email: "test@gmail.com", Password: "12345"})
+	if err != nil {
+		t.Fatalf("could not add user, %v", err)
+	}
+	login, err := c.Login(schemas.Login{Email: "test@gmail.com", Password: "12345"})
+	if err != nil {
+		t.Fatalf("could not log in, %v", err)
+	}
+	assert.Equal(t, user.Id, login.Id)
+	c = c.WithToken(login.Token)
+	_, err = c.GetTimer(user.Id + 1)
+	apiErr, ok := err.(*client.Error)
+	if assert.True(t, ok, "expected a client error, got %v", err) {
+		assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+	}
+
+	activity, err := c.CreateActivity(schemas.ActivityCreate{Name: "Running", UserId: user.Id})
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	started, err := c.RunTimerCommand("start", schemas.TimerRequest{
+		UserId: user.Id, ActivityId: activity.Id, Time: "2023-02-01T14:00:00Z",
+	})
+	if err != nil {
+		t.Fatalf("could not start timer, %v", err)
+	}
+	current, err := c.GetTimer(user.Id)
+	if err != nil {
+		t.Fatalf("could not get timer, %v", err)
+	}
+	assert.Equal(t, started.Id, current.Id)
+
+	stopped, err := c.RunTimerCommand("stop", schemas.TimerRequest{UserId: user.Id, Time: "2023-02-01T14:30:00Z"})
+	if err != nil {
+		t.Fatalf("could not stop timer, %v", err)
+	}
+	assert.Equal(t, "2023-02-01T14:30:00Z", stopped.EndTime)
+
+	_, err = c.RunTimerCommand("stop", schemas.TimerRequest{UserId: user.Id})
+	apiErr, ok = err.(*client.Error)
+	if assert.True(t, ok, "expected a client error, got %v", err) {
+		assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+	}
+
+	activities, err := c.GetActivities(user.Id)
+	if err != nil {
+		t.Fatalf("could not get activities, %v", err)
+	}
+	assert.Len(t, activities, 1)
+	assert.Len(t, activities[0].Blocks, 1)
+}
+
+// TestReferencesByUuid makes sure request bodies may refer to other entities
+// by their UUIDs instead of their ids.
+func TestReferencesByUuid(t *testing.T) {
+	c := newTestClient(t)
+
+	user, err := c.CreateUser(schemas.UserCreate{Name: "Apollo", Email: "test@gmail.com", Password: "12345"})
+	if err != nil {
+		t.Fatalf("could not add user, %v", err)
+	}
+	created, err := c.CreateActivity(schemas.ActivityCreate{Name: "Running", UserId: user.Id})
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	activity, err := c.GetActivity(created.Id)
+	if err != nil {
+		t.Fatalf("could not get activity, %v", err)
+	}
+	block, err := c.CreateBlock(schemas.BlockCreate{
+		StartTime: "2023-02-01T14:00:00Z", EndTime: "2023-02-01T15:00:00Z", ActivityUuid: activity.Uuid,
+	})
+	if err != nil {
+		t.Fatalf("could not add block, %v", err)
+	}
+	created, err = c.CreateActivity(schemas.ActivityCreate{Name: "Cycling", UserId: user.Id})
+	if err != nil {
+		t.Fatalf("could not add activity, %v", err)
+	}
+	target, err := c.GetActivity(created.Id)
+	if err != nil {
+		t.Fatalf("could not get activity, %v", err)
+	}
+	stored, err := c.GetBlock(block.Id)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, activity.Id, stored.ActivityId)
+	if _, err := c.CreatePause(schemas.PauseCreate{
+		StartTime: "2023-02-01T14:10:00Z", EndTime: "2023-02-01T14:20:00Z", BlockUuid: stored.Uuid,
+	}); err != nil {
+		t.Fatalf("could not add pause, %v", err)
+	}
+	if err := c.MoveBlocks(client.MoveBlocksParams{UserId: user.Id}, schemas.BlockMove{BlockUuids: []string{stored.Uuid}, ActivityUuid: target.Uuid}); err != nil {
+		t.Fatalf("could not move blocks, %v", err)
+	}
+	stored, err = c.GetBlock(block.Id)
+	if err != nil {
+		t.Fatalf("could not get block, %v", err)
+	}
+	assert.Equal(t, target.Id, stored.ActivityId)
+	assert.Len(t, stored.Pauses, 1)
+
+	started, err := c.RunTimerCommand("start", schemas.TimerRequest{
+		UserId: user.Id, ActivityUuid: target.Uuid, Time: "2023-02-01T16:00:00Z",
+	})
+	if err != nil {
+		t.Fatalf("could not start timer, %v", err)
+	}
+	assert.Equal(t, target.Id, started.ActivityId)
+
+	_, err = c.CreateBlock(schemas.BlockCreate{StartTime: "2023-02-01T14:00:00Z", ActivityUuid: "not a uuid"})
+	apiErr, ok := err.(*client.Error)
+	if assert.True(t, ok, "expected a client error, got %v", err) {
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	}
+}
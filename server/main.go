@@ -1,258 +1,183 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"flag"
 	"log"
-
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
 	"github.com/kilianmandscharo/activities/database"
-	"github.com/kilianmandscharo/activities/schemas"
+	"github.com/kilianmandscharo/activities/events"
+	"github.com/kilianmandscharo/activities/logging"
+	"github.com/kilianmandscharo/activities/metrics"
+	"github.com/kilianmandscharo/activities/webhooks"
 
 	_ "github.com/lib/pq"
 )
 
 func main() {
-	err := godotenv.Load("../.env")
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, err := logging.New(os.Stderr, cfg.LogLevel)
 	if err != nil {
-		log.Fatal(("Could not load .env file"))
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	if cfg.LogLevel != "debug" {
+		gin.SetMode(gin.ReleaseMode)
 	}
 
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PW"),
-		os.Getenv("DB_NAME"))
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	db, err := database.New(connStr)
+	db, err := database.Connect(cfg.Database.connStr(), cfg.Database.ConnectAttempts, time.Second)
 	if err != nil {
-		log.Fatal("could not open database")
+		fatal("could not connect to database", err)
 	}
 
 	defer db.Close()
-	err = db.Init()
-	if err != nil {
-		log.Fatal("could not init database", err)
-	}
-	err = db.Clear()
+	err = db.Init(ctx)
 	if err != nil {
-		log.Fatal("could not clear database", err)
+		fatal("could not init database", err)
 	}
-	_, err = db.AddUser("Apollo", "test@gmail.com", "12345")
-	if err != nil {
-		log.Fatal("could not add user", err)
-	}
-
-	router := gin.Default()
-	router.Use(cors.Default())
-
-	router.POST("/user", func(c *gin.Context) {
-		var user schemas.UserCreate
-		if err := c.BindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
-			return
-		}
-		if id, err := db.AddUser(user.Name, user.Email, user.Password); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not add user"})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"id": id})
-		}
-	})
-
-	router.GET("/activities/:userId", func(c *gin.Context) {
-		userId, _ := strconv.Atoi(c.Param("userId"))
-		activities, err := db.GetActivities(userId)
+	if cfg.Features.ResetDatabase {
+		err = db.Clear(ctx)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not get activities"})
-		} else {
-			c.JSON(http.StatusOK, activities)
+			fatal("could not clear database", err)
 		}
-	})
-
-	router.GET("/activity/:id", func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		activity, err := db.GetActivity(id)
+		_, err = db.AddUser(ctx, "Apollo", "test@gmail.com", "12345")
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not get activity"})
-		} else {
-			c.JSON(http.StatusOK, activity)
+			fatal("could not add user", err)
 		}
-	})
+	}
 
-	router.POST("/activity", func(c *gin.Context) {
-		var activity schemas.ActivityCreate
-		if err := c.BindJSON(&activity); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
-			return
-		}
-		if id, err := db.AddActivity(activity.Name, activity.UserId); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not add activity"})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"id": id})
-		}
-	})
+	metrics.RegisterDatabase(db.Stats, func() (int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.RequestTimeout))
+		defer cancel()
+		return db.CountRunningBlocks(ctx)
+	})
+
+	var jobs sync.WaitGroup
+	hub := events.NewHub()
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		runTimerJobs(ctx, db, hub, cfg, time.Minute)
+	}()
+
+	webhookWorker := webhooks.NewWorker(db, cfg.Features.PrivateWebhooks)
+	if cfg.Features.Webhooks {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			webhookWorker.Run(ctx, 10*time.Second)
+		}()
+	}
 
-	router.PUT("/activity", func(c *gin.Context) {
-		var activity schemas.Activity
-		if err := c.BindJSON(&activity); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
-			return
-		}
-		err := db.UpdateActivity(activity.Id, activity.Name)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not update activity"})
+	server := &http.Server{Addr: cfg.Listen, Handler: newRouter(cfg, db, hub, webhookWorker)}
+	server.RegisterOnShutdown(hub.Close)
+	served := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "address", cfg.Listen, "tls", cfg.TLS.CertFile != "")
+		if cfg.TLS.CertFile != "" {
+			served <- server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
 		} else {
-			c.Status(http.StatusOK)
+			served <- server.ListenAndServe()
 		}
-	})
+	}()
 
-	router.DELETE("/activity/:id", func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		err := db.DeleteByTableAndId("activities", id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not delete activity"})
-		} else {
-			c.Status(http.StatusOK)
-		}
-	})
+	select {
+	case err := <-served:
+		fatal("could not serve", err)
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("shutting down", "drain_timeout", time.Duration(cfg.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("could not drain requests", "err", err)
+	}
+	jobs.Wait()
+}
 
-	router.GET("/current", func(c *gin.Context) {
-		block, err := db.GetCurrentBlock()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not get current block"})
-		} else {
-			c.JSON(http.StatusOK, block)
-		}
-	})
+// fatal logs the error that keeps the server from running and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
 
-	router.GET("/blocks/:activityId", func(c *gin.Context) {
-		activityId, _ := strconv.Atoi(c.Param("activityId"))
-		blocks, err := db.GetBlocks(activityId)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not get blocks"})
-		} else {
-			c.JSON(http.StatusOK, blocks)
+func runTimerJobs(ctx context.Context, db *database.Database, hub *events.Hub, cfg Config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now().UTC()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			jobCtx, cancel := context.WithTimeout(ctx, interval)
+			last = runTimerJob(jobCtx, db, hub, cfg, last)
+			cancel()
 		}
-	})
+	}
+}
 
-	router.GET("/block/:id", func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		block, err := db.GetBlock(id)
+// runTimerJob stops idle blocks and starts and ends pomodoro breaks. Breaks
+// that ended since the previous run are published as resumed blocks. It
+// returns the time of this run.
+func runTimerJob(ctx context.Context, db *database.Database, hub *events.Hub, cfg Config, since time.Time) time.Time {
+	now := time.Now().UTC()
+	if cfg.Features.IdleStop {
+		blocks, err := db.StopIdleBlocks(ctx, now)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "coult not get block"})
-		} else {
-			c.JSON(http.StatusOK, block)
+			slog.ErrorContext(ctx, "could not stop idle blocks", "err", err)
 		}
-	})
-
-	router.POST("/block", func(c *gin.Context) {
-		var block schemas.BlockCreate
-		if err := c.BindJSON(&block); err != nil {
-      fmt.Println(err)
-			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read block"})
-			return
+		for _, block := range blocks {
+			slog.InfoContext(ctx, "stopped idle block", "block_id", block.Id, "end_time", block.EndTime)
+			publishBlock(ctx, hub, db, events.BlockStopped, block.Id)
 		}
-		id, err := db.AddBlock(block.StartTime, block.EndTime, block.ActivityId)
+	}
+	if cfg.Features.Pomodoro {
+		blockIds, err := db.InsertPomodoroPauses(ctx, now)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not add block"})
-			return
-		}
-		for _, pause := range block.Pauses {
-			_, err := db.AddPause(pause.StartTime, pause.EndTime, id)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"status": "could not add pause"})
-				return
-			}
-		}
-		c.JSON(http.StatusOK, gin.H{"id": id})
-	})
-
-	router.PUT("/block", func(c *gin.Context) {
-		var block schemas.Block
-		if err := c.BindJSON(&block); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read block"})
-			return
-		}
-		if err := db.UpdateBlock(block.Id, block.StartTime, block.EndTime); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not update block"})
-			return
-		}
-		if err := db.DeletePauses(block.Id); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not update pauses"})
-			return
-		}
-		for _, pause := range block.Pauses {
-			_, err := db.AddPause(pause.StartTime, pause.EndTime, block.Id)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"status": "could not update pause"})
-				return
-			}
+			slog.ErrorContext(ctx, "could not insert pomodoro pauses", "err", err)
 		}
-		c.Status(http.StatusOK)
-	})
-
-	router.DELETE("/block/:id", func(c *gin.Context) {
-		blockId, _ := strconv.Atoi(c.Param("id"))
-		err := db.DeleteByTableAndId("blocks", blockId)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not delete block"})
-		} else {
-			c.Status(http.StatusOK)
+		for _, blockId := range blockIds {
+			publishBlock(ctx, hub, db, events.BlockPaused, blockId)
 		}
-	})
-
-	router.GET("/pause/:blockId", func(c *gin.Context) {
-		blockId, _ := strconv.Atoi(c.Param("blockId"))
-		pauses, err := db.GetBlocks(blockId)
+		resumed, err := db.GetResumedBlocks(ctx, since, now)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not get pauses"})
-		} else {
-			c.JSON(http.StatusOK, pauses)
-		}
-	})
-
-	router.POST("/pause", func(c *gin.Context) {
-		var pause schemas.PauseCreate
-		if err := c.BindJSON(&pause); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read pause"})
-			return
-		}
-		if id, err := db.AddPause(pause.StartTime, pause.EndTime, pause.BlockId); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not add pause"})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"id": id})
-		}
-	})
-
-	router.PUT("/pause", func(c *gin.Context) {
-		var pause schemas.Pause
-		if err := c.BindJSON(&pause); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read pause"})
-			return
-		}
-		if err := db.UpdatePause(pause.Id, pause.StartTime, pause.EndTime); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not update pause"})
-		} else {
-			c.Status(http.StatusOK)
+			slog.ErrorContext(ctx, "could not get resumed blocks", "err", err)
 		}
-	})
-
-	router.DELETE("/pause/:id", func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		err := db.DeleteByTableAndId("blocks", id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "could not delete pause"})
-		} else {
-			c.Status(http.StatusOK)
+		for _, blockId := range resumed {
+			publishBlock(ctx, hub, db, events.BlockResumed, blockId)
 		}
-	})
-
-	router.Run(":8080")
+	}
+	deleted, err := db.DeleteIdempotencyKeys(ctx, now.Add(-time.Duration(cfg.IdempotencyRetention)))
+	if err != nil {
+		slog.ErrorContext(ctx, "could not delete expired idempotency keys", "err", err)
+	} else if deleted > 0 {
+		slog.DebugContext(ctx, "deleted expired idempotency keys", "count", deleted)
+	}
+	deleted, err = db.DeleteSessions(ctx, now)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not delete expired sessions", "err", err)
+	} else if deleted > 0 {
+		slog.DebugContext(ctx, "deleted expired sessions", "count", deleted)
+	}
+	return now
 }
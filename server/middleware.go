@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kilianmandscharo/activities/database"
+	"github.com/kilianmandscharo/activities/logging"
+)
+
+const (
+	requestIdHeader    = "X-Request-ID"
+	lockOverrideHeader = "X-Lock-Override"
+	idempotencyHeader  = "Idempotency-Key"
+	replayedHeader     = "Idempotent-Replayed"
+	sessionUserKey     = "sessionUser"
+)
+
+// withRequestId takes the request id from the X-Request-ID header or creates
+// one, returns it in the response and puts it into the context of the
+// request, so that records logged by handlers and the database carry it. Once
+// the request is handled, it is logged with its outcome.
+func withRequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(requestIdHeader)
+		if !validRequestId(id) {
+			id = logging.NewRequestId()
+		}
+		c.Header(requestIdHeader, id)
+		c.Request = c.Request.WithContext(logging.WithRequestId(c.Request.Context(), id))
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		level := slog.LevelInfo
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if c.Writer.Status() >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+		slog.Log(c.Request.Context(), level, "request",
+			"method", c.Request.Method,
+			"route", route,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+			"client_ip", c.ClientIP())
+	}
+}
+
+// validRequestId accepts ids of clients and proxies as long as they are short
+// and cannot break the log format.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// recovered logs a panic of a handler and answers with a 500.
+func recovered(c *gin.Context, err any) {
+	slog.ErrorContext(c.Request.Context(), "handler panicked", "route", c.FullPath(), "err", err)
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "internal error"})
+}
+
+// internalError logs the cause of a failed request and answers with a 500
+// carrying only the status.
+func internalError(c *gin.Context, status string, err error) {
+	slog.ErrorContext(c.Request.Context(), status, "route", c.FullPath(), "err", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"status": status})
+}
+
+// withTimeout bounds the context of every request, which handlers pass on to
+// the database so slow queries are canceled. The streaming routes are left
+// out, since they live as long as the client stays connected, and bound each
+// of their database calls themselves.
+func withTimeout(timeout time.Duration, streaming ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, route := range streaming {
+			if c.FullPath() == route {
+				c.Next()
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// withLockOverride lets the user given by the X-Lock-Override header change
+// blocks before the lock dates they administer. The database rejects the
+// override for other users and logs every lock it is used on.
+func withLockOverride() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if header := c.GetHeader(lockOverrideHeader); header != "" {
+			userId, err := strconv.Atoi(header)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "could not read lock override"})
+				return
+			}
+			c.Request = c.Request.WithContext(database.WithLockOverride(c.Request.Context(), userId))
+		}
+		c.Next()
+	}
+}
+
+// withActor attributes the changes of a request to the user given by the
+// userId query parameter in the audit log.
+func withActor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if userId, err := strconv.Atoi(c.Query("userId")); err == nil {
+			actingUser(c, userId)
+		}
+		c.Next()
+	}
+}
+
+// sessionStore looks up the users of the session tokens returned by /login.
+type sessionStore interface {
+	GetSessionUser(ctx context.Context, token string, now time.Time) (int, error)
+}
+
+// withSession authenticates requests carrying a session token from /login as
+// a bearer token in the Authorization header. The userId given by the query
+// or the path then has to be the user of the session. Requests without a
+// token are passed on unchanged.
+func withSession(store sessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "invalid session"})
+			return
+		}
+		userId, err := store.GetSessionUser(c.Request.Context(), token, time.Now().UTC())
+		if errors.Is(err, sql.ErrNoRows) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "invalid session"})
+			return
+		} else if err != nil {
+			internalError(c, "could not check session", err)
+			c.Abort()
+			return
+		}
+		c.Set(sessionUserKey, userId)
+		for _, value := range []string{c.Query("userId"), c.Param("userId")} {
+			if value != "" && !sessionAllows(c, value) {
+				return
+			}
+		}
+		actingUser(c, userId)
+		c.Next()
+	}
+}
+
+// sessionAllows reports whether the request may act for the user given by
+// value, which is the case if it has no session or a session of that user.
+// Otherwise it answers the request itself.
+func sessionAllows(c *gin.Context, value string) bool {
+	sessionUser, ok := c.Get(sessionUserKey)
+	if !ok {
+		return true
+	}
+	if value != strconv.Itoa(sessionUser.(int)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "session belongs to another user"})
+		return false
+	}
+	return true
+}
+
+// actingUser attributes the changes of the request to the user, for handlers
+// reading the acting user from the body, and returns the new context.
+func actingUser(c *gin.Context, userId int) context.Context {
+	if userId != 0 {
+		c.Request = c.Request.WithContext(database.WithActor(c.Request.Context(), userId))
+	}
+	return c.Request.Context()
+}
+
+// idempotencyStoreTimeout bounds saving or releasing an idempotency key once
+// the request has been handled, which is done even if the request has been
+// cancelled in the meantime.
+const idempotencyStoreTimeout = 5 * time.Second
+
+// maxIdempotentBody is the largest body of a request with an idempotency key,
+// which is read into memory to be hashed.
+const maxIdempotentBody = 1 << 20
+
+// idempotencyStore records the responses of requests with idempotency keys.
+type idempotencyStore interface {
+	ReserveIdempotencyKey(ctx context.Context, key string, route string, userId int, hash string, now time.Time, retention time.Duration) (*database.IdempotentResponse, error)
+	SaveIdempotentResponse(ctx context.Context, key string, route string, userId int, response database.IdempotentResponse) error
+	ReleaseIdempotencyKey(ctx context.Context, key string, route string, userId int) error
+}
+
+// withIdempotency makes POST requests carrying an Idempotency-Key header safe
+// to retry. The first request with a key is handled and its response
+// recorded, repetitions within the retention get the recorded response
+// without being handled again. Keys are scoped to the user of the request.
+// A key reused for a different request is answered with 422, one whose
+// request is still being handled with 409. Responses with a server error are
+// not recorded and handlers that panic release the key as well, so the
+// request can be retried. Bodies above maxIdempotentBody are refused with 413.
+func withIdempotency(store idempotencyStore, retention time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyHeader)
+		if c.Request.Method != http.MethodPost || key == "" {
+			c.Next()
+			return
+		}
+		if !validRequestId(key) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "could not read idempotency key"})
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"status": "body is too large"})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := c.Request.Context()
+		route := c.Request.URL.Path
+		userId := requestUser(c, body)
+		recorded, err := store.ReserveIdempotencyKey(ctx, key, route, userId, requestHash(c.Request, body), time.Now(), retention)
+		switch {
+		case errors.Is(err, database.ErrIdempotencyKeyReused):
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"status": err.Error()})
+			return
+		case errors.Is(err, database.ErrIdempotencyKeyInUse):
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"status": err.Error()})
+			return
+		case err != nil:
+			internalError(c, "could not reserve idempotency key", err)
+			c.Abort()
+			return
+		case recorded != nil:
+			c.Header(replayedHeader, "true")
+			c.Data(recorded.Status, recorded.ContentType, recorded.Body)
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		defer func() {
+			storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyStoreTimeout)
+			defer cancel()
+			recovered := recover()
+			var err error
+			if recovered != nil || c.Writer.Status() >= http.StatusInternalServerError {
+				err = store.ReleaseIdempotencyKey(storeCtx, key, route, userId)
+			} else {
+				err = store.SaveIdempotentResponse(storeCtx, key, route, userId, database.IdempotentResponse{
+					Status:      c.Writer.Status(),
+					ContentType: c.Writer.Header().Get("Content-Type"),
+					Body:        writer.body.Bytes(),
+				})
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "could not record idempotent response", "err", err)
+			}
+			if recovered != nil {
+				panic(recovered)
+			}
+		}()
+		c.Next()
+	}
+}
+
+// requestUser returns the user a request is made for, given by the userId
+// query parameter or the userId of the JSON body, or 0 for neither.
+func requestUser(c *gin.Context, body []byte) int {
+	if userId, err := strconv.Atoi(c.Query("userId")); err == nil {
+		return userId
+	}
+	var request struct {
+		UserId int `json:"userId"`
+	}
+	json.Unmarshal(body, &request)
+	return request.UserId
+}
+
+// requestHash identifies a request by its method, path, query and body.
+func requestHash(request *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(request.Method + " " + request.URL.RequestURI() + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response body written through it.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(data string) (int, error) {
+	w.body.WriteString(data)
+	return w.ResponseWriter.WriteString(data)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kilianmandscharo/activities/database"
+	"github.com/kilianmandscharo/activities/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(withTimeout(time.Second, "/events"))
+	deadlines := make(map[string]bool)
+	handler := func(c *gin.Context) {
+		_, ok := c.Request.Context().Deadline()
+		deadlines[c.FullPath()] = ok
+	}
+	router.GET("/block/:id", handler)
+	router.GET("/events", handler)
+
+	for _, path := range []string{"/block/1", "/events"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	assert.True(t, deadlines["/block/:id"])
+	assert.False(t, deadlines["/events"])
+}
+
+func TestWithRequestId(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(withRequestId())
+	var seen string
+	router.GET("/block/:id", func(c *gin.Context) {
+		seen = logging.RequestId(c.Request.Context())
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/block/1", nil)
+	request.Header.Set(requestIdHeader, "abc-123")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, "abc-123", seen)
+	assert.Equal(t, "abc-123", recorder.Header().Get(requestIdHeader))
+
+	request = httptest.NewRequest(http.MethodGet, "/block/1", nil)
+	request.Header.Set(requestIdHeader, "bad id\n")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Len(t, seen, 16)
+	assert.Equal(t, seen, recorder.Header().Get(requestIdHeader))
+}
+
+func TestWithLockOverride(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(withLockOverride())
+	handled := 0
+	router.PUT("/block", func(c *gin.Context) {
+		handled++
+	})
+
+	for header, status := range map[string]int{"": http.StatusOK, "2": http.StatusOK, "admin": http.StatusBadRequest} {
+		request := httptest.NewRequest(http.MethodPut, "/block", nil)
+		if header != "" {
+			request.Header.Set(lockOverrideHeader, header)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		assert.Equal(t, status, recorder.Code, header)
+	}
+	assert.Equal(t, 2, handled)
+}
+
+// sessionUsers maps session tokens to their users.
+type sessionUsers map[string]int
+
+func (s sessionUsers) GetSessionUser(ctx context.Context, token string, now time.Time) (int, error) {
+	userId, ok := s[token]
+	if !ok {
+		return -1, sql.ErrNoRows
+	}
+	return userId, nil
+}
+
+func TestWithSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(withSession(sessionUsers{"secret": 1}))
+	handled := 0
+	router.GET("/timer/:userId", func(c *gin.Context) {
+		handled++
+	})
+
+	requests := []struct {
+		path          string
+		authorization string
+		status        int
+	}{
+		{"/timer/2", "", http.StatusOK},
+		{"/timer/1", "Bearer secret", http.StatusOK},
+		{"/timer/1?userId=1", "Bearer secret", http.StatusOK},
+		{"/timer/2", "Bearer secret", http.StatusForbidden},
+		{"/timer/1?userId=2", "Bearer secret", http.StatusForbidden},
+		{"/timer/1", "Bearer unknown", http.StatusUnauthorized},
+		{"/timer/1", "secret", http.StatusUnauthorized},
+	}
+	for _, r := range requests {
+		request := httptest.NewRequest(http.MethodGet, r.path, nil)
+		if r.authorization != "" {
+			request.Header.Set("Authorization", r.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		assert.Equal(t, r.status, recorder.Code, r.path+" "+r.authorization)
+	}
+	assert.Equal(t, 3, handled)
+}
+
+func TestWithIdempotencyPassesThrough(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(withIdempotency(nil, time.Hour))
+	handled := 0
+	handler := func(c *gin.Context) {
+		handled++
+	}
+	router.GET("/block/:id", handler)
+	router.POST("/block", handler)
+
+	requests := []struct {
+		method string
+		key    string
+		status int
+	}{
+		{http.MethodPost, "", http.StatusOK},
+		{http.MethodGet, "retry-1", http.StatusOK},
+		{http.MethodPost, "with space", http.StatusBadRequest},
+		{http.MethodPost, "too-large", http.StatusRequestEntityTooLarge},
+	}
+	for _, r := range requests {
+		path := "/block"
+		if r.method == http.MethodGet {
+			path = "/block/1"
+		}
+		var body io.Reader
+		if r.key == "too-large" {
+			body = strings.NewReader(strings.Repeat("x", maxIdempotentBody+1))
+		}
+		request := httptest.NewRequest(r.method, path, body)
+		if r.key != "" {
+			request.Header.Set(idempotencyHeader, r.key)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		assert.Equal(t, r.status, recorder.Code, r.key)
+	}
+	assert.Equal(t, 2, handled)
+}
+
+// memoryStore keeps idempotency keys in memory. Like the database, it fails
+// once the context of a call is cancelled.
+type memoryStore struct {
+	mu        sync.Mutex
+	responses map[string]*database.IdempotentResponse
+}
+
+func storeKey(key string, route string, userId int) string {
+	return fmt.Sprintf("%s %s %d", key, route, userId)
+}
+
+func (s *memoryStore) ReserveIdempotencyKey(ctx context.Context, key string, route string, userId int, hash string, now time.Time, retention time.Duration) (*database.IdempotentResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response, ok := s.responses[storeKey(key, route, userId)]
+	if !ok {
+		s.responses[storeKey(key, route, userId)] = nil
+		return nil, nil
+	}
+	if response == nil {
+		return nil, database.ErrIdempotencyKeyInUse
+	}
+	return response, nil
+}
+
+func (s *memoryStore) SaveIdempotentResponse(ctx context.Context, key string, route string, userId int, response database.IdempotentResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[storeKey(key, route, userId)] = &response
+	return nil
+}
+
+func (s *memoryStore) ReleaseIdempotencyKey(ctx context.Context, key string, route string, userId int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responses[storeKey(key, route, userId)] == nil {
+		delete(s.responses, storeKey(key, route, userId))
+	}
+	return nil
+}
+
+func TestWithIdempotencyReleasesKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(gin.CustomRecovery(recovered))
+	router.Use(withIdempotency(&memoryStore{responses: make(map[string]*database.IdempotentResponse)}, time.Hour))
+	var cancel context.CancelFunc
+	handled := 0
+	router.POST("/block", func(c *gin.Context) {
+		handled++
+		switch handled {
+		case 1:
+			cancel()
+			internalError(c, "could not add block", c.Request.Context().Err())
+		case 2:
+			panic("handler failed")
+		default:
+			c.JSON(http.StatusOK, gin.H{"id": handled})
+		}
+	})
+
+	requests := []struct {
+		query    string
+		status   int
+		replayed string
+	}{
+		{"?userId=1", http.StatusInternalServerError, ""},
+		{"?userId=1", http.StatusInternalServerError, ""},
+		{"?userId=1", http.StatusOK, ""},
+		{"?userId=1", http.StatusOK, "true"},
+		{"?userId=2", http.StatusOK, ""},
+	}
+	for i, r := range requests {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		request := httptest.NewRequest(http.MethodPost, "/block"+r.query, nil).WithContext(ctx)
+		request.Header.Set(idempotencyHeader, "retry-1")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		cancel()
+		assert.Equal(t, r.status, recorder.Code, i)
+		assert.Equal(t, r.replayed, recorder.Header().Get(replayedHeader), i)
+	}
+	assert.Equal(t, 4, handled)
+}
@@ -0,0 +1,1196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/kilianmandscharo/activities/api"
+	"github.com/kilianmandscharo/activities/database"
+	"github.com/kilianmandscharo/activities/events"
+	"github.com/kilianmandscharo/activities/metrics"
+	"github.com/kilianmandscharo/activities/schemas"
+	"github.com/kilianmandscharo/activities/webhooks"
+)
+
+// readinessTimeout bounds the database checks of /readyz, so a hanging
+// connection fails the probe instead of blocking it.
+const readinessTimeout = 2 * time.Second
+
+// maxBatchOperations bounds the operations of a batch, which all run in one
+// transaction.
+const maxBatchOperations = 1000
+
+func newRouter(cfg Config, db *database.Database, hub *events.Hub, webhookWorker *webhooks.Worker) *gin.Engine {
+	router := gin.New()
+	router.Use(withRequestId(), gin.CustomRecovery(recovered))
+	if len(cfg.CORSOrigins) > 0 {
+		corsConfig := cors.DefaultConfig()
+		if cfg.allowsAllOrigins() {
+			corsConfig.AllowAllOrigins = true
+		} else {
+			corsConfig.AllowOrigins = cfg.CORSOrigins
+		}
+		corsConfig.AddAllowHeaders("Authorization")
+		router.Use(cors.New(corsConfig))
+	}
+	router.Use(metrics.Middleware())
+	router.Use(withTimeout(time.Duration(cfg.RequestTimeout), "/events", "/ws"))
+	router.Use(withLockOverride(), withActor(), withSession(db))
+	router.Use(withIdempotency(db, time.Duration(cfg.IdempotencyRetention)))
+
+	router.POST("/user", func(c *gin.Context) {
+		var user schemas.UserCreate
+		if err := c.BindJSON(&user); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
+			return
+		}
+		if id, err := db.AddUser(c.Request.Context(), user.Name, user.Email, user.Password); err != nil {
+			internalError(c, "could not add user", err)
+		} else {
+			c.JSON(http.StatusOK, gin.H{"id": id})
+		}
+	})
+
+	router.POST("/login", func(c *gin.Context) {
+		var login schemas.Login
+		if err := c.BindJSON(&login); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
+			return
+		}
+		user, err := db.GetUserByLogin(c.Request.Context(), login.Email, login.Password)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusUnauthorized, gin.H{"status": "invalid email or password"})
+		} else if err != nil {
+			internalError(c, "could not log in", err)
+		} else if token, err := db.AddSession(c.Request.Context(), user.Id, time.Now().UTC(), time.Duration(cfg.SessionLifetime)); err != nil {
+			internalError(c, "could not log in", err)
+		} else {
+			c.JSON(http.StatusOK, gin.H{"id": user.Id, "name": user.Name, "token": token})
+		}
+	})
+
+	router.GET("/settings/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		settings, err := db.GetSettings(c.Request.Context(), userId)
+		if err != nil {
+			internalError(c, "could not get settings", err)
+		} else {
+			c.JSON(http.StatusOK, settings)
+		}
+	})
+
+	router.PUT("/settings", func(c *gin.Context) {
+		var settings schemas.Settings
+		if err := c.BindJSON(&settings); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read settings"})
+			return
+		}
+		if err := db.UpdateSettings(c.Request.Context(), settings); err != nil {
+			databaseError(c, "could not update settings", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.GET("/activities/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		activities, err := db.GetActivities(c.Request.Context(), userId)
+		if err != nil {
+			internalError(c, "could not get activities", err)
+		} else {
+			c.JSON(http.StatusOK, activities)
+		}
+	})
+
+	router.GET("/activity/:id", func(c *gin.Context) {
+		id, ok := entityId(c, db, "activity", c.Param("id"))
+		if !ok {
+			return
+		}
+		activity, err := db.GetActivity(c.Request.Context(), id)
+		if err != nil {
+			internalError(c, "could not get activity", err)
+		} else {
+			c.Header("ETag", etag(activity.Version))
+			c.JSON(http.StatusOK, activity)
+		}
+	})
+
+	router.POST("/activity", func(c *gin.Context) {
+		var activity schemas.ActivityCreate
+		if err := c.BindJSON(&activity); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
+			return
+		}
+		if id, err := db.AddActivity(actingUser(c, activity.UserId), activity.Name, activity.UserId, activity.Uuid); err != nil {
+			databaseError(c, "could not add activity", err)
+		} else {
+			hub.Publish(activity.UserId, events.ActivityChanged, events.Ref{Id: id})
+			c.JSON(http.StatusOK, gin.H{"id": id})
+		}
+	})
+
+	router.PUT("/activity", func(c *gin.Context) {
+		var activity schemas.Activity
+		if err := c.BindJSON(&activity); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
+			return
+		}
+		expected, ok := requiredVersion(c, activity.Version)
+		if !ok {
+			return
+		}
+		if activity.Id == 0 && activity.Uuid != "" {
+			if activity.Id, ok = entityId(c, db, "activity", activity.Uuid); !ok {
+				return
+			}
+		}
+		ctx := actingUser(c, activity.UserId)
+		version, err := db.UpdateActivity(ctx, activity.Id, expected, activity.Name)
+		if errors.Is(err, database.ErrVersionConflict) {
+			if current, err := db.GetActivity(ctx, activity.Id); err != nil {
+				internalError(c, "could not get activity", err)
+			} else {
+				versionConflict(c, current, current.Version)
+			}
+		} else if err != nil {
+			databaseError(c, "could not update activity", err)
+		} else {
+			publishActivity(c.Request.Context(), hub, db, activity.Id)
+			c.Header("ETag", etag(version))
+			c.JSON(http.StatusOK, gin.H{"version": version})
+		}
+	})
+
+	router.DELETE("/activity/:id", func(c *gin.Context) {
+		id, ok := entityId(c, db, "activity", c.Param("id"))
+		if !ok {
+			return
+		}
+		userId, err := db.GetActivityUserId(c.Request.Context(), id)
+		if err != nil {
+			internalError(c, "could not delete activity", err)
+			return
+		}
+		err = db.DeleteByTableAndId(c.Request.Context(), "activities", id)
+		if err != nil {
+			databaseError(c, "could not delete activity", err)
+		} else {
+			hub.Publish(userId, events.ActivityChanged, events.Ref{Id: id})
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.POST("/activities/merge", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		var merge schemas.ActivityMerge
+		if err := c.BindJSON(&merge); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read merge"})
+			return
+		}
+		var ok bool
+		if merge.SourceId, ok = referenceId(c, db, "activity", merge.SourceId, merge.SourceUuid); !ok {
+			return
+		}
+		if merge.TargetId, ok = referenceId(c, db, "activity", merge.TargetId, merge.TargetUuid); !ok {
+			return
+		}
+		if merge.SourceId == 0 || merge.TargetId == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read merge"})
+			return
+		}
+		err := db.MergeActivities(c.Request.Context(), userId, merge.SourceId, merge.TargetId)
+		if errors.Is(err, database.ErrMergeIntoSelf) {
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		} else if err != nil {
+			databaseError(c, "could not merge activities", err)
+		} else {
+			if userId, err := db.GetActivityUserId(c.Request.Context(), merge.TargetId); err == nil {
+				hub.Publish(userId, events.ActivityChanged, events.Ref{Id: merge.SourceId})
+				hub.Publish(userId, events.ActivityChanged, events.Ref{Id: merge.TargetId})
+			}
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.GET("/current", func(c *gin.Context) {
+		block, err := db.GetCurrentBlock(c.Request.Context())
+		if err != nil {
+			internalError(c, "could not get current block", err)
+			return
+		}
+		pomodoro, err := db.GetPomodoroState(c.Request.Context(), block, time.Now().UTC())
+		if err != nil {
+			internalError(c, "could not get pomodoro state", err)
+			return
+		}
+		c.JSON(http.StatusOK, schemas.CurrentBlock{Block: block, Pomodoro: pomodoro})
+	})
+
+	router.GET("/timer/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		block, err := db.GetRunningBlock(c.Request.Context(), userId)
+		if err != nil && !errors.Is(err, database.ErrNoRunningBlock) {
+			internalError(c, "could not get running block", err)
+			return
+		}
+		pomodoro, err := db.GetPomodoroState(c.Request.Context(), block, time.Now().UTC())
+		if err != nil {
+			internalError(c, "could not get pomodoro state", err)
+			return
+		}
+		c.JSON(http.StatusOK, schemas.CurrentBlock{Block: block, Pomodoro: pomodoro})
+	})
+
+	router.POST("/timer/:command", func(c *gin.Context) {
+		var timer schemas.TimerRequest
+		if err := c.BindJSON(&timer); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read timer"})
+			return
+		}
+		if !sessionAllows(c, strconv.Itoa(timer.UserId)) {
+			return
+		}
+		command := c.Param("command")
+		block, err := runTimerCommand(c.Request.Context(), db, hub, timer.UserId, command, timer.ActivityId, timer.ActivityUuid, timer.Time)
+		if err != nil {
+			c.JSON(timerStatus(err), gin.H{"status": timerError(command, err)})
+		} else {
+			c.JSON(http.StatusOK, block)
+		}
+	})
+
+	router.GET("/blocks/:activityId", func(c *gin.Context) {
+		activityId, ok := entityId(c, db, "activity", c.Param("activityId"))
+		if !ok {
+			return
+		}
+		blocks, err := db.GetBlocks(c.Request.Context(), activityId)
+		if err != nil {
+			internalError(c, "could not get blocks", err)
+		} else {
+			c.JSON(http.StatusOK, blocks)
+		}
+	})
+
+	router.GET("/autostopped/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		blocks, err := db.GetAutoStoppedBlocks(c.Request.Context(), userId)
+		if err != nil {
+			internalError(c, "could not get auto stopped blocks", err)
+		} else {
+			c.JSON(http.StatusOK, blocks)
+		}
+	})
+
+	router.GET("/block/:id", func(c *gin.Context) {
+		id, ok := entityId(c, db, "block", c.Param("id"))
+		if !ok {
+			return
+		}
+		block, err := db.GetBlock(c.Request.Context(), id)
+		if err != nil {
+			internalError(c, "coult not get block", err)
+		} else {
+			c.Header("ETag", etag(block.Version))
+			c.JSON(http.StatusOK, block)
+		}
+	})
+
+	router.POST("/block", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var block schemas.BlockCreate
+		if err := c.BindJSON(&block); err != nil {
+			slog.InfoContext(ctx, "could not read block", "err", err)
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read block"})
+			return
+		}
+		var ok bool
+		if block.ActivityId, ok = referenceId(c, db, "activity", block.ActivityId, block.ActivityUuid); !ok {
+			return
+		}
+		if block.ActivityId == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read block"})
+			return
+		}
+		ctx = actingUser(c, block.UserId)
+		id, err := db.CreateBlock(ctx, block)
+		if err != nil {
+			databaseError(c, "could not add block", err)
+			return
+		}
+		if block.EndTime == "" {
+			publishBlock(ctx, hub, db, events.BlockStarted, id)
+		} else {
+			publishBlock(ctx, hub, db, events.BlockChanged, id)
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id})
+	})
+
+	router.PUT("/block", func(c *gin.Context) {
+		var block schemas.Block
+		if err := c.BindJSON(&block); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read block"})
+			return
+		}
+		expected, ok := requiredVersion(c, block.Version)
+		if !ok {
+			return
+		}
+		if block.Id == 0 && block.Uuid != "" {
+			if block.Id, ok = entityId(c, db, "block", block.Uuid); !ok {
+				return
+			}
+		}
+		ctx := actingUser(c, block.UserId)
+		previous, err := db.GetBlock(ctx, block.Id)
+		if err != nil {
+			databaseError(c, "could not update block", err)
+			return
+		}
+		version, err := db.ReplaceBlock(ctx, block, expected, time.Now())
+		if errors.Is(err, database.ErrVersionConflict) {
+			if current, err := db.GetBlock(ctx, block.Id); err != nil {
+				internalError(c, "could not get block", err)
+			} else {
+				versionConflict(c, current, current.Version)
+			}
+			return
+		}
+		if err != nil {
+			databaseError(c, "could not update block", err)
+			return
+		}
+		if previous.EndTime == "" && block.EndTime != "" {
+			publishBlock(ctx, hub, db, events.BlockStopped, block.Id)
+		} else {
+			publishBlock(ctx, hub, db, events.BlockChanged, block.Id)
+		}
+		c.Header("ETag", etag(version))
+		c.JSON(http.StatusOK, gin.H{"version": version})
+	})
+
+	router.DELETE("/block/:id", func(c *gin.Context) {
+		blockId, ok := entityId(c, db, "block", c.Param("id"))
+		if !ok {
+			return
+		}
+		userId, err := db.GetBlockUserId(c.Request.Context(), blockId)
+		if err != nil {
+			internalError(c, "could not delete block", err)
+			return
+		}
+		err = db.DeleteByTableAndId(c.Request.Context(), "blocks", blockId)
+		if err != nil {
+			databaseError(c, "could not delete block", err)
+		} else {
+			hub.Publish(userId, events.BlockDeleted, events.Ref{Id: blockId})
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.POST("/block/:id/split", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		id, ok := entityId(c, db, "block", c.Param("id"))
+		if !ok {
+			return
+		}
+		var split schemas.BlockSplit
+		if err := c.BindJSON(&split); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read split"})
+			return
+		}
+		if split.NewActivityId, ok = referenceId(c, db, "activity", split.NewActivityId, split.NewActivityUuid); !ok {
+			return
+		}
+		newId, err := db.SplitBlock(ctx, id, split.At, split.NewActivityId)
+		if errors.Is(err, database.ErrInvalidSplitTime) {
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		} else if errors.Is(err, database.ErrForeignActivity) {
+			c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+		} else if err != nil {
+			databaseError(c, "could not split block", err)
+		} else {
+			publishBlock(ctx, hub, db, events.BlockChanged, id)
+			publishBlock(ctx, hub, db, events.BlockChanged, newId)
+			c.JSON(http.StatusOK, gin.H{"id": newId})
+		}
+	})
+
+	router.GET("/block/:id/revisions", func(c *gin.Context) {
+		id, ok := entityId(c, db, "block", c.Param("id"))
+		if !ok {
+			return
+		}
+		revisions, err := db.GetBlockRevisions(c.Request.Context(), id)
+		if err != nil {
+			internalError(c, "could not get revisions", err)
+		} else {
+			c.JSON(http.StatusOK, revisions)
+		}
+	})
+
+	router.GET("/block/:id/diff", func(c *gin.Context) {
+		id, ok := entityId(c, db, "block", c.Param("id"))
+		if !ok {
+			return
+		}
+		from, _ := strconv.Atoi(c.Query("from"))
+		to, _ := strconv.Atoi(c.Query("to"))
+		if from == 0 || to == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "from and to revisions are required"})
+			return
+		}
+		diff, err := db.DiffBlockRevisions(c.Request.Context(), id, from, to)
+		if err != nil {
+			databaseError(c, "could not find revision", err)
+		} else {
+			c.JSON(http.StatusOK, diff)
+		}
+	})
+
+	router.POST("/block/:id/revert/:rev", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		id, ok := entityId(c, db, "block", c.Param("id"))
+		if !ok {
+			return
+		}
+		rev, _ := strconv.Atoi(c.Param("rev"))
+		if rev == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read revision"})
+			return
+		}
+		revision, err := db.RevertBlock(ctx, id, rev, time.Now())
+		if err != nil {
+			databaseError(c, "could not revert block", err)
+		} else {
+			publishBlock(ctx, hub, db, events.BlockChanged, id)
+			c.JSON(http.StatusOK, gin.H{"revision": revision})
+		}
+	})
+
+	router.POST("/blocks/merge", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var merge schemas.BlockMerge
+		if err := c.BindJSON(&merge); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read merge"})
+			return
+		}
+		var ok bool
+		if merge.Ids, ok = referenceIds(c, db, "block", merge.Ids, merge.Uuids); !ok {
+			return
+		}
+		id, err := db.MergeBlocks(ctx, merge.Ids)
+		if errors.Is(err, database.ErrBlocksNotMergeable) {
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		} else if err != nil {
+			databaseError(c, "could not merge blocks", err)
+		} else {
+			if userId, err := db.GetBlockUserId(ctx, id); err == nil {
+				for _, mergedId := range merge.Ids {
+					if mergedId != id {
+						hub.Publish(userId, events.BlockDeleted, events.Ref{Id: mergedId})
+					}
+				}
+			}
+			publishBlock(ctx, hub, db, events.BlockChanged, id)
+			c.JSON(http.StatusOK, gin.H{"id": id})
+		}
+	})
+
+	router.POST("/blocks/move", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		var move schemas.BlockMove
+		if err := c.BindJSON(&move); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read move"})
+			return
+		}
+		var ok bool
+		if move.BlockIds, ok = referenceIds(c, db, "block", move.BlockIds, move.BlockUuids); !ok {
+			return
+		}
+		if move.ActivityId, ok = referenceId(c, db, "activity", move.ActivityId, move.ActivityUuid); !ok {
+			return
+		}
+		if len(move.BlockIds) == 0 || move.ActivityId == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read move"})
+			return
+		}
+		err := db.MoveBlocks(c.Request.Context(), userId, move.BlockIds, move.ActivityId)
+		if err != nil {
+			databaseError(c, "could not move blocks", err)
+		} else {
+			for _, blockId := range move.BlockIds {
+				publishBlock(c.Request.Context(), hub, db, events.BlockChanged, blockId)
+			}
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.GET("/pause/:blockId", func(c *gin.Context) {
+		blockId, ok := entityId(c, db, "block", c.Param("blockId"))
+		if !ok {
+			return
+		}
+		pauses, err := db.GetPauses(c.Request.Context(), blockId)
+		if err != nil {
+			internalError(c, "could not get pauses", err)
+		} else {
+			c.JSON(http.StatusOK, pauses)
+		}
+	})
+
+	router.POST("/pause", func(c *gin.Context) {
+		var pause schemas.PauseCreate
+		if err := c.BindJSON(&pause); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read pause"})
+			return
+		}
+		var ok bool
+		if pause.BlockId, ok = referenceId(c, db, "block", pause.BlockId, pause.BlockUuid); !ok {
+			return
+		}
+		if id, err := db.AddPause(c.Request.Context(), pause.StartTime, pause.EndTime, pause.BlockId, pause.Uuid); err != nil {
+			databaseError(c, "could not add pause", err)
+		} else {
+			publishPause(c.Request.Context(), hub, db, pause)
+			c.JSON(http.StatusOK, gin.H{"id": id})
+		}
+	})
+
+	router.PUT("/pause", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var pause schemas.Pause
+		if err := c.BindJSON(&pause); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read pause"})
+			return
+		}
+		expected, ok := requiredVersion(c, pause.Version)
+		if !ok {
+			return
+		}
+		if pause.Id == 0 && pause.Uuid != "" {
+			if pause.Id, ok = entityId(c, db, "pause", pause.Uuid); !ok {
+				return
+			}
+		}
+		version, err := db.UpdatePause(ctx, pause.Id, expected, pause.StartTime, pause.EndTime)
+		if errors.Is(err, database.ErrVersionConflict) {
+			if current, err := db.GetPause(ctx, pause.Id); err != nil {
+				internalError(c, "could not get pause", err)
+			} else {
+				versionConflict(c, current, current.Version)
+			}
+		} else if err != nil {
+			databaseError(c, "could not update pause", err)
+		} else {
+			if updated, err := db.GetPause(ctx, pause.Id); err == nil {
+				publishBlock(ctx, hub, db, events.BlockChanged, updated.BlockId)
+			}
+			c.Header("ETag", etag(version))
+			c.JSON(http.StatusOK, gin.H{"version": version})
+		}
+	})
+
+	router.DELETE("/pause/:id", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		id, ok := entityId(c, db, "pause", c.Param("id"))
+		if !ok {
+			return
+		}
+		pause, err := db.GetPause(ctx, id)
+		if err != nil {
+			internalError(c, "could not delete pause", err)
+			return
+		}
+		err = db.DeleteByTableAndId(ctx, "pauses", id)
+		if err != nil {
+			databaseError(c, "could not delete pause", err)
+		} else {
+			publishBlock(ctx, hub, db, events.BlockChanged, pause.BlockId)
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.GET("/search", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		query := c.Query("q")
+		if query == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "missing search query"})
+			return
+		}
+		results, err := db.Search(c.Request.Context(), userId, query, c.Query("from"), c.Query("to"))
+		if err != nil {
+			internalError(c, "could not search", err)
+		} else {
+			c.JSON(http.StatusOK, results)
+		}
+	})
+
+	router.POST("/webhook", func(c *gin.Context) {
+		var webhook schemas.WebhookCreate
+		if err := c.BindJSON(&webhook); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read webhook"})
+			return
+		}
+		for _, event := range webhook.Events {
+			if !events.IsType(event) {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "unknown event " + event})
+				return
+			}
+		}
+		if err := webhookWorker.CheckURL(c.Request.Context(), webhook.Url); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+			return
+		}
+		if id, err := db.AddWebhook(c.Request.Context(), webhook.UserId, webhook.Url, webhook.Secret, webhook.Events); err != nil {
+			internalError(c, "could not add webhook", err)
+		} else {
+			c.JSON(http.StatusOK, gin.H{"id": id})
+		}
+	})
+
+	router.GET("/webhooks/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		webhooks, err := db.GetWebhooks(c.Request.Context(), userId)
+		if err != nil {
+			internalError(c, "could not get webhooks", err)
+		} else {
+			c.JSON(http.StatusOK, webhooks)
+		}
+	})
+
+	router.DELETE("/webhook/:id", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		err := db.DeleteByTableAndId(c.Request.Context(), "webhooks", id)
+		if err != nil {
+			internalError(c, "could not delete webhook", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.GET("/webhook/:id/deliveries", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		deliveries, err := db.GetWebhookDeliveries(c.Request.Context(), id)
+		if err != nil {
+			internalError(c, "could not get deliveries", err)
+		} else {
+			c.JSON(http.StatusOK, deliveries)
+		}
+	})
+
+	router.POST("/webhook/:id/test", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		delivery, err := webhookWorker.Test(c.Request.Context(), id)
+		if err != nil {
+			internalError(c, "could not test webhook", err)
+		} else {
+			c.JSON(http.StatusOK, delivery)
+		}
+	})
+
+	router.POST("/workspace", func(c *gin.Context) {
+		var workspace schemas.WorkspaceCreate
+		if err := c.BindJSON(&workspace); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read workspace"})
+			return
+		}
+		if id, err := db.AddWorkspace(c.Request.Context(), workspace.UserId, workspace.Name, time.Now()); err != nil {
+			internalError(c, "could not add workspace", err)
+		} else {
+			c.JSON(http.StatusOK, gin.H{"id": id})
+		}
+	})
+
+	router.GET("/workspaces/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		workspaces, err := db.GetWorkspaces(c.Request.Context(), userId)
+		if err != nil {
+			internalError(c, "could not get workspaces", err)
+		} else {
+			c.JSON(http.StatusOK, workspaces)
+		}
+	})
+
+	router.GET("/workspace/:id", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		workspace, err := db.GetWorkspace(c.Request.Context(), userId, id)
+		if err != nil {
+			databaseError(c, "could not get workspace", err)
+		} else {
+			c.JSON(http.StatusOK, workspace)
+		}
+	})
+
+	router.DELETE("/workspace/:id", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		if err := db.DeleteWorkspace(c.Request.Context(), userId, id); err != nil {
+			databaseError(c, "could not delete workspace", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.PUT("/workspace/:id/member/:memberId", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		memberId, _ := strconv.Atoi(c.Param("memberId"))
+		var update schemas.MemberUpdate
+		if err := c.BindJSON(&update); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read member"})
+			return
+		}
+		if err := db.UpdateMemberRole(c.Request.Context(), update.UserId, id, memberId, update.Role); err != nil {
+			databaseError(c, "could not update member", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.DELETE("/workspace/:id/member/:memberId", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		memberId, _ := strconv.Atoi(c.Param("memberId"))
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		if err := db.RemoveMember(c.Request.Context(), userId, id, memberId); err != nil {
+			databaseError(c, "could not remove member", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.POST("/workspace/:id/invitation", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		var invitation schemas.InvitationCreate
+		if err := c.BindJSON(&invitation); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read invitation"})
+			return
+		}
+		created, err := db.AddInvitation(c.Request.Context(), invitation.UserId, id, invitation.Email, invitation.Role, time.Now())
+		if err != nil {
+			databaseError(c, "could not add invitation", err)
+		} else {
+			c.JSON(http.StatusOK, created)
+		}
+	})
+
+	router.GET("/workspace/:id/invitations", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		invitations, err := db.GetWorkspaceInvitations(c.Request.Context(), userId, id)
+		if err != nil {
+			databaseError(c, "could not get invitations", err)
+		} else {
+			c.JSON(http.StatusOK, invitations)
+		}
+	})
+
+	router.GET("/invitations/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		invitations, err := db.GetInvitations(c.Request.Context(), userId)
+		if err != nil {
+			internalError(c, "could not get invitations", err)
+		} else {
+			c.JSON(http.StatusOK, invitations)
+		}
+	})
+
+	router.POST("/invitation/:token/accept", func(c *gin.Context) {
+		var accept schemas.InvitationAccept
+		if err := c.BindJSON(&accept); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
+			return
+		}
+		id, err := db.AcceptInvitation(c.Request.Context(), accept.UserId, c.Param("token"), time.Now())
+		if err != nil {
+			databaseError(c, "could not accept invitation", err)
+		} else {
+			c.JSON(http.StatusOK, gin.H{"id": id})
+		}
+	})
+
+	router.POST("/workspace/:id/activity", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		var activity schemas.ActivityCreate
+		if err := c.BindJSON(&activity); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read body"})
+			return
+		}
+		activityId, err := db.AddWorkspaceActivity(actingUser(c, activity.UserId), activity.UserId, id, activity.Name, activity.Uuid)
+		if err != nil {
+			databaseError(c, "could not add activity", err)
+		} else {
+			hub.Publish(activity.UserId, events.ActivityChanged, events.Ref{Id: activityId})
+			c.JSON(http.StatusOK, gin.H{"id": activityId})
+		}
+	})
+
+	router.GET("/workspace/:id/activities", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		activities, err := db.GetWorkspaceActivities(c.Request.Context(), userId, id)
+		if err != nil {
+			databaseError(c, "could not get activities", err)
+		} else {
+			c.JSON(http.StatusOK, activities)
+		}
+	})
+
+	router.GET("/workspace/:id/report", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		report, err := db.GetWorkspaceReport(c.Request.Context(), userId, id, c.Query("from"), c.Query("to"))
+		if err != nil {
+			databaseError(c, "could not get report", err)
+		} else {
+			c.JSON(http.StatusOK, report)
+		}
+	})
+
+	router.GET("/timesheet/:userId/:week", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		week, err := time.Parse(time.DateOnly, c.Param("week"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "week is not a date"})
+			return
+		}
+		timesheet, err := db.GetTimesheet(c.Request.Context(), userId, week)
+		if err != nil {
+			internalError(c, "could not get timesheet", err)
+		} else {
+			c.JSON(http.StatusOK, timesheet)
+		}
+	})
+
+	router.POST("/timesheet/:userId/:week/:action", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		week, err := time.Parse(time.DateOnly, c.Param("week"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "week is not a date"})
+			return
+		}
+		var action schemas.TimesheetAction
+		if err := c.BindJSON(&action); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read action"})
+			return
+		}
+		now := time.Now()
+		switch c.Param("action") {
+		case database.TimesheetSubmit:
+			if action.UserId != userId {
+				err = database.ErrForeignTimesheet
+			} else {
+				err = db.SubmitTimesheet(ctx, userId, week, action.Comment, now)
+			}
+		case database.TimesheetApprove, database.TimesheetReject:
+			approve := c.Param("action") == database.TimesheetApprove
+			err = db.ReviewTimesheet(ctx, action.UserId, userId, week, approve, action.Comment, now)
+		case database.TimesheetComment:
+			err = db.CommentTimesheet(ctx, action.UserId, userId, week, action.Comment, now)
+		default:
+			c.JSON(http.StatusNotFound, gin.H{"status": "unknown action " + c.Param("action")})
+			return
+		}
+		if err != nil {
+			databaseError(c, "could not "+c.Param("action")+" timesheet", err)
+			return
+		}
+		timesheet, err := db.GetTimesheet(ctx, userId, week)
+		if err != nil {
+			internalError(c, "could not get timesheet", err)
+		} else {
+			c.JSON(http.StatusOK, timesheet)
+		}
+	})
+
+	router.GET("/timesheets/pending/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		timesheets, err := db.GetPendingTimesheets(c.Request.Context(), userId)
+		if err != nil {
+			internalError(c, "could not get timesheets", err)
+		} else {
+			c.JSON(http.StatusOK, timesheets)
+		}
+	})
+
+	router.GET("/locks/:userId", func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Param("userId"))
+		locks, err := db.GetLockDates(c.Request.Context(), userId)
+		if err != nil {
+			internalError(c, "could not get lock dates", err)
+		} else {
+			c.JSON(http.StatusOK, locks)
+		}
+	})
+
+	router.PUT("/lock/user/:id", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		var update schemas.LockDateUpdate
+		if err := c.BindJSON(&update); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read lock date"})
+			return
+		}
+		if err := db.SetUserLockDate(c.Request.Context(), update.UserId, id, update.LockDate, time.Now()); err != nil {
+			databaseError(c, "could not set lock date", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.DELETE("/lock/user/:id", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		if err := db.DeleteUserLockDate(c.Request.Context(), userId, id); err != nil {
+			databaseError(c, "could not delete lock date", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.PUT("/lock/workspace/:id", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		var update schemas.LockDateUpdate
+		if err := c.BindJSON(&update); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read lock date"})
+			return
+		}
+		if err := db.SetWorkspaceLockDate(c.Request.Context(), update.UserId, id, update.LockDate, time.Now()); err != nil {
+			databaseError(c, "could not set lock date", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.DELETE("/lock/workspace/:id", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		if err := db.DeleteWorkspaceLockDate(c.Request.Context(), userId, id); err != nil {
+			databaseError(c, "could not delete lock date", err)
+		} else {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	router.GET("/audit", func(c *gin.Context) {
+		id, ok := entityId(c, db, c.Query("entity"), c.Query("id"))
+		if !ok {
+			return
+		}
+		entries, err := db.GetAuditLog(c.Request.Context(), c.Query("entity"), id)
+		if err != nil {
+			databaseError(c, "could not get audit log", err)
+		} else {
+			c.JSON(http.StatusOK, entries)
+		}
+	})
+
+	router.GET("/sync", func(c *gin.Context) {
+		userId, err := strconv.Atoi(c.Query("userId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read user id"})
+			return
+		}
+		changes, err := db.GetChanges(c.Request.Context(), userId, c.Query("since"))
+		if err != nil {
+			databaseError(c, "could not get changes", err)
+		} else {
+			c.JSON(http.StatusOK, changes)
+		}
+	})
+
+	router.POST("/sync", func(c *gin.Context) {
+		var request schemas.SyncRequest
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read mutations"})
+			return
+		}
+		ctx := actingUser(c, request.UserId)
+		results, err := db.ApplyMutations(ctx, request.UserId, request.Mutations)
+		if err != nil {
+			internalError(c, "could not apply mutations", err)
+		} else {
+			publishSyncResults(ctx, hub, db, request.UserId, results)
+			c.JSON(http.StatusOK, results)
+		}
+	})
+
+	router.POST("/batch", func(c *gin.Context) {
+		var request schemas.BatchRequest
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read operations"})
+			return
+		}
+		if len(request.Operations) > maxBatchOperations {
+			c.JSON(http.StatusBadRequest, gin.H{"status": fmt.Sprintf("a batch has at most %d operations", maxBatchOperations)})
+			return
+		}
+		ctx := actingUser(c, request.UserId)
+		response, err := db.ApplyBatch(ctx, request.UserId, request.Operations, request.Atomic)
+		if err != nil {
+			internalError(c, "could not apply operations", err)
+			return
+		}
+		if response.Committed {
+			results := make([]schemas.SyncResult, len(response.Results))
+			for i, result := range response.Results {
+				results[i] = result.SyncResult
+			}
+			publishSyncResults(ctx, hub, db, request.UserId, results)
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	router.GET("/events", streamEvents(hub))
+	router.GET("/ws", timerSocket(hub, db, newUpgrader(cfg), time.Duration(cfg.RequestTimeout)))
+
+	router.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", api.Spec)
+	})
+
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	router.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		defer cancel()
+		if err := db.Ping(ctx); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "database unreachable"})
+			return
+		}
+		pending, err := db.PendingMigrations(ctx)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "could not check migrations"})
+		} else if pending > 0 {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": fmt.Sprintf("%d migrations pending", pending)})
+		} else {
+			c.JSON(http.StatusOK, gin.H{"status": "ready"})
+		}
+	})
+
+	return router
+}
+
+// databaseError answers with the status matching the error returned by the
+// database, falling back to a 500.
+func databaseError(c *gin.Context, status string, err error) {
+	switch {
+	case errors.Is(err, database.ErrForeignActivity),
+		errors.Is(err, database.ErrForeignEntity),
+		errors.Is(err, database.ErrNotMember),
+		errors.Is(err, database.ErrRoleNotAllowed),
+		errors.Is(err, database.ErrInvitationEmail),
+		errors.Is(err, database.ErrForeignTimesheet),
+		errors.Is(err, database.ErrNotApprover),
+		errors.Is(err, database.ErrLockOverrideDenied):
+		c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
+	case errors.Is(err, database.ErrInvalidRole),
+		errors.Is(err, database.ErrCommentRequired),
+		errors.Is(err, database.ErrInvalidLockDate),
+		errors.Is(err, database.ErrUnknownEntity),
+		errors.Is(err, database.ErrInvalidSyncToken),
+		errors.Is(err, database.ErrInvalidUuid),
+		errors.Is(err, database.ErrInvalidTimezone):
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+	case errors.Is(err, database.ErrAlreadyMember),
+		errors.Is(err, database.ErrOwnerLeaves),
+		errors.Is(err, database.ErrTimesheetApproved),
+		errors.Is(err, database.ErrPeriodLocked),
+		errors.Is(err, database.ErrInvalidTransition),
+		errors.Is(err, database.ErrVersionConflict),
+		errors.Is(err, database.ErrUuidTaken):
+		c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"status": status})
+	default:
+		internalError(c, status, err)
+	}
+}
+
+// entityId reads the id of an activity, block or pause, which clients give
+// either as its serial id or as its UUID. It answers the request itself and
+// returns false if no entity has the UUID.
+func entityId(c *gin.Context, db *database.Database, entity string, value string) (int, bool) {
+	if !database.IsUuid(value) {
+		id, _ := strconv.Atoi(value)
+		return id, true
+	}
+	id, err := db.ResolveUuid(c.Request.Context(), entity, value)
+	if err != nil {
+		databaseError(c, "could not find "+entity, err)
+		return 0, false
+	}
+	return id, true
+}
+
+// referenceId returns the id of an entity a request body refers to, either by
+// its id or by its UUID. It answers the request itself and returns false if
+// the UUID is invalid or no entity has it.
+func referenceId(c *gin.Context, db *database.Database, entity string, id int, uuid string) (int, bool) {
+	if id != 0 || uuid == "" {
+		return id, true
+	}
+	id, err := db.ResolveUuid(c.Request.Context(), entity, uuid)
+	if err != nil {
+		databaseError(c, "could not find "+entity, err)
+		return 0, false
+	}
+	return id, true
+}
+
+// referenceIds appends the ids of the entities referred to by their UUIDs to
+// those referred to by their ids, like referenceId.
+func referenceIds(c *gin.Context, db *database.Database, entity string, ids []int, uuids []string) ([]int, bool) {
+	for _, uuid := range uuids {
+		id, ok := referenceId(c, db, entity, 0, uuid)
+		if !ok {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// etag formats the version of an entity as an entity tag.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// requiredVersion returns the version an update expects the entity to have,
+// taken from the If-Match header or else from the body. Updates without
+// either are answered with 428, since they would overwrite changes blindly.
+func requiredVersion(c *gin.Context, bodyVersion int) (int, bool) {
+	if header := c.GetHeader("If-Match"); header != "" {
+		version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+		if err != nil || version <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "could not read If-Match"})
+			return 0, false
+		}
+		return version, true
+	}
+	if bodyVersion > 0 {
+		return bodyVersion, true
+	}
+	c.JSON(http.StatusPreconditionRequired, gin.H{"status": "version is required"})
+	return 0, false
+}
+
+// versionConflict answers a stale update with the current state of the
+// entity, so the client can merge its changes and retry.
+func versionConflict(c *gin.Context, current any, version int) {
+	c.Header("ETag", etag(version))
+	c.JSON(http.StatusConflict, gin.H{"status": database.ErrVersionConflict.Error(), "current": current})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kilianmandscharo/activities/api"
+	"github.com/kilianmandscharo/activities/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRoutesMatchSpec fails when a route is registered without being
+// documented in api/openapi.json or the other way around.
+func TestRoutesMatchSpec(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newRouter(defaultConfig(), nil, events.NewHub(), nil)
+
+	registered := make(map[string]bool)
+	for _, route := range router.Routes() {
+		registered[route.Method+" "+specPath(route.Path)] = true
+	}
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(api.Spec, &spec); err != nil {
+		t.Fatalf("could not read spec, %v", err)
+	}
+	documented := make(map[string]bool)
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	for _, route := range sortedKeys(registered) {
+		if !documented[route] {
+			t.Errorf("route %s is missing from the spec", route)
+		}
+	}
+	for _, route := range sortedKeys(documented) {
+		if !registered[route] {
+			t.Errorf("spec documents %s which is not registered", route)
+		}
+	}
+}
+
+// specPath turns gin parameters like :id into OpenAPI parameters like {id}.
+func specPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRequiredVersion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		header      string
+		bodyVersion int
+		version     int
+		status      int
+	}{
+		{`"3"`, 2, 3, http.StatusOK},
+		{`W/"4"`, 0, 4, http.StatusOK},
+		{"", 2, 2, http.StatusOK},
+		{"", 0, 0, http.StatusPreconditionRequired},
+		{"*", 2, 0, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPut, "/block", nil)
+		if test.header != "" {
+			c.Request.Header.Set("If-Match", test.header)
+		}
+		version, ok := requiredVersion(c, test.bodyVersion)
+		assert.Equal(t, test.version, version, test.header)
+		assert.Equal(t, test.status == http.StatusOK, ok, test.header)
+		assert.Equal(t, test.status, recorder.Code, test.header)
+	}
+}
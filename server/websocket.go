@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/kilianmandscharo/activities/database"
+	"github.com/kilianmandscharo/activities/events"
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingInterval   = pongWait * 9 / 10
+	maxCommandSize = 4096
+	outgoingBuffer = 16
+)
+
+const (
+	commandStart  = "start"
+	commandStop   = "stop"
+	commandPause  = "pause"
+	commandResume = "resume"
+)
+
+const (
+	messageAck   = "ack"
+	messageEvent = "event"
+	messageState = "state"
+)
+
+var (
+	errInvalidTime     = errors.New("could not read time")
+	errUnknownCommand  = errors.New("unknown command")
+	errUnknownActivity = errors.New("unknown activity")
+)
+
+// newUpgrader returns an upgrader accepting connections from the server's own
+// origin and from the CORS origins listed explicitly. Unlike for the REST
+// routes, the wildcard does not open the socket to every origin, since
+// browsers do not apply CORS to websockets and any page could otherwise
+// control the timer. Requests without an origin, which are not sent by
+// browsers, are accepted as well.
+func newUpgrader(cfg Config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || contains(cfg.CORSOrigins, origin) {
+				return true
+			}
+			parsed, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(parsed.Host, r.Host)
+		},
+	}
+}
+
+// timerSocket lets a client control the timer of a user. Every command is
+// acknowledged with the resulting block or an error, and all events of the
+// user are forwarded so the client stays in sync with other devices.
+func timerSocket(hub *events.Hub, db *database.Database, upgrader *websocket.Upgrader, timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId, _ := strconv.Atoi(c.Query("userId"))
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		subscription, _, unsubscribe := hub.Subscribe(userId, 0)
+		defer unsubscribe()
+
+		outgoing := make(chan schemas.TimerMessage, outgoingBuffer)
+		closed := make(chan struct{})
+		defer close(closed)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			readTimerCommands(c.Request.Context(), conn, db, hub, userId, timeout, outgoing, closed)
+		}()
+
+		state := schemas.TimerMessage{Type: messageState}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		block, err := db.GetRunningBlock(ctx, userId)
+		cancel()
+		if err == nil {
+			state.Data = block
+		} else if !errors.Is(err, database.ErrNoRunningBlock) {
+			slog.ErrorContext(ctx, "could not get running block", "err", err)
+		}
+		if err := writeTimerMessage(conn, state); err != nil {
+			return
+		}
+
+		ping := time.NewTicker(pingInterval)
+		defer ping.Stop()
+		for {
+			var err error
+			select {
+			case <-done:
+				return
+			case message := <-outgoing:
+				err = writeTimerMessage(conn, message)
+			case event, ok := <-subscription:
+				if !ok {
+					// The hub closes the subscription on shutdown and when the
+					// client lags behind, reconnecting returns the current state.
+					message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "subscription closed")
+					conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+					return
+				}
+				err = writeTimerMessage(conn, schemas.TimerMessage{
+					Type:    messageEvent,
+					Event:   event.Type,
+					EventId: event.Id,
+					Data:    event.Data,
+				})
+			case <-ping.C:
+				err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readTimerCommands(
+	ctx context.Context,
+	conn *websocket.Conn,
+	db *database.Database,
+	hub *events.Hub,
+	userId int,
+	timeout time.Duration,
+	outgoing chan<- schemas.TimerMessage,
+	closed <-chan struct{},
+) {
+	conn.SetReadLimit(maxCommandSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var message schemas.TimerMessage
+		var command schemas.TimerCommand
+		if err := json.Unmarshal(data, &command); err != nil {
+			message = schemas.TimerMessage{Type: messageAck, Error: "could not read command"}
+		} else {
+			commandCtx, cancel := context.WithTimeout(ctx, timeout)
+			message = executeTimerCommand(commandCtx, db, hub, userId, command)
+			cancel()
+		}
+		select {
+		case outgoing <- message:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func executeTimerCommand(
+	ctx context.Context,
+	db *database.Database,
+	hub *events.Hub,
+	userId int,
+	command schemas.TimerCommand,
+) schemas.TimerMessage {
+	ack := schemas.TimerMessage{Type: messageAck, CommandId: command.Id}
+	block, err := runTimerCommand(ctx, db, hub, userId, command.Type, command.ActivityId, command.ActivityUuid, command.Time)
+	if err != nil {
+		ack.Error = timerError(command.Type, err)
+		return ack
+	}
+	ack.Ok = true
+	ack.Data = block
+	return ack
+}
+
+// runTimerCommand starts, stops, pauses or resumes the timer of the user at
+// the given time, or now if no time is given, and publishes the change. The
+// activity to start is given by its id or by its UUID.
+func runTimerCommand(
+	ctx context.Context,
+	db *database.Database,
+	hub *events.Hub,
+	userId int,
+	commandType string,
+	activityId int,
+	activityUuid string,
+	atTime string,
+) (schemas.Block, error) {
+	ctx = database.WithActor(ctx, userId)
+	if activityId == 0 && activityUuid != "" {
+		id, err := db.ResolveUuid(ctx, "activity", activityUuid)
+		if errors.Is(err, sql.ErrNoRows) {
+			return schemas.Block{}, errUnknownActivity
+		} else if err != nil {
+			return schemas.Block{}, err
+		}
+		activityId = id
+	}
+	at := time.Now().UTC()
+	if atTime != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, atTime)
+		if err != nil {
+			return schemas.Block{}, errInvalidTime
+		}
+		at = parsed
+	}
+
+	var id int
+	var err error
+	var eventType string
+	switch commandType {
+	case commandStart:
+		id, err = db.StartBlock(ctx, userId, activityId, at)
+		eventType = events.BlockStarted
+	case commandStop:
+		id, err = db.StopBlock(ctx, userId, at)
+		eventType = events.BlockStopped
+	case commandPause:
+		id, err = db.PauseBlock(ctx, userId, at)
+		eventType = events.BlockPaused
+	case commandResume:
+		id, err = db.ResumeBlock(ctx, userId, at)
+		eventType = events.BlockResumed
+	default:
+		return schemas.Block{}, errUnknownCommand
+	}
+	if err != nil {
+		return schemas.Block{}, err
+	}
+
+	publishBlock(ctx, hub, db, eventType, id)
+	return db.GetBlock(ctx, id)
+}
+
+func timerError(commandType string, err error) string {
+	switch {
+	case errors.Is(err, errInvalidTime),
+		errors.Is(err, errUnknownCommand),
+		errors.Is(err, errUnknownActivity),
+		errors.Is(err, database.ErrInvalidUuid),
+		errors.Is(err, database.ErrForeignActivity),
+		errors.Is(err, database.ErrNoRunningBlock),
+		errors.Is(err, database.ErrAlreadyPaused),
+		errors.Is(err, database.ErrNotPaused),
+		errors.Is(err, database.ErrTimeBeforeRun),
+		errors.Is(err, database.ErrTimesheetApproved),
+		errors.Is(err, database.ErrPeriodLocked),
+		errors.Is(err, database.ErrLockOverrideDenied):
+		return err.Error()
+	default:
+		return "could not " + commandType + " block"
+	}
+}
+
+// timerStatus maps the errors of runTimerCommand to the status code of the
+// corresponding REST route.
+func timerStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidTime),
+		errors.Is(err, database.ErrTimeBeforeRun),
+		errors.Is(err, database.ErrInvalidUuid):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnknownCommand),
+		errors.Is(err, errUnknownActivity):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrForeignActivity),
+		errors.Is(err, database.ErrLockOverrideDenied):
+		return http.StatusForbidden
+	case errors.Is(err, database.ErrNoRunningBlock),
+		errors.Is(err, database.ErrAlreadyPaused),
+		errors.Is(err, database.ErrNotPaused),
+		errors.Is(err, database.ErrTimesheetApproved),
+		errors.Is(err, database.ErrPeriodLocked):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeTimerMessage(conn *websocket.Conn, message schemas.TimerMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteJSON(message)
+}
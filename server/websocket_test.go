@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpgraderOrigins(t *testing.T) {
+	tests := []struct {
+		origins []string
+		origin  string
+		allowed bool
+	}{
+		{[]string{"https://app.example"}, "https://app.example", true},
+		{[]string{"https://app.example"}, "https://evil.example", false},
+		{[]string{"https://app.example"}, "http://localhost:8080", true},
+		{[]string{"https://app.example"}, "", true},
+		{nil, "https://evil.example", false},
+		{[]string{"*"}, "https://evil.example", false},
+		{[]string{"*"}, "http://localhost:8080", true},
+	}
+	for _, test := range tests {
+		cfg := defaultConfig()
+		cfg.CORSOrigins = test.origins
+		request := httptest.NewRequest(http.MethodGet, "http://localhost:8080/ws", nil)
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		assert.Equal(t, test.allowed, newUpgrader(cfg).CheckOrigin(request), test.origin)
+	}
+}
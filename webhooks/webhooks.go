@@ -0,0 +1,417 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/kilianmandscharo/activities/database"
+	"github.com/kilianmandscharo/activities/events"
+	"github.com/kilianmandscharo/activities/schemas"
+)
+
+const (
+	TestEvent = "webhook.test"
+
+	EventHeader     = "X-Activities-Event"
+	DeliveryHeader  = "X-Activities-Delivery"
+	TimestampHeader = "X-Activities-Timestamp"
+	SignatureHeader = "X-Activities-Signature"
+)
+
+const (
+	maxAttempts    = 10
+	baseRetryDelay = 30 * time.Second
+	maxRetryDelay  = 6 * time.Hour
+	deliveryLease  = time.Minute
+	batchSize      = 20
+	outboxSize     = 100
+	requestTimeout = 10 * time.Second
+
+	// SignatureTolerance is how far the timestamp of a delivery may be off
+	// for Verify to accept it.
+	SignatureTolerance = 5 * time.Minute
+)
+
+var (
+	ErrInvalidURL       = errors.New("webhook url must be an absolute http or https url")
+	ErrPrivateAddress   = errors.New("webhook url must not point to a loopback or private address")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleTimestamp   = errors.New("webhook timestamp is outside of the tolerance")
+)
+
+// Worker turns the changes recorded in the audit log into webhook deliveries
+// and sends them, retrying failed deliveries with exponential backoff.
+type Worker struct {
+	db           *database.Database
+	client       *http.Client
+	allowPrivate bool
+}
+
+// NewWorker returns a worker whose requests can only reach public addresses,
+// unless allowPrivate is set, e.g. to deliver webhooks to a local receiver
+// during development.
+func NewWorker(db *database.Database, allowPrivate bool) *Worker {
+	dialer := &net.Dialer{Timeout: requestTimeout}
+	if !allowPrivate {
+		// The address is checked after resolving the host, so that a name
+		// resolving to a private address cannot be used to get around
+		// CheckURL.
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		}
+	}
+	return &Worker{
+		db: db,
+		client: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+		allowPrivate: allowPrivate,
+	}
+}
+
+// CheckURL makes sure webhooks can be delivered to the url: it has to be an
+// http or https url whose host only resolves to public addresses.
+func (w *Worker) CheckURL(ctx context.Context, rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return ErrInvalidURL
+	}
+	if w.allowPrivate {
+		return nil
+	}
+	if ip := net.ParseIP(parsed.Hostname()); ip != nil {
+		if !isPublic(ip) {
+			return ErrPrivateAddress
+		}
+		return nil
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, parsed.Hostname())
+	if err != nil {
+		return ErrInvalidURL
+	}
+	for _, address := range addresses {
+		if !isPublic(address.IP) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// sharedAddressSpace is the range used for carrier-grade NAT, which is not
+// covered by IsPrivate.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublic(ip net.IP) bool {
+	return !ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// Run turns new changes into deliveries and delivers pending webhooks every
+// interval until the context is done.
+func (w *Worker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+			if err := w.EnqueueChanges(ctx, now); err != nil {
+				slog.ErrorContext(ctx, "could not enqueue webhook deliveries", "err", err)
+			}
+			if err := w.DeliverPending(ctx, now); err != nil {
+				slog.ErrorContext(ctx, "could not deliver webhooks", "err", err)
+			}
+		}
+	}
+}
+
+// EnqueueChanges reads the changes from the outbox of the audit log and
+// stores a delivery of the resulting events for every subscribed webhook.
+// Since the changes are recorded in the transactions making them, no event
+// is lost when the server stops before it has been delivered.
+func (w *Worker) EnqueueChanges(ctx context.Context, now time.Time) error {
+	for {
+		outbox, err := w.db.ReadWebhookOutbox(ctx, outboxSize)
+		if err != nil {
+			return err
+		}
+		if len(outbox.Changes) == 0 {
+			return nil
+		}
+		var webhookEvents []database.WebhookEvent
+		for _, event := range changeEvents(outbox.Changes) {
+			data, ok, err := w.eventData(ctx, event)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			payload, err := json.Marshal(schemas.WebhookPayload{
+				Event:     event.Type,
+				Timestamp: now.Format(time.RFC3339),
+				Data:      data,
+			})
+			if err != nil {
+				return err
+			}
+			webhookEvents = append(webhookEvents, database.WebhookEvent{UserId: event.UserId, Event: event.Type, Payload: payload})
+		}
+		if err := w.db.EnqueueWebhookEvents(ctx, outbox, webhookEvents, now); err != nil {
+			return err
+		}
+		if len(outbox.Changes) < outboxSize {
+			return nil
+		}
+	}
+}
+
+// eventPriority orders the events about the same block within a transaction,
+// only the event with the highest priority is delivered.
+var eventPriority = map[string]int{
+	events.BlockChanged: 0,
+	events.BlockResumed: 1,
+	events.BlockPaused:  2,
+	events.BlockStopped: 3,
+	events.BlockStarted: 4,
+	events.BlockDeleted: 5,
+}
+
+// changeEvents turns the changes into events. The changes of a transaction
+// that concern the same block or activity result in a single event, like
+// the one the request making them published.
+func changeEvents(changes []database.OutboxChange) []events.Event {
+	type key struct {
+		xid    int64
+		entity string
+		id     int
+	}
+	var result []events.Event
+	index := map[key]int{}
+	for _, change := range changes {
+		event := changeEvent(change)
+		k := key{xid: change.Xid, entity: change.Entity, id: event.Data.(events.Ref).Id}
+		if change.Entity == "pause" {
+			k.entity = "block"
+		}
+		i, ok := index[k]
+		if !ok {
+			index[k] = len(result)
+			result = append(result, event)
+			continue
+		}
+		if eventPriority[event.Type] > eventPriority[result[i].Type] {
+			result[i] = event
+		}
+	}
+	return result
+}
+
+func changeEvent(change database.OutboxChange) events.Event {
+	event := events.Event{UserId: change.UserId, Type: events.BlockChanged, Data: events.Ref{Id: change.Id}}
+	switch change.Entity {
+	case "activity":
+		event.Type = events.ActivityChanged
+	case "block":
+		switch {
+		case change.Action == "delete":
+			event.Type = events.BlockDeleted
+		case change.Action == "insert" && change.Open:
+			event.Type = events.BlockStarted
+		case change.Action == "update" && change.WasOpen && !change.Open:
+			event.Type = events.BlockStopped
+		}
+	case "pause":
+		event.Data = events.Ref{Id: change.BlockId}
+		switch {
+		case change.Open && !change.WasOpen:
+			event.Type = events.BlockPaused
+		case change.WasOpen && !change.Open:
+			event.Type = events.BlockResumed
+		}
+	}
+	return event
+}
+
+// eventData returns the current state of the block or activity of the event,
+// or the reference for deleted ones. Events about blocks that are gone by
+// now are skipped, the deletion has its own event.
+func (w *Worker) eventData(ctx context.Context, event events.Event) (any, bool, error) {
+	ref := event.Data.(events.Ref)
+	switch event.Type {
+	case events.BlockDeleted:
+		return ref, true, nil
+	case events.ActivityChanged:
+		activity, err := w.db.GetActivity(ctx, ref.Id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ref, true, nil
+		}
+		return activity, err == nil, err
+	default:
+		block, err := w.db.GetBlock(ctx, ref.Id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return block, err == nil, err
+	}
+}
+
+// DeliverPending attempts the pending deliveries that are due. A delivery
+// that cannot be attempted does not keep the others from being sent, the
+// errors of all of them are returned together.
+func (w *Worker) DeliverPending(ctx context.Context, now time.Time) error {
+	deliveries, err := w.db.ClaimWebhookDeliveries(ctx, now, now.Add(deliveryLease), batchSize)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, delivery := range deliveries {
+		if err := w.attempt(ctx, delivery, now); err != nil {
+			errs = append(errs, fmt.Errorf("delivery %d: %w", delivery.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Test sends a test event to the webhook right away and returns the
+// resulting delivery.
+func (w *Worker) Test(ctx context.Context, webhookId int) (schemas.WebhookDelivery, error) {
+	now := time.Now().UTC()
+	payload, err := json.Marshal(schemas.WebhookPayload{
+		Event:     TestEvent,
+		Timestamp: now.Format(time.RFC3339),
+		Data:      events.Ref{Id: webhookId},
+	})
+	if err != nil {
+		return schemas.WebhookDelivery{}, err
+	}
+	id, err := w.db.AddWebhookDelivery(ctx, webhookId, TestEvent, payload, now)
+	if err != nil {
+		return schemas.WebhookDelivery{}, err
+	}
+	delivery, err := w.db.GetWebhookDelivery(ctx, id)
+	if err != nil {
+		return delivery, err
+	}
+	if err := w.attempt(ctx, delivery, now); err != nil {
+		return delivery, err
+	}
+	return w.db.GetWebhookDelivery(ctx, id)
+}
+
+func (w *Worker) attempt(ctx context.Context, delivery schemas.WebhookDelivery, now time.Time) error {
+	webhook, err := w.db.GetWebhook(ctx, delivery.WebhookId)
+	if err != nil {
+		return err
+	}
+	statusCode, err := Send(ctx, w.client, webhook.Url, webhook.Secret, delivery)
+	if err == nil {
+		return w.db.RecordWebhookAttempt(ctx, delivery.Id, database.DeliveryDelivered, statusCode, "", now, now)
+	}
+	attempts := delivery.Attempts + 1
+	status := database.DeliveryPending
+	if attempts >= maxAttempts {
+		status = database.DeliveryFailed
+	}
+	return w.db.RecordWebhookAttempt(ctx, delivery.Id, status, statusCode, err.Error(), now.Add(RetryDelay(attempts)), now)
+}
+
+// RetryDelay doubles the delay after every failed attempt, starting at
+// baseRetryDelay and capped at maxRetryDelay.
+func RetryDelay(attempts int) time.Duration {
+	delay := baseRetryDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return delay
+}
+
+// Send posts the payload of the delivery to the url, signed with the secret.
+// Any response status outside of 2xx is treated as a failure.
+func Send(ctx context.Context, client *http.Client, url string, secret string, delivery schemas.WebhookDelivery) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "activities-webhooks")
+	request.Header.Set(EventHeader, delivery.Event)
+	request.Header.Set(DeliveryHeader, strconv.Itoa(delivery.Id))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, Sign(secret, timestamp, delivery.Payload))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the timestamp and the payload,
+// joined by a dot and prefixed with the name of the hash function. Signing
+// the timestamp lets receivers reject deliveries replayed later on.
+func Sign(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery received at now, which has to
+// match the timestamp and payload and must not be older or newer than
+// SignatureTolerance.
+func Verify(secret string, timestamp string, signature string, payload []byte, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, payload))) {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+		return ErrStaleTimestamp
+	}
+	return nil
+}
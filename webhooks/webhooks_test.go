@@ -0,0 +1,148 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kilianmandscharo/activities/database"
+	"github.com/kilianmandscharo/activities/events"
+	"github.com/kilianmandscharo/activities/schemas"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testSecret  = "secret"
+	testPayload = `{"event":"block.started","timestamp":"2023-02-01T14:00:00Z","data":{"id":1}}`
+	testEvent   = "block.started"
+)
+
+func TestSend(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	delivery := schemas.WebhookDelivery{Id: 1, Event: testEvent, Payload: []byte(testPayload)}
+	statusCode, err := Send(context.Background(), receiver.Client(), receiver.URL, testSecret, delivery)
+	if err != nil {
+		t.Fatalf("could not send webhook, %v", err)
+	}
+	assert.Equal(t, http.StatusNoContent, statusCode)
+	assert.Equal(t, testPayload, string(body))
+	assert.Equal(t, testEvent, received.Header.Get(EventHeader))
+	assert.Equal(t, "1", received.Header.Get(DeliveryHeader))
+	timestamp := received.Header.Get(TimestampHeader)
+	assert.Equal(t, Sign(testSecret, timestamp, body), received.Header.Get(SignatureHeader))
+	assert.Nil(t, Verify(testSecret, timestamp, received.Header.Get(SignatureHeader), body, time.Now()))
+}
+
+func TestSendFailure(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	delivery := schemas.WebhookDelivery{Id: 1, Event: testEvent, Payload: []byte(testPayload)}
+	statusCode, err := Send(context.Background(), receiver.Client(), receiver.URL, testSecret, delivery)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, statusCode)
+}
+
+// TestChangeEvents makes sure the changes of a transaction result in a single
+// event per block, and that pauses are reported as pausing and resuming their
+// block.
+func TestChangeEvents(t *testing.T) {
+	changes := []database.OutboxChange{
+		{Xid: 1, Entity: "block", Id: 1, Action: "insert", UserId: 1, Open: true},
+		{Xid: 1, Entity: "pause", Id: 5, BlockId: 1, Action: "insert", UserId: 1},
+		{Xid: 2, Entity: "pause", Id: 6, BlockId: 1, Action: "insert", UserId: 1, Open: true},
+		{Xid: 3, Entity: "pause", Id: 6, BlockId: 1, Action: "update", UserId: 1, WasOpen: true},
+		{Xid: 4, Entity: "pause", Id: 6, BlockId: 1, Action: "update", UserId: 1, WasOpen: true},
+		{Xid: 4, Entity: "block", Id: 1, Action: "update", UserId: 1, WasOpen: true},
+		{Xid: 5, Entity: "activity", Id: 2, Action: "update", UserId: 1},
+		{Xid: 6, Entity: "pause", Id: 6, BlockId: 1, Action: "delete", UserId: 1},
+		{Xid: 6, Entity: "block", Id: 1, Action: "delete", UserId: 1},
+	}
+	result := changeEvents(changes)
+	var types []string
+	for _, event := range result {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{
+		events.BlockStarted,
+		events.BlockPaused,
+		events.BlockResumed,
+		events.BlockStopped,
+		events.ActivityChanged,
+		events.BlockDeleted,
+	}, types)
+	assert.Equal(t, events.Ref{Id: 1}, result[1].Data)
+	assert.Equal(t, events.Ref{Id: 2}, result[4].Data)
+}
+
+func TestCheckURL(t *testing.T) {
+	worker := NewWorker(nil, false)
+	ctx := context.Background()
+	assert.Nil(t, worker.CheckURL(ctx, "https://93.184.216.34/hook"))
+	assert.ErrorIs(t, worker.CheckURL(ctx, "ftp://93.184.216.34/hook"), ErrInvalidURL)
+	assert.ErrorIs(t, worker.CheckURL(ctx, "/hook"), ErrInvalidURL)
+	for _, url := range []string{
+		"http://127.0.0.1:9000/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.10/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://100.64.0.1/hook",
+		"http://0.0.0.0/hook",
+	} {
+		assert.ErrorIs(t, worker.CheckURL(ctx, url), ErrPrivateAddress, url)
+	}
+	assert.Nil(t, NewWorker(nil, true).CheckURL(ctx, "http://127.0.0.1:9000/hook"))
+}
+
+// TestPrivateAddress makes sure the worker does not connect to private
+// addresses, even when they are not caught by CheckURL.
+func TestPrivateAddress(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	delivery := schemas.WebhookDelivery{Id: 1, Event: testEvent, Payload: []byte(testPayload)}
+	_, err := Send(context.Background(), NewWorker(nil, false).client, receiver.URL, testSecret, delivery)
+	assert.ErrorIs(t, err, ErrPrivateAddress)
+	_, err = Send(context.Background(), NewWorker(nil, true).client, receiver.URL, testSecret, delivery)
+	assert.Nil(t, err)
+}
+
+func TestSign(t *testing.T) {
+	assert.Equal(
+		t,
+		"sha256=fed5a4a72c010b15ab73ec536258f87190e2586118ad0038078cda07ef0d878d",
+		Sign("key", "1675260000", []byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1675260000, 0)
+	timestamp := "1675260000"
+	signature := Sign(testSecret, timestamp, []byte(testPayload))
+	assert.Nil(t, Verify(testSecret, timestamp, signature, []byte(testPayload), now.Add(time.Minute)))
+	assert.ErrorIs(t, Verify(testSecret, timestamp, signature, []byte(testPayload), now.Add(time.Hour)), ErrStaleTimestamp)
+	assert.ErrorIs(t, Verify(testSecret, "1675260001", signature, []byte(testPayload), now), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("other", timestamp, signature, []byte(testPayload), now), ErrInvalidSignature)
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 30*time.Second, RetryDelay(1))
+	assert.Equal(t, time.Minute, RetryDelay(2))
+	assert.Equal(t, 4*time.Minute, RetryDelay(4))
+	assert.Equal(t, maxRetryDelay, RetryDelay(20))
+}